@@ -0,0 +1,94 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	logx "github.com/mashiike/go-logx"
+)
+
+type requestIDContextKey struct{}
+
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestID returns the request id of the webhook server request, empty if ctx is not of a request.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// AccessLog is the access log record of the webhook server, written as a JSON line with the `[info] access` prefix.
+type AccessLog struct {
+	RequestID     string  `json:"request_id"`
+	Method        string  `json:"method"`
+	Path          string  `json:"path"`
+	ChannelID     string  `json:"channel_id,omitempty"`
+	ResourceID    string  `json:"resource_id,omitempty"`
+	ResourceState string  `json:"resource_state,omitempty"`
+	MessageNumber string  `json:"message_number,omitempty"`
+	Status        int     `json:"status"`
+	DurationMs    float64 `json:"duration_ms"`
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// accessLog writes an access log per request. The request id is taken from X-Request-Id header or generated,
+// and every log of the request is prefixed with it, so that the logs can be correlated with the access log.
+func (app *App) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+		ctx := withRequestID(r.Context(), requestID)
+		parent := logx.Default(ctx)
+		ctx = logx.WithLogger(ctx, log.New(parent.Writer(), "request_id="+requestID+" ", parent.Flags()|log.Lmsgprefix))
+		w.Header().Set("X-Request-Id", requestID)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		bs, err := json.Marshal(&AccessLog{
+			RequestID:     RequestID(ctx),
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ChannelID:     r.Header.Get("X-Goog-Channel-Id"),
+			ResourceID:    r.Header.Get("X-Goog-Resource-Id"),
+			ResourceState: r.Header.Get("X-Goog-Resource-State"),
+			MessageNumber: r.Header.Get("X-Goog-Message-Number"),
+			Status:        rec.status,
+			DurationMs:    float64(time.Since(start).Microseconds()) / 1000,
+		})
+		if err != nil {
+			logx.Printf(ctx, "[warn] access log marshal failed: %s", err.Error())
+			return
+		}
+		// written by the parent logger, the request id is in the record.
+		parent.Printf("[info] access %s", bs)
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
@@ -16,7 +17,6 @@ import (
 	"text/template"
 	"time"
 
-	"github.com/Songmu/flextime"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -26,29 +26,75 @@ import (
 	"github.com/mattn/go-shellwords"
 	"github.com/olekukonko/tablewriter"
 	"github.com/samber/lo"
+	"github.com/shogo82148/go-retry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
 type App struct {
-	storage            Storage
-	notification       Notification
-	drivesAutoDetect   bool
-	drives             map[string]*DriveConfig
-	rotateRemaining    time.Duration
-	driveSvc           *drive.Service
-	cleanupFns         []func() error
-	expiration         time.Duration
-	withinModifiedTime *time.Duration
-	webhookAddress     string
+	storage                   Storage
+	notification              Notification
+	driveSvc                  *drive.Service
+	cleanupFns                []func() error
+	metrics                   MetricsRecorder
+	tracer                    trace.Tracer
+	emitLifecycle             bool
+	syncConcurrency           int
+	notificationFailureStatus int
+	webhookSem                *semaphore.Weighted
+	webhookQueueTimeout       time.Duration
+	webhookHMACSecret         []byte
+	replayToken               string
+	allowedUserAgentPrefixes  []string
+	maxDumpBytes              int
+	pageTokenRefreshInterval  time.Duration
+	enableMetrics             bool
+	dryRun                    bool
+	driveAPIRetryPolicy       *retry.Policy
+	driveAPIRetryable         func(error) bool
+	clock                     Clock
+	driveAPILimiter           *rate.Limiter
+
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+	shutdownTimeout time.Duration
+	closeOnce       sync.Once
+	closeErr        error
+
+	settingsMu sync.RWMutex
+	settings   *appSettings
+
+	orphanMu       sync.Mutex
+	orphanChannels map[string]*orphanChannel
+
+	fileVersions *fileVersionCache
+
+	folderParentsMu sync.Mutex
+	folderParents   map[string][]string
+
+	pageTokensMu      sync.Mutex
+	pendingPageTokens map[string]string
 }
 
 type RunOptions struct {
 	Mode         RunMode
 	LocalAddress string
 	CLICommand   CLICommand
+	DriveID      string
+	ListLimit    int
+	ListFormat   string
+	ChannelID    string
+	ResourceID   string
+	FileID       string
+	// CleanupOnShutdown stops all channels when the webhook server is shut down.
+	CleanupOnShutdown bool
 }
 
 func WithRunMode(mode string) func(*RunOptions) error {
@@ -80,6 +126,62 @@ func WithCLICommand(cmd string) func(*RunOptions) error {
 	}
 }
 
+func WithDriveID(driveID string) func(*RunOptions) error {
+	return func(opts *RunOptions) error {
+		opts.DriveID = driveID
+		return nil
+	}
+}
+
+// WithOrphanChannel sets the channel to stop for reconcile command.
+func WithOrphanChannel(channelID, resourceID string) func(*RunOptions) error {
+	return func(opts *RunOptions) error {
+		opts.ChannelID = channelID
+		opts.ResourceID = resourceID
+		return nil
+	}
+}
+
+// WithFileID sets the file to watch for watch-file command.
+func WithFileID(fileID string) func(*RunOptions) error {
+	return func(opts *RunOptions) error {
+		opts.FileID = fileID
+		return nil
+	}
+}
+
+// WithCleanupOnShutdown stops all channels when the webhook server is shut down, e.g. for ephemeral environments.
+func WithCleanupOnShutdown(enabled bool) func(*RunOptions) error {
+	return func(opts *RunOptions) error {
+		opts.CleanupOnShutdown = enabled
+		return nil
+	}
+}
+
+// WithListLimit caps the number of rows of list command, 0 means unlimited.
+func WithListLimit(limit int) func(*RunOptions) error {
+	return func(opts *RunOptions) error {
+		if limit < 0 {
+			return errors.New("list limit must be positive")
+		}
+		opts.ListLimit = limit
+		return nil
+	}
+}
+
+// WithListFormat sets the output format of list command, `table` or `json`.
+func WithListFormat(format string) func(*RunOptions) error {
+	return func(opts *RunOptions) error {
+		switch format {
+		case ListFormatTable, ListFormatJSON:
+			opts.ListFormat = format
+		default:
+			return fmt.Errorf("unknown list format `%s`, allowed `%s` or `%s`", format, ListFormatTable, ListFormatJSON)
+		}
+		return nil
+	}
+}
+
 func isLambda() bool {
 	if strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda") || os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
 		return true
@@ -98,6 +200,7 @@ func newRunOptions() *RunOptions {
 	return &RunOptions{
 		Mode:         DefaultRunMode(),
 		LocalAddress: ":8080",
+		ListFormat:   ListFormatTable,
 	}
 }
 
@@ -113,14 +216,30 @@ func defaultAWSConfig(ctx context.Context) (aws.Config, error) {
 	return awsCfg, nil
 }
 
-func New(cfg *Config, gcpOpts ...option.ClientOption) (*App, error) {
-	drives := lo.FromEntries(lo.Map(cfg.Drives, func(cfg *DriveConfig, _ int) lo.Entry[string, *DriveConfig] {
-		return lo.Entry[string, *DriveConfig]{
-			Key:   cfg.DriveID,
-			Value: cfg,
-		}
-	}))
+func newDriveService(ctx context.Context, cfg *Config, awsCfg aws.Config, gcpOpts ...option.ClientOption) (*drive.Service, error) {
+	gcpOpts = append(
+		gcpOpts,
+		option.WithScopes(
+			drive.DriveScope,
+			drive.DriveFileScope,
+		),
+	)
+	credentialsBackend, err := NewCredentialsBackend(ctx, cfg.Credentials, awsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("create Credentials Backend: %w", err)
+	}
+	gcpOpts, err = credentialsBackend.WithCredentialsClientOption(ctx, gcpOpts)
+	if err != nil {
+		return nil, fmt.Errorf("google Application Credentials Load: %w", err)
+	}
+	driveSvc, err := drive.NewService(ctx, gcpOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("create Google Drive Service: %w", err)
+	}
+	return driveSvc, nil
+}
 
+func New(cfg *Config, gcpOpts ...option.ClientOption) (*App, error) {
 	ctx := context.Background()
 
 	awsCfg, err := defaultAWSConfig(ctx)
@@ -144,45 +263,158 @@ func New(cfg *Config, gcpOpts ...option.ClientOption) (*App, error) {
 		cleanupFns = append(cleanupFns, cleanup)
 	}
 
-	gcpOpts = append(
-		gcpOpts,
-		option.WithScopes(
-			drive.DriveScope,
-			drive.DriveFileScope,
-		),
-	)
-	credentialsBackend, err := NewCredentialsBackend(ctx, cfg.Credentials, awsCfg)
-	if err != nil {
-		return nil, fmt.Errorf("create Credentials Backend: %w", err)
+	metricsCfg := cfg.Metrics
+	if cfg.Server.EnableMetrics && metricsCfg.Type == MetricsTypeNone {
+		metricsCfg = &MetricsConfig{
+			Type: MetricsTypePrometheus,
+		}
 	}
-	gcpOpts, err = credentialsBackend.WithCredentialsClientOption(ctx, gcpOpts)
+	metrics, err := NewMetricsRecorder(metricsCfg)
 	if err != nil {
-		return nil, fmt.Errorf("google Application Credentials Load: %w", err)
+		return nil, fmt.Errorf("create MetricsRecorder: %w", err)
 	}
-	driveSvc, err := drive.NewService(ctx, gcpOpts...)
+
+	driveSvc, err := newDriveService(ctx, cfg, awsCfg, gcpOpts...)
 	if err != nil {
-		return nil, fmt.Errorf("create Google Drive Service: %w", err)
+		return nil, err
 	}
 
-	rotateRemaining := time.Duration(0.2 * float64(cfg.Expiration))
-	log.Printf("[debug] cfg.Expiration=%s 20%% rotateRemaining=%s", cfg.Expiration, rotateRemaining)
+	notificationFailureStatus := http.StatusOK
+	if cfg.Server.NotificationFailure == NotificationFailureRetry {
+		notificationFailureStatus = http.StatusInternalServerError
+	}
 
-	app := &App{
-		storage:            storage,
-		notification:       notification,
-		drivesAutoDetect:   *cfg.DrivesAutoDetect,
-		drives:             drives,
-		rotateRemaining:    rotateRemaining,
-		driveSvc:           driveSvc,
-		cleanupFns:         cleanupFns,
-		webhookAddress:     cfg.Webhook,
-		expiration:         cfg.Expiration,
-		withinModifiedTime: cfg.WithinModifiedTime,
+	var webhookSem *semaphore.Weighted
+	if cfg.Server.MaxConcurrentWebhooks > 0 {
+		webhookSem = semaphore.NewWeighted(int64(cfg.Server.MaxConcurrentWebhooks))
 	}
+
+	appCtx, cancel := context.WithCancel(context.Background())
+	app := &App{
+		storage:                   storage,
+		notification:              notification,
+		driveSvc:                  driveSvc,
+		cleanupFns:                cleanupFns,
+		metrics:                   metrics,
+		tracer:                    newTracer(cfg),
+		emitLifecycle:             cfg.EmitLifecycleEvents,
+		syncConcurrency:           cfg.SyncConcurrency,
+		notificationFailureStatus: notificationFailureStatus,
+		webhookSem:                webhookSem,
+		webhookQueueTimeout:       cfg.Server.WebhookQueueTimeout,
+		webhookHMACSecret:         []byte(cfg.Server.WebhookHMACSecret),
+		replayToken:               cfg.Server.ReplayToken,
+		allowedUserAgentPrefixes:  cfg.Server.AllowedUserAgentPrefixes,
+		maxDumpBytes:              cfg.Server.MaxDumpBytes,
+		pageTokenRefreshInterval:  cfg.PageTokenRefreshInterval,
+		enableMetrics:             cfg.Server.EnableMetrics,
+		dryRun:                    cfg.DryRun,
+		driveAPIRetryPolicy: &retry.Policy{
+			MinDelay: cfg.DriveAPI.RetryMinDelay,
+			MaxDelay: cfg.DriveAPI.RetryMaxDelay,
+			MaxCount: *cfg.DriveAPI.MaxRetries + 1,
+		},
+		driveAPIRetryable: isRetryable,
+		clock:             flextimeClock{},
+		driveAPILimiter:   newDriveAPILimiter(cfg.DriveAPI),
+		ctx:               appCtx,
+		cancel:            cancel,
+		shutdownTimeout:   cfg.ShutdownTimeout,
+		settings:          newAppSettings(cfg),
+		orphanChannels:    make(map[string]*orphanChannel),
+		folderParents:     make(map[string][]string),
+		fileVersions:      newFileVersionCache(maxFileVersions),
+		pendingPageTokens: make(map[string]string),
+	}
+	app.watchTableRecreated(storage)
 	return app, nil
 }
 
+// tableRecreateNotifier is implemented by the storages which can recreate the lost table at runtime.
+type tableRecreateNotifier interface {
+	OnTableRecreated(fn func())
+}
+
+func (app *App) watchTableRecreated(storage Storage) {
+	if n, ok := storage.(tableRecreateNotifier); ok {
+		n.OnTableRecreated(app.reRegisterChannels)
+	}
+}
+
+// reRegisterChannels creates the channels of the drives again in background, after the storage lost all channels.
+// files:watch channels are not restored, they must be watched again.
+func (app *App) reRegisterChannels() {
+	ctx, done := app.startWork(app.ctx)
+	go func() {
+		defer done()
+		if len(app.currentSettings().webhookAddresses) == 0 {
+			logx.Println(ctx, "[warn] webhook address is empty, channels are not re-registered")
+			return
+		}
+		logx.Println(ctx, "[info] re-register channels")
+		if err := app.maintenanceChannels(ctx, true); err != nil {
+			logx.Printf(ctx, "[error] failed re-register channels: %s", err.Error())
+		}
+	}()
+}
+
+// SetMetricsRecorder replaces the MetricsRecorder, for example to collect metrics in tests.
+func (app *App) SetMetricsRecorder(metrics MetricsRecorder) {
+	if metrics == nil {
+		metrics = NopMetricsRecorder{}
+	}
+	app.metrics = metrics
+}
+
+// Close cancels in-flight sync work, waits for it to settle up to shutdown_timeout, and then runs cleanups.
 func (app *App) Close() error {
+	app.closeOnce.Do(func() {
+		app.cancel()
+		app.waitInFlight()
+		app.closeErr = app.cleanup()
+	})
+	return app.closeErr
+}
+
+func (app *App) waitInFlight() {
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+	if app.shutdownTimeout <= 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+		log.Println("[debug] in-flight work settled")
+	case <-time.After(app.shutdownTimeout):
+		log.Printf("[warn] shutdown timeout %s exceeded, in-flight work is abandoned", app.shutdownTimeout)
+	}
+}
+
+// startWork tracks in-flight work until the returned func is called.
+// The returned context is cancelled when ctx is done or the App is closed.
+func (app *App) startWork(ctx context.Context) (context.Context, func()) {
+	app.wg.Add(1)
+	workCtx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-app.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	return workCtx, func() {
+		close(stop)
+		cancel()
+		app.wg.Done()
+	}
+}
+
+func (app *App) cleanup() error {
 	eg, ctx := errgroup.WithContext(context.Background())
 	for i, cleanup := range app.cleanupFns {
 		_i, _cleanup := i, cleanup
@@ -269,11 +501,66 @@ func (app *App) runAsWebhookServer(ctx context.Context, opts *RunOptions) error
 			}
 		}()
 	}
-	ridge.RunWithContext(ctx, opts.LocalAddress, "/", app)
+	ridge.RunWithContext(ctx, opts.LocalAddress, "/", app.setupRoute())
 	wg.Wait()
+	if opts.CleanupOnShutdown {
+		return app.cleanupOnShutdown(ctx)
+	}
 	return nil
 }
 
+// cleanupOnShutdown stops all channels after the webhook server is shut down, within shutdown_timeout.
+func (app *App) cleanupOnShutdown(ctx context.Context) error {
+	timeout := app.shutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	// ctx is already done at shutdown, only the logger is kept.
+	cleanupCtx, cancel := context.WithTimeout(logx.WithLogger(context.Background(), logx.Default(ctx)), timeout)
+	defer cancel()
+	logx.Printf(cleanupCtx, "[info] cleanup channels on shutdown, timeout=%s", timeout)
+	if err := app.cleanupChannels(cleanupCtx); err != nil {
+		return fmt.Errorf("cleanup channels on shutdown: %w", err)
+	}
+	return nil
+}
+
+func (app *App) setupRoute() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", app.verifySignature(app))
+	mux.HandleFunc("/health", app.handleHealth)
+	mux.HandleFunc("/ready", app.handleReady)
+	if app.replayToken != "" {
+		mux.HandleFunc("/replay", app.handleReplay)
+	}
+	if app.enableMetrics {
+		if recorder, ok := app.metrics.(*PrometheusMetricsRecorder); ok {
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				app.refreshActiveChannels(r.Context(), recorder)
+				recorder.ServeHTTP(w, r)
+			})
+		} else {
+			log.Println("[warn] server.enable_metrics is set, but metrics type is not Prometheus. /metrics is disabled")
+		}
+	}
+	return app.accessLog(mux)
+}
+
+func (app *App) refreshActiveChannels(ctx context.Context, recorder *PrometheusMetricsRecorder) {
+	itemsCh, err := app.storage.FindAllChannels(ctx)
+	if err != nil {
+		logx.Printf(ctx, "[warn] failed refresh active channels: %s", err.Error())
+		return
+	}
+	counts := make(map[string]int)
+	for items := range itemsCh {
+		for _, item := range items {
+			counts[item.DriveID]++
+		}
+	}
+	recorder.SetActiveChannels(counts)
+}
+
 func (app *App) runAsChannelMaintainer(ctx context.Context, _ *RunOptions) error {
 	if isLambda() {
 		logx.Println(ctx, "[info] run on lambda")
@@ -316,32 +603,75 @@ func (app *App) runAsCLI(ctx context.Context, opts *RunOptions) error {
 	}
 	switch opts.CLICommand {
 	case CLICommandList:
-		return app.listChannels(ctx, os.Stdout)
+		return app.List(ctx, os.Stdout, &ListOptions{
+			DriveID: opts.DriveID,
+			Limit:   opts.ListLimit,
+			Format:  opts.ListFormat,
+		})
 	case CLICommandServe:
 		return app.runAsWebhookServer(ctx, opts)
 	case CLICommandRegister:
+		if opts.DriveID != "" {
+			return app.Register(ctx, opts.DriveID)
+		}
 		return app.maintenanceChannels(ctx, true)
 	case CLICommandMaintenance:
 		return app.maintenanceChannels(ctx, false)
 	case CLICommandCleanup:
 		return app.cleanupChannels(ctx)
 	case CLICommandSync:
+		if err := app.maintenanceChannels(ctx, false); err != nil {
+			return err
+		}
+		if app.dryRun {
+			logx.Println(ctx, "[notice] [dry-run] skip fetching changes and sending notifications")
+			return nil
+		}
 		return app.syncChannels(ctx)
+	case CLICommandReconcile:
+		if opts.ChannelID == "" || opts.ResourceID == "" {
+			return errors.New("reconcile command requires channel id and resource id of the orphaned channel")
+		}
+		return app.StopOrphanChannel(ctx, opts.ChannelID, opts.ResourceID)
+	case CLICommandExport:
+		return app.ExportChannels(ctx, os.Stdout)
+	case CLICommandImport:
+		return app.ImportChannels(ctx, os.Stdin)
+	case CLICommandStats:
+		return app.WriteStats(ctx, os.Stdout, opts.ListFormat)
+	case CLICommandWatchFile:
+		if opts.FileID == "" {
+			return errors.New("watch_file command requires file id")
+		}
+		return app.WatchFile(ctx, opts.FileID)
+	case CLICommandDescribeChannel:
+		if opts.ChannelID == "" {
+			return errors.New("describe_channel command requires channel id")
+		}
+		return app.WriteChannelDescription(ctx, os.Stdout, opts.ChannelID, opts.ListFormat)
+	case CLICommandValidate:
+		return errors.New("validate command runs without App, use Config.WriteSummary after loading the config")
+	case CLICommandDoctor:
+		return errors.New("doctor command runs without App, use Config.Doctor after loading the config")
 	default:
 		return fmt.Errorf("unknown cli command `%s`", opts.CLICommand)
 	}
 }
 
 func (app *App) DriveIDs(ctx context.Context) ([]string, error) {
-	driveIDs := lo.Keys(app.drives)
-	if !app.drivesAutoDetect {
-		return driveIDs, nil
+	settings := app.currentSettings()
+	driveIDs := lo.Keys(settings.drives)
+	if !settings.drivesAutoDetect {
+		return app.filterDriveIDs(ctx, driveIDs), nil
 	}
 	if len(driveIDs) == 0 {
 		driveIDs = append(driveIDs, DefaultDriveID)
 	}
 	nextPageToken := "__initial__"
 	for nextPageToken != "" {
+		if err := app.waitDriveAPI(ctx); err != nil {
+			return nil, err
+		}
 		cell := app.driveSvc.Drives.List().PageSize(2).Context(ctx)
 		if nextPageToken != "__initial__" {
 			cell = cell.PageToken(nextPageToken)
@@ -356,11 +686,31 @@ func (app *App) DriveIDs(ctx context.Context) ([]string, error) {
 		}
 		nextPageToken = drivesListResp.NextPageToken
 	}
-	return lo.Uniq(driveIDs), nil
+	return app.filterDriveIDs(ctx, lo.Uniq(driveIDs)), nil
+}
+
+func (app *App) filterDriveIDs(ctx context.Context, driveIDs []string) []string {
+	return lo.Filter(driveIDs, func(driveID string, _ int) bool {
+		if !app.isTargetDrive(driveID) {
+			logx.Printf(ctx, "[info] filterd drive_id=%s", driveID)
+			return false
+		}
+		return true
+	})
+}
+
+// isTargetDrive reports whether the drive passes include_drive_ids and exclude_drive_ids.
+// `__default__` is matched literally as well as other drive ids.
+func (app *App) isTargetDrive(driveID string) bool {
+	settings := app.currentSettings()
+	if len(settings.includeDriveIDs) > 0 && !settings.includeDriveIDs[driveID] {
+		return false
+	}
+	return !settings.excludeDriveIDs[driveID]
 }
 
 func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error {
-	if app.webhookAddress == "" {
+	if len(app.currentSettings().webhookAddresses) == 0 {
 		return errors.New("webhook address is empty, plz check configure")
 	}
 	itemsCh, err := app.storage.FindAllChannels(ctx)
@@ -378,12 +728,23 @@ func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error
 		}
 	}))
 	channelsByDriveID := make(map[string][]*ChannelItem, len(existsDriveIDs))
+	excludedChannels := make([]*ChannelItem, 0)
+	fileChannels := make([]*ChannelItem, 0)
 	for items := range itemsCh {
 		for _, item := range items {
 			logx.Printf(ctx,
 				"[info] find channel_id=%s, drive_id=%s, expiration=%s, created_at=%s",
 				item.ChannelID, item.DriveID, item.Expiration.Format(time.RFC3339), item.CreatedAt.Format(time.RFC3339),
 			)
+			if item.FileID != "" {
+				// files:watch channels are registered explicitly by WatchFile, and are rotated one by one.
+				fileChannels = append(fileChannels, item)
+				continue
+			}
+			if !app.isTargetDrive(item.DriveID) {
+				excludedChannels = append(excludedChannels, item)
+				continue
+			}
 			existsDriveIDs[item.DriveID] = true
 			channels, ok := channelsByDriveID[item.DriveID]
 			if !ok {
@@ -393,6 +754,15 @@ func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error
 			channelsByDriveID[item.DriveID] = channels
 		}
 	}
+	for _, item := range excludedChannels {
+		if createOnly {
+			break
+		}
+		logx.Printf(ctx, "[info] drive_id=%s is excluded, delete channel_id=%s", item.DriveID, item.ChannelID)
+		if err := app.DeleteChannel(ctx, item); err != nil {
+			logx.Printf(ctx, "[warn] failed delete excluded channel drive_id=%s, channel_id=%s, resource_id=%s: %s", item.DriveID, item.ChannelID, item.ResourceID, err.Error())
+		}
+	}
 	egForNew, egCtxForNew := errgroup.WithContext(ctx)
 	for driveID, exists := range existsDriveIDs {
 		if exists {
@@ -402,6 +772,11 @@ func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error
 		egForNew.Go(func() error {
 			logx.Printf(egCtxForNew, "[info] channel not exist drive_id=%s, try create channel", _driveID)
 			if err := app.CreateChannel(egCtxForNew, _driveID); err != nil {
+				if isPushNotificationsNotEnabled(err) {
+					// e.g. a consumer account, the other drives can have channels.
+					logx.Printf(egCtxForNew, "[warn] push notifications are not enabled drive_id=%s, skip create channel: %s", _driveID, err.Error())
+					return nil
+				}
 				logx.Printf(egCtxForNew, "[error] failed CreateChannel drive_id=%s", _driveID)
 				return fmt.Errorf("CreateChannel:%w", err)
 			}
@@ -410,11 +785,17 @@ func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error
 	}
 	egForRotate, egCtxForRotate := errgroup.WithContext(ctx)
 	for driveID, channels := range channelsByDriveID {
+		if createOnly {
+			break
+		}
 		_driveID := driveID
 		noRotateExists := false
 		rotationTargets := make([]*ChannelItem, 0)
 		for _, channel := range channels {
-			if channel.IsAboutToExpired(egCtxForRotate, app.rotateRemaining) {
+			if channel.isAboutToExpiredAt(egCtxForRotate, app.clock.Now(), app.driveRotateRemaining(driveID)) {
+				rotationTargets = append(rotationTargets, channel)
+			} else if app.isStaleWebhookAddress(channel) {
+				logx.Printf(egCtxForRotate, "[info] webhook address changed, channel_id=%s, drive_id=%s, address=%s", channel.ChannelID, channel.DriveID, channel.WebhookAddress)
 				rotationTargets = append(rotationTargets, channel)
 			} else {
 				noRotateExists = true
@@ -443,6 +824,19 @@ func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error
 		})
 
 	}
+	for _, channel := range fileChannels {
+		if createOnly {
+			break
+		}
+		if !channel.isAboutToExpiredAt(egCtxForRotate, app.clock.Now(), app.driveRotateRemaining(channel.DriveID)) && !app.isStaleWebhookAddress(channel) {
+			continue
+		}
+		_channel := channel
+		egForRotate.Go(func() error {
+			logx.Printf(egCtxForRotate, "[info] try rotation file_id=%s", _channel.FileID)
+			return app.RotateChannel(egCtxForRotate, _channel)
+		})
+	}
 	if err := egForNew.Wait(); err != nil {
 		return fmt.Errorf("NewChannel:%w", err)
 	}
@@ -452,7 +846,40 @@ func (app *App) maintenanceChannels(ctx context.Context, createOnly bool) error
 	return nil
 }
 
+// Register creates a notification channel for the drive, if the drive does not have a channel yet.
+func (app *App) Register(ctx context.Context, driveID string) error {
+	driveIDs, err := app.DriveIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("get DriveIDs: %w", err)
+	}
+	if !lo.Contains(driveIDs, driveID) {
+		return fmt.Errorf("drive_id=%s is not a target drive, plz check configure", driveID)
+	}
+	itemsCh, err := app.storage.FindAllChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("find all channels: %w", err)
+	}
+	var exists *ChannelItem
+	for items := range itemsCh {
+		for _, item := range items {
+			if item.DriveID == driveID && item.FileID == "" {
+				exists = item
+			}
+		}
+	}
+	if exists != nil {
+		logx.Printf(ctx, "[info] channel already exists drive_id=%s, channel_id=%s, skip register", driveID, exists.ChannelID)
+		return nil
+	}
+	logx.Printf(ctx, "[info] channel not exist drive_id=%s, try create channel", driveID)
+	return app.CreateChannel(ctx, driveID)
+}
+
 func (app *App) CreateChannel(ctx context.Context, driveID string) error {
+	if app.dryRun {
+		logx.Printf(ctx, "[notice] [dry-run] create channel drive_id=%s", driveID)
+		return nil
+	}
 	token, err := app.getStartPageToken(ctx, driveID)
 	if err != nil {
 		return err
@@ -461,7 +888,12 @@ func (app *App) CreateChannel(ctx context.Context, driveID string) error {
 		PageToken: token,
 		DriveID:   driveID,
 	}
-	return app.createChannel(ctx, item)
+	if err := app.createChannel(ctx, item); err != nil {
+		return err
+	}
+	app.metrics.IncrChannelsCreated(ctx, driveID)
+	app.sendLifecycleEvent(ctx, NewLifecycleEvent(DetailTypeChannelCreated, item, nil))
+	return nil
 }
 
 func (app *App) getStartPageToken(ctx context.Context, driveID string) (string, error) {
@@ -469,7 +901,12 @@ func (app *App) getStartPageToken(ctx context.Context, driveID string) (string,
 	if driveID != DefaultDriveID {
 		getStartPageTokenCell = getStartPageTokenCell.DriveId(driveID)
 	}
-	token, err := getStartPageTokenCell.Context(ctx).Do()
+	var token *drive.StartPageToken
+	err := app.retryDriveAPI(ctx, "changes:getStartPageToken", func() error {
+		var err error
+		token, err = getStartPageTokenCell.Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		logx.Println(ctx, "[debug] drive API changes:getStartPageToken failed:", err)
 		return "", fmt.Errorf("drive API changes:getStartPageToken:%w", err)
@@ -481,44 +918,122 @@ func (app *App) getStartPageToken(ctx context.Context, driveID string) (string,
 	return token.StartPageToken, nil
 }
 
+// driveExpiration returns the channel expiration of the drive, the global expiration if the drive has no override.
+func (app *App) driveExpiration(driveID string) time.Duration {
+	settings := app.currentSettings()
+	if cfg, ok := settings.drives[driveID]; ok && cfg.Expiration > 0 {
+		return cfg.Expiration
+	}
+	return settings.expiration
+}
+
+// expirationJitter returns a random duration within expiration_jitter, capped by the rotate remaining of the drive,
+// so that a jittered channel is not rotated later than its expiration.
+func (app *App) expirationJitter(driveID string) time.Duration {
+	jitter := app.currentSettings().expirationJitter
+	if remaining := app.driveRotateRemaining(driveID); jitter > remaining {
+		jitter = remaining
+	}
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter) + 1))
+}
+
+// driveRotateRemaining returns the remaining time to rotate the channel of the drive, 20% of the drive expiration.
+func (app *App) driveRotateRemaining(driveID string) time.Duration {
+	settings := app.currentSettings()
+	if cfg, ok := settings.drives[driveID]; ok && cfg.Expiration > 0 {
+		return time.Duration(0.2 * float64(cfg.Expiration))
+	}
+	return settings.rotateRemaining
+}
+
+// isStaleWebhookAddress reports whether the channel is pointed at an address that is no longer configured.
+// Channels created before the address was recorded are not regarded as stale.
+func (app *App) isStaleWebhookAddress(item *ChannelItem) bool {
+	return item.WebhookAddress != "" && !lo.Contains(app.currentSettings().webhookAddresses, item.WebhookAddress)
+}
+
+// webhookAddresses returns the webhook addresses in the order of preference, `webhook` first.
+func webhookAddresses(cfg *Config) []string {
+	addresses := make([]string, 0, len(cfg.WebhookAddresses)+1)
+	if cfg.Webhook != "" {
+		addresses = append(addresses, cfg.Webhook)
+	}
+	return lo.Uniq(append(addresses, cfg.WebhookAddresses...))
+}
+
+// watchChanges calls changes:watch with the webhook address.
+func (app *App) watchChanges(ctx context.Context, item *ChannelItem, address string) (*drive.Channel, error) {
+	watchCall := app.driveSvc.Changes.Watch(item.PageToken, &drive.Channel{
+		Id:         item.ChannelID,
+		Address:    address,
+		Expiration: item.Expiration.UnixMilli(),
+		Type:       "web_hook",
+		Payload:    true,
+	}).SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+	if item.DriveID != DefaultDriveID {
+		watchCall = watchCall.DriveId(item.DriveID)
+	}
+	var resp *drive.Channel
+	err := app.retryDriveAPI(ctx, "changes:watch", func() error {
+		var err error
+		resp, err = watchCall.Context(ctx).Do()
+		return err
+	})
+	return resp, err
+}
+
 func (app *App) createChannel(ctx context.Context, item *ChannelItem) error {
 	uuidObj, err := uuid.NewRandom()
 	if err != nil {
 		logx.Println(ctx, "[debug] create new uuid v4: ", err)
 		return fmt.Errorf(" create new uuid v4: %w", err)
 	}
-	now := flextime.Now()
+	now := app.clock.Now()
 	item.ChannelID = uuidObj.String()
-	item.Expiration = now.Add(app.expiration)
+	item.Expiration = now.Add(app.driveExpiration(item.DriveID) + app.expirationJitter(item.DriveID))
+	// message numbers of the new channel start from 1 again.
+	item.LastMessageNumber = 0
 	item.CreatedAt = now
 	item.UpdatedAt = now
 	if item.PageTokenFetchedAt.IsZero() {
 		item.PageTokenFetchedAt = now
 	}
 
-	watchCall := app.driveSvc.Changes.Watch(item.PageToken, &drive.Channel{
-		Id:         item.ChannelID,
-		Address:    app.webhookAddress,
-		Expiration: item.Expiration.UnixMilli(),
-		Type:       "web_hook",
-		Payload:    true,
-	}).SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
-	if item.DriveID != DefaultDriveID {
-		watchCall = watchCall.DriveId(item.DriveID)
+	// try the webhook addresses in order, the following ones are failover.
+	watch, watchName := app.watchChanges, "changes:watch"
+	if item.FileID != "" {
+		watch, watchName = app.watchFile, "files:watch"
+	}
+	item.WebhookAddress = ""
+	var resp *drive.Channel
+	var watchErr error
+	for _, address := range app.currentSettings().webhookAddresses {
+		resp, err = watch(ctx, item, address)
+		if err == nil {
+			item.WebhookAddress = address
+			break
+		}
+		logx.Printf(ctx, "[warn] drive API %s failed address=%s, drive_id=%s: %s", watchName, address, item.DriveID, err)
+		watchErr = errors.Join(watchErr, err)
+		if ctx.Err() != nil {
+			break
+		}
 	}
-	resp, err := watchCall.Context(ctx).Do()
-	if err != nil {
-		logx.Println(ctx, "[debug] drive API changes:watch failed:", err)
-		return fmt.Errorf("drive API changes:watch:%w", err)
+	if item.WebhookAddress == "" {
+		logx.Printf(ctx, "[debug] drive API %s failed: %s", watchName, watchErr)
+		return fmt.Errorf("drive API %s:%w", watchName, watchErr)
 	}
 	if err != nil {
-		logx.Printf(ctx, "[debug] drive API changes:watch response status not ok (status:%d)", resp.HTTPStatusCode)
-		return fmt.Errorf("drive API changes:watch response status not ok (status:%d)", resp.HTTPStatusCode)
+		logx.Printf(ctx, "[debug] drive API %s response status not ok (status:%d)", watchName, resp.HTTPStatusCode)
+		return fmt.Errorf("drive API %s response status not ok (status:%d)", watchName, resp.HTTPStatusCode)
 	}
 	item.ResourceID = resp.ResourceId
 	item.Expiration = time.UnixMilli(resp.Expiration)
-	logx.Printf(ctx, "[info] create channel id=%s, resource_id=%s, drive_id=%s page_token=%s, resource_uri=%s, expiration=%s",
-		resp.Id, resp.ResourceId, item.DriveID, item.PageToken, resp.ResourceUri, item.Expiration,
+	logx.Printf(ctx, "[info] create channel id=%s, resource_id=%s, drive_id=%s file_id=%s page_token=%s, resource_uri=%s, expiration=%s, address=%s",
+		resp.Id, resp.ResourceId, item.DriveID, coalesce(item.FileID, "-"), item.PageToken, resp.ResourceUri, item.Expiration, item.WebhookAddress,
 	)
 	if err := app.storage.SaveChannel(ctx, item); err != nil {
 		logx.Println(ctx, "[debug] save channel failed", err)
@@ -527,31 +1042,159 @@ func (app *App) createChannel(ctx context.Context, item *ChannelItem) error {
 	return nil
 }
 
-func (app *App) listChannels(ctx context.Context, w io.Writer) error {
+const (
+	ListFormatTable = "table"
+	ListFormatJSON  = "json"
+)
+
+// ListOptions is options of App.List.
+type ListOptions struct {
+	// DriveID filters channels by drive id, empty means all drives.
+	DriveID string
+	// Limit caps the number of rows, 0 means unlimited.
+	Limit int
+	// Format is `table` (default) or `json`.
+	Format string
+}
+
+// ListItem is a row of list command.
+// Drives that have no notification channel are listed with empty channel fields.
+type ListItem struct {
+	ChannelID          string     `json:"channelId"`
+	DriveID            string     `json:"driveId"`
+	DriveName          string     `json:"driveName"`
+	FileID             string     `json:"fileId,omitempty"`
+	PageToken          string     `json:"pageToken"`
+	Expiration         *time.Time `json:"expiration"`
+	ResourceID         string     `json:"resourceId"`
+	WebhookAddress     string     `json:"webhookAddress"`
+	LastChangeAt       *time.Time `json:"lastChangeAt"`
+	PageTokenFetchedAt *time.Time `json:"pageTokenFetchedAt"`
+	CreatedAt          *time.Time `json:"createdAt"`
+	UpdatedAt          *time.Time `json:"updatedAt"`
+}
+
+func newListItem(item *ChannelItem, driveName string) *ListItem {
+	var lastChangeAt *time.Time
+	if !item.LastChangeAt.IsZero() {
+		lastChangeAt = aws.Time(item.LastChangeAt)
+	}
+	return &ListItem{
+		ChannelID:          item.ChannelID,
+		DriveID:            item.DriveID,
+		DriveName:          driveName,
+		FileID:             item.FileID,
+		PageToken:          item.PageToken,
+		Expiration:         aws.Time(item.Expiration),
+		ResourceID:         item.ResourceID,
+		WebhookAddress:     item.WebhookAddress,
+		LastChangeAt:       lastChangeAt,
+		PageTokenFetchedAt: aws.Time(item.PageTokenFetchedAt),
+		CreatedAt:          aws.Time(item.CreatedAt),
+		UpdatedAt:          aws.Time(item.UpdatedAt),
+	}
+}
+
+// List writes notification channels to w.
+func (app *App) List(ctx context.Context, w io.Writer, opts *ListOptions) error {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	switch opts.Format {
+	case ListFormatTable, ListFormatJSON, "":
+	default:
+		return fmt.Errorf("unknown list format `%s`", opts.Format)
+	}
 	itemsCh, err := app.storage.FindAllChannels(ctx)
 	if err != nil {
 		return fmt.Errorf("find all channels: %w", err)
 	}
-	table := tablewriter.NewWriter(w)
-	table.SetHeader([]string{"Channel ID", "Drive ID", "Page Token", "Expiration", "Resource ID", "Start Page Token Fetched At", "Created At", "Updated At"})
+	channels := make([]*ChannelItem, 0)
+	hasChannel := make(map[string]bool)
 	for items := range itemsCh {
 		for _, item := range items {
-			table.Append([]string{
-				item.ChannelID,
-				item.DriveID,
-				item.PageToken,
-				item.Expiration.Format(time.RFC3339),
-				item.ResourceID,
-				item.PageTokenFetchedAt.Format(time.RFC3339),
-				item.CreatedAt.Format(time.RFC3339),
-				item.UpdatedAt.Format(time.RFC3339),
-			})
+			if opts.DriveID != "" && item.DriveID != opts.DriveID {
+				continue
+			}
+			if item.FileID == "" {
+				hasChannel[item.DriveID] = true
+			}
+			channels = append(channels, item)
+		}
+	}
+	driveIDs, err := app.DriveIDs(ctx)
+	if err != nil {
+		logx.Printf(ctx, "[warn] get DriveIDs failed, drives without channel are not listed: %s", err.Error())
+	}
+	driveNames := make(map[string]string)
+	rows := make([]*ListItem, 0, len(channels))
+	for _, item := range channels {
+		if _, ok := driveNames[item.DriveID]; !ok {
+			driveNames[item.DriveID] = app.driveName(ctx, item.DriveID)
+		}
+		rows = append(rows, newListItem(item, driveNames[item.DriveID]))
+	}
+	for _, driveID := range driveIDs {
+		if hasChannel[driveID] || (opts.DriveID != "" && driveID != opts.DriveID) {
+			continue
+		}
+		rows = append(rows, &ListItem{
+			DriveID:   driveID,
+			DriveName: app.driveName(ctx, driveID),
+		})
+	}
+	if opts.Limit > 0 && len(rows) > opts.Limit {
+		rows = rows[:opts.Limit]
+	}
+	if opts.Format == ListFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
 		}
+		return t.Format(time.RFC3339)
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Channel ID", "Drive ID", "File ID", "Page Token", "Expiration", "Resource ID", "Webhook Address", "Last Change At", "Start Page Token Fetched At", "Created At", "Updated At"})
+	for _, row := range rows {
+		table.Append([]string{
+			row.ChannelID,
+			row.DriveID,
+			row.FileID,
+			row.PageToken,
+			formatTime(row.Expiration),
+			row.ResourceID,
+			row.WebhookAddress,
+			formatTime(row.LastChangeAt),
+			formatTime(row.PageTokenFetchedAt),
+			formatTime(row.CreatedAt),
+			formatTime(row.UpdatedAt),
+		})
 	}
 	table.Render()
 	return nil
 }
 
+// driveName returns the name of the shared drive, empty for `__default__` or if it can not be fetched.
+func (app *App) driveName(ctx context.Context, driveID string) string {
+	if driveID == DefaultDriveID {
+		return ""
+	}
+	if err := app.waitDriveAPI(ctx); err != nil {
+		logx.Printf(ctx, "[warn] get drive name drive_id=%s failed: %s", driveID, err.Error())
+		return ""
+	}
+	d, err := app.driveSvc.Drives.Get(driveID).Fields("name").Context(ctx).Do()
+	if err != nil {
+		logx.Printf(ctx, "[warn] get drive name drive_id=%s failed: %s", driveID, err.Error())
+		return ""
+	}
+	return d.Name
+}
+
 func (app *App) cleanupChannels(ctx context.Context) error {
 	itemsCh, err := app.storage.FindAllChannels(ctx)
 	if err != nil {
@@ -577,59 +1220,95 @@ func (app *App) cleanupChannels(ctx context.Context) error {
 }
 
 func (app *App) syncChannels(ctx context.Context) error {
+	ctx, done := app.startWork(ctx)
+	defer done()
 	itemsCh, err := app.storage.FindAllChannels(ctx)
 	if err != nil {
 		return fmt.Errorf("find all channels: %w", err)
 	}
+	var eg errgroup.Group
+	eg.SetLimit(app.syncConcurrency)
 	for items := range itemsCh {
 		for _, item := range items {
-			logx.Printf(ctx,
-				"[info] find channel_id=%s, drive_id=%s, expiration=%s, created_at=%s",
-				item.ChannelID, item.DriveID, item.Expiration.Format(time.RFC3339), item.CreatedAt.Format(time.RFC3339),
-			)
-			changes, _, err := app.changesList(ctx, item)
-			if err != nil {
-				logx.Printf(ctx, "[warn] failed sync channel_id=%s, resource_id=%s, drive_id=%s", item.ChannelID, item.ResourceID, item.DriveID)
-				continue
-			}
-			if err != nil {
-				logx.Printf(ctx, "[warn] get changes list failed channel_id:%s resource_id:%s err:%s",
-					coalesce(item.ChannelID, "-"),
-					coalesce(item.ResourceID, "-"),
-					err.Error(),
-				)
+			if err := ctx.Err(); err != nil {
+				logx.Printf(ctx, "[warn] sync interrupted: %s", err.Error())
+				eg.Wait()
+				return err
 			}
-			if len(changes) > 0 {
-				logx.Printf(ctx, "[debug] send changes channel_id:%s resource_id:%s",
-					coalesce(item.ChannelID, "-"),
-					coalesce(item.ResourceID, "-"),
-				)
-				if err := app.SendNotification(ctx, item, changes); err != nil {
-					logx.Printf(ctx, "[error] send changes failed channel_id:%s resource_id:%s err:%s",
-						coalesce(item.ChannelID, "-"),
-						coalesce(item.ResourceID, "-"),
-						err.Error(),
-					)
-				}
-			} else {
-				logx.Printf(ctx, "[debug] no changes channel_id:%s resource_id:%s",
-					coalesce(item.ChannelID, "-"),
-					coalesce(item.ResourceID, "-"),
-				)
+			if item.FileID != "" {
+				logx.Printf(ctx, "[debug] skip sync files:watch channel_id=%s, file_id=%s", item.ChannelID, item.FileID)
+				continue
 			}
+			_item := item
+			eg.Go(func() error {
+				return app.syncChannel(ctx, _item)
+			})
+		}
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// syncChannel fetches all changes of the channel and sends notification.
+// errors other than context cancellation are logged and not returned, so that other channels continue to sync.
+func (app *App) syncChannel(ctx context.Context, item *ChannelItem) error {
+	logx.Printf(ctx,
+		"[info] find channel_id=%s, drive_id=%s, expiration=%s, created_at=%s",
+		item.ChannelID, item.DriveID, item.Expiration.Format(time.RFC3339), item.CreatedAt.Format(time.RFC3339),
+	)
+	start := time.Now()
+	if _, err := app.ChangesPages(ctx, item, func(changes []*drive.Change) error {
+		if err := app.sendChangesPage(ctx, item, changes); err != nil {
+			logx.Printf(ctx, "[error] send changes failed channel_id:%s resource_id:%s err:%s",
+				coalesce(item.ChannelID, "-"),
+				coalesce(item.ResourceID, "-"),
+				err.Error(),
+			)
 		}
+		return nil
+	}); err != nil {
+		logx.Printf(ctx, "[warn] failed sync channel_id=%s, resource_id=%s, drive_id=%s: %s", item.ChannelID, item.ResourceID, item.DriveID, err.Error())
+		return ctx.Err()
 	}
+	app.metrics.ObserveSyncDuration(ctx, item.DriveID, time.Since(start))
 	return nil
 }
 
+// sendChangesPage sends a page of changes fetched by ChangesPages.
+func (app *App) sendChangesPage(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	if len(changes) == 0 {
+		logx.Printf(ctx, "[debug] no changes channel_id:%s resource_id:%s",
+			coalesce(item.ChannelID, "-"),
+			coalesce(item.ResourceID, "-"),
+		)
+		return nil
+	}
+	logx.Printf(ctx, "[debug] send changes channel_id:%s resource_id:%s changes:%d",
+		coalesce(item.ChannelID, "-"),
+		coalesce(item.ResourceID, "-"),
+		len(changes),
+	)
+	return app.SendNotification(ctx, item, changes)
+}
+
 func (app *App) DeleteChannel(ctx context.Context, item *ChannelItem) error {
+	if app.dryRun {
+		logx.Printf(ctx, "[notice] [dry-run] delete channel id=%s, resource_id=%s, drive_id=%s",
+			item.ChannelID, item.ResourceID, item.DriveID,
+		)
+		return nil
+	}
 	logx.Printf(ctx, "[info] delete channel id=%s, resource_id=%s, drive_id=%s page_token=%s",
 		item.ChannelID, item.ResourceID, item.DriveID, item.PageToken,
 	)
-	err := app.driveSvc.Channels.Stop(&drive.Channel{
-		Id:         item.ChannelID,
-		ResourceId: item.ResourceID,
-	}).Context(ctx).Do()
+	err := app.retryDriveAPI(ctx, "channels:stop", func() error {
+		return app.driveSvc.Channels.Stop(&drive.Channel{
+			Id:         item.ChannelID,
+			ResourceId: item.ResourceID,
+		}).Context(ctx).Do()
+	})
 	if err != nil {
 		logx.Println(ctx, "[debug] drive API channels:stop failed:", err)
 		var apiError *googleapi.Error
@@ -647,22 +1326,25 @@ func (app *App) DeleteChannel(ctx context.Context, item *ChannelItem) error {
 		logx.Println(ctx, "[debug] delete channel failed", err)
 		return fmt.Errorf("delete channel:%w", err)
 	}
+	app.sendLifecycleEvent(ctx, NewLifecycleEvent(DetailTypeChannelDeleted, item, nil))
 	return nil
 }
 
-const (
-	pageTokenRefreshIntervalDays = 90
-)
-
 func (app *App) RotateChannel(ctx context.Context, item *ChannelItem) error {
+	if app.dryRun {
+		logx.Printf(ctx, "[notice] [dry-run] rotate channel channel id=%s, resource_id=%s, drive_id=%s, expiration=%s",
+			item.ChannelID, item.ResourceID, item.DriveID, item.Expiration.Format(time.RFC3339),
+		)
+		return nil
+	}
 	logx.Printf(ctx, "[info] try rotate channel channel id=%s, resource_id=%s, drive_id=%s",
 		item.ChannelID, item.ResourceID, item.DriveID,
 	)
 	newItem := *item
-	now := flextime.Now()
-	if now.Sub(item.PageTokenFetchedAt) >= pageTokenRefreshIntervalDays*24*time.Hour {
-		logx.Printf(ctx, "[info] 90 days have passed since the first acquisition of the PageToken, so try to re-acquire the PageToken: channel id=%s, resource_id=%s, drive_id=%s",
-			item.ChannelID, item.ResourceID, item.DriveID,
+	now := app.clock.Now()
+	if item.FileID == "" && now.Sub(item.PageTokenFetchedAt) >= app.pageTokenRefreshInterval {
+		logx.Printf(ctx, "[info] %s have passed since the first acquisition of the PageToken, so try to re-acquire the PageToken: channel id=%s, resource_id=%s, drive_id=%s",
+			app.pageTokenRefreshInterval, item.ChannelID, item.ResourceID, item.DriveID,
 		)
 		token, err := app.getStartPageToken(ctx, item.DriveID)
 		if err != nil {
@@ -681,11 +1363,15 @@ func (app *App) RotateChannel(ctx context.Context, item *ChannelItem) error {
 		logx.Printf(ctx, "[error] failed rotate channel id=%s, resource_id=%s, drive_id=%s: %s",
 			item.ChannelID, item.ResourceID, item.DriveID, err.Error(),
 		)
+		app.metrics.IncrChannelRotationFailures(ctx, item.DriveID)
+		app.sendLifecycleEvent(ctx, NewLifecycleEvent(DetailTypeChannelRotationFailed, item, err))
 		return err
 	}
 	logx.Printf(ctx, "[info] success rotate channel old_channel_id=%s, new_channel_id=%s, drive_id=%s",
 		item.ChannelID, newItem.ChannelID, item.DriveID,
 	)
+	app.metrics.IncrChannelsRotated(ctx, item.DriveID)
+	app.sendLifecycleEvent(ctx, NewChannelRotatedEvent(item, &newItem))
 	if err := app.DeleteChannel(ctx, item); err != nil {
 		logx.Printf(ctx, "[error] failed delete old channel id=%s, resource_id=%s, drive_id=%s: %s",
 			item.ChannelID, item.ResourceID, item.DriveID, err.Error(),
@@ -699,44 +1385,102 @@ var driveFields = fmt.Sprintf("drive(%s)", strings.Join(
 	[]string{"id", "name", "kind", "themeId", "orgUnitId", "createdTime", "hidden"},
 	",",
 ))
-var fileFields = fmt.Sprintf("file(%s)", strings.Join(
-	[]string{"id", "name", "driveId", "kind", "mimeType", "modifiedTime", "lastModifyingUser", "trashed", "trashedTime", "trashingUser", "version", "size", "md5Checksum", "createdTime"},
-	",",
-))
-var changesFields = fmt.Sprintf("changes(%s)", strings.Join(
-	[]string{"time", "kind", "removed", "fileId", "changeType", "driveId", driveFields, fileFields},
+var fileFieldNames = strings.Join(
+	[]string{"id", "name", "driveId", "kind", "mimeType", "modifiedTime", "lastModifyingUser", "trashed", "trashedTime", "trashingUser", "version", "size", "md5Checksum", "createdTime", "parents", "webViewLink", "iconLink"},
 	",",
-))
+)
+
+// permissionFieldNames are requested only if include_permissions is true, because they enlarge the responses.
+const permissionFieldNames = "permissions,permissionIds"
+
+// fileFieldNamesOf returns the fields of files:get, change_file_fields or the default ones, with the permissions if include_permissions is true.
+func fileFieldNamesOf(settings *appSettings) string {
+	names := fileFieldNames
+	if len(settings.changeFileFields) > 0 {
+		names = strings.Join(settings.changeFileFields, ",")
+	}
+	if settings.includePermissions {
+		return names + "," + permissionFieldNames
+	}
+	return names
+}
+
+// changesFieldsOf returns the changes fields of changes:list, with the file fields of fileFieldNamesOf.
+func changesFieldsOf(settings *appSettings) string {
+	return fmt.Sprintf("changes(%s)", strings.Join(
+		[]string{"time", "kind", "removed", "fileId", "changeType", "driveId", driveFields, fmt.Sprintf("file(%s)", fileFieldNamesOf(settings))},
+		",",
+	))
+}
 
 func (app *App) ChangesList(ctx context.Context, channelID string) ([]*drive.Change, *ChannelItem, error) {
+	item, err := app.findChannel(ctx, channelID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return app.changesList(ctx, item)
+}
+
+func (app *App) findChannel(ctx context.Context, channelID string) (*ChannelItem, error) {
 	logx.Printf(ctx, "[debug] try FindOneByChannelID  channel id=%s", channelID)
 	item, err := app.storage.FindOneByChannelID(ctx, channelID)
 	logx.Printf(ctx, "[debug] finish FindOneByChannelID  channel id=%s err=%#v", channelID, err)
 	if err != nil {
 		logx.Printf(ctx, "[debug] failed FindOneByChannelID channel_id=%s err=%s", channelID, err.Error())
-		return nil, nil, err
+		return nil, err
 	}
 	logx.Printf(ctx, "[debug] try change list channel id=%s, resource_id=%s, drive_id=%s",
 		item.ChannelID, item.ResourceID, item.DriveID,
 	)
-	return app.changesList(ctx, item)
+	return item, nil
 }
 
 func (app *App) changesList(ctx context.Context, item *ChannelItem) ([]*drive.Change, *ChannelItem, error) {
 	changes := make([]*drive.Change, 0, 100)
+	newItem, err := app.ChangesPages(ctx, item, func(page []*drive.Change) error {
+		changes = append(changes, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return changes, newItem, nil
+}
+
+// ChangesPages fetches the changes of the channel page by page, and calls fn with each page as soon as it is fetched,
+// so that a drive with a lot of pending changes is not buffered in memory.
+// The new page token is persisted only after the final page, if fn returns an error, it is not persisted.
+func (app *App) ChangesPages(ctx context.Context, item *ChannelItem, fn func([]*drive.Change) error) (*ChannelItem, error) {
+	return app.changesPages(ctx, item, fn, true)
+}
+
+// changesPages is ChangesPages, the new page token is not persisted unless persist is true.
+func (app *App) changesPages(ctx context.Context, item *ChannelItem, fn func([]*drive.Change) error, persist bool) (*ChannelItem, error) {
+	processed := 0
 	nextPageToken := ""
 	newStartPageToken := ""
-	process := func(ctx context.Context, pageToken string) error {
+	process := func(ctx context.Context, pageToken string) (err error) {
+		ctx, span := app.tracer.Start(ctx, "changes:list", trace.WithAttributes(
+			attribute.String("gdnotify.channel_id", item.ChannelID),
+			attribute.String("gdnotify.drive_id", item.DriveID),
+			attribute.String("gdnotify.page_token", pageToken),
+		))
+		defer func() { endSpan(span, err) }()
 		call := app.driveSvc.Changes.List(pageToken).
 			IncludeCorpusRemovals(true).
 			IncludeItemsFromAllDrives(true).
 			SupportsAllDrives(true).
 			PageSize(100).
-			Fields("newStartPageToken", "nextPageToken", googleapi.Field(changesFields))
+			Fields("newStartPageToken", "nextPageToken", googleapi.Field(changesFieldsOf(app.currentSettings())))
 		if item.DriveID != DefaultDriveID {
 			call = call.DriveId(item.DriveID)
 		}
-		changeList, err := call.Context(ctx).Do()
+		var changeList *drive.ChangeList
+		err = app.retryDriveAPI(ctx, "changes:list", func() error {
+			var err error
+			changeList, err = call.Context(ctx).Do()
+			return err
+		})
 		logx.Printf(ctx, "[debug] try Drive API changes:list: channel_id=%s drive_id=%s page_token=%s", item.ChannelID, item.DriveID, pageToken)
 		if err != nil {
 			logx.Printf(ctx, "[debug] failed Drive API changes:list channel id=%s, resource_id=%s, drive_id=%s: %s",
@@ -745,42 +1489,123 @@ func (app *App) changesList(ctx context.Context, item *ChannelItem) ([]*drive.Ch
 			return err
 		}
 		logx.Printf(ctx, "[debug] success Drive API changes:list: channel_id=%s drive_id=%s, pageToken=%s changes=%d", item.ChannelID, item.DriveID, pageToken, len(changeList.Changes))
-		changes = append(changes, changeList.Changes...)
+		span.SetAttributes(attribute.Int("gdnotify.changes", len(changeList.Changes)))
+		processed += len(changeList.Changes)
 		nextPageToken = changeList.NextPageToken
 		newStartPageToken = changeList.NewStartPageToken
 		logx.Printf(ctx, "[debug] Drive API changes:list: channel_id=%s drive_id=%s, next_page_token=%s  new_start_page_token=%s", item.ChannelID, item.DriveID, pageToken, newStartPageToken)
-		return nil
+		return fn(changeList.Changes)
 	}
-	if err := process(ctx, item.PageToken); err != nil {
-		return nil, nil, err
+	startPageToken := item.PageToken
+	if persist {
+		startPageToken = app.pendingPageToken(item)
+	}
+	if err := process(ctx, startPageToken); err != nil {
+		return nil, err
 	}
 	for nextPageToken != "" {
-		time.Sleep(200 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
 		if err := process(ctx, nextPageToken); err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
-	logx.Printf(ctx, "[info] PageToken refresh channel_id=%s old_page_token=%s new_page_token=%s", item.ChannelID, item.PageToken, newStartPageToken)
 	newItem := *item
 	newItem.PageToken = newStartPageToken
-	newItem.UpdatedAt = flextime.Now()
-	if err := app.storage.UpdatePageToken(ctx, &newItem); err != nil {
-		return nil, nil, err
+	newItem.UpdatedAt = app.clock.Now()
+	if processed > 0 {
+		newItem.LastChangeAt = newItem.UpdatedAt
+	}
+	if !persist {
+		return &newItem, nil
+	}
+	if err := app.commitPageToken(ctx, item, &newItem); err != nil {
+		return nil, err
 	}
-	return changes, &newItem, nil
+	app.metrics.ObserveChangesProcessed(ctx, item.DriveID, processed)
+	return &newItem, nil
 }
 
-func (app *App) SendNotification(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+// pendingPageToken returns the page token to fetch the changes of the channel from.
+// It is ahead of the stored page token while the changes fetched are pending in a DeferredNotification.
+func (app *App) pendingPageToken(item *ChannelItem) string {
+	app.pageTokensMu.Lock()
+	defer app.pageTokensMu.Unlock()
+	if pageToken, ok := app.pendingPageTokens[item.ChannelID]; ok {
+		return pageToken
+	}
+	return item.PageToken
+}
+
+// commitPageToken persists the new page token of the channel.
+// With a DeferredNotification, it is persisted only after the changes fetched are sent,
+// so that the changes are fetched again from the stored page token if the process exits while they are pending.
+func (app *App) commitPageToken(ctx context.Context, item, newItem *ChannelItem) error {
+	commit := func(ctx context.Context) error {
+		logx.Printf(ctx, "[info] PageToken refresh channel_id=%s old_page_token=%s new_page_token=%s", item.ChannelID, item.PageToken, newItem.PageToken)
+		return app.storage.UpdatePageToken(ctx, newItem)
+	}
+	d, ok := app.notification.(DeferredNotification)
+	if !ok {
+		return commit(ctx)
+	}
+	app.pageTokensMu.Lock()
+	app.pendingPageTokens[newItem.ChannelID] = newItem.PageToken
+	app.pageTokensMu.Unlock()
+	return d.AfterSent(ctx, newItem.ChannelID, func(ctx context.Context) error {
+		err := commit(ctx)
+		app.pageTokensMu.Lock()
+		defer app.pageTokensMu.Unlock()
+		if app.pendingPageTokens[newItem.ChannelID] == newItem.PageToken {
+			delete(app.pendingPageTokens, newItem.ChannelID)
+		}
+		return err
+	})
+}
+
+func (app *App) SendNotification(ctx context.Context, item *ChannelItem, changes []*drive.Change) (err error) {
+	ctx, span := app.tracer.Start(ctx, "notification", trace.WithAttributes(
+		attribute.String("gdnotify.channel_id", item.ChannelID),
+		attribute.String("gdnotify.drive_id", item.DriveID),
+		attribute.Int("gdnotify.changes", len(changes)),
+	))
+	defer func() { endSpan(span, err) }()
+	if err := app.sendNotification(ctx, item, changes); err != nil {
+		app.metrics.IncrNotificationErrors(ctx, item.DriveID)
+		return err
+	}
+	return nil
+}
+
+func (app *App) sendNotification(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
 	logx.Printf(ctx, "[debug] send notification for channel %s", item.ChannelID)
-	if app.withinModifiedTime == nil {
+	settings := app.currentSettings()
+	changes = app.filterChangeTypes(ctx, settings, changes)
+	changes = app.filterSelfEdits(ctx, settings, changes)
+	changes = app.filterParentFolders(ctx, settings, changes)
+	changes = app.filterVersionNoops(ctx, settings, changes)
+	if settings.withinModifiedTime == nil {
 		logx.Printf(ctx, "[debug] no filter send for %s", item.ChannelID)
-		return app.notification.SendChanges(ctx, item, changes)
+		return app.forwardChanges(ctx, item, changes)
 	}
 	logx.Printf(ctx, "[debug] try filter %s", item.ChannelID)
-	now := time.Now()
+	now := app.clock.Now()
 	filterd := make([]*drive.Change, 0, len(changes))
 	for _, change := range changes {
 		if change.File == nil {
+			if change.ChangeType != "drive" || settings.includeDriveChangesAlways {
+				filterd = append(filterd, change)
+				continue
+			}
+			// drive changes have no modified time, so the time of the change is checked instead.
+			logx.Printf(ctx, "[debug] try check change time: drive_id=%s time=%s", change.DriveId, change.Time)
+			if t, err := time.Parse(time.RFC3339Nano, change.Time); err == nil && now.Sub(t) > *settings.withinModifiedTime {
+				logx.Printf(ctx, "[info] filterd changes item: drive_id=%s time=%s", change.DriveId, change.Time)
+				continue
+			}
 			filterd = append(filterd, change)
 			continue
 		}
@@ -790,11 +1615,216 @@ func (app *App) SendNotification(ctx context.Context, item *ChannelItem, changes
 			filterd = append(filterd, change)
 			continue
 		}
-		if now.Sub(t) > *app.withinModifiedTime {
+		if now.Sub(t) > *settings.withinModifiedTime {
 			logx.Printf(ctx, "[info] filterd changes item: id=%s modified_time=%s", change.File.Id, change.File.ModifiedTime)
 			continue
 		}
 		filterd = append(filterd, change)
 	}
-	return app.notification.SendChanges(ctx, item, filterd)
+	return app.forwardChanges(ctx, item, filterd)
+}
+
+func (app *App) forwardChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	if err := app.notification.SendChanges(ctx, item, changes); err != nil {
+		return err
+	}
+	app.metrics.ObserveChangesForwarded(ctx, item.DriveID, len(changes))
+	return nil
+}
+
+func (app *App) sendLifecycleEvent(ctx context.Context, e *LifecycleEvent) {
+	if !app.emitLifecycle {
+		return
+	}
+	n, ok := app.notification.(LifecycleNotification)
+	if !ok {
+		logx.Printf(ctx, "[warn] notification does not support lifecycle events, skip type=%s channel_id=%s drive_id=%s", e.Type, e.ChannelID, e.DriveID)
+		return
+	}
+	if err := n.SendLifecycleEvent(ctx, e); err != nil {
+		logx.Printf(ctx, "[error] send lifecycle event failed type=%s channel_id=%s drive_id=%s: %s", e.Type, e.ChannelID, e.DriveID, err.Error())
+	}
+}
+
+func (app *App) filterChangeTypes(ctx context.Context, settings *appSettings, changes []*drive.Change) []*drive.Change {
+	if len(settings.changeTypes) == 0 {
+		return changes
+	}
+	return lo.Filter(changes, func(change *drive.Change, _ int) bool {
+		if settings.changeTypes[change.ChangeType] {
+			return true
+		}
+		logx.Printf(ctx, "[info] filterd changes item: change_type=%s file_id=%s drive_id=%s",
+			coalesce(change.ChangeType, "-"),
+			coalesce(change.FileId, "-"),
+			coalesce(change.DriveId, "-"),
+		)
+		return false
+	})
+}
+
+func (app *App) filterSelfEdits(ctx context.Context, settings *appSettings, changes []*drive.Change) []*drive.Change {
+	if !settings.suppressSelfEdits {
+		return changes
+	}
+	return lo.Filter(changes, func(change *drive.Change, _ int) bool {
+		if change.File == nil {
+			return true
+		}
+		actor := change.File.LastModifyingUser
+		if change.File.Trashed && change.File.TrashingUser != nil {
+			actor = change.File.TrashingUser
+		}
+		if actor == nil {
+			return true
+		}
+		if !actor.Me && !settings.selfEditEmails[strings.ToLower(actor.EmailAddress)] {
+			return true
+		}
+		logx.Printf(ctx, "[info] filterd self edit changes item: id=%s actor=%s",
+			change.File.Id,
+			coalesce(actor.EmailAddress, actor.DisplayName, "-"),
+		)
+		return false
+	})
+}
+
+// maxFolderDepth limits the ancestry resolution of parent_folder_ids, to avoid endless lookups.
+const maxFolderDepth = 32
+
+// filterParentFolders drops file changes that are not within the subtree of parent_folder_ids.
+// Changes without parent data are passed through, because the ancestry can not be resolved.
+func (app *App) filterParentFolders(ctx context.Context, settings *appSettings, changes []*drive.Change) []*drive.Change {
+	if len(settings.parentFolderIDs) == 0 {
+		return changes
+	}
+	return lo.Filter(changes, func(change *drive.Change, _ int) bool {
+		if change.ChangeType != "file" {
+			return true
+		}
+		if change.File == nil || len(change.File.Parents) == 0 {
+			logx.Printf(ctx, "[warn] parent folders of file_id=%s is unknown, pass through parent_folder_ids filter", change.FileId)
+			return true
+		}
+		if settings.parentFolderIDs[change.File.Id] || app.isWithinParentFolders(ctx, settings.parentFolderIDs, change.File.Parents) {
+			return true
+		}
+		logx.Printf(ctx, "[info] filterd out of parent folders changes item: id=%s", change.File.Id)
+		return false
+	})
+}
+
+func (app *App) isWithinParentFolders(ctx context.Context, parentFolderIDs map[string]bool, parents []string) bool {
+	visited := make(map[string]bool)
+	current := parents
+	for depth := 0; depth < maxFolderDepth && len(current) > 0; depth++ {
+		next := make([]string, 0)
+		for _, folderID := range current {
+			if parentFolderIDs[folderID] {
+				return true
+			}
+			if visited[folderID] {
+				continue
+			}
+			visited[folderID] = true
+			folderParents, err := app.getFolderParents(ctx, folderID)
+			if err != nil {
+				logx.Printf(ctx, "[warn] get parents of folder_id=%s failed, pass through parent_folder_ids filter: %s", folderID, err.Error())
+				return true
+			}
+			next = append(next, folderParents...)
+		}
+		current = next
+	}
+	return false
+}
+
+func (app *App) getFolderParents(ctx context.Context, folderID string) ([]string, error) {
+	app.folderParentsMu.Lock()
+	parents, ok := app.folderParents[folderID]
+	app.folderParentsMu.Unlock()
+	if ok {
+		return parents, nil
+	}
+	if err := app.waitDriveAPI(ctx); err != nil {
+		return nil, err
+	}
+	f, err := app.driveSvc.Files.Get(folderID).Fields("parents").SupportsAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("drive API files:get: %w", err)
+	}
+	app.folderParentsMu.Lock()
+	app.folderParents[folderID] = f.Parents
+	app.folderParentsMu.Unlock()
+	return f.Parents, nil
+}
+
+// maxRetryAfter caps the wait of Retry-After header of Drive API responses.
+const maxRetryAfter = time.Minute
+
+// newDriveAPILimiter returns the rate limiter of Drive API calls, it does not limit if qps is 0.
+func newDriveAPILimiter(cfg *DriveAPIConfig) *rate.Limiter {
+	if cfg.QPS <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(cfg.QPS), cfg.Burst)
+}
+
+// waitDriveAPI blocks until a Drive API call is allowed by the rate limiter, or the context is done.
+func (app *App) waitDriveAPI(ctx context.Context) error {
+	if err := app.driveAPILimiter.Wait(ctx); err != nil {
+		return fmt.Errorf("wait for drive API rate limit: %w", err)
+	}
+	return nil
+}
+
+// retryDriveAPI calls fn, and retries it with exponential backoff while it fails with rate limit or server errors.
+// If the response has Retry-After header, it waits for that duration in addition to the backoff.
+func (app *App) retryDriveAPI(ctx context.Context, name string, fn func() error) error {
+	retrier := app.driveAPIRetryPolicy.Start(ctx)
+	var lastErr error
+	for retrier.Continue() {
+		if err := app.waitDriveAPI(ctx); err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !app.driveAPIRetryable(err) {
+			return err
+		}
+		logx.Printf(ctx, "[warn] drive API %s failed, retry: %s", name, err.Error())
+		retryAfter := retryAfterOf(err)
+		if retryAfter <= 0 {
+			continue
+		}
+		if retryAfter > maxRetryAfter {
+			retryAfter = maxRetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(retryAfter):
+		}
+	}
+	return lastErr
+}
+
+// isPushNotificationsNotEnabled reports whether the error is of changes:watch not available for the account or the drive.
+func isPushNotificationsNotEnabled(err error) bool {
+	var apiError *googleapi.Error
+	if !errors.As(err, &apiError) || apiError.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiError.Errors {
+		if item.Reason == "pushNotificationsNotEnabled" || item.Reason == "notAuthorized" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,1802 @@
+package gdnotify_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/mashiike/gdnotify"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeDrive is a minimal Google Drive API v3 server for App tests.
+type fakeDrive struct {
+	mu             sync.Mutex
+	startPageToken string
+	changes        []*drive.Change
+	changePages    [][]*drive.Change
+	fileParents    map[string][]string
+	files          map[string]*drive.File
+	failures       map[string][]int
+	drives         []*drive.Drive
+	watchCalls     []*drive.Channel
+	stopCalls      []*drive.Channel
+	changesHook    func(*http.Request)
+	watchError     bool
+	rejectAddress  map[string]bool
+	rejectDriveIDs map[string]bool
+	watchDriveIDs  []string
+	watchFileIDs   []string
+	drivesError    bool
+
+	startPageTokenCalls int
+	requestTimes        []time.Time
+}
+
+func newFakeDrive() *fakeDrive {
+	return &fakeDrive{
+		startPageToken: "100",
+	}
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/changes" && f.changesHook != nil {
+		f.changesHook(r)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requestTimes = append(f.requestTimes, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if codes := f.failures[r.URL.Path]; len(codes) > 0 {
+		f.failures[r.URL.Path] = codes[1:]
+		switch codes[0] {
+		case http.StatusForbidden:
+			http.Error(w, `{"error":{"code":403,"message":"Rate Limit Exceeded","errors":[{"reason":"rateLimitExceeded","message":"Rate Limit Exceeded"}]}}`, codes[0])
+		default:
+			http.Error(w, fmt.Sprintf(`{"error":{"code":%d,"message":"backend error"}}`, codes[0]), codes[0])
+		}
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/about":
+		json.NewEncoder(w).Encode(&drive.About{
+			Kind: "drive#about",
+			User: &drive.User{EmailAddress: "gdnotify@example.com"},
+		})
+	case r.Method == http.MethodGet && r.URL.Path == "/changes/startPageToken":
+		f.startPageTokenCalls++
+		json.NewEncoder(w).Encode(&drive.StartPageToken{
+			Kind:           "drive#startPageToken",
+			StartPageToken: f.startPageToken,
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/changes/watch":
+		if f.watchError {
+			http.Error(w, `{"error":{"code":400,"message":"watch failed"}}`, http.StatusBadRequest)
+			return
+		}
+		var channel drive.Channel
+		if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.rejectDriveIDs[coalesce(r.URL.Query().Get("driveId"), gdnotify.DefaultDriveID)] {
+			http.Error(w, `{"error":{"code":403,"message":"Push notifications are not enabled for this account.","errors":[{"reason":"pushNotificationsNotEnabled","message":"Push notifications are not enabled for this account."}]}}`, http.StatusForbidden)
+			return
+		}
+		if f.rejectAddress[channel.Address] {
+			http.Error(w, `{"error":{"code":400,"message":"invalid webhook address"}}`, http.StatusBadRequest)
+			return
+		}
+		f.watchCalls = append(f.watchCalls, &channel)
+		f.watchDriveIDs = append(f.watchDriveIDs, coalesce(r.URL.Query().Get("driveId"), gdnotify.DefaultDriveID))
+		resp := channel
+		resp.Kind = "api#channel"
+		resp.ResourceId = "resource-" + channel.Id
+		json.NewEncoder(w).Encode(&resp)
+	case r.Method == http.MethodGet && r.URL.Path == "/changes" && f.changePages != nil:
+		var page int
+		fmt.Sscanf(r.URL.Query().Get("pageToken"), "page-%d", &page)
+		resp := &drive.ChangeList{
+			Kind:    "drive#changeList",
+			Changes: f.changePages[page],
+		}
+		if page+1 < len(f.changePages) {
+			resp.NextPageToken = fmt.Sprintf("page-%d", page+1)
+		} else {
+			resp.NewStartPageToken = f.startPageToken
+		}
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == http.MethodGet && r.URL.Path == "/changes":
+		json.NewEncoder(w).Encode(&drive.ChangeList{
+			Kind:              "drive#changeList",
+			Changes:           f.changes,
+			NewStartPageToken: f.startPageToken,
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/channels/stop":
+		var channel drive.Channel
+		if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.stopCalls = append(f.stopCalls, &channel)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/files/") && strings.HasSuffix(r.URL.Path, "/watch"):
+		var channel drive.Channel
+		if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.watchCalls = append(f.watchCalls, &channel)
+		f.watchFileIDs = append(f.watchFileIDs, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/files/"), "/watch"))
+		resp := channel
+		resp.Kind = "api#channel"
+		resp.ResourceId = "resource-" + channel.Id
+		json.NewEncoder(w).Encode(&resp)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/files/"):
+		fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+		if file, ok := f.files[fileID]; ok {
+			json.NewEncoder(w).Encode(file)
+			return
+		}
+		parents, ok := f.fileParents[fileID]
+		if !ok {
+			http.Error(w, `{"error":{"code":404,"message":"file not found"}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&drive.File{Id: fileID, Parents: parents})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/drives/"):
+		for _, d := range f.drives {
+			if d.Id == strings.TrimPrefix(r.URL.Path, "/drives/") {
+				json.NewEncoder(w).Encode(d)
+				return
+			}
+		}
+		http.Error(w, `{"error":{"code":404,"message":"drive not found"}}`, http.StatusNotFound)
+	case r.Method == http.MethodGet && r.URL.Path == "/drives":
+		if f.drivesError {
+			http.Error(w, `{"error":{"code":500,"message":"backend error"}}`, http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&drive.DriveList{
+			Kind:   "drive#driveList",
+			Drives: f.drives,
+		})
+	default:
+		http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+	}
+}
+
+func (f *fakeDrive) WatchCalls() []*drive.Channel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*drive.Channel{}, f.watchCalls...)
+}
+
+func (f *fakeDrive) WatchDriveIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.watchDriveIDs...)
+}
+
+func (f *fakeDrive) WatchFileIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.watchFileIDs...)
+}
+
+func (f *fakeDrive) RequestTimes() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Time{}, f.requestTimes...)
+}
+
+func (f *fakeDrive) StartPageTokenCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.startPageTokenCalls
+}
+
+func (f *fakeDrive) SetWatchError(watchError bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watchError = watchError
+}
+
+func (f *fakeDrive) StopCalls() []*drive.Channel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*drive.Channel{}, f.stopCalls...)
+}
+
+func newTestApp(t *testing.T, f *fakeDrive, optFns ...func(*gdnotify.Config)) (*gdnotify.App, *gdnotify.Config) {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+	cfg := gdnotify.DefaultConfig()
+	cfg.Webhook = "https://gdnotify.example.com/"
+	cfg.Storage = &gdnotify.StorageConfig{
+		Type:     gdnotify.StorageTypeFile,
+		DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+		LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+	}
+	cfg.Notification = &gdnotify.NotificationConfig{
+		Type:      gdnotify.NotificationTypeFile,
+		EventFile: aws.String(filepath.Join(dir, "events.json")),
+	}
+	for _, optFn := range optFns {
+		optFn(cfg)
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := gdnotify.New(cfg,
+		option.WithEndpoint(server.URL+"/"),
+		option.WithoutAuthentication(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		app.Close()
+	})
+	return app, cfg
+}
+
+func coalesce(strs ...string) string {
+	for _, str := range strs {
+		if str != "" {
+			return str
+		}
+	}
+	return ""
+}
+
+func readEvents(t *testing.T, cfg *gdnotify.Config) []*drive.Change {
+	t.Helper()
+	fp, err := os.Open(*cfg.Notification.EventFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	defer fp.Close()
+	changes := make([]*drive.Change, 0)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var change drive.Change
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &change))
+		changes = append(changes, &change)
+	}
+	require.NoError(t, scanner.Err())
+	return changes
+}
+
+func readLifecycleEvents(t *testing.T, cfg *gdnotify.Config) []*gdnotify.LifecycleEvent {
+	t.Helper()
+	fp, err := os.Open(*cfg.Notification.EventFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	defer fp.Close()
+	events := make([]*gdnotify.LifecycleEvent, 0)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var e gdnotify.LifecycleEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		if e.Kind == gdnotify.LifecycleEventKind {
+			events = append(events, &e)
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestAppSendNotificationChangeTypes(t *testing.T) {
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "drive1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	cases := []struct {
+		name        string
+		changeTypes []string
+		expected    []string
+	}{
+		{
+			name:     "default",
+			expected: []string{"file", "drive", "file"},
+		},
+		{
+			name:        "file only",
+			changeTypes: []string{"file"},
+			expected:    []string{"file", "file"},
+		},
+		{
+			name:        "drive only",
+			changeTypes: []string{"drive"},
+			expected:    []string{"drive"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			app, cfg := newTestApp(t, newFakeDrive(), func(cfg *gdnotify.Config) {
+				cfg.ChangeTypes = c.changeTypes
+			})
+			item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+			require.NoError(t, app.SendNotification(context.Background(), item, changes))
+			actual := lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+				return change.ChangeType
+			})
+			require.EqualValues(t, c.expected, actual)
+		})
+	}
+}
+
+func TestAppSendNotificationWithinModifiedTimeDriveChanges(t *testing.T) {
+	now := time.Now().UTC()
+	recent := now.Add(-10 * time.Minute).Format(time.RFC3339Nano)
+	old := now.Add(-3 * time.Hour).Format(time.RFC3339Nano)
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "recent", Time: recent},
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "old", Time: old},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: recent, File: &drive.File{Id: "file1", ModifiedTime: recent}},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: recent, File: &drive.File{Id: "file2", ModifiedTime: old}},
+	}
+	cases := []struct {
+		name                      string
+		includeDriveChangesAlways bool
+		expected                  []string
+	}{
+		{
+			name:     "drive changes are checked by the time of the change",
+			expected: []string{"recent", "file1"},
+		},
+		{
+			name:                      "include drive changes always",
+			includeDriveChangesAlways: true,
+			expected:                  []string{"recent", "old", "file1"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			app, cfg := newTestApp(t, newFakeDrive(), func(cfg *gdnotify.Config) {
+				cfg.WithinModifiedTime = aws.Duration(time.Hour)
+				cfg.IncludeDriveChangesAlways = c.includeDriveChangesAlways
+			})
+			item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+			require.NoError(t, app.SendNotification(context.Background(), item, changes))
+			actual := lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+				return coalesce(change.FileId, change.DriveId)
+			})
+			require.EqualValues(t, c.expected, actual)
+		})
+	}
+}
+
+func TestAppReload(t *testing.T) {
+	now := time.Now().UTC()
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "recent", File: &drive.File{Id: "recent", ModifiedTime: now.Add(-10 * time.Minute).Format(time.RFC3339Nano)}},
+		{Kind: "drive#change", ChangeType: "file", FileId: "old", File: &drive.File{Id: "old", ModifiedTime: now.Add(-3 * time.Hour).Format(time.RFC3339Nano)}},
+	}
+	app, cfg := newTestApp(t, newFakeDrive())
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+	require.NoError(t, app.SendNotification(context.Background(), item, changes))
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+webhook: "https://reloaded.example.com/"
+within_modified_time: 1h
+storage:
+  type: Memory
+notification:
+  type: File
+  event_file: ignored.json
+`), 0644))
+	reloaded := gdnotify.DefaultConfig()
+	require.NoError(t, reloaded.Load(context.Background(), path))
+	app.Reload(context.Background(), reloaded)
+	require.NoError(t, app.SendNotification(context.Background(), item, changes))
+
+	actual := lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+		return change.FileId
+	})
+	require.EqualValues(t, []string{"recent", "old", "recent"}, actual, "within_modified_time is applied after reload, and the notification is kept")
+}
+
+func TestAppSendNotificationSuppressSelfEdits(t *testing.T) {
+	changes := []*drive.Change{
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "self",
+			File: &drive.File{Id: "self", LastModifyingUser: &drive.User{DisplayName: "gdnotify", Me: true}},
+		},
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "automation",
+			File: &drive.File{Id: "automation", LastModifyingUser: &drive.User{DisplayName: "bot", EmailAddress: "Bot@example.iam.gserviceaccount.com"}},
+		},
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "other",
+			File: &drive.File{Id: "other", LastModifyingUser: &drive.User{DisplayName: "hoge", EmailAddress: "hoge@example.com"}},
+		},
+		{
+			Kind: "drive#change", ChangeType: "drive", DriveId: "drive1",
+		},
+	}
+	cases := []struct {
+		name     string
+		suppress bool
+		expected []string
+	}{
+		{
+			name:     "disabled",
+			suppress: false,
+			expected: []string{"self", "automation", "other", ""},
+		},
+		{
+			name:     "enabled",
+			suppress: true,
+			expected: []string{"other", ""},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			app, cfg := newTestApp(t, newFakeDrive(), func(cfg *gdnotify.Config) {
+				cfg.SuppressSelfEdits = c.suppress
+				cfg.SelfEditEmails = []string{"bot@example.iam.gserviceaccount.com"}
+			})
+			item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+			require.NoError(t, app.SendNotification(context.Background(), item, changes))
+			actual := lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+				return change.FileId
+			})
+			require.EqualValues(t, c.expected, actual)
+		})
+	}
+}
+
+func TestAppSendNotificationSuppressVersionNoops(t *testing.T) {
+	change := func(fileID string, version int64) *drive.Change {
+		return &drive.Change{
+			Kind: "drive#change", ChangeType: "file", FileId: fileID,
+			File: &drive.File{Id: fileID, Version: version},
+		}
+	}
+	batches := [][]*drive.Change{
+		{change("file1", 3), change("file2", 5)},
+		{change("file1", 3), change("file2", 6)},
+		{change("file1", 2), change("file1", 4), {Kind: "drive#change", ChangeType: "file", FileId: "file2", Removed: true}},
+	}
+	cases := []struct {
+		name     string
+		suppress bool
+		expected []string
+	}{
+		{
+			name:     "disabled",
+			suppress: false,
+			expected: []string{"file1:3", "file2:5", "file1:3", "file2:6", "file1:2", "file1:4", "file2:0"},
+		},
+		{
+			name:     "enabled",
+			suppress: true,
+			expected: []string{"file1:3", "file2:5", "file2:6", "file1:4", "file2:0"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			app, cfg := newTestApp(t, newFakeDrive(), func(cfg *gdnotify.Config) {
+				cfg.SuppressVersionNoops = c.suppress
+			})
+			item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+			for _, changes := range batches {
+				require.NoError(t, app.SendNotification(context.Background(), item, changes))
+			}
+			actual := lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+				if change.File == nil {
+					return change.FileId + ":0"
+				}
+				return fmt.Sprintf("%s:%d", change.FileId, change.File.Version)
+			})
+			require.EqualValues(t, c.expected, actual)
+		})
+	}
+}
+
+func TestAppRegister(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0XXXXXXXXXXXXXXXXXX"},
+		}
+	})
+	ctx := context.Background()
+	register := func(driveID string) error {
+		return app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("register"),
+			gdnotify.WithDriveID(driveID),
+		)
+	}
+	require.NoError(t, register("0XXXXXXXXXXXXXXXXXX"))
+	require.Len(t, f.WatchCalls(), 1, "channel created")
+	require.NoError(t, register("0XXXXXXXXXXXXXXXXXX"))
+	require.Len(t, f.WatchCalls(), 1, "second register is no-op")
+	require.Error(t, register("unknown"))
+	require.Len(t, f.WatchCalls(), 1)
+}
+
+func TestAppMaintenanceDoesNotSendNotification(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	app, cfg := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	require.Len(t, f.WatchCalls(), 1, "channel created")
+	require.Empty(t, readEvents(t, cfg), "maintenance emits no change notifications")
+
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("sync"),
+	))
+	require.Len(t, readEvents(t, cfg), 1, "sync fetches changes")
+}
+
+type fakeMetricsRecorder struct {
+	mu                      sync.Mutex
+	channelsCreated         map[string]int
+	channelsRotated         map[string]int
+	channelRotationFailures map[string]int
+	changesProcessed        map[string]int
+	notificationErrors      map[string]int
+}
+
+func newFakeMetricsRecorder() *fakeMetricsRecorder {
+	return &fakeMetricsRecorder{
+		channelsCreated:         make(map[string]int),
+		channelsRotated:         make(map[string]int),
+		channelRotationFailures: make(map[string]int),
+		changesProcessed:        make(map[string]int),
+		notificationErrors:      make(map[string]int),
+	}
+}
+
+func (r *fakeMetricsRecorder) IncrChannelsCreated(_ context.Context, driveID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channelsCreated[driveID]++
+}
+
+func (r *fakeMetricsRecorder) IncrChannelsRotated(_ context.Context, driveID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channelsRotated[driveID]++
+}
+
+func (r *fakeMetricsRecorder) IncrChannelRotationFailures(_ context.Context, driveID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channelRotationFailures[driveID]++
+}
+
+func (r *fakeMetricsRecorder) ObserveChangesProcessed(_ context.Context, driveID string, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changesProcessed[driveID] += count
+}
+
+func (r *fakeMetricsRecorder) IncrNotificationErrors(_ context.Context, driveID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notificationErrors[driveID]++
+}
+
+func (r *fakeMetricsRecorder) ObserveChangesForwarded(_ context.Context, _ string, _ int) {}
+
+func (r *fakeMetricsRecorder) IncrWebhooksReceived(_ context.Context, _ string) {}
+
+func (r *fakeMetricsRecorder) ObserveSyncDuration(_ context.Context, _ string, _ time.Duration) {}
+
+func TestAppMetricsRecorder(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	app, cfg := newTestApp(t, f)
+	recorder := newFakeMetricsRecorder()
+	app.SetMetricsRecorder(recorder)
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("sync"),
+	))
+	require.Equal(t, map[string]int{gdnotify.DefaultDriveID: 1}, recorder.channelsCreated)
+	require.Empty(t, recorder.channelsRotated)
+	require.Equal(t, map[string]int{gdnotify.DefaultDriveID: 2}, recorder.changesProcessed)
+	require.Empty(t, recorder.notificationErrors)
+
+	*cfg.Notification.EventFile = filepath.Join(t.TempDir(), "not_found", "events.json")
+	app, _ = newTestApp(t, f, func(c *gdnotify.Config) {
+		c.Notification = cfg.Notification
+	})
+	app.SetMetricsRecorder(recorder)
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+	require.Error(t, app.SendNotification(ctx, item, f.changes))
+	require.Equal(t, map[string]int{gdnotify.DefaultDriveID: 1}, recorder.notificationErrors)
+}
+
+func TestAppCloseCancelsInFlightSync(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	requested := make(chan struct{}, 1)
+	f.changesHook = func(r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.ShutdownTimeout = 5 * time.Second
+	})
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("sync"),
+		)
+	}()
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync did not start")
+	}
+	start := time.Now()
+	require.NoError(t, app.Close())
+	require.Less(t, time.Since(start), 5*time.Second, "Close returns after in-flight work settles")
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync did not return after Close")
+	}
+	require.Empty(t, readEvents(t, cfg))
+}
+
+func TestAppRotationFailureLifecycleEvent(t *testing.T) {
+	f := newFakeDrive()
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.EmitLifecycleEvents = true
+	})
+	recorder := newFakeMetricsRecorder()
+	app.SetMetricsRecorder(recorder)
+	ctx := context.Background()
+	maintenance := func() error {
+		return app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		)
+	}
+	require.NoError(t, maintenance())
+	require.Len(t, f.WatchCalls(), 1)
+	channel := f.WatchCalls()[0]
+
+	restore := flextime.Fix(time.UnixMilli(channel.Expiration))
+	defer restore()
+	f.SetWatchError(true)
+	require.Error(t, maintenance())
+
+	events := readLifecycleEvents(t, cfg)
+	require.Len(t, events, 2)
+	require.Equal(t, gdnotify.DetailTypeChannelCreated, events[0].Type)
+	require.Equal(t, gdnotify.DetailTypeChannelRotationFailed, events[1].Type)
+	require.Equal(t, gdnotify.DefaultDriveID, events[1].DriveID)
+	require.Equal(t, channel.Id, events[1].ChannelID)
+	require.NotEmpty(t, events[1].Error)
+	require.Equal(t, map[string]int{gdnotify.DefaultDriveID: 1}, recorder.channelRotationFailures)
+}
+
+func TestAppRotationLifecycleEvent(t *testing.T) {
+	f := newFakeDrive()
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.EmitLifecycleEvents = true
+	})
+	ctx := context.Background()
+	maintenance := func() error {
+		return app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		)
+	}
+	require.NoError(t, maintenance())
+	require.Len(t, f.WatchCalls(), 1)
+	oldChannel := f.WatchCalls()[0]
+
+	restore := flextime.Fix(time.UnixMilli(oldChannel.Expiration))
+	defer restore()
+	require.NoError(t, maintenance())
+	require.Len(t, f.WatchCalls(), 2)
+	newChannel := f.WatchCalls()[1]
+
+	events := readLifecycleEvents(t, cfg)
+	require.Equal(t, []string{
+		gdnotify.DetailTypeChannelCreated,
+		gdnotify.DetailTypeChannelRotated,
+		gdnotify.DetailTypeChannelDeleted,
+	}, lo.Map(events, func(e *gdnotify.LifecycleEvent, _ int) string {
+		return e.Type
+	}))
+	require.Equal(t, oldChannel.Id, events[0].ChannelID)
+	require.Equal(t, newChannel.Id, events[1].ChannelID)
+	require.Equal(t, oldChannel.Id, events[1].PreviousChannelID)
+	require.Equal(t, gdnotify.DefaultDriveID, events[1].DriveID)
+	require.Equal(t, "resource-"+newChannel.Id, events[1].ResourceID)
+	require.Equal(t, oldChannel.Id, events[2].ChannelID, "the old channel is deleted")
+}
+
+func TestAppLifecycleEventsDisabled(t *testing.T) {
+	f := newFakeDrive()
+	app, cfg := newTestApp(t, f)
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	require.Len(t, f.WatchCalls(), 1)
+	require.Empty(t, readLifecycleEvents(t, cfg))
+}
+
+func TestAppSyncDurationHistogram(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Metrics = &gdnotify.MetricsConfig{
+			Type: gdnotify.MetricsTypePrometheus,
+		}
+		cfg.Server.EnableMetrics = true
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0XXXXXXXXXXXXXXXXXX"},
+		}
+	})
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("sync"),
+	))
+
+	w := httptest.NewRecorder()
+	app.SetupRoute().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	require.Contains(t, body, "# TYPE gdnotify_sync_duration_seconds histogram\n")
+	require.Contains(t, body, `gdnotify_sync_duration_seconds_count{drive_id="__default__"} 1`)
+	require.Contains(t, body, `gdnotify_sync_duration_seconds_count{drive_id="0XXXXXXXXXXXXXXXXXX"} 1`)
+	require.Contains(t, body, `gdnotify_sync_duration_seconds_bucket{drive_id="__default__",le="+Inf"} 1`)
+}
+
+func TestAppSyncConcurrency(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	f.changesHook = func(_ *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+	driveIDs := []string{"drive1", "drive2", "drive3", "drive4", "drive5", "drive6"}
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.SyncConcurrency = 2
+		cfg.Drives = lo.Map(driveIDs, func(driveID string, _ int) *gdnotify.DriveConfig {
+			return &gdnotify.DriveConfig{DriveID: driveID}
+		})
+	})
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("sync"),
+	))
+	require.Len(t, readEvents(t, cfg), len(driveIDs), "all changes are delivered")
+	require.Equal(t, 2, maxInFlight, "concurrency is capped")
+}
+
+func TestAppPageTokenRefreshInterval(t *testing.T) {
+	interval := 10 * 24 * time.Hour
+	base := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		elapsed  time.Duration
+		expected int
+	}{
+		{name: "before", elapsed: interval - time.Minute, expected: 1},
+		{name: "after", elapsed: interval + time.Minute, expected: 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			restore := flextime.Fix(base)
+			defer restore()
+			f := newFakeDrive()
+			app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.PageTokenRefreshInterval = interval
+			})
+			ctx := context.Background()
+			maintenance := func() error {
+				return app.RunWithContext(ctx,
+					gdnotify.WithRunMode("cli"),
+					gdnotify.WithCLICommand("maintenance"),
+				)
+			}
+			require.NoError(t, maintenance())
+			require.Equal(t, 1, f.StartPageTokenCalls())
+
+			flextime.Fix(base.Add(c.elapsed))
+			require.NoError(t, maintenance())
+			require.Len(t, f.WatchCalls(), 2, "channel rotated")
+			require.Equal(t, c.expected, f.StartPageTokenCalls())
+		})
+	}
+}
+
+func TestAppExpirationJitter(t *testing.T) {
+	cases := []struct {
+		name     string
+		jitter   time.Duration
+		expected time.Duration
+	}{
+		{name: "within jitter", jitter: time.Hour, expected: time.Hour},
+		{name: "capped by rotate remaining", jitter: 10 * time.Hour, expected: 24 * time.Hour / 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+			restore := flextime.Fix(now)
+			defer restore()
+			f := newFakeDrive()
+			f.drives = []*drive.Drive{
+				{Kind: "drive#drive", Id: "0AAAAAAAAAAAAAAAAAA", Name: "A"},
+				{Kind: "drive#drive", Id: "0BBBBBBBBBBBBBBBBBB", Name: "B"},
+				{Kind: "drive#drive", Id: "0CCCCCCCCCCCCCCCCCC", Name: "C"},
+			}
+			app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.DrivesAutoDetect = aws.Bool(true)
+				cfg.Expiration = 24 * time.Hour
+				cfg.ExpirationJitter = c.jitter
+			})
+			require.NoError(t, app.RunWithContext(context.Background(),
+				gdnotify.WithRunMode("cli"),
+				gdnotify.WithCLICommand("maintenance"),
+			))
+			expirations := make(map[int64]bool)
+			for _, channel := range f.WatchCalls() {
+				expiration := time.UnixMilli(channel.Expiration)
+				require.False(t, expiration.Before(now.Add(24*time.Hour)), "expiration %s", expiration)
+				require.False(t, expiration.After(now.Add(24*time.Hour+c.expected)), "expiration %s", expiration)
+				expirations[channel.Expiration] = true
+			}
+			require.Len(t, f.WatchCalls(), 4)
+			require.Greater(t, len(expirations), 1, "expirations are spread")
+		})
+	}
+}
+
+func TestAppMaintenancePushNotificationsNotEnabled(t *testing.T) {
+	f := newFakeDrive()
+	f.drives = []*drive.Drive{
+		{Kind: "drive#drive", Id: "0AAAAAAAAAAAAAAAAAA", Name: "A"},
+		{Kind: "drive#drive", Id: "0BBBBBBBBBBBBBBBBBB", Name: "B"},
+	}
+	f.rejectDriveIDs = map[string]bool{gdnotify.DefaultDriveID: true}
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.DrivesAutoDetect = aws.Bool(true)
+	})
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	require.ElementsMatch(t, []string{"0AAAAAAAAAAAAAAAAAA", "0BBBBBBBBBBBBBBBBBB"}, f.WatchDriveIDs())
+
+	t.Run("other errors abort", func(t *testing.T) {
+		f := newFakeDrive()
+		f.SetWatchError(true)
+		app, _ := newTestApp(t, f)
+		require.Error(t, app.RunWithContext(context.Background(),
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		))
+	})
+}
+
+func TestAppDriveFiltering(t *testing.T) {
+	newDrives := func() *fakeDrive {
+		f := newFakeDrive()
+		f.drives = []*drive.Drive{
+			{Kind: "drive#drive", Id: "0AAAAAAAAAAAAAAAAAA", Name: "A"},
+			{Kind: "drive#drive", Id: "0BBBBBBBBBBBBBBBBBB", Name: "B"},
+			{Kind: "drive#drive", Id: "0CCCCCCCCCCCCCCCCCC", Name: "C"},
+		}
+		return f
+	}
+	cases := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{
+			name:     "no filter",
+			expected: []string{gdnotify.DefaultDriveID, "0AAAAAAAAAAAAAAAAAA", "0BBBBBBBBBBBBBBBBBB", "0CCCCCCCCCCCCCCCCCC"},
+		},
+		{
+			name:     "include only",
+			include:  []string{gdnotify.DefaultDriveID, "0AAAAAAAAAAAAAAAAAA"},
+			expected: []string{gdnotify.DefaultDriveID, "0AAAAAAAAAAAAAAAAAA"},
+		},
+		{
+			name:     "exclude only",
+			exclude:  []string{gdnotify.DefaultDriveID, "0BBBBBBBBBBBBBBBBBB"},
+			expected: []string{"0AAAAAAAAAAAAAAAAAA", "0CCCCCCCCCCCCCCCCCC"},
+		},
+		{
+			name:     "combined",
+			include:  []string{"0AAAAAAAAAAAAAAAAAA", "0BBBBBBBBBBBBBBBBBB"},
+			exclude:  []string{"0BBBBBBBBBBBBBBBBBB"},
+			expected: []string{"0AAAAAAAAAAAAAAAAAA"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newDrives()
+			app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.DrivesAutoDetect = aws.Bool(true)
+				cfg.IncludeDriveIDs = c.include
+				cfg.ExcludeDriveIDs = c.exclude
+			})
+			require.NoError(t, app.RunWithContext(context.Background(),
+				gdnotify.WithRunMode("cli"),
+				gdnotify.WithCLICommand("maintenance"),
+			))
+			require.ElementsMatch(t, c.expected, f.WatchDriveIDs())
+		})
+	}
+	t.Run("delete excluded channels", func(t *testing.T) {
+		f := newDrives()
+		ctx := context.Background()
+		app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+			cfg.DrivesAutoDetect = aws.Bool(true)
+		})
+		require.NoError(t, app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		))
+		require.Len(t, f.WatchCalls(), 4)
+
+		app, _ = newTestApp(t, f, func(c *gdnotify.Config) {
+			c.DrivesAutoDetect = aws.Bool(true)
+			c.Storage = cfg.Storage
+			c.ExcludeDriveIDs = []string{"0CCCCCCCCCCCCCCCCCC"}
+		})
+		require.NoError(t, app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		))
+		require.Len(t, f.WatchCalls(), 4, "no new channel")
+		require.Len(t, f.StopCalls(), 1, "excluded channel stopped")
+		storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+		require.NoError(t, err)
+		itemsCh, err := storage.FindAllChannels(ctx)
+		require.NoError(t, err)
+		driveIDs := make([]string, 0)
+		for items := range itemsCh {
+			for _, item := range items {
+				driveIDs = append(driveIDs, item.DriveID)
+			}
+		}
+		require.ElementsMatch(t, []string{gdnotify.DefaultDriveID, "0AAAAAAAAAAAAAAAAAA", "0BBBBBBBBBBBBBBBBBB"}, driveIDs)
+	})
+}
+
+func TestAppList(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0XXXXXXXXXXXXXXXXXX"},
+		}
+	})
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("register")))
+	list := func(opts *gdnotify.ListOptions) []*gdnotify.ListItem {
+		t.Helper()
+		var buf bytes.Buffer
+		require.NoError(t, app.List(ctx, &buf, opts))
+		var items []*gdnotify.ListItem
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &items), buf.String())
+		return items
+	}
+	t.Run("json", func(t *testing.T) {
+		items := list(&gdnotify.ListOptions{Format: gdnotify.ListFormatJSON})
+		require.ElementsMatch(t, []string{gdnotify.DefaultDriveID, "0XXXXXXXXXXXXXXXXXX"}, lo.Map(items, func(item *gdnotify.ListItem, _ int) string {
+			return item.DriveID
+		}))
+		for _, item := range items {
+			require.NotEmpty(t, item.ChannelID)
+			require.NotEmpty(t, item.PageToken)
+		}
+	})
+	t.Run("drive id", func(t *testing.T) {
+		items := list(&gdnotify.ListOptions{Format: gdnotify.ListFormatJSON, DriveID: "0XXXXXXXXXXXXXXXXXX"})
+		require.Len(t, items, 1)
+		require.EqualValues(t, "0XXXXXXXXXXXXXXXXXX", items[0].DriveID)
+	})
+	t.Run("limit", func(t *testing.T) {
+		items := list(&gdnotify.ListOptions{Format: gdnotify.ListFormatJSON, Limit: 1})
+		require.Len(t, items, 1)
+	})
+	t.Run("table", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, app.List(ctx, &buf, &gdnotify.ListOptions{DriveID: "0XXXXXXXXXXXXXXXXXX"}))
+		require.Contains(t, buf.String(), "0XXXXXXXXXXXXXXXXXX")
+		require.NotContains(t, buf.String(), gdnotify.DefaultDriveID)
+	})
+}
+
+func TestAppListDrivesWithoutChannel(t *testing.T) {
+	f := newFakeDrive()
+	f.drives = []*drive.Drive{
+		{Kind: "drive#drive", Id: "0AAAAAAAAAAAAAAAAAA", Name: "A"},
+		{Kind: "drive#drive", Id: "0BBBBBBBBBBBBBBBBBB", Name: "B"},
+	}
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0AAAAAAAAAAAAAAAAAA"},
+			{DriveID: "0BBBBBBBBBBBBBBBBBB"},
+		}
+	})
+	ctx := context.Background()
+	require.NoError(t, app.Register(ctx, "0AAAAAAAAAAAAAAAAAA"))
+
+	var buf bytes.Buffer
+	require.NoError(t, app.List(ctx, &buf, &gdnotify.ListOptions{Format: gdnotify.ListFormatJSON}))
+	require.True(t, json.Valid(buf.Bytes()), buf.String())
+	var rows []map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &rows))
+	require.Len(t, rows, 3)
+	byDriveID := lo.KeyBy(rows, func(row map[string]interface{}) string {
+		return row["driveId"].(string)
+	})
+	require.EqualValues(t, "A", byDriveID["0AAAAAAAAAAAAAAAAAA"]["driveName"])
+	require.NotEmpty(t, byDriveID["0AAAAAAAAAAAAAAAAAA"]["channelId"])
+	require.NotNil(t, byDriveID["0AAAAAAAAAAAAAAAAAA"]["expiration"])
+	for _, driveID := range []string{gdnotify.DefaultDriveID, "0BBBBBBBBBBBBBBBBBB"} {
+		row, ok := byDriveID[driveID]
+		require.True(t, ok, "drive without channel %s is listed", driveID)
+		require.EqualValues(t, "", row["channelId"])
+		require.Nil(t, row["expiration"])
+		require.Nil(t, row["createdAt"])
+	}
+	require.EqualValues(t, "B", byDriveID["0BBBBBBBBBBBBBBBBBB"]["driveName"])
+}
+
+func TestAppDryRun(t *testing.T) {
+	f := newFakeDrive()
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.DryRun = true
+	})
+	ctx := context.Background()
+	run := func(command string) {
+		t.Helper()
+		require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand(command)))
+	}
+	channels := func() []*gdnotify.ChannelItem {
+		t.Helper()
+		storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+		require.NoError(t, err)
+		itemsCh, err := storage.FindAllChannels(ctx)
+		require.NoError(t, err)
+		items := make([]*gdnotify.ChannelItem, 0)
+		for i := range itemsCh {
+			items = append(items, i...)
+		}
+		return items
+	}
+
+	run("maintenance")
+	require.Empty(t, f.WatchCalls(), "dry-run does not call the Drive API")
+	require.Empty(t, channels(), "dry-run does not save channels")
+
+	app.SetDryRun(false)
+	run("maintenance")
+	require.Len(t, f.WatchCalls(), 1)
+	require.Len(t, channels(), 1)
+
+	app.SetDryRun(true)
+	run("cleanup")
+	require.Empty(t, f.StopCalls(), "dry-run does not call the Drive API")
+	require.Len(t, channels(), 1, "dry-run does not delete channels")
+
+	app.SetDryRun(false)
+	run("cleanup")
+	require.Len(t, f.StopCalls(), 1)
+	require.Empty(t, channels())
+}
+
+func TestAppDriveExpiration(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Expiration = 7 * 24 * time.Hour
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0AAAAAAAAAAAAAAAAAA", Expiration: 24 * time.Hour},
+			{DriveID: "0BBBBBBBBBBBBBBBBBB", Expiration: 14 * 24 * time.Hour},
+		}
+	})
+	base := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	restore := flextime.Fix(base)
+	defer restore()
+	require.NoError(t, app.RunWithContext(context.Background(), gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance")))
+	expirations := make(map[string]time.Duration)
+	for i, driveID := range f.WatchDriveIDs() {
+		expirations[driveID] = time.UnixMilli(f.WatchCalls()[i].Expiration).Sub(base)
+	}
+	require.EqualValues(t, map[string]time.Duration{
+		gdnotify.DefaultDriveID: 7 * 24 * time.Hour,
+		"0AAAAAAAAAAAAAAAAAA":   24 * time.Hour,
+		"0BBBBBBBBBBBBBBBBBB":   14 * 24 * time.Hour,
+	}, expirations)
+}
+
+func TestAppWebhookAddresses(t *testing.T) {
+	f := newFakeDrive()
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Webhook = ""
+		cfg.WebhookAddresses = []string{"https://primary.example.com/", "https://secondary.example.com/"}
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0XXXXXXXXXXXXXXXXXX"},
+		}
+	})
+	ctx := context.Background()
+	register := func(driveID string) error {
+		return app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("register"),
+			gdnotify.WithDriveID(driveID),
+		)
+	}
+	require.NoError(t, register(gdnotify.DefaultDriveID))
+	f.mu.Lock()
+	f.rejectAddress = map[string]bool{"https://primary.example.com/": true}
+	f.mu.Unlock()
+	require.NoError(t, register("0XXXXXXXXXXXXXXXXXX"))
+
+	watchAddresses := make(map[string]string)
+	for _, channel := range f.WatchCalls() {
+		watchAddresses[channel.Id] = channel.Address
+	}
+	storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+	require.NoError(t, err)
+	itemsCh, err := storage.FindAllChannels(ctx)
+	require.NoError(t, err)
+	storedAddresses := make(map[string]string)
+	for items := range itemsCh {
+		for _, item := range items {
+			require.EqualValues(t, watchAddresses[item.ChannelID], item.WebhookAddress, "stored address is the one used for changes:watch")
+			storedAddresses[item.DriveID] = item.WebhookAddress
+		}
+	}
+	require.EqualValues(t, map[string]string{
+		gdnotify.DefaultDriveID: "https://primary.example.com/",
+		"0XXXXXXXXXXXXXXXXXX":   "https://secondary.example.com/",
+	}, storedAddresses)
+
+	f.mu.Lock()
+	f.rejectAddress["https://secondary.example.com/"] = true
+	f.mu.Unlock()
+	require.Error(t, app.CreateChannel(ctx, "0XXXXXXXXXXXXXXXXXX"), "all addresses rejected")
+}
+
+func TestAppRotateOnWebhookAddressChange(t *testing.T) {
+	dir := t.TempDir()
+	withAddress := func(address string) func(*gdnotify.Config) {
+		return func(cfg *gdnotify.Config) {
+			cfg.Webhook = address
+			cfg.Storage = &gdnotify.StorageConfig{
+				Type:     gdnotify.StorageTypeFile,
+				DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+				LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+			}
+		}
+	}
+	ctx := context.Background()
+	maintenance := func(app *gdnotify.App) error {
+		return app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance"))
+	}
+	oldDrive := newFakeDrive()
+	oldApp, _ := newTestApp(t, oldDrive, withAddress("https://old.example.com/"))
+	require.NoError(t, maintenance(oldApp))
+	require.Len(t, oldDrive.WatchCalls(), 1)
+
+	newDrive := newFakeDrive()
+	newApp, cfg := newTestApp(t, newDrive, withAddress("https://new.example.com/"))
+	require.NoError(t, maintenance(newApp))
+	require.Len(t, newDrive.WatchCalls(), 1, "channel on the old address is rotated")
+	require.EqualValues(t, "https://new.example.com/", newDrive.WatchCalls()[0].Address)
+	require.Len(t, newDrive.StopCalls(), 1)
+	require.EqualValues(t, oldDrive.WatchCalls()[0].Id, newDrive.StopCalls()[0].Id)
+
+	require.NoError(t, maintenance(newApp))
+	require.Len(t, newDrive.WatchCalls(), 1, "no more rotation")
+
+	var buf bytes.Buffer
+	require.NoError(t, newApp.List(ctx, &buf, &gdnotify.ListOptions{Format: gdnotify.ListFormatJSON}))
+	var items []*gdnotify.ListItem
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &items))
+	require.Len(t, items, 1)
+	require.EqualValues(t, cfg.Webhook, items[0].WebhookAddress)
+}
+
+func TestAppExportImportChannels(t *testing.T) {
+	withDrives := func(cfg *gdnotify.Config) {
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0XXXXXXXXXXXXXXXXXX"},
+		}
+	}
+	ctx := context.Background()
+	src, _ := newTestApp(t, newFakeDrive(), withDrives)
+	require.NoError(t, src.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("register")))
+	var exported bytes.Buffer
+	require.NoError(t, src.ExportChannels(ctx, &exported))
+	lines := strings.Split(strings.TrimSpace(exported.String()), "\n")
+	require.Len(t, lines, 2)
+
+	f := newFakeDrive()
+	dst, _ := newTestApp(t, f, withDrives)
+	require.NoError(t, dst.ImportChannels(ctx, bytes.NewReader(exported.Bytes())))
+	var reexported bytes.Buffer
+	require.NoError(t, dst.ExportChannels(ctx, &reexported))
+	require.ElementsMatch(t, lines, strings.Split(strings.TrimSpace(reexported.String()), "\n"))
+
+	require.NoError(t, dst.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("register")))
+	require.Empty(t, f.WatchCalls(), "imported channels are used")
+
+	require.Error(t, dst.ImportChannels(ctx, strings.NewReader(`{"DriveID":"__default__"}`)), "channel id is required")
+	require.Error(t, dst.ImportChannels(ctx, strings.NewReader(`{`)))
+
+	t.Run("overwrite on the storage that does not overwrite on save", func(t *testing.T) {
+		memory, _ := newTestApp(t, newFakeDrive(), withDrives, func(cfg *gdnotify.Config) {
+			cfg.Storage = &gdnotify.StorageConfig{Type: gdnotify.StorageTypeMemory}
+		})
+		require.NoError(t, memory.ImportChannels(ctx, bytes.NewReader(exported.Bytes())))
+		require.NoError(t, memory.ImportChannels(ctx, bytes.NewReader(exported.Bytes())), "import twice")
+		var reexported bytes.Buffer
+		require.NoError(t, memory.ExportChannels(ctx, &reexported))
+		require.ElementsMatch(t, lines, strings.Split(strings.TrimSpace(reexported.String()), "\n"))
+	})
+}
+
+func TestAppChangesPagesStreaming(t *testing.T) {
+	f := newFakeDrive()
+	f.changePages = [][]*drive.Change{
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+			{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+		},
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file3", Time: "2022-06-15T00:03:55.849Z"},
+		},
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file4", Time: "2022-06-15T00:03:55.849Z"},
+		},
+	}
+	app, cfg := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance")))
+	f.mu.Lock()
+	f.startPageToken = "200"
+	f.mu.Unlock()
+
+	sentBeforeFetch := make(map[string]int)
+	f.changesHook = func(r *http.Request) {
+		sentBeforeFetch[coalesce(r.URL.Query().Get("pageToken"), "-")] = len(readEvents(t, cfg))
+	}
+	require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("sync")))
+	require.EqualValues(t, map[string]int{
+		"100":    0,
+		"page-1": 2,
+		"page-2": 3,
+	}, sentBeforeFetch, "each page is sent before fetching the next page")
+	require.EqualValues(t, []string{"file1", "file2", "file3", "file4"}, lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+		return change.FileId
+	}))
+
+	storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+	require.NoError(t, err)
+	item, err := storage.FindOneByChannelID(ctx, f.WatchCalls()[0].Id)
+	require.NoError(t, err)
+	require.EqualValues(t, "200", item.PageToken, "new start page token is saved after the final page")
+}
+
+func TestAppSendNotificationParentFolders(t *testing.T) {
+	f := newFakeDrive()
+	f.fileParents = map[string][]string{
+		"folderA": {"root"},
+		"folderB": {"folderA"},
+		"folderC": {"root"},
+		"root":    {},
+	}
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.ParentFolderIDs = []string{"folderA"}
+	})
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "direct", File: &drive.File{Id: "direct", Parents: []string{"folderA"}}},
+		{Kind: "drive#change", ChangeType: "file", FileId: "nested", File: &drive.File{Id: "nested", Parents: []string{"folderB"}}},
+		{Kind: "drive#change", ChangeType: "file", FileId: "outside", File: &drive.File{Id: "outside", Parents: []string{"folderC"}}},
+		{Kind: "drive#change", ChangeType: "file", FileId: "no_parents", File: &drive.File{Id: "no_parents"}},
+		{Kind: "drive#change", ChangeType: "file", FileId: "removed", Removed: true},
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "drive1"},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+	require.NoError(t, app.SendNotification(context.Background(), item, changes))
+	actual := lo.Map(readEvents(t, cfg), func(change *drive.Change, _ int) string {
+		return coalesce(change.FileId, change.DriveId)
+	})
+	require.EqualValues(t, []string{"direct", "nested", "no_parents", "removed", "drive1"}, actual)
+}
+
+func TestAppDriveAPIRetry(t *testing.T) {
+	newApp := func(f *fakeDrive, maxRetries int) *gdnotify.App {
+		app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+			cfg.DriveAPI = &gdnotify.DriveAPIConfig{
+				MaxRetries:    aws.Int(maxRetries),
+				RetryMinDelay: time.Millisecond,
+				RetryMaxDelay: 10 * time.Millisecond,
+			}
+		})
+		return app
+	}
+	run := func(app *gdnotify.App, command string) error {
+		return app.RunWithContext(context.Background(), gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand(command))
+	}
+	t.Run("eventual success", func(t *testing.T) {
+		f := newFakeDrive()
+		f.changes = []*drive.Change{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		}
+		f.failures = map[string][]int{
+			"/changes/startPageToken": {http.StatusForbidden},
+			"/changes/watch":          {http.StatusServiceUnavailable, http.StatusForbidden},
+			"/changes":                {http.StatusForbidden},
+		}
+		app := newApp(f, 3)
+		require.NoError(t, run(app, "maintenance"))
+		require.Len(t, f.WatchCalls(), 1)
+		require.NoError(t, run(app, "sync"))
+		require.Empty(t, f.failures["/changes"], "changes:list is retried")
+	})
+	t.Run("retries exhausted", func(t *testing.T) {
+		f := newFakeDrive()
+		f.failures = map[string][]int{
+			"/changes/startPageToken": {http.StatusForbidden, http.StatusForbidden},
+		}
+		app := newApp(f, 1)
+		require.Error(t, run(app, "maintenance"))
+		require.Empty(t, f.WatchCalls())
+	})
+	t.Run("not retryable", func(t *testing.T) {
+		f := newFakeDrive()
+		f.failures = map[string][]int{
+			"/changes/startPageToken": {http.StatusBadRequest},
+		}
+		app := newApp(f, 3)
+		require.Error(t, run(app, "maintenance"))
+		require.Empty(t, f.WatchCalls())
+	})
+	t.Run("retry policy", func(t *testing.T) {
+		f := newFakeDrive()
+		f.failures = map[string][]int{
+			"/changes/startPageToken": {http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		}
+		app := newApp(f, 0)
+		app.SetRetryPolicy(gdnotify.RetryPolicy{
+			MaxRetries: 2,
+			MinDelay:   time.Millisecond,
+			MaxDelay:   10 * time.Millisecond,
+		})
+		require.NoError(t, run(app, "maintenance"))
+		require.Len(t, f.WatchCalls(), 1)
+	})
+	t.Run("retry policy classification", func(t *testing.T) {
+		f := newFakeDrive()
+		f.failures = map[string][]int{
+			"/changes/startPageToken": {http.StatusServiceUnavailable},
+		}
+		app := newApp(f, 0)
+		var classified []error
+		app.SetRetryPolicy(gdnotify.RetryPolicy{
+			MaxRetries: 3,
+			MinDelay:   time.Millisecond,
+			MaxDelay:   10 * time.Millisecond,
+			Retryable: func(err error) bool {
+				classified = append(classified, err)
+				return false
+			},
+		})
+		require.Error(t, run(app, "maintenance"))
+		require.Len(t, classified, 1)
+		require.Empty(t, f.WatchCalls())
+	})
+	t.Run("channels:stop is retried", func(t *testing.T) {
+		f := newFakeDrive()
+		app := newApp(f, 3)
+		require.NoError(t, run(app, "maintenance"))
+		f.failures = map[string][]int{
+			"/channels/stop": {http.StatusInternalServerError},
+		}
+		require.NoError(t, run(app, "cleanup"))
+		require.Len(t, f.StopCalls(), 1)
+	})
+}
+
+func TestAppDriveAPIRateLimit(t *testing.T) {
+	newApp := func(f *fakeDrive, qps float64) *gdnotify.App {
+		app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+			cfg.Drives = []*gdnotify.DriveConfig{
+				{DriveID: gdnotify.DefaultDriveID},
+				{DriveID: "0AAAAAAAAAAAAAAAAAA"},
+				{DriveID: "0BBBBBBBBBBBBBBBBBB"},
+			}
+			cfg.DriveAPI = &gdnotify.DriveAPIConfig{QPS: qps}
+		})
+		return app
+	}
+	t.Run("call spacing", func(t *testing.T) {
+		f := newFakeDrive()
+		app := newApp(f, 20)
+		require.NoError(t, app.RunWithContext(context.Background(), gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance")))
+		times := f.RequestTimes()
+		require.GreaterOrEqual(t, len(times), 6, "getStartPageToken and watch for each drive")
+		require.GreaterOrEqual(t, times[len(times)-1].Sub(times[0]), time.Duration(len(times)-2)*50*time.Millisecond, "calls are spaced by 50ms")
+	})
+	t.Run("context cancellation", func(t *testing.T) {
+		f := newFakeDrive()
+		app := newApp(f, 0.1)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		require.Error(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance")))
+		require.Less(t, time.Since(start), time.Second, "does not wait for the rate limit beyond the context")
+	})
+}
+
+func TestAppLastChangeAt(t *testing.T) {
+	f := newFakeDrive()
+	app, cfg := newTestApp(t, f)
+	ctx := context.Background()
+	runSync := func(now time.Time) *gdnotify.ChannelItem {
+		t.Helper()
+		restore := flextime.Fix(now)
+		defer restore()
+		require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("sync")))
+		storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+		require.NoError(t, err)
+		item, err := storage.FindOneByChannelID(ctx, f.WatchCalls()[0].Id)
+		require.NoError(t, err)
+		return item
+	}
+	base := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	item := runSync(base)
+	require.True(t, item.LastChangeAt.IsZero(), "no changes")
+
+	f.mu.Lock()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	f.mu.Unlock()
+	item = runSync(base.Add(time.Minute))
+	require.True(t, base.Add(time.Minute).Equal(item.LastChangeAt), "advanced by changes")
+
+	f.mu.Lock()
+	f.changes = nil
+	f.mu.Unlock()
+	item = runSync(base.Add(2 * time.Minute))
+	require.True(t, base.Add(time.Minute).Equal(item.LastChangeAt), "not advanced without changes")
+	require.Len(t, f.WatchCalls(), 1)
+}
+
+func TestAppStats(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Expiration = 24 * time.Hour
+		cfg.Drives = []*gdnotify.DriveConfig{
+			{DriveID: gdnotify.DefaultDriveID},
+			{DriveID: "0AAAAAAAAAAAAAAAAAA"},
+			{DriveID: "0BBBBBBBBBBBBBBBBBB", Expiration: 4 * time.Hour},
+		}
+	})
+	ctx := context.Background()
+	base := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	restore := flextime.Fix(base)
+	require.NoError(t, app.CreateChannel(ctx, gdnotify.DefaultDriveID))
+	restore()
+	restore = flextime.Fix(base.Add(2 * time.Hour))
+	require.NoError(t, app.CreateChannel(ctx, "0BBBBBBBBBBBBBBBBBB"))
+	restore()
+
+	restore = flextime.Fix(base.Add(5*time.Hour + 30*time.Minute))
+	defer restore()
+	stats, err := app.Stats(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, &gdnotify.ChannelStats{
+		TotalChannels: 2,
+		ChannelsPerDrive: map[string]int{
+			gdnotify.DefaultDriveID: 1,
+			"0BBBBBBBBBBBBBBBBBB":   1,
+		},
+		AboutToExpire:        1,
+		OldestPageTokenAge:   5*time.Hour + 30*time.Minute,
+		DrivesWithoutChannel: []string{"0AAAAAAAAAAAAAAAAAA"},
+	}, stats)
+
+	var buf bytes.Buffer
+	require.NoError(t, app.WriteStats(ctx, &buf, gdnotify.ListFormatJSON))
+	var actual gdnotify.ChannelStats
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &actual))
+	require.EqualValues(t, stats, &actual)
+}
+
+func TestAppDescribeChannel(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.CreateChannel(ctx, gdnotify.DefaultDriveID))
+	channelID := f.WatchCalls()[0].Id
+	f.mu.Lock()
+	f.startPageToken = "130"
+	f.mu.Unlock()
+
+	var buf bytes.Buffer
+	require.NoError(t, app.WriteChannelDescription(ctx, &buf, channelID, gdnotify.ListFormatJSON))
+	var actual map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &actual))
+	require.EqualValues(t, channelID, actual["channelId"])
+	require.EqualValues(t, gdnotify.DefaultDriveID, actual["driveId"])
+	require.EqualValues(t, "resource-"+channelID, actual["resourceId"])
+	require.EqualValues(t, "100", actual["pageToken"])
+	require.EqualValues(t, "130", actual["currentStartPageToken"])
+	require.EqualValues(t, 30, actual["pageTokenDrift"])
+
+	buf.Reset()
+	require.NoError(t, app.WriteChannelDescription(ctx, &buf, channelID, gdnotify.ListFormatTable))
+	require.Contains(t, buf.String(), channelID)
+
+	buf.Reset()
+	err := app.WriteChannelDescription(ctx, &buf, "unknown", gdnotify.ListFormatTable)
+	var channelNotFound *gdnotify.ChannelNotFound
+	require.ErrorAs(t, err, &channelNotFound)
+	require.EqualValues(t, "unknown", channelNotFound.ChannelID)
+	require.ErrorIs(t, err, gdnotify.ErrChannelNotFound)
+	require.Empty(t, buf.String())
+}
+
+func TestAppWatchFile(t *testing.T) {
+	f := newFakeDrive()
+	f.files = map[string]*drive.File{
+		"file1": {Id: "file1", Name: "report.xlsx", DriveId: "drive1", Version: 2},
+	}
+	app, cfg := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.WatchFile(ctx, "file1"))
+	require.Len(t, f.WatchCalls(), 1)
+	require.EqualValues(t, []string{"file1"}, f.WatchFileIDs())
+	require.Empty(t, f.WatchDriveIDs(), "changes:watch is not called")
+
+	fileChannelID := f.WatchCalls()[0].Id
+	storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+	require.NoError(t, err)
+	item, err := storage.FindOneByChannelID(ctx, fileChannelID)
+	require.NoError(t, err)
+	require.EqualValues(t, "file1", item.FileID)
+	require.EqualValues(t, "drive1", item.DriveID)
+
+	require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance")))
+	require.EqualValues(t, []string{gdnotify.DefaultDriveID}, f.WatchDriveIDs(), "the file channel is not regarded as the channel of the drive")
+	require.Empty(t, f.StopCalls(), "the file channel is kept")
+}
+
+func TestAppWatchFileRotatedConcurrently(t *testing.T) {
+	f := newFakeDrive()
+	f.files = map[string]*drive.File{
+		"file1": {Id: "file1", Name: "report.xlsx", DriveId: "drive1", Version: 2},
+		"file2": {Id: "file2", Name: "summary.xlsx", DriveId: "drive1", Version: 1},
+	}
+	clock := &fixedClock{now: time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)}
+	app, _ := newTestApp(t, f)
+	app.SetClock(clock)
+	ctx := context.Background()
+	require.NoError(t, app.WatchFile(ctx, "file1"))
+	require.NoError(t, app.WatchFile(ctx, "file2"))
+
+	// both file channels are rotated, while the channel of the drive is created, by the goroutines sharing the storage.
+	clock.Set(clock.Now().Add(30 * 24 * time.Hour))
+	require.NoError(t, app.RunWithContext(ctx, gdnotify.WithRunMode("cli"), gdnotify.WithCLICommand("maintenance")))
+	require.ElementsMatch(t, []string{"file1", "file2", "file1", "file2"}, f.WatchFileIDs())
+	require.EqualValues(t, []string{gdnotify.DefaultDriveID}, f.WatchDriveIDs())
+	require.Len(t, f.StopCalls(), 2, "the old file channels are stopped")
+}
+
+func TestAppCleanupOnShutdown(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cleanup_on_shutdown=%v", enabled), func(t *testing.T) {
+			f := newFakeDrive()
+			app, _ := newTestApp(t, f)
+			require.NoError(t, app.CreateChannel(context.Background(), gdnotify.DefaultDriveID))
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- app.RunWithContext(ctx,
+					gdnotify.WithRunMode("webhook"),
+					gdnotify.WithLocalAddress("127.0.0.1:0"),
+					gdnotify.WithCleanupOnShutdown(enabled),
+				)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+			select {
+			case err := <-errCh:
+				require.NoError(t, err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("webhook server is not shut down")
+			}
+			if !enabled {
+				require.Empty(t, f.StopCalls())
+				return
+			}
+			require.Len(t, f.StopCalls(), 1)
+			require.Equal(t, f.WatchCalls()[0].Id, f.StopCalls()[0].Id)
+		})
+	}
+}
+
+func TestAppDeleteChannelAlreadyDeleted(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f)
+	storage, _, err := gdnotify.NewDynamoDBStorageWithClient(context.Background(), &gdnotify.StorageConfig{
+		Type:      gdnotify.StorageTypeDynamoDB,
+		TableName: aws.String("gdnotify"),
+	}, newMockDynamoDBClient())
+	require.NoError(t, err)
+	app.SetStorage(storage)
+	f.failures = map[string][]int{
+		"/channels/stop": {http.StatusNotFound},
+	}
+	item := &gdnotify.ChannelItem{
+		ChannelID:  "channel1",
+		DriveID:    gdnotify.DefaultDriveID,
+		ResourceID: "resource1",
+	}
+	require.NoError(t, app.DeleteChannel(context.Background(), item), "stopped on Drive and absent in the storage")
+	require.Empty(t, f.failures["/channels/stop"])
+}
+
+type fixedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fixedClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func TestAppClock(t *testing.T) {
+	ctx := context.Background()
+	maintenance := func(app *gdnotify.App) error {
+		return app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		)
+	}
+	f1, f2 := newFakeDrive(), newFakeDrive()
+	app1, cfg := newTestApp(t, f1)
+	app2, _ := newTestApp(t, f2)
+	clock1 := &fixedClock{now: time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)}
+	clock2 := &fixedClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	app1.SetClock(clock1)
+	app2.SetClock(clock2)
+
+	require.NoError(t, maintenance(app1))
+	require.NoError(t, maintenance(app2))
+	require.Len(t, f1.WatchCalls(), 1)
+	require.Len(t, f2.WatchCalls(), 1)
+	require.Equal(t, clock1.Now().Add(cfg.Expiration).UnixMilli(), f1.WatchCalls()[0].Expiration)
+	require.Equal(t, clock2.Now().Add(cfg.Expiration).UnixMilli(), f2.WatchCalls()[0].Expiration)
+
+	clock1.Set(time.UnixMilli(f1.WatchCalls()[0].Expiration))
+	require.NoError(t, maintenance(app1))
+	require.NoError(t, maintenance(app2))
+	require.Len(t, f1.WatchCalls(), 2, "rotated by the clock of the app")
+	require.Equal(t, clock1.Now().Add(cfg.Expiration).UnixMilli(), f1.WatchCalls()[1].Expiration)
+	require.Len(t, f2.WatchCalls(), 1, "not rotated by the clock of the other app")
+}
+
+func TestAppRotateChannelResetsMessageNumber(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	app, cfg := newTestApp(t, f)
+	clock := &fixedClock{now: time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)}
+	app.SetClock(clock)
+	ctx := context.Background()
+	maintenance := func() error {
+		return app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		)
+	}
+	deliver := func(channelID, messageNumber string) {
+		t.Helper()
+		req := newWebhookRequest(channelID)
+		req.Header.Set("X-Goog-Message-Number", messageNumber)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	require.NoError(t, maintenance())
+	oldChannel := f.WatchCalls()[0]
+	deliver(oldChannel.Id, "10")
+	require.Len(t, readEvents(t, cfg), 1)
+
+	clock.Set(time.UnixMilli(oldChannel.Expiration))
+	require.NoError(t, maintenance())
+	require.Len(t, f.WatchCalls(), 2)
+	newChannel := f.WatchCalls()[1]
+	deliver(newChannel.Id, "1")
+	require.Len(t, readEvents(t, cfg), 2, "the first message of the rotated channel is not a duplicate")
+	deliver(newChannel.Id, "2")
+	require.Len(t, readEvents(t, cfg), 3)
+}
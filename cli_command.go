@@ -10,6 +10,14 @@ const (
 	CLICommandMaintenance
 	CLICommandCleanup
 	CLICommandSync
+	CLICommandReconcile
+	CLICommandExport
+	CLICommandImport
+	CLICommandStats
+	CLICommandWatchFile
+	CLICommandDescribeChannel
+	CLICommandValidate
+	CLICommandDoctor
 )
 
 func (cmd CLICommand) Description() string {
@@ -21,9 +29,27 @@ func (cmd CLICommand) Description() string {
 	case CLICommandRegister:
 		return "register a new notification channel for a drive for which a notification channel has not yet been set"
 	case CLICommandMaintenance:
-		return "re-register expired notification channels or register new unregistered channels."
+		return "re-register expired notification channels or register new unregistered channels, without fetching changes."
 	case CLICommandCleanup:
 		return "remove all notification channels"
+	case CLICommandSync:
+		return "maintenance notification channels, then fetch all changes and send notifications."
+	case CLICommandReconcile:
+		return "stop an orphaned notification channel that is active on Google Drive but not in the storage."
+	case CLICommandExport:
+		return "export all notification channels in the storage to stdout as newline-delimited JSON."
+	case CLICommandImport:
+		return "import notification channels exported by the export command from stdin into the storage."
+	case CLICommandStats:
+		return "print the aggregate health of notification channels."
+	case CLICommandWatchFile:
+		return "register a new notification channel that watches a single file instead of the whole drive."
+	case CLICommandDescribeChannel:
+		return "print the details of a notification channel, with the drift from the current start page token."
+	case CLICommandValidate:
+		return "validate the config and required_version, without creating channels or calling Google Drive and AWS."
+	case CLICommandDoctor:
+		return "check AWS config, storage, Google Drive, webhook address and event bus, and print the checklist with hints."
 	default:
 		return ""
 	}
@@ -7,11 +7,11 @@ import (
 	"strings"
 )
 
-const _CLICommandName = "listserveregistermaintenancecleanupsync"
+const _CLICommandName = "listserveregistermaintenancecleanupsyncreconcileexportimportstatswatch_filedescribe_channelvalidatedoctor"
 
-var _CLICommandIndex = [...]uint8{0, 4, 9, 17, 28, 35, 39}
+var _CLICommandIndex = [...]uint8{0, 4, 9, 17, 28, 35, 39, 48, 54, 60, 65, 75, 91, 99, 105}
 
-const _CLICommandLowerName = "listserveregistermaintenancecleanupsync"
+const _CLICommandLowerName = "listserveregistermaintenancecleanupsyncreconcileexportimportstatswatch_filedescribe_channelvalidatedoctor"
 
 func (i CLICommand) String() string {
 	if i < 0 || i >= CLICommand(len(_CLICommandIndex)-1) {
@@ -30,23 +30,47 @@ func _CLICommandNoOp() {
 	_ = x[CLICommandMaintenance-(3)]
 	_ = x[CLICommandCleanup-(4)]
 	_ = x[CLICommandSync-(5)]
+	_ = x[CLICommandReconcile-(6)]
+	_ = x[CLICommandExport-(7)]
+	_ = x[CLICommandImport-(8)]
+	_ = x[CLICommandStats-(9)]
+	_ = x[CLICommandWatchFile-(10)]
+	_ = x[CLICommandDescribeChannel-(11)]
+	_ = x[CLICommandValidate-(12)]
+	_ = x[CLICommandDoctor-(13)]
 }
 
-var _CLICommandValues = []CLICommand{CLICommandList, CLICommandServe, CLICommandRegister, CLICommandMaintenance, CLICommandCleanup, CLICommandSync}
+var _CLICommandValues = []CLICommand{CLICommandList, CLICommandServe, CLICommandRegister, CLICommandMaintenance, CLICommandCleanup, CLICommandSync, CLICommandReconcile, CLICommandExport, CLICommandImport, CLICommandStats, CLICommandWatchFile, CLICommandDescribeChannel, CLICommandValidate, CLICommandDoctor}
 
 var _CLICommandNameToValueMap = map[string]CLICommand{
-	_CLICommandName[0:4]:        CLICommandList,
-	_CLICommandLowerName[0:4]:   CLICommandList,
-	_CLICommandName[4:9]:        CLICommandServe,
-	_CLICommandLowerName[4:9]:   CLICommandServe,
-	_CLICommandName[9:17]:       CLICommandRegister,
-	_CLICommandLowerName[9:17]:  CLICommandRegister,
-	_CLICommandName[17:28]:      CLICommandMaintenance,
-	_CLICommandLowerName[17:28]: CLICommandMaintenance,
-	_CLICommandName[28:35]:      CLICommandCleanup,
-	_CLICommandLowerName[28:35]: CLICommandCleanup,
-	_CLICommandName[35:39]:      CLICommandSync,
-	_CLICommandLowerName[35:39]: CLICommandSync,
+	_CLICommandName[0:4]:         CLICommandList,
+	_CLICommandLowerName[0:4]:    CLICommandList,
+	_CLICommandName[4:9]:         CLICommandServe,
+	_CLICommandLowerName[4:9]:    CLICommandServe,
+	_CLICommandName[9:17]:        CLICommandRegister,
+	_CLICommandLowerName[9:17]:   CLICommandRegister,
+	_CLICommandName[17:28]:       CLICommandMaintenance,
+	_CLICommandLowerName[17:28]:  CLICommandMaintenance,
+	_CLICommandName[28:35]:       CLICommandCleanup,
+	_CLICommandLowerName[28:35]:  CLICommandCleanup,
+	_CLICommandName[35:39]:       CLICommandSync,
+	_CLICommandLowerName[35:39]:  CLICommandSync,
+	_CLICommandName[39:48]:       CLICommandReconcile,
+	_CLICommandLowerName[39:48]:  CLICommandReconcile,
+	_CLICommandName[48:54]:       CLICommandExport,
+	_CLICommandLowerName[48:54]:  CLICommandExport,
+	_CLICommandName[54:60]:       CLICommandImport,
+	_CLICommandLowerName[54:60]:  CLICommandImport,
+	_CLICommandName[60:65]:       CLICommandStats,
+	_CLICommandLowerName[60:65]:  CLICommandStats,
+	_CLICommandName[65:75]:       CLICommandWatchFile,
+	_CLICommandLowerName[65:75]:  CLICommandWatchFile,
+	_CLICommandName[75:91]:       CLICommandDescribeChannel,
+	_CLICommandLowerName[75:91]:  CLICommandDescribeChannel,
+	_CLICommandName[91:99]:       CLICommandValidate,
+	_CLICommandLowerName[91:99]:  CLICommandValidate,
+	_CLICommandName[99:105]:      CLICommandDoctor,
+	_CLICommandLowerName[99:105]: CLICommandDoctor,
 }
 
 var _CLICommandNames = []string{
@@ -56,6 +80,14 @@ var _CLICommandNames = []string{
 	_CLICommandName[17:28],
 	_CLICommandName[28:35],
 	_CLICommandName[35:39],
+	_CLICommandName[39:48],
+	_CLICommandName[48:54],
+	_CLICommandName[54:60],
+	_CLICommandName[60:65],
+	_CLICommandName[65:75],
+	_CLICommandName[75:91],
+	_CLICommandName[91:99],
+	_CLICommandName[99:105],
 }
 
 // CLICommandString retrieves an enum value from the enum constants string name.
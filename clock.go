@@ -0,0 +1,27 @@
+package gdnotify
+
+import (
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+// Clock is the source of the current time of the App.
+type Clock interface {
+	Now() time.Time
+}
+
+type flextimeClock struct{}
+
+func (flextimeClock) Now() time.Time {
+	return flextime.Now()
+}
+
+// SetClock replaces the clock of the App, used for the expiration of channels, the rotation and the filter of modified time.
+// By default, it is flextime.Now, which is shared by the process. It must be called before the App is run.
+func (app *App) SetClock(clock Clock) {
+	if clock == nil {
+		clock = flextimeClock{}
+	}
+	app.clock = clock
+}
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/fujiwara/logutils"
@@ -45,15 +46,39 @@ func _main() error {
 		port     int
 		mode     string
 		minLevel string
+		driveID  string
+		limit    int
+		format   string
+
+		channelID  string
+		resourceID string
+		fileID     string
+		dryRun     bool
+
+		pageTokenRefreshInterval time.Duration
+		configCacheTTL           time.Duration
+		logSampleRate            float64
+		cleanupOnShutdown        bool
 	)
 
-	flag.Var(&configs, "config", "config list")
+	flag.Var(&configs, "config", "config file path or url (file, http(s), s3, gs or secretsmanager), can be specified multiple times and later ones override earlier ones")
 	flag.IntVar(&port, "port", 0, "webhook httpd port")
 	flag.StringVar(&mode, "run-mode", gdnotify.DefaultRunMode().String(), fmt.Sprintf(
 		"run mode (%s)",
 		strings.Join(gdnotify.RunModeStrings(), "|"),
 	))
 	flag.StringVar(&minLevel, "log-level", "info", "run mode")
+	flag.Float64Var(&logSampleRate, "log-sample-rate", 1, "fraction of debug logs to write, 0.0 to 1.0, logs of the other levels are always written")
+	flag.StringVar(&driveID, "drive-id", "", "target drive id for register command, or filter of list command")
+	flag.IntVar(&limit, "limit", 0, "max number of channels for list command (0 is unlimited)")
+	flag.StringVar(&format, "format", gdnotify.ListFormatTable, fmt.Sprintf("output format for list, stats and describe_channel command (%s|%s)", gdnotify.ListFormatTable, gdnotify.ListFormatJSON))
+	flag.StringVar(&channelID, "channel-id", "", "channel id for describe_channel command, or orphaned channel id for reconcile command")
+	flag.StringVar(&resourceID, "resource-id", "", "orphaned resource id for reconcile command")
+	flag.StringVar(&fileID, "file-id", "", "target file id for watch_file command")
+	flag.BoolVar(&dryRun, "dry-run", false, "log the channels to create, rotate or delete without executing (for register, maintenance, sync and cleanup command)")
+	flag.DurationVar(&pageTokenRefreshInterval, "page-token-refresh-interval", 0, "interval to re-acquire the start page token at channel rotation (overrides page_token_refresh_interval of config)")
+	flag.BoolVar(&cleanupOnShutdown, "cleanup-on-shutdown", false, "stop all channels when the webhook server is shut down, for ephemeral environments")
+	flag.DurationVar(&configCacheTTL, "config-cache-ttl", 0, "reuse the config fetched from S3 without revalidating the ETag within this duration, on reload")
 	flag.VisitAll(flagx.EnvToFlagWithPrefix("GDNOTIFY_"))
 	didumean.Parse()
 
@@ -69,24 +94,74 @@ func _main() error {
 		MinLevel: logutils.LogLevel(strings.ToLower(minLevel)),
 		Writer:   os.Stdout,
 	}
-	log.SetOutput(filter)
+	log.SetOutput(gdnotify.NewLogSampler(filter, logSampleRate))
 	if minLevel == "debug" {
 		log.SetFlags(log.Lshortfile)
 	}
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	// the webhook server reloads the config on SIGHUP, instead of shutting down.
+	// the maintainer and syncer run modes are batches, they are not regarded as the webhook server.
+	runMode, _ := gdnotify.RunModeString(mode)
+	serve := runMode == gdnotify.RunModeWebhook ||
+		(runMode == gdnotify.RunModeCLI && flag.Arg(0) == gdnotify.CLICommandServe.String())
+	signals := []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	if !serve {
+		signals = append(signals, syscall.SIGHUP)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), signals...)
 	defer cancel()
-	cfg := gdnotify.DefaultConfig()
-	if err := cfg.Load(ctx, configs...); err != nil {
-		return err
+	// the loader is shared by the reloads, to revalidate the config on S3 by the ETag.
+	loader := gdnotify.NewConfigLoader()
+	loader.SetCacheTTL(configCacheTTL)
+	loader.SetVersion(Version)
+	loadConfig := func() (*gdnotify.Config, error) {
+		cfg := gdnotify.DefaultConfig()
+		if err := loader.Load(ctx, cfg, configs...); err != nil {
+			return nil, err
+		}
+		if dryRun {
+			cfg.DryRun = true
+		}
+		if pageTokenRefreshInterval > 0 {
+			cfg.PageTokenRefreshInterval = pageTokenRefreshInterval
+		}
+		return cfg, nil
 	}
-	if err := cfg.ValidateVersion(Version); err != nil {
+	cfg, err := loadConfig()
+	if err != nil {
 		return err
 	}
+	if flag.Arg(0) == gdnotify.CLICommandValidate.String() {
+		return cfg.WriteSummary(os.Stdout)
+	}
+	if flag.Arg(0) == gdnotify.CLICommandDoctor.String() {
+		return cfg.Doctor(ctx, os.Stdout)
+	}
 	app, err := gdnotify.New(cfg)
 	if err != nil {
 		return err
 	}
 	defer app.Close()
+	if serve {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+				}
+				log.Println("[info] SIGHUP received, reload config")
+				cfg, err := loadConfig()
+				if err != nil {
+					log.Println("[error] reload config failed, keep the current config:", err)
+					continue
+				}
+				app.Reload(ctx, cfg)
+			}
+		}()
+	}
 	optFns := make([]func(*gdnotify.RunOptions) error, 0)
 	if port > 0 {
 		optFns = append(optFns, gdnotify.WithLocalAddress(fmt.Sprintf(":%d", port)))
@@ -94,6 +169,24 @@ func _main() error {
 	if mode != "" {
 		optFns = append(optFns, gdnotify.WithRunMode(mode))
 	}
+	if driveID != "" {
+		optFns = append(optFns, gdnotify.WithDriveID(driveID))
+	}
+	if limit > 0 {
+		optFns = append(optFns, gdnotify.WithListLimit(limit))
+	}
+	if format != "" {
+		optFns = append(optFns, gdnotify.WithListFormat(format))
+	}
+	if channelID != "" || resourceID != "" {
+		optFns = append(optFns, gdnotify.WithOrphanChannel(channelID, resourceID))
+	}
+	if fileID != "" {
+		optFns = append(optFns, gdnotify.WithFileID(fileID))
+	}
+	if cleanupOnShutdown {
+		optFns = append(optFns, gdnotify.WithCleanupOnShutdown(true))
+	}
 	if command := flag.Arg(0); command != "" {
 		optFns = append(optFns, gdnotify.WithCLICommand(command))
 	}
@@ -9,29 +9,66 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Songmu/flextime"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	gv "github.com/hashicorp/go-version"
 	gc "github.com/kayac/go-config"
 	logx "github.com/mashiike/go-logx"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
 )
 
 // Config for App
 type Config struct {
 	RequiredVersion string `yaml:"required_version,omitempty"`
 
-	Webhook            string                    `yaml:"webhook,omitempty"`
-	Credentials        *CredentialsBackendConfig `yaml:"credentials,omitempty"`
-	Expiration         time.Duration             `yaml:"expiration,omitempty"`
-	Storage            *StorageConfig            `yaml:"storage,omitempty"`
-	Notification       *NotificationConfig       `yaml:"notification,omitempty"`
-	Drives             []*DriveConfig            `yaml:"drives,omitempty"`
-	WithinModifiedTime *time.Duration            `yaml:"within_modified_time,omitempty"`
-	DrivesAutoDetect   *bool                     `yaml:"drives_auto_detect,omitempty"`
+	Webhook             string                    `yaml:"webhook,omitempty"`
+	Credentials         *CredentialsBackendConfig `yaml:"credentials,omitempty"`
+	Expiration          time.Duration             `yaml:"expiration,omitempty"`
+	Storage             *StorageConfig            `yaml:"storage,omitempty"`
+	Notification        *NotificationConfig       `yaml:"notification,omitempty"`
+	Drives              []*DriveConfig            `yaml:"drives,omitempty"`
+	WithinModifiedTime  *time.Duration            `yaml:"within_modified_time,omitempty"`
+	DrivesAutoDetect    *bool                     `yaml:"drives_auto_detect,omitempty"`
+	ChangeTypes         []string                  `yaml:"change_types,omitempty"`
+	SuppressSelfEdits   bool                      `yaml:"suppress_self_edits,omitempty"`
+	SelfEditEmails      []string                  `yaml:"self_edit_emails,omitempty"`
+	Metrics             *MetricsConfig            `yaml:"metrics,omitempty"`
+	ShutdownTimeout     time.Duration             `yaml:"shutdown_timeout,omitempty"`
+	EmitLifecycleEvents bool                      `yaml:"emit_lifecycle_events,omitempty"`
+	SyncConcurrency     int                       `yaml:"sync_concurrency,omitempty"`
+	Server              *ServerConfig             `yaml:"server,omitempty"`
+	DriveAPI            *DriveAPIConfig           `yaml:"drive_api,omitempty"`
+
+	PageTokenRefreshInterval time.Duration `yaml:"page_token_refresh_interval,omitempty"`
+	IncludeDriveIDs          []string      `yaml:"include_drive_ids,omitempty"`
+	ExcludeDriveIDs          []string      `yaml:"exclude_drive_ids,omitempty"`
+	DryRun                   bool          `yaml:"dry_run,omitempty"`
+	ParentFolderIDs          []string      `yaml:"parent_folder_ids,omitempty"`
+	WebhookAddresses         []string      `yaml:"webhook_addresses,omitempty"`
+	// IncludeDriveChangesAlways passes drive changes through within_modified_time, they are checked by the time of the change by default.
+	IncludeDriveChangesAlways bool `yaml:"include_drive_changes_always,omitempty"`
+	// ExpirationJitter adds a random duration up to this to the expiration of each created channel, so that the channels do not rotate at once.
+	// It is capped by the time to rotate before the expiration, 20% of the expiration.
+	ExpirationJitter time.Duration `yaml:"expiration_jitter,omitempty"`
+	// SuppressVersionNoops drops file changes whose version is not increased since the last seen change of the file.
+	SuppressVersionNoops bool `yaml:"suppress_version_noops,omitempty"`
+	// IncludePermissions requests permissions and permissionIds of the changed files, to be included in the change events.
+	IncludePermissions bool `yaml:"include_permissions,omitempty"`
+	// ChangeFileFields overrides the fields of the changed files requested by changes:list, e.g. `webViewLink` or `owners(emailAddress)`.
+	ChangeFileFields []string `yaml:"change_file_fields,omitempty"`
+	// EnableTracing records OpenTelemetry spans by the global TracerProvider.
+	EnableTracing bool `yaml:"enable_tracing,omitempty"`
 
 	versionConstraints gv.Constraints `yaml:"version_constraints,omitempty"`
 }
@@ -56,50 +93,217 @@ type StorageType int
 const (
 	StorageTypeDynamoDB StorageType = iota
 	StorageTypeFile
+	StorageTypeMemory
 )
 
 type StorageConfig struct {
-	Type      StorageType `yaml:"type,omitempty"`
-	TableName *string     `yaml:"table_name,omitempty"`
-	DataFile  *string     `yaml:"data_file,omitempty"`
-	LockFile  *string     `yaml:"lock_file,omitempty"`
+	Type       StorageType `yaml:"type,omitempty"`
+	TableName  *string     `yaml:"table_name,omitempty"`
+	AutoCreate *bool       `yaml:"auto_create,omitempty"`
+	DataFile   *string     `yaml:"data_file,omitempty"`
+	LockFile   *string     `yaml:"lock_file,omitempty"`
+	FileFormat string      `yaml:"file_format,omitempty"`
+	// BillingMode is the billing mode of the auto created DynamoDB table, `PAY_PER_REQUEST` (default) or `PROVISIONED`.
+	BillingMode   string `yaml:"billing_mode,omitempty"`
+	ReadCapacity  int64  `yaml:"read_capacity,omitempty"`
+	WriteCapacity int64  `yaml:"write_capacity,omitempty"`
+	// ScanSegments is the number of segments to scan the DynamoDB table in parallel, 0 or 1 means a sequential scan.
+	ScanSegments int `yaml:"scan_segments,omitempty"`
+	// OperationTimeout is the timeout of each storage operation, 0 means no timeout.
+	OperationTimeout time.Duration `yaml:"operation_timeout,omitempty"`
 }
 
+const (
+	// FileFormatGob is the default format of the File storage.
+	FileFormatGob = "gob"
+	// FileFormatJSON is the human readable format of the File storage.
+	FileFormatJSON = "json"
+
+	BillingModePayPerRequest = "PAY_PER_REQUEST"
+	BillingModeProvisioned   = "PROVISIONED"
+
+	// maxScanSegments is the limit of TotalSegments of DynamoDB Scan.
+	maxScanSegments = 1000000
+)
+
 type NotificationType int
 
 //go:generate enumer -type=NotificationType -yaml -trimprefix NotificationType -output notification_type_enumer.gen.go
 const (
 	NotificationTypeEventBridge NotificationType = iota
 	NotificationTypeFile
+	NotificationTypeMulti
+	NotificationTypeChat
+	NotificationTypeKinesis
 )
 
 type NotificationConfig struct {
 	Type      NotificationType `yaml:"type,omitempty"`
 	EventBus  *string          `yaml:"event_bus,omitempty"`
 	EventFile *string          `yaml:"event_file,omitempty"`
+	// BatchWindow sends the changes received within the window together, the page token is saved after the pending changes are sent.
+	BatchWindow time.Duration `yaml:"batch_window,omitempty"`
+	BatchSize   int           `yaml:"batch_size,omitempty"`
+
+	Targets []*NotificationConfig `yaml:"targets,omitempty"`
+
+	SourcePrefix           *string `yaml:"source_prefix,omitempty"`
+	IncludeAccountInSource bool    `yaml:"include_account_in_source,omitempty"`
+	IncludeChannelMetadata bool    `yaml:"include_channel_metadata,omitempty"`
+	// EventTimeSource is the timestamp used as the time of the events, `change` (default) or `modified`.
+	EventTimeSource string `yaml:"event_time_source,omitempty"`
+	// DetailTypeExpr is a CEL expression returning the detail-type of the change events instead of the built-in one, if type is EventBridge.
+	DetailTypeExpr string `yaml:"detail_type_expr,omitempty"`
+
+	MaxRetries    *int          `yaml:"max_retries,omitempty"`
+	RetryMinDelay time.Duration `yaml:"retry_min_delay,omitempty"`
+	RetryMaxDelay time.Duration `yaml:"retry_max_delay,omitempty"`
+
+	ChatWebhookURL *string `yaml:"chat_webhook_url,omitempty"`
+	ChatFormat     string  `yaml:"chat_format,omitempty"`
+	// ChatSummaryThreshold is the number of changes at once, above which they are posted as a summary message.
+	ChatSummaryThreshold int `yaml:"chat_summary_threshold,omitempty"`
+	// ChatRateLimit is the max messages per second posted to the chat webhook.
+	ChatRateLimit float64 `yaml:"chat_rate_limit,omitempty"`
+
+	// StreamName is the name or the ARN of the Kinesis data stream, if type is Kinesis.
+	StreamName *string `yaml:"stream_name,omitempty"`
 }
 
+// DefaultSourcePrefix is the default prefix of the source of events.
+const DefaultSourcePrefix = "oss.gdnotify"
+
+const (
+	// EventTimeSourceChange uses the time of the change, when Google Drive recorded it.
+	EventTimeSourceChange = "change"
+	// EventTimeSourceModified uses the modifiedTime of the changed file, the change time if the change has no file.
+	EventTimeSourceModified = "modified"
+)
+
+const (
+	// ChatFormatSlack is the default format of the Chat notification, Slack incoming webhook messages.
+	ChatFormatSlack = "slack"
+	// ChatFormatTeams is the message card of Microsoft Teams incoming webhooks.
+	ChatFormatTeams = "teams"
+
+	DefaultChatSummaryThreshold = 10
+	DefaultChatRateLimit        = 1.0
+)
+
+// DefaultNotificationMaxRetries is the default number of retries of putting events failed with retryable errors.
+const DefaultNotificationMaxRetries = 3
+
+type MetricsType int
+
+//go:generate enumer -type=MetricsType -yaml -trimprefix MetricsType -output metrics_type_enumer.gen.go
+const (
+	MetricsTypeNone MetricsType = iota
+	MetricsTypeEMF
+	MetricsTypePrometheus
+)
+
+type MetricsConfig struct {
+	Type      MetricsType `yaml:"type,omitempty"`
+	Namespace *string     `yaml:"namespace,omitempty"`
+}
+
+const (
+	// NotificationFailureAck returns 200 on notification failure, the changes are not re-fetched because the page token is already advanced.
+	NotificationFailureAck = "ack"
+	// NotificationFailureRetry returns 500 on notification failure without advancing the page token, Google retries the push notification and the changes are re-fetched.
+	NotificationFailureRetry = "retry"
+)
+
+type ServerConfig struct {
+	NotificationFailure string `yaml:"notification_failure,omitempty"`
+	EnableMetrics       bool   `yaml:"enable_metrics,omitempty"`
+	// MaxConcurrentWebhooks is the max number of change notifications processed concurrently, 0 means unlimited.
+	MaxConcurrentWebhooks int `yaml:"max_concurrent_webhooks,omitempty"`
+	// WebhookQueueTimeout is how long a change notification waits for processing when saturated, before 503 is returned.
+	WebhookQueueTimeout time.Duration `yaml:"webhook_queue_timeout,omitempty"`
+	// WebhookHMACSecret enables the verification of X-Signature header signed by a proxy in front of gdnotify.
+	WebhookHMACSecret string `yaml:"webhook_hmac_secret,omitempty"`
+	// ReplayToken enables POST /replay, the requests must have `Authorization: Bearer <replay_token>` header.
+	ReplayToken string `yaml:"replay_token,omitempty"`
+	// AllowedUserAgentPrefixes are the User-Agent prefixes of the accepted webhook requests, the others are returned 404.
+	AllowedUserAgentPrefixes []string `yaml:"allowed_user_agent_prefixes,omitempty"`
+	// MaxDumpBytes caps the size of the request dump in the debug log.
+	MaxDumpBytes int `yaml:"max_dump_bytes,omitempty"`
+}
+
+// DefaultWebhookQueueTimeout is the default of server.webhook_queue_timeout.
+const DefaultWebhookQueueTimeout = 5 * time.Second
+
+// DefaultMaxDumpBytes is the default of server.max_dump_bytes.
+const DefaultMaxDumpBytes = 4096
+
+// DefaultAllowedUserAgentPrefixes is the default of server.allowed_user_agent_prefixes, the User-Agent of Google push notifications.
+var DefaultAllowedUserAgentPrefixes = []string{"APIs-Google;"}
+
+// DriveAPIConfig is retry settings of Drive API calls, changes:list, changes:watch and changes:getStartPageToken,
+// and the rate limit of all Drive API calls.
+type DriveAPIConfig struct {
+	MaxRetries    *int          `yaml:"max_retries,omitempty"`
+	RetryMinDelay time.Duration `yaml:"retry_min_delay,omitempty"`
+	RetryMaxDelay time.Duration `yaml:"retry_max_delay,omitempty"`
+	// QPS is the max number of Drive API calls per second, 0 means unlimited.
+	QPS   float64 `yaml:"qps,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+const (
+	// DefaultDriveAPIMaxRetries is the default number of retries of Drive API calls failed with rate limit or server errors.
+	DefaultDriveAPIMaxRetries    = 3
+	DefaultDriveAPIRetryMinDelay = 500 * time.Millisecond
+	DefaultDriveAPIRetryMaxDelay = 10 * time.Second
+)
+
 const (
 	DefaultDriveID = "__default__"
+
+	// DefaultPageTokenRefreshInterval is the interval to re-acquire the start page token at channel rotation.
+	DefaultPageTokenRefreshInterval = 90 * 24 * time.Hour
 )
 
 type DriveConfig struct {
 	DriveID string `yaml:"drive_id,omitempty"`
+
+	// Expiration overrides the expiration of the notification channel for this drive, if positive.
+	Expiration time.Duration `yaml:"expiration,omitempty"`
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		Expiration: 7 * 24 * time.Hour,
+		Expiration:      7 * 24 * time.Hour,
+		ShutdownTimeout: 30 * time.Second,
+		SyncConcurrency: 4,
+
+		PageTokenRefreshInterval: DefaultPageTokenRefreshInterval,
 		Credentials: &CredentialsBackendConfig{
 			BackendType: CredentialsBackendTypeNone,
 		},
 		Storage: &StorageConfig{
-			Type:      StorageTypeDynamoDB,
-			TableName: aws.String("gdnotify"),
+			Type:       StorageTypeDynamoDB,
+			TableName:  aws.String("gdnotify"),
+			AutoCreate: aws.Bool(true),
 		},
 		Notification: &NotificationConfig{
-			Type:     NotificationTypeEventBridge,
-			EventBus: aws.String("default"),
+			Type:         NotificationTypeEventBridge,
+			EventBus:     aws.String("default"),
+			SourcePrefix: aws.String(DefaultSourcePrefix),
+		},
+		Server: &ServerConfig{
+			NotificationFailure: NotificationFailureAck,
+			WebhookQueueTimeout: DefaultWebhookQueueTimeout,
+		},
+		DriveAPI: &DriveAPIConfig{
+			MaxRetries:    aws.Int(DefaultDriveAPIMaxRetries),
+			RetryMinDelay: DefaultDriveAPIRetryMinDelay,
+			RetryMaxDelay: DefaultDriveAPIRetryMaxDelay,
+		},
+		Metrics: &MetricsConfig{
+			Type:      MetricsTypeNone,
+			Namespace: aws.String("gdnotify"),
 		},
 		Drives: []*DriveConfig{
 			{
@@ -109,25 +313,119 @@ func DefaultConfig() *Config {
 	}
 }
 
-// Load loads configuration file from file paths.
+// Load loads configuration file from file paths, by a new ConfigLoader.
 func (cfg *Config) Load(ctx context.Context, paths ...string) error {
+	return NewConfigLoader().Load(ctx, cfg, paths...)
+}
+
+// ConfigLoader fetches the config files from local files, HTTP(S), S3, GCS and Secrets Manager.
+// The config fetched from S3 is cached with the ETag, so that reloading by the same loader does not download the unchanged object again.
+type ConfigLoader struct {
+	version              string
+	cacheTTL             time.Duration
+	s3Client             S3Client
+	secretsManagerClient SecretsManagerClient
+	gcsOptions           []option.ClientOption
+
+	s3CacheMu sync.Mutex
+	s3Cache   map[string]*s3ConfigCacheEntry
+}
+
+func NewConfigLoader() *ConfigLoader {
+	return &ConfigLoader{
+		s3Cache: make(map[string]*s3ConfigCacheEntry),
+	}
+}
+
+// SetVersion sets the version of the running binary, the loaded config is rejected if the version does not satisfy required_version.
+func (l *ConfigLoader) SetVersion(version string) {
+	l.version = version
+}
+
+// SetCacheTTL sets how long the config fetched from S3 is reused without revalidating the ETag, 0 means revalidating on every load.
+func (l *ConfigLoader) SetCacheTTL(ttl time.Duration) {
+	l.cacheTTL = ttl
+}
+
+// SetS3Client replaces the client of `s3://` config files, which is created from the default AWS config by default.
+func (l *ConfigLoader) SetS3Client(client S3Client) {
+	l.s3Client = client
+}
+
+// SetSecretsManagerClient replaces the client of `secretsmanager://` config files, which is created from the default AWS config by default.
+func (l *ConfigLoader) SetSecretsManagerClient(client SecretsManagerClient) {
+	l.secretsManagerClient = client
+}
+
+// SetGCSClientOptions sets the client options of `gs://` config files, e.g. the endpoint or the credentials.
+func (l *ConfigLoader) SetGCSClientOptions(opts ...option.ClientOption) {
+	l.gcsOptions = opts
+}
+
+// Load loads configuration files from paths into cfg, restricts it and validates required_version by the version set by SetVersion.
+func (l *ConfigLoader) Load(ctx context.Context, cfg *Config, paths ...string) error {
 	for _, path := range paths {
-		if err := cfg.load(ctx, path); err != nil {
+		if err := l.load(ctx, cfg, path); err != nil {
 			return fmt.Errorf("%s load failed: %w", path, err)
 		}
 	}
-	return cfg.Restrict()
+	if err := cfg.Restrict(); err != nil {
+		return err
+	}
+	if l.version == "" {
+		return nil
+	}
+	return cfg.ValidateVersion(l.version)
 }
 
-func (cfg *Config) load(ctx context.Context, path string) error {
-	content, err := fetchConfig(ctx, path)
+func (l *ConfigLoader) load(ctx context.Context, cfg *Config, path string) error {
+	content, err := l.fetchConfig(ctx, path)
 	if err != nil {
 		return err
 	}
+	if err := checkEnvReferences(content); err != nil {
+		return err
+	}
 	return gc.LoadWithEnvBytes(cfg, content)
 }
 
-func fetchConfig(ctx context.Context, path string) ([]byte, error) {
+var (
+	envReferencePattern = regexp.MustCompile(`(?:\{\{-?|\()\s*(must_env|env)((?:\s+(?:"[^"]*"|` + "`[^`]*`" + `))+)`)
+	envArgumentPattern  = regexp.MustCompile(`"([^"]*)"|` + "`([^`]*)`")
+)
+
+// checkEnvReferences reports the environment variables referenced by `env` or `must_env` of the config template that are not set, with the line numbers.
+// `env` without a default value renders the variable name itself if it is not set, which only fails later with a confusing message.
+func checkEnvReferences(content []byte) error {
+	var undefined []string
+	for i, line := range strings.Split(string(content), "\n") {
+		for _, m := range envReferencePattern.FindAllStringSubmatch(line, -1) {
+			args := envArgumentPattern.FindAllStringSubmatch(m[2], -1)
+			name := args[0][1] + args[0][2]
+			switch m[1] {
+			case "must_env":
+				if _, ok := os.LookupEnv(name); ok {
+					continue
+				}
+			case "env":
+				if len(args) > 1 || os.Getenv(name) != "" {
+					continue
+				}
+			}
+			undefined = append(undefined, fmt.Sprintf("%s (line %d)", name, i+1))
+		}
+	}
+	if len(undefined) > 0 {
+		return fmt.Errorf("environment variables are not set: %s", strings.Join(undefined, ", "))
+	}
+	return nil
+}
+
+func (l *ConfigLoader) fetchConfig(ctx context.Context, path string) ([]byte, error) {
+	// the ARN of a secret is not a valid host of URL.
+	if secretID, ok := strings.CutPrefix(path, "secretsmanager://"); ok {
+		return l.fetchConfigFromSecretsManager(ctx, secretID)
+	}
 	u, err := url.Parse(path)
 	if err != nil {
 		return os.ReadFile(path)
@@ -136,7 +434,9 @@ func fetchConfig(ctx context.Context, path string) ([]byte, error) {
 	case "http", "https":
 		return fetchConfigFromHTTP(ctx, u)
 	case "s3":
-		return fetchConfigFromS3(ctx, u)
+		return l.fetchConfigFromS3(ctx, u)
+	case "gs":
+		return l.fetchConfigFromGCS(ctx, u)
 	case "file", "":
 		return os.ReadFile(u.Path)
 	default:
@@ -157,26 +457,130 @@ func fetchConfigFromHTTP(ctx context.Context, u *url.URL) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-func fetchConfigFromS3(ctx context.Context, u *url.URL) ([]byte, error) {
+type S3Client interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// s3ConfigCacheEntry is the config fetched from S3, with the ETag of the object.
+type s3ConfigCacheEntry struct {
+	etag      string
+	content   []byte
+	checkedAt time.Time
+}
+
+func (l *ConfigLoader) fetchConfigFromS3(ctx context.Context, u *url.URL) ([]byte, error) {
 	logx.Println(ctx, "[info] fetching from", u)
 
-	awsCfg, err := defaultAWSConfig(ctx)
+	client := l.s3Client
+	if client == nil {
+		awsCfg, err := defaultAWSConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client = s3.NewFromConfig(awsCfg)
+	}
+	bucket, key := u.Host, strings.TrimLeft(u.Path, "/")
+	cacheKey := u.String()
+	l.s3CacheMu.Lock()
+	cached, ok := l.s3Cache[cacheKey]
+	l.s3CacheMu.Unlock()
+	now := flextime.Now()
+	if ok && l.cacheTTL > 0 && now.Sub(cached.checkedAt) < l.cacheTTL {
+		logx.Printf(ctx, "[debug] use cached config Bucket=%s, Key=%s, ETag=%s", bucket, key, cached.etag)
+		return cached.content, nil
+	}
+	var etag string
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return nil, err
+		logx.Printf(ctx, "[warn] failed to revalidate the config on S3, download without cache: %s", err)
+	} else {
+		etag = aws.ToString(head.ETag)
 	}
-	downloader := manager.NewDownloader(s3.NewFromConfig(awsCfg))
+	if ok && etag != "" && etag == cached.etag {
+		logx.Printf(ctx, "[debug] config is not modified Bucket=%s, Key=%s, ETag=%s", bucket, key, etag)
+		l.s3CacheMu.Lock()
+		l.s3Cache[cacheKey] = &s3ConfigCacheEntry{etag: etag, content: cached.content, checkedAt: now}
+		l.s3CacheMu.Unlock()
+		return cached.content, nil
+	}
+
+	downloader := manager.NewDownloader(client)
 	var buf manager.WriteAtBuffer
-	logx.Printf(ctx, "[debug] try download Bucket=%s, Key=%s", u.Host, u.Path)
+	logx.Printf(ctx, "[debug] try download Bucket=%s, Key=%s", bucket, key)
 	_, err = downloader.Download(ctx, &buf, &s3.GetObjectInput{
-		Bucket: aws.String(u.Host),
-		Key:    aws.String(strings.TrimLeft(u.Path, "/")),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch from S3, %s", err)
 	}
+	if etag != "" {
+		l.s3CacheMu.Lock()
+		l.s3Cache[cacheKey] = &s3ConfigCacheEntry{etag: etag, content: buf.Bytes(), checkedAt: now}
+		l.s3CacheMu.Unlock()
+	}
 	return buf.Bytes(), nil
 }
 
+// fetchConfigFromGCS downloads the object of `gs://<bucket>/<object>` with the application default credentials of Google Cloud.
+func (l *ConfigLoader) fetchConfigFromGCS(ctx context.Context, u *url.URL) ([]byte, error) {
+	logx.Println(ctx, "[info] fetching from", u)
+
+	opts := append([]option.ClientOption{option.WithScopes(storage.DevstorageReadOnlyScope)}, l.gcsOptions...)
+	svc, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create Google Cloud Storage Service: %w", err)
+	}
+	bucket, object := u.Host, strings.TrimLeft(u.Path, "/")
+	logx.Printf(ctx, "[debug] try download Bucket=%s, Object=%s", bucket, object)
+	resp, err := svc.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from GCS, %s", err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+type SecretsManagerClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// fetchConfigFromSecretsManager gets the secret value of `secretsmanager://<secret id>`, the secret id is the name or the ARN of the secret.
+func (l *ConfigLoader) fetchConfigFromSecretsManager(ctx context.Context, secretID string) ([]byte, error) {
+	logx.Println(ctx, "[info] fetching from secretsmanager://"+secretID)
+
+	client := l.secretsManagerClient
+	if client == nil {
+		awsCfg, err := defaultAWSConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client = secretsmanager.NewFromConfig(awsCfg)
+	}
+	secretID = strings.TrimSuffix(secretID, "/")
+	if secretID == "" {
+		return nil, errors.New("secret id is empty, e.g. secretsmanager://<secret id>")
+	}
+	logx.Printf(ctx, "[debug] try get secret value SecretId=%s", secretID)
+	output, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from Secrets Manager, %s", err)
+	}
+	if output.SecretString != nil {
+		return []byte(*output.SecretString), nil
+	}
+	if len(output.SecretBinary) > 0 {
+		return output.SecretBinary, nil
+	}
+	return nil, fmt.Errorf("secret `%s` is empty", secretID)
+}
+
 // Restrict restricts a configuration.
 func (cfg *Config) Restrict() error {
 	if cfg.RequiredVersion != "" {
@@ -189,9 +593,35 @@ func (cfg *Config) Restrict() error {
 	if cfg.Expiration == 0 {
 		return errors.New("expiration is required")
 	}
-	if cfg.Webhook == "" {
+	if err := restrictChangeFileFields(cfg.ChangeFileFields); err != nil {
+		return err
+	}
+	if cfg.ExpirationJitter < 0 {
+		return errors.New("expiration_jitter must be positive")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if cfg.PageTokenRefreshInterval < 0 {
+		return errors.New("page_token_refresh_interval must be positive")
+	}
+	if cfg.PageTokenRefreshInterval == 0 {
+		cfg.PageTokenRefreshInterval = DefaultPageTokenRefreshInterval
+	}
+	if cfg.SyncConcurrency < 0 {
+		return errors.New("sync_concurrency must be positive")
+	}
+	if cfg.SyncConcurrency == 0 {
+		cfg.SyncConcurrency = 1
+	}
+	if cfg.Webhook == "" && len(cfg.WebhookAddresses) == 0 {
 		log.Println("[warn] webhook is required, if run_mode is maintainer")
 	}
+	for i, address := range cfg.WebhookAddresses {
+		if address == "" {
+			return fmt.Errorf("webhook_addresses[%d]: empty address", i)
+		}
+	}
 	if cfg.Credentials == nil {
 		return errors.New("credentials does not configured")
 	}
@@ -213,6 +643,26 @@ func (cfg *Config) Restrict() error {
 	if err := cfg.Notification.Restrict(); err != nil {
 		return fmt.Errorf("notification:%w", err)
 	}
+	if cfg.Server == nil {
+		cfg.Server = &ServerConfig{}
+	}
+	if err := cfg.Server.Restrict(); err != nil {
+		return fmt.Errorf("server:%w", err)
+	}
+	if cfg.DriveAPI == nil {
+		cfg.DriveAPI = &DriveAPIConfig{}
+	}
+	if err := cfg.DriveAPI.Restrict(); err != nil {
+		return fmt.Errorf("drive_api:%w", err)
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = &MetricsConfig{
+			Type: MetricsTypeNone,
+		}
+	}
+	if err := cfg.Metrics.Restrict(); err != nil {
+		return fmt.Errorf("metrics:%w", err)
+	}
 	if cfg.DrivesAutoDetect == nil {
 		log.Println("[warn] after v0.5.0 drives_auto_ditect default value is true, but now set false")
 		value := false
@@ -223,6 +673,11 @@ func (cfg *Config) Restrict() error {
 			return fmt.Errorf("drives[%d]:%w", i, err)
 		}
 	}
+	for i, changeType := range cfg.ChangeTypes {
+		if changeType != "file" && changeType != "drive" {
+			return fmt.Errorf("change_types[%d]: `%s` is invalid change type, allowed `file` or `drive`", i, changeType)
+		}
+	}
 	return nil
 }
 
@@ -253,11 +708,16 @@ func (cfg *StorageConfig) Restrict() error {
 	if !cfg.Type.IsAStorageType() {
 		return errors.New("invalid storage type")
 	}
+	if cfg.OperationTimeout < 0 {
+		return errors.New("operation_timeout must be positive")
+	}
 	switch cfg.Type {
 	case StorageTypeDynamoDB:
 		return cfg.restrictDynamoDB()
 	case StorageTypeFile:
 		return cfg.restrictFile()
+	case StorageTypeMemory:
+		return nil
 	default:
 		return errors.New("unknown storage type")
 	}
@@ -267,6 +727,23 @@ func (cfg *StorageConfig) restrictDynamoDB() error {
 	if cfg.TableName == nil || *cfg.TableName == "" {
 		return errors.New("table_name is required, if type is DynamoDB")
 	}
+	if cfg.ScanSegments < 0 || cfg.ScanSegments > maxScanSegments {
+		return fmt.Errorf("scan_segments must be between 0 and %d", maxScanSegments)
+	}
+	switch cfg.BillingMode {
+	case "":
+		cfg.BillingMode = BillingModePayPerRequest
+	case BillingModePayPerRequest, BillingModeProvisioned:
+	default:
+		return fmt.Errorf("billing_mode: `%s` is invalid, allowed `%s` or `%s`", cfg.BillingMode, BillingModePayPerRequest, BillingModeProvisioned)
+	}
+	if cfg.BillingMode == BillingModeProvisioned {
+		if cfg.ReadCapacity <= 0 || cfg.WriteCapacity <= 0 {
+			return fmt.Errorf("read_capacity and write_capacity must be positive, if billing_mode is %s", BillingModeProvisioned)
+		}
+	} else if cfg.ReadCapacity != 0 || cfg.WriteCapacity != 0 {
+		return fmt.Errorf("read_capacity and write_capacity can be set only if billing_mode is %s", BillingModeProvisioned)
+	}
 	return nil
 }
 
@@ -277,6 +754,86 @@ func (cfg *StorageConfig) restrictFile() error {
 	if cfg.LockFile == nil || *cfg.LockFile == "" {
 		cfg.LockFile = aws.String("/tmp/gdnotify_file_storage.lock")
 	}
+	switch cfg.FileFormat {
+	case "":
+		cfg.FileFormat = FileFormatGob
+	case FileFormatGob, FileFormatJSON:
+	default:
+		return fmt.Errorf("file_format: `%s` is invalid, allowed `%s` or `%s`", cfg.FileFormat, FileFormatGob, FileFormatJSON)
+	}
+	return nil
+}
+
+// driveFileFieldNames are the names of the fields of Drive files, for validation of change_file_fields.
+var driveFileFieldNames = func() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(drive.File{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+func restrictChangeFileFields(fields []string) error {
+	for i, field := range fields {
+		// nested selectors like `owners(emailAddress)` or `capabilities/canEdit` are checked by the top level name.
+		name := field
+		if j := strings.IndexAny(field, "(/"); j >= 0 {
+			name = field[:j]
+		}
+		if !driveFileFieldNames[name] {
+			return fmt.Errorf("change_file_fields[%d]: `%s` is invalid, unknown field of Drive files", i, field)
+		}
+	}
+	return nil
+}
+
+// Restrict restricts a configuration.
+func (cfg *ServerConfig) Restrict() error {
+	switch cfg.NotificationFailure {
+	case "":
+		cfg.NotificationFailure = NotificationFailureAck
+	case NotificationFailureAck, NotificationFailureRetry:
+	default:
+		return fmt.Errorf("notification_failure: `%s` is invalid, allowed `%s` or `%s`", cfg.NotificationFailure, NotificationFailureAck, NotificationFailureRetry)
+	}
+	if cfg.MaxConcurrentWebhooks < 0 {
+		return errors.New("max_concurrent_webhooks must be positive")
+	}
+	if cfg.WebhookQueueTimeout < 0 {
+		return errors.New("webhook_queue_timeout must be positive")
+	}
+	if cfg.WebhookQueueTimeout == 0 {
+		cfg.WebhookQueueTimeout = DefaultWebhookQueueTimeout
+	}
+	if cfg.MaxDumpBytes < 0 {
+		return errors.New("max_dump_bytes must be positive")
+	}
+	if cfg.MaxDumpBytes == 0 {
+		cfg.MaxDumpBytes = DefaultMaxDumpBytes
+	}
+	if len(cfg.AllowedUserAgentPrefixes) == 0 {
+		cfg.AllowedUserAgentPrefixes = append([]string{}, DefaultAllowedUserAgentPrefixes...)
+	}
+	for _, prefix := range cfg.AllowedUserAgentPrefixes {
+		if prefix == "" {
+			return errors.New("allowed_user_agent_prefixes must not contain an empty prefix")
+		}
+	}
+	return nil
+}
+
+// Restrict restricts a configuration.
+func (cfg *MetricsConfig) Restrict() error {
+	if !cfg.Type.IsAMetricsType() {
+		return errors.New("invalid metrics type")
+	}
+	if cfg.Type == MetricsTypeEMF && (cfg.Namespace == nil || *cfg.Namespace == "") {
+		return errors.New("namespace is required, if type is EMF")
+	}
 	return nil
 }
 
@@ -285,11 +842,29 @@ func (cfg *NotificationConfig) Restrict() error {
 	if !cfg.Type.IsANotificationType() {
 		return errors.New("invalid notification type")
 	}
+	if cfg.BatchWindow < 0 {
+		return errors.New("batch_window must be positive")
+	}
+	if cfg.BatchSize < 0 {
+		return errors.New("batch_size must be positive")
+	}
+	if cfg.MaxRetries != nil && *cfg.MaxRetries < 0 {
+		return errors.New("max_retries must be positive")
+	}
+	if cfg.RetryMinDelay < 0 || cfg.RetryMaxDelay < 0 {
+		return errors.New("retry_min_delay and retry_max_delay must be positive")
+	}
 	switch cfg.Type {
 	case NotificationTypeEventBridge:
 		return cfg.restrictEventBridge()
 	case NotificationTypeFile:
 		return cfg.restrictFile()
+	case NotificationTypeMulti:
+		return cfg.restrictMulti()
+	case NotificationTypeChat:
+		return cfg.restrictChat()
+	case NotificationTypeKinesis:
+		return cfg.restrictKinesis()
 	default:
 		return errors.New("unknown notification type")
 	}
@@ -299,6 +874,51 @@ func (cfg *NotificationConfig) restrictEventBridge() error {
 	if cfg.EventBus == nil || *cfg.EventBus == "" {
 		return errors.New("event_bus is required, if type is EventBridge")
 	}
+	if cfg.SourcePrefix == nil || *cfg.SourcePrefix == "" {
+		cfg.SourcePrefix = aws.String(DefaultSourcePrefix)
+	}
+	switch cfg.EventTimeSource {
+	case "":
+		cfg.EventTimeSource = EventTimeSourceChange
+	case EventTimeSourceChange, EventTimeSourceModified:
+	default:
+		return fmt.Errorf("event_time_source: `%s` is invalid, allowed `%s` or `%s`", cfg.EventTimeSource, EventTimeSourceChange, EventTimeSourceModified)
+	}
+	if cfg.DetailTypeExpr != "" {
+		if _, err := newDetailTypeExpr(cfg.DetailTypeExpr); err != nil {
+			return fmt.Errorf("detail_type_expr: %w", err)
+		}
+	}
+	return nil
+}
+
+func (cfg *NotificationConfig) restrictChat() error {
+	if cfg.ChatWebhookURL == nil || *cfg.ChatWebhookURL == "" {
+		return errors.New("chat_webhook_url is required, if type is Chat")
+	}
+	u, err := url.Parse(*cfg.ChatWebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("chat_webhook_url must be http or https url")
+	}
+	switch cfg.ChatFormat {
+	case "":
+		cfg.ChatFormat = ChatFormatSlack
+	case ChatFormatSlack, ChatFormatTeams:
+	default:
+		return fmt.Errorf("chat_format: `%s` is invalid, allowed `%s` or `%s`", cfg.ChatFormat, ChatFormatSlack, ChatFormatTeams)
+	}
+	if cfg.ChatSummaryThreshold < 0 {
+		return errors.New("chat_summary_threshold must be positive")
+	}
+	if cfg.ChatSummaryThreshold == 0 {
+		cfg.ChatSummaryThreshold = DefaultChatSummaryThreshold
+	}
+	if cfg.ChatRateLimit < 0 {
+		return errors.New("chat_rate_limit must be positive")
+	}
+	if cfg.ChatRateLimit == 0 {
+		cfg.ChatRateLimit = DefaultChatRateLimit
+	}
 	return nil
 }
 
@@ -309,11 +929,71 @@ func (cfg *NotificationConfig) restrictFile() error {
 	return nil
 }
 
+func (cfg *NotificationConfig) restrictKinesis() error {
+	if cfg.StreamName == nil || *cfg.StreamName == "" {
+		return errors.New("stream_name is required, if type is Kinesis")
+	}
+	return nil
+}
+
+func (cfg *NotificationConfig) restrictMulti() error {
+	if len(cfg.Targets) == 0 {
+		return errors.New("targets is required, if type is Multi")
+	}
+	for i, target := range cfg.Targets {
+		if target == nil {
+			return fmt.Errorf("targets[%d]: target is empty", i)
+		}
+		if target.Type == NotificationTypeMulti {
+			return fmt.Errorf("targets[%d]: nested Multi is not supported", i)
+		}
+		if target.Type == NotificationTypeEventBridge && target.EventBus == nil {
+			target.EventBus = aws.String("default")
+		}
+		if err := target.Restrict(); err != nil {
+			return fmt.Errorf("targets[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Restrict restricts a configuration.
+func (cfg *DriveAPIConfig) Restrict() error {
+	if cfg.MaxRetries == nil {
+		cfg.MaxRetries = aws.Int(DefaultDriveAPIMaxRetries)
+	}
+	if *cfg.MaxRetries < 0 {
+		return errors.New("max_retries must be positive")
+	}
+	if cfg.RetryMinDelay < 0 || cfg.RetryMaxDelay < 0 {
+		return errors.New("retry_min_delay and retry_max_delay must be positive")
+	}
+	if cfg.RetryMinDelay == 0 {
+		cfg.RetryMinDelay = DefaultDriveAPIRetryMinDelay
+	}
+	if cfg.RetryMaxDelay == 0 {
+		cfg.RetryMaxDelay = DefaultDriveAPIRetryMaxDelay
+	}
+	if cfg.RetryMaxDelay < cfg.RetryMinDelay {
+		return errors.New("retry_max_delay must be greater than or equal to retry_min_delay")
+	}
+	if cfg.QPS < 0 || cfg.Burst < 0 {
+		return errors.New("qps and burst must be positive")
+	}
+	if cfg.Burst == 0 {
+		cfg.Burst = 1
+	}
+	return nil
+}
+
 // Restrict restricts a configuration.
 func (cfg *DriveConfig) Restrict() error {
 	if cfg.DriveID == "" {
 		return errors.New("drive_id is required")
 	}
+	if cfg.Expiration < 0 {
+		return errors.New("expiration must be positive")
+	}
 	return nil
 }
 
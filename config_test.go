@@ -1,14 +1,26 @@
 package gdnotify_test
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
 	"github.com/mashiike/gdnotify"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
 )
 
 func TestConfigLoadNoError(t *testing.T) {
@@ -63,6 +75,31 @@ func TestConfigLoadNoError(t *testing.T) {
 				require.EqualValues(t, "/gdnotify/GOOGLE_APPLICATION_CREDENTIALS", *actual.Credentials.ParameterName)
 			},
 		},
+		{
+			casename: "local",
+			paths:    []string{"testdata/local.yaml"},
+			check: func(t *testing.T, actual *gdnotify.Config) {
+				require.EqualValues(t, "https://gdnotify.example.com/", actual.Webhook)
+				require.EqualValues(t, gdnotify.StorageTypeFile, actual.Storage.Type)
+				require.EqualValues(t, "data/storage.gob", *actual.Storage.DataFile)
+				require.EqualValues(t, "/tmp/gdnotify_file_storage.lock", *actual.Storage.LockFile)
+				require.EqualValues(t, gdnotify.NotificationTypeFile, actual.Notification.Type)
+				require.EqualValues(t, "data/events.json", *actual.Notification.EventFile)
+			},
+		},
+		{
+			casename: "multi",
+			paths:    []string{"testdata/multi.yaml"},
+			check: func(t *testing.T, actual *gdnotify.Config) {
+				require.EqualValues(t, gdnotify.NotificationTypeMulti, actual.Notification.Type)
+				require.Len(t, actual.Notification.Targets, 2)
+				require.EqualValues(t, gdnotify.NotificationTypeEventBridge, actual.Notification.Targets[0].Type)
+				require.EqualValues(t, "gdnotify", *actual.Notification.Targets[0].EventBus)
+				require.EqualValues(t, gdnotify.DefaultSourcePrefix, *actual.Notification.Targets[0].SourcePrefix)
+				require.EqualValues(t, gdnotify.NotificationTypeFile, actual.Notification.Targets[1].Type)
+				require.EqualValues(t, "data/audit.json", *actual.Notification.Targets[1].EventFile)
+			},
+		},
 		{
 			casename: "short",
 			paths:    []string{"testdata/short.yaml"},
@@ -90,6 +127,161 @@ func TestConfigLoadNoError(t *testing.T) {
 	}
 }
 
+func TestConfigLoadEnv(t *testing.T) {
+	t.Setenv("GDNOTIFY_TEST_UNDEFINED_WEBHOOK", "https://gdnotify.example.com/")
+	t.Setenv("GDNOTIFY_TEST_UNDEFINED_EVENT_BUS", "")
+	cfg := gdnotify.DefaultConfig()
+	require.EqualError(t, cfg.Load(context.Background(), "testdata/undefined_env.yaml"), "notification:event_bus is required, if type is EventBridge", "must_env accepts an empty value")
+
+	t.Setenv("GDNOTIFY_TEST_UNDEFINED_EVENT_BUS", "gdnotify")
+	cfg = gdnotify.DefaultConfig()
+	require.NoError(t, cfg.Load(context.Background(), "testdata/undefined_env.yaml"))
+	require.Equal(t, "https://gdnotify.example.com/", cfg.Webhook)
+	require.Equal(t, "gdnotify", *cfg.Notification.EventBus)
+	require.Equal(t, "oss.gdnotify", *cfg.Notification.SourcePrefix)
+}
+
+type mockS3Client struct {
+	mu      sync.Mutex
+	content []byte
+	etag    string
+	heads   int
+	gets    int
+}
+
+func (c *mockS3Client) HeadObject(_ context.Context, _ *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heads++
+	return &s3.HeadObjectOutput{ETag: aws.String(c.etag), ContentLength: int64(len(c.content))}, nil
+}
+
+func (c *mockS3Client) GetObject(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets++
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(c.content)),
+		ContentLength: int64(len(c.content)),
+		ETag:          aws.String(c.etag),
+	}, nil
+}
+
+func (c *mockS3Client) put(content string, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.content = []byte(content)
+	c.etag = etag
+}
+
+func (c *mockS3Client) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.heads, c.gets
+}
+
+func TestConfigLoadFromS3Cache(t *testing.T) {
+	client := &mockS3Client{}
+	client.put("webhook: https://v1.example.com/\n", `"etag-v1"`)
+	loader := gdnotify.NewConfigLoader()
+	loader.SetS3Client(client)
+	load := func(ttl time.Duration) *gdnotify.Config {
+		t.Helper()
+		cfg := gdnotify.DefaultConfig()
+		loader.SetCacheTTL(ttl)
+		require.NoError(t, loader.Load(context.Background(), cfg, "s3://gdnotify-config/TestConfigLoadFromS3Cache.yaml"))
+		return cfg
+	}
+
+	require.Equal(t, "https://v1.example.com/", load(0).Webhook)
+	heads, gets := client.counts()
+	require.Equal(t, 1, heads)
+	require.Equal(t, 1, gets)
+
+	require.Equal(t, "https://v1.example.com/", load(0).Webhook)
+	heads, gets = client.counts()
+	require.Equal(t, 2, heads, "revalidated by the ETag")
+	require.Equal(t, 1, gets, "not downloaded again while the ETag is unchanged")
+
+	client.put("webhook: https://v2.example.com/\n", `"etag-v2"`)
+	require.Equal(t, "https://v2.example.com/", load(0).Webhook)
+	heads, gets = client.counts()
+	require.Equal(t, 3, heads)
+	require.Equal(t, 2, gets, "downloaded again when the ETag is changed")
+
+	client.put("webhook: https://v3.example.com/\n", `"etag-v3"`)
+	require.Equal(t, "https://v2.example.com/", load(time.Hour).Webhook, "cached config is used within the cache TTL")
+	heads, gets = client.counts()
+	require.Equal(t, 3, heads)
+	require.Equal(t, 2, gets)
+}
+
+func TestConfigLoadFromGCS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b/gdnotify-config/o/gdnotify/config.yaml" || r.URL.Query().Get("alt") != "media" {
+			http.Error(w, "not found: "+r.URL.String(), http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "webhook: https://gcs.example.com/\n")
+	}))
+	defer server.Close()
+	loader := gdnotify.NewConfigLoader()
+	loader.SetGCSClientOptions(option.WithEndpoint(server.URL+"/"), option.WithoutAuthentication())
+	load := func(path string) (*gdnotify.Config, error) {
+		cfg := gdnotify.DefaultConfig()
+		return cfg, loader.Load(context.Background(), cfg, path)
+	}
+
+	cfg, err := load("gs://gdnotify-config/gdnotify/config.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "https://gcs.example.com/", cfg.Webhook)
+
+	_, err = load("gs://gdnotify-config/missing.yaml")
+	require.ErrorContains(t, err, "gs://gdnotify-config/missing.yaml load failed: failed to fetch from GCS")
+}
+
+type mockSecretsManagerClient struct {
+	secrets   map[string]string
+	secretIDs []string
+}
+
+func (c *mockSecretsManagerClient) GetSecretValue(_ context.Context, params *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	c.secretIDs = append(c.secretIDs, *params.SecretId)
+	value, ok := c.secrets[*params.SecretId]
+	if !ok {
+		return nil, &smtypes.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+	}
+	return &secretsmanager.GetSecretValueOutput{Name: params.SecretId, SecretString: aws.String(value)}, nil
+}
+
+func TestConfigLoadFromSecretsManager(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:gdnotify/config-AbCdEf"
+	client := &mockSecretsManagerClient{
+		secrets: map[string]string{
+			"gdnotify/config": "webhook: https://secrets.example.com/\n",
+			arn:               "webhook: https://arn.example.com/\n",
+		},
+	}
+	loader := gdnotify.NewConfigLoader()
+	loader.SetSecretsManagerClient(client)
+	load := func(path string) (*gdnotify.Config, error) {
+		cfg := gdnotify.DefaultConfig()
+		return cfg, loader.Load(context.Background(), cfg, path)
+	}
+
+	cfg, err := load("secretsmanager://gdnotify/config")
+	require.NoError(t, err)
+	require.Equal(t, "https://secrets.example.com/", cfg.Webhook)
+
+	cfg, err = load("secretsmanager://" + arn)
+	require.NoError(t, err)
+	require.Equal(t, "https://arn.example.com/", cfg.Webhook)
+
+	_, err = load("secretsmanager://gdnotify/missing")
+	require.ErrorContains(t, err, "secretsmanager://gdnotify/missing load failed: failed to fetch from Secrets Manager")
+	require.Equal(t, []string{"gdnotify/config", arn, "gdnotify/missing"}, client.secretIDs)
+}
+
 func TestConfigLoadInvalid(t *testing.T) {
 	server := httptest.NewServer(http.NotFoundHandler())
 	defer server.Close()
@@ -108,6 +300,31 @@ func TestConfigLoadInvalid(t *testing.T) {
 			paths:    []string{"testdata/invalid_notification_type.yaml"},
 			expected: "testdata/invalid_notification_type.yaml load failed: parse failed: Hoge does not belong to NotificationType values",
 		},
+		{
+			casename: "kinesis_without_stream_name",
+			paths:    []string{"testdata/kinesis_without_stream_name.yaml"},
+			expected: "notification:stream_name is required, if type is Kinesis",
+		},
+		{
+			casename: "invalid_change_types",
+			paths:    []string{"testdata/invalid_change_types.yaml"},
+			expected: "change_types[1]: `hoge` is invalid change type, allowed `file` or `drive`",
+		},
+		{
+			casename: "invalid_change_file_fields",
+			paths:    []string{"testdata/invalid_change_file_fields.yaml"},
+			expected: "change_file_fields[2]: `hoge` is invalid, unknown field of Drive files",
+		},
+		{
+			casename: "undefined_env",
+			paths:    []string{"testdata/undefined_env.yaml"},
+			expected: "testdata/undefined_env.yaml load failed: environment variables are not set: GDNOTIFY_TEST_UNDEFINED_WEBHOOK (line 3), GDNOTIFY_TEST_UNDEFINED_EVENT_BUS (line 8)",
+		},
+		{
+			casename: "unsupported scheme",
+			paths:    []string{"ftp://example.com/config.yaml"},
+			expected: "ftp://example.com/config.yaml load failed: scheme ftp is not supported",
+		},
 		{
 			casename: "can not load from http",
 			paths:    []string{"testdata/short.yaml", server.URL},
@@ -126,3 +343,169 @@ func TestConfigLoadInvalid(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigValidateVersion(t *testing.T) {
+	cases := []struct {
+		version  string
+		expected string
+	}{
+		{
+			version: "v0.5.0",
+		},
+		{
+			version: "v0.4.0-1-gxxxxxxx",
+		},
+		{
+			version:  "v0.3.2",
+			expected: "version v0.3.2 does not satisfy constraints required_version: >=0.4.0",
+		},
+		{
+			version: "current",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.version, func(t *testing.T) {
+			cfg := gdnotify.DefaultConfig()
+			cfg.RequiredVersion = ">=0.4.0"
+			require.NoError(t, cfg.Restrict())
+			err := cfg.ValidateVersion(c.version)
+			if c.expected == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, c.expected)
+			}
+		})
+	}
+}
+
+func TestConfigLoaderRequiredVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("required_version: \">=0.4.0\"\nwebhook: https://gdnotify.example.com/\n"), 0o600))
+	cases := []struct {
+		version  string
+		expected string
+	}{
+		{
+			version: "v0.5.0",
+		},
+		{
+			version:  "v0.3.2",
+			expected: "version v0.3.2 does not satisfy constraints required_version: >=0.4.0",
+		},
+		{
+			version: "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.version, func(t *testing.T) {
+			loader := gdnotify.NewConfigLoader()
+			loader.SetVersion(c.version)
+			cfg := gdnotify.DefaultConfig()
+			err := loader.Load(context.Background(), cfg, path)
+			if c.expected == "" {
+				require.NoError(t, err)
+				require.Equal(t, "https://gdnotify.example.com/", cfg.Webhook)
+			} else {
+				require.EqualError(t, err, c.expected, "the binary older than required_version is rejected on start and reload")
+			}
+		})
+	}
+}
+
+func TestStorageConfigRestrictBillingMode(t *testing.T) {
+	cases := []struct {
+		casename string
+		cfg      gdnotify.StorageConfig
+		expected string
+	}{
+		{
+			casename: "default",
+		},
+		{
+			casename: "provisioned",
+			cfg:      gdnotify.StorageConfig{BillingMode: gdnotify.BillingModeProvisioned, ReadCapacity: 5, WriteCapacity: 10},
+		},
+		{
+			casename: "provisioned without capacity",
+			cfg:      gdnotify.StorageConfig{BillingMode: gdnotify.BillingModeProvisioned, ReadCapacity: 5},
+			expected: "read_capacity and write_capacity must be positive, if billing_mode is PROVISIONED",
+		},
+		{
+			casename: "capacity with pay per request",
+			cfg:      gdnotify.StorageConfig{BillingMode: gdnotify.BillingModePayPerRequest, WriteCapacity: 10},
+			expected: "read_capacity and write_capacity can be set only if billing_mode is PROVISIONED",
+		},
+		{
+			casename: "invalid",
+			cfg:      gdnotify.StorageConfig{BillingMode: "ON_DEMAND"},
+			expected: "billing_mode: `ON_DEMAND` is invalid, allowed `PAY_PER_REQUEST` or `PROVISIONED`",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			cfg := c.cfg
+			cfg.Type = gdnotify.StorageTypeDynamoDB
+			cfg.TableName = aws.String("gdnotify")
+			err := cfg.Restrict()
+			if c.expected == "" {
+				require.NoError(t, err)
+				require.NotEmpty(t, cfg.BillingMode)
+			} else {
+				require.EqualError(t, err, c.expected)
+			}
+		})
+	}
+}
+
+func TestNotificationConfigRestrictEventTimeSource(t *testing.T) {
+	cfg := &gdnotify.NotificationConfig{
+		Type:     gdnotify.NotificationTypeEventBridge,
+		EventBus: aws.String("default"),
+	}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, gdnotify.EventTimeSourceChange, cfg.EventTimeSource)
+
+	cfg.EventTimeSource = "created"
+	require.EqualError(t, cfg.Restrict(), "event_time_source: `created` is invalid, allowed `change` or `modified`")
+}
+
+func TestNotificationConfigRestrictDetailTypeExpr(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected string
+	}{
+		{expr: `detail.change.file.mimeType.startsWith("image/") ? "Image Changed" : detailType`},
+		{expr: `detail.change.fileId`},
+		{expr: `detail.change.fileId ==`, expected: "detail_type_expr: ERROR: <input>:1:24: Syntax error: mismatched input '<EOF>' expecting"},
+		{expr: `size(detailType)`, expected: "detail_type_expr: must return string, but returns int"},
+		{expr: `unknown`, expected: "detail_type_expr: ERROR: <input>:1:1: undeclared reference to 'unknown'"},
+	}
+	for _, c := range cases {
+		t.Run(c.expr, func(t *testing.T) {
+			cfg := &gdnotify.NotificationConfig{
+				Type:           gdnotify.NotificationTypeEventBridge,
+				EventBus:       aws.String("default"),
+				DetailTypeExpr: c.expr,
+			}
+			err := cfg.Restrict()
+			if c.expected == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.expected)
+		})
+	}
+}
+
+func TestConfigWriteSummary(t *testing.T) {
+	cfg := gdnotify.DefaultConfig()
+	require.NoError(t, cfg.Load(context.Background(), "testdata/multi.yaml"))
+	require.NoError(t, cfg.ValidateVersion("v0.5.0"))
+	var buf bytes.Buffer
+	require.NoError(t, cfg.WriteSummary(&buf))
+	actual := buf.String()
+	require.True(t, strings.HasPrefix(actual, "config is valid\n"), actual)
+	require.Regexp(t, `\| Notification\s+\| Multi \(EventBridge, File\)\s+\|`, actual)
+	require.Regexp(t, `\| Storage\s+\| DynamoDB\s+\|`, actual)
+}
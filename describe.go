@@ -0,0 +1,101 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+	"github.com/olekukonko/tablewriter"
+)
+
+// ChannelDescription is the detail of a notification channel with the live status on Google Drive.
+type ChannelDescription struct {
+	*ListItem
+	LastMessageNumber int64 `json:"lastMessageNumber"`
+	// CurrentStartPageToken is the start page token of the drive now, empty if it can not be fetched.
+	CurrentStartPageToken string `json:"currentStartPageToken"`
+	// PageTokenDrift is CurrentStartPageToken minus the stored page token, nil if they are not comparable.
+	PageTokenDrift *int64 `json:"pageTokenDrift"`
+}
+
+// DescribeChannel returns the detail of the channel, ErrChannelNotFound if the channel is not in the storage.
+func (app *App) DescribeChannel(ctx context.Context, channelID string) (*ChannelDescription, error) {
+	item, err := app.storage.FindOneByChannelID(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	desc := &ChannelDescription{
+		ListItem:          newListItem(item, app.driveName(ctx, item.DriveID)),
+		LastMessageNumber: item.LastMessageNumber,
+	}
+	if item.FileID != "" {
+		// files:watch channels do not have a page token.
+		return desc, nil
+	}
+	token, err := app.getStartPageToken(ctx, item.DriveID)
+	if err != nil {
+		logx.Printf(ctx, "[warn] get current start page token drive_id=%s failed: %s", item.DriveID, err.Error())
+		return desc, nil
+	}
+	desc.CurrentStartPageToken = token
+	current, currentErr := strconv.ParseInt(token, 10, 64)
+	stored, storedErr := strconv.ParseInt(item.PageToken, 10, 64)
+	if currentErr == nil && storedErr == nil {
+		drift := current - stored
+		desc.PageTokenDrift = &drift
+	}
+	return desc, nil
+}
+
+// WriteChannelDescription writes the detail of the channel to w, format is `table` (default) or `json`.
+func (app *App) WriteChannelDescription(ctx context.Context, w io.Writer, channelID string, format string) error {
+	switch format {
+	case ListFormatTable, ListFormatJSON, "":
+	default:
+		return fmt.Errorf("unknown describe_channel format `%s`", format)
+	}
+	desc, err := app.DescribeChannel(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("describe channel: %w", err)
+	}
+	if format == ListFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(desc)
+	}
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	drift := ""
+	if desc.PageTokenDrift != nil {
+		drift = strconv.FormatInt(*desc.PageTokenDrift, 10)
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Name", "Value"})
+	table.AppendBulk([][]string{
+		{"Channel ID", desc.ChannelID},
+		{"Drive ID", desc.DriveID},
+		{"Drive Name", desc.DriveName},
+		{"File ID", desc.FileID},
+		{"Resource ID", desc.ResourceID},
+		{"Webhook Address", desc.WebhookAddress},
+		{"Expiration", formatTime(desc.Expiration)},
+		{"Page Token", desc.PageToken},
+		{"Current Start Page Token", desc.CurrentStartPageToken},
+		{"Page Token Drift", drift},
+		{"Last Message Number", strconv.FormatInt(desc.LastMessageNumber, 10)},
+		{"Last Change At", formatTime(desc.LastChangeAt)},
+		{"Start Page Token Fetched At", formatTime(desc.PageTokenFetchedAt)},
+		{"Created At", formatTime(desc.CreatedAt)},
+		{"Updated At", formatTime(desc.UpdatedAt)},
+	})
+	table.Render()
+	return nil
+}
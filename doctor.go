@@ -0,0 +1,279 @@
+package gdnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// EventBusDescriber is the client to check the event bus exists, for the doctor command.
+type EventBusDescriber interface {
+	DescribeEventBus(ctx context.Context, params *eventbridge.DescribeEventBusInput, optFns ...func(*eventbridge.Options)) (*eventbridge.DescribeEventBusOutput, error)
+}
+
+// DoctorOptions is the options of Config.Doctor.
+type DoctorOptions struct {
+	// DynamoDBClient is the client to check the table of DynamoDB storage, created from the default AWS config if nil.
+	DynamoDBClient DynamoDBClient
+	// EventBusDescriber is the client to check the event buses of EventBridge notification, created from the default AWS config if nil.
+	EventBusDescriber EventBusDescriber
+	// GCPOptions is the client options of Google Drive API.
+	GCPOptions []option.ClientOption
+}
+
+type doctorStatus string
+
+const (
+	doctorStatusPass doctorStatus = "PASS"
+	doctorStatusFail doctorStatus = "FAIL"
+	doctorStatusSkip doctorStatus = "SKIP"
+)
+
+type doctorCheck struct {
+	name    string
+	status  doctorStatus
+	message string
+	hint    string
+}
+
+func (c *doctorCheck) writeTo(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", c.status, c.name, c.message); err != nil {
+		return err
+	}
+	if c.status != doctorStatusFail || c.hint == "" {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "       hint: %s\n", c.hint)
+	return err
+}
+
+// Doctor checks the environment of the loaded config and writes the checklist with remediation hints to w, for the doctor command.
+// It does not create App, so neither channels nor the DynamoDB table are created. It returns an error if any check fails.
+func (cfg *Config) Doctor(ctx context.Context, w io.Writer, optFns ...func(*DoctorOptions)) error {
+	opts := &DoctorOptions{}
+	for _, optFn := range optFns {
+		optFn(opts)
+	}
+	awsCfg, awsCheck := cfg.doctorAWSConfig(ctx)
+	awsOK := awsCheck.status != doctorStatusFail
+	checks := []*doctorCheck{
+		awsCheck,
+		cfg.doctorStorage(ctx, awsCfg, awsOK, opts.DynamoDBClient),
+		cfg.doctorDrive(ctx, awsCfg, opts.GCPOptions...),
+		cfg.doctorWebhook(),
+		cfg.doctorEventBus(ctx, awsCfg, awsOK, opts.EventBusDescriber),
+	}
+	failed := 0
+	for _, check := range checks {
+		if check.status == doctorStatusFail {
+			failed++
+		}
+		if err := check.writeTo(w); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("doctor found %d problem(s)", failed)
+	}
+	return nil
+}
+
+func (cfg *Config) usesAWS() bool {
+	return cfg.Storage.Type == StorageTypeDynamoDB ||
+		cfg.Credentials.BackendType == CredentialsBackendTypeSSMParameterStore ||
+		len(notificationConfigsOf(cfg.Notification, NotificationTypeEventBridge)) > 0 ||
+		len(notificationConfigsOf(cfg.Notification, NotificationTypeKinesis)) > 0
+}
+
+// notificationConfigsOf returns the notification config of the type, or the targets of the type if Multi.
+func notificationConfigsOf(cfg *NotificationConfig, notificationType NotificationType) []*NotificationConfig {
+	switch cfg.Type {
+	case notificationType:
+		return []*NotificationConfig{cfg}
+	case NotificationTypeMulti:
+		configs := make([]*NotificationConfig, 0, len(cfg.Targets))
+		for _, target := range cfg.Targets {
+			configs = append(configs, notificationConfigsOf(target, notificationType)...)
+		}
+		return configs
+	}
+	return nil
+}
+
+func (cfg *Config) doctorAWSConfig(ctx context.Context) (aws.Config, *doctorCheck) {
+	check := &doctorCheck{name: "AWS config"}
+	if !cfg.usesAWS() {
+		check.status = doctorStatusSkip
+		check.message = "neither DynamoDB, EventBridge, Kinesis nor SSM Parameter Store is used"
+		return *aws.NewConfig(), check
+	}
+	awsCfg, err := defaultAWSConfig(ctx)
+	if err != nil {
+		check.status = doctorStatusFail
+		check.message = err.Error()
+		check.hint = "check AWS_PROFILE, AWS_CONFIG_FILE and AWS_SHARED_CREDENTIALS_FILE, and that the profile exists"
+		return awsCfg, check
+	}
+	if awsCfg.Region == "" {
+		check.status = doctorStatusFail
+		check.message = "region is not set"
+		check.hint = "set AWS_REGION or AWS_DEFAULT_REGION, or the region of the profile"
+		return awsCfg, check
+	}
+	check.status = doctorStatusPass
+	check.message = "region=" + awsCfg.Region
+	return awsCfg, check
+}
+
+func (cfg *Config) doctorStorage(ctx context.Context, awsCfg aws.Config, awsOK bool, client DynamoDBClient) *doctorCheck {
+	check := &doctorCheck{name: "Storage"}
+	switch cfg.Storage.Type {
+	case StorageTypeDynamoDB:
+		if !awsOK {
+			check.status = doctorStatusSkip
+			check.message = "AWS config is not loaded"
+			return check
+		}
+		if client == nil {
+			client = dynamodb.NewFromConfig(awsCfg)
+		}
+		tableName := *cfg.Storage.TableName
+		table, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(tableName),
+		})
+		if err != nil {
+			if !isResourceNotFound(err) {
+				check.status = doctorStatusFail
+				check.message = fmt.Sprintf("describe dynamodb table `%s`: %s", tableName, err.Error())
+				check.hint = "check the network to the DynamoDB endpoint and that dynamodb:DescribeTable is allowed"
+				return check
+			}
+			if cfg.Storage.AutoCreate == nil || *cfg.Storage.AutoCreate {
+				check.status = doctorStatusPass
+				check.message = fmt.Sprintf("dynamodb table `%s` does not exist, it will be created on start", tableName)
+				return check
+			}
+			check.status = doctorStatusFail
+			check.message = fmt.Sprintf("dynamodb table `%s` does not exist", tableName)
+			check.hint = "create the table, or set storage.auto_create to true"
+			return check
+		}
+		check.status = doctorStatusPass
+		check.message = fmt.Sprintf("dynamodb table `%s` is %s", tableName, table.Table.TableStatus)
+	case StorageTypeFile:
+		dir := filepath.Dir(*cfg.Storage.DataFile)
+		if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+			check.status = doctorStatusFail
+			check.message = fmt.Sprintf("directory of data_file `%s` does not exist", dir)
+			check.hint = "create the directory, or change storage.data_file"
+			return check
+		}
+		check.status = doctorStatusPass
+		check.message = fmt.Sprintf("data_file `%s`", *cfg.Storage.DataFile)
+	default:
+		check.status = doctorStatusPass
+		check.message = cfg.Storage.Type.String()
+	}
+	return check
+}
+
+func (cfg *Config) doctorDrive(ctx context.Context, awsCfg aws.Config, gcpOpts ...option.ClientOption) *doctorCheck {
+	check := &doctorCheck{name: "Google Drive"}
+	driveSvc, err := newDriveService(ctx, cfg, awsCfg, gcpOpts...)
+	if err != nil {
+		check.status = doctorStatusFail
+		check.message = err.Error()
+		check.hint = "set GOOGLE_APPLICATION_CREDENTIALS, or check the credentials backend config"
+		return check
+	}
+	about, err := driveSvc.About.Get().Fields("user").Context(ctx).Do()
+	if err != nil {
+		check.status = doctorStatusFail
+		check.message = "about.get: " + err.Error()
+		check.hint = "check the credentials are valid and the Google Drive API is enabled in the project of the credentials"
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && (gerr.Code == 401 || gerr.Code == 403) {
+			check.hint = "check the credentials are valid and have the drive scope, and the Google Drive API is enabled in the project of the credentials"
+		}
+		return check
+	}
+	check.status = doctorStatusPass
+	check.message = "about.get succeeded"
+	if about.User != nil && about.User.EmailAddress != "" {
+		check.message += " as " + about.User.EmailAddress
+	}
+	return check
+}
+
+func (cfg *Config) doctorWebhook() *doctorCheck {
+	check := &doctorCheck{name: "Webhook address"}
+	addresses := webhookAddresses(cfg)
+	if len(addresses) == 0 {
+		check.status = doctorStatusFail
+		check.message = "webhook address is not set"
+		check.hint = "set webhook or webhook_addresses to the https URL of the webhook server, e.g. the Lambda Function URL"
+		return check
+	}
+	for _, address := range addresses {
+		if !strings.HasPrefix(address, "https://") {
+			check.status = doctorStatusFail
+			check.message = fmt.Sprintf("webhook address `%s` is not https", address)
+			check.hint = "Google Drive sends notifications only to https addresses with a valid certificate"
+			return check
+		}
+	}
+	check.status = doctorStatusPass
+	check.message = strings.Join(addresses, ", ")
+	return check
+}
+
+func (cfg *Config) doctorEventBus(ctx context.Context, awsCfg aws.Config, awsOK bool, client EventBusDescriber) *doctorCheck {
+	check := &doctorCheck{name: "Event bus"}
+	configs := notificationConfigsOf(cfg.Notification, NotificationTypeEventBridge)
+	if len(configs) == 0 {
+		check.status = doctorStatusSkip
+		check.message = "notification is not EventBridge"
+		return check
+	}
+	if !awsOK {
+		check.status = doctorStatusSkip
+		check.message = "AWS config is not loaded"
+		return check
+	}
+	if client == nil {
+		client = eventbridge.NewFromConfig(awsCfg)
+	}
+	eventBuses := make([]string, 0, len(configs))
+	for _, notificationCfg := range configs {
+		eventBus := *notificationCfg.EventBus
+		if _, err := client.DescribeEventBus(ctx, &eventbridge.DescribeEventBusInput{
+			Name: aws.String(eventBus),
+		}); err != nil {
+			check.status = doctorStatusFail
+			var notFound *types.ResourceNotFoundException
+			if errors.As(err, &notFound) {
+				check.message = fmt.Sprintf("event bus `%s` does not exist", eventBus)
+				check.hint = "create the event bus, or change notification.event_bus"
+				return check
+			}
+			check.message = fmt.Sprintf("describe event bus `%s`: %s", eventBus, err.Error())
+			check.hint = "check the network to the EventBridge endpoint and that events:DescribeEventBus is allowed"
+			return check
+		}
+		eventBuses = append(eventBuses, eventBus)
+	}
+	check.status = doctorStatusPass
+	check.message = strings.Join(eventBuses, ", ")
+	return check
+}
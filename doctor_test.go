@@ -0,0 +1,223 @@
+package gdnotify_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/mashiike/gdnotify"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+type mockEventBusDescriber struct {
+	eventBuses map[string]bool
+	err        error
+}
+
+func (c *mockEventBusDescriber) DescribeEventBus(_ context.Context, params *eventbridge.DescribeEventBusInput, _ ...func(*eventbridge.Options)) (*eventbridge.DescribeEventBusOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if !c.eventBuses[*params.Name] {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("Event bus " + *params.Name + " does not exist.")}
+	}
+	return &eventbridge.DescribeEventBusOutput{Name: params.Name}, nil
+}
+
+func TestConfigDoctor(t *testing.T) {
+	cases := []struct {
+		name     string
+		setup    func(t *testing.T, cfg *gdnotify.Config, f *fakeDrive, dynamoDB *mockDynamoDBClient, eventBus *mockEventBusDescriber)
+		expected []string
+		problems int
+	}{
+		{
+			name: "all pass",
+			expected: []string{
+				"[PASS] AWS config: region=ap-northeast-1\n",
+				"[PASS] Storage: dynamodb table `gdnotify` is ACTIVE\n",
+				"[PASS] Google Drive: about.get succeeded as gdnotify@example.com\n",
+				"[PASS] Webhook address: https://gdnotify.example.com/\n",
+				"[PASS] Event bus: default\n",
+			},
+		},
+		{
+			name: "aws config not loaded",
+			setup: func(t *testing.T, _ *gdnotify.Config, _ *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				configFile := filepath.Join(t.TempDir(), "aws_config")
+				require.NoError(t, os.WriteFile(configFile, []byte("[default\nregion = ap-northeast-1\n"), 0o600))
+				t.Setenv("AWS_CONFIG_FILE", configFile)
+			},
+			expected: []string{
+				"[FAIL] AWS config: ",
+				"       hint: check AWS_PROFILE, AWS_CONFIG_FILE and AWS_SHARED_CREDENTIALS_FILE, and that the profile exists\n",
+				"[SKIP] Storage: AWS config is not loaded\n",
+				"[SKIP] Event bus: AWS config is not loaded\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "aws region not set",
+			setup: func(t *testing.T, _ *gdnotify.Config, _ *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				t.Setenv("AWS_REGION", "")
+				t.Setenv("AWS_DEFAULT_REGION", "")
+			},
+			expected: []string{
+				"[FAIL] AWS config: region is not set\n",
+				"       hint: set AWS_REGION or AWS_DEFAULT_REGION, or the region of the profile\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "dynamodb table not found",
+			setup: func(_ *testing.T, cfg *gdnotify.Config, _ *fakeDrive, dynamoDB *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				cfg.Storage.AutoCreate = aws.Bool(false)
+				dynamoDB.tableExists = false
+			},
+			expected: []string{
+				"[FAIL] Storage: dynamodb table `gdnotify` does not exist\n",
+				"       hint: create the table, or set storage.auto_create to true\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "dynamodb table created on start",
+			setup: func(_ *testing.T, _ *gdnotify.Config, _ *fakeDrive, dynamoDB *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				dynamoDB.tableExists = false
+			},
+			expected: []string{
+				"[PASS] Storage: dynamodb table `gdnotify` does not exist, it will be created on start\n",
+			},
+		},
+		{
+			name: "file storage directory not found",
+			setup: func(t *testing.T, cfg *gdnotify.Config, _ *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				dir := filepath.Join(t.TempDir(), "missing")
+				cfg.Storage = &gdnotify.StorageConfig{
+					Type:     gdnotify.StorageTypeFile,
+					DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+				}
+			},
+			expected: []string{
+				"[FAIL] Storage: directory of data_file `",
+				"       hint: create the directory, or change storage.data_file\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "drive about.get forbidden",
+			setup: func(_ *testing.T, _ *gdnotify.Config, f *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				f.failures = map[string][]int{"/about": {http.StatusForbidden}}
+			},
+			expected: []string{
+				"[FAIL] Google Drive: about.get: ",
+				"       hint: check the credentials are valid and have the drive scope, and the Google Drive API is enabled in the project of the credentials\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "webhook address not set",
+			setup: func(_ *testing.T, cfg *gdnotify.Config, _ *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				cfg.Webhook = ""
+			},
+			expected: []string{
+				"[FAIL] Webhook address: webhook address is not set\n",
+				"       hint: set webhook or webhook_addresses to the https URL of the webhook server, e.g. the Lambda Function URL\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "event bus not found",
+			setup: func(_ *testing.T, cfg *gdnotify.Config, _ *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				cfg.Notification.EventBus = aws.String("missing")
+			},
+			expected: []string{
+				"[FAIL] Event bus: event bus `missing` does not exist\n",
+				"       hint: create the event bus, or change notification.event_bus\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "event bus access denied",
+			setup: func(_ *testing.T, _ *gdnotify.Config, _ *fakeDrive, _ *mockDynamoDBClient, eventBus *mockEventBusDescriber) {
+				eventBus.err = errors.New("AccessDeniedException")
+			},
+			expected: []string{
+				"[FAIL] Event bus: describe event bus `default`: AccessDeniedException\n",
+				"       hint: check the network to the EventBridge endpoint and that events:DescribeEventBus is allowed\n",
+			},
+			problems: 1,
+		},
+		{
+			name: "multiple problems",
+			setup: func(_ *testing.T, cfg *gdnotify.Config, f *fakeDrive, _ *mockDynamoDBClient, _ *mockEventBusDescriber) {
+				cfg.Webhook = ""
+				f.failures = map[string][]int{"/about": {http.StatusForbidden}}
+			},
+			expected: []string{
+				"[FAIL] Google Drive: about.get: ",
+				"[FAIL] Webhook address: webhook address is not set\n",
+			},
+			problems: 2,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "aws_config"))
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "aws_credentials"))
+			t.Setenv("AWS_PROFILE", "")
+			t.Setenv("AWS_REGION", "ap-northeast-1")
+			t.Setenv("AWS_DEFAULT_REGION", "ap-northeast-1")
+			f := newFakeDrive()
+			server := httptest.NewServer(f)
+			t.Cleanup(server.Close)
+			dynamoDB := newMockDynamoDBClient()
+			eventBus := &mockEventBusDescriber{eventBuses: map[string]bool{"default": true}}
+			cfg := gdnotify.DefaultConfig()
+			cfg.Webhook = "https://gdnotify.example.com/"
+			cfg.Storage = &gdnotify.StorageConfig{
+				Type:      gdnotify.StorageTypeDynamoDB,
+				TableName: aws.String("gdnotify"),
+			}
+			cfg.Notification = &gdnotify.NotificationConfig{
+				Type:     gdnotify.NotificationTypeEventBridge,
+				EventBus: aws.String("default"),
+			}
+			if c.setup != nil {
+				c.setup(t, cfg, f, dynamoDB, eventBus)
+			}
+			require.NoError(t, cfg.Restrict())
+			var buf bytes.Buffer
+			err := cfg.Doctor(context.Background(), &buf, func(opts *gdnotify.DoctorOptions) {
+				opts.DynamoDBClient = dynamoDB
+				opts.EventBusDescriber = eventBus
+				opts.GCPOptions = []option.ClientOption{
+					option.WithEndpoint(server.URL + "/"),
+					option.WithoutAuthentication(),
+				}
+			})
+			actual := buf.String()
+			t.Log(actual)
+			for _, expected := range c.expected {
+				require.Contains(t, actual, expected)
+			}
+			if c.problems == 0 {
+				require.NoError(t, err)
+				require.NotContains(t, actual, "[FAIL]")
+				return
+			}
+			require.EqualError(t, err, fmt.Sprintf("doctor found %d problem(s)", c.problems))
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	logx "github.com/mashiike/go-logx"
+)
+
+// ExportChannels writes all channels in the storage to w as newline-delimited JSON.
+// The output does not depend on the storage backend, so it can be used as a backup or for migration.
+func (app *App) ExportChannels(ctx context.Context, w io.Writer) error {
+	itemsCh, err := app.storage.FindAllChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("find all channels: %w", err)
+	}
+	encoder := json.NewEncoder(w)
+	var exported int
+	for items := range itemsCh {
+		for _, item := range items {
+			if err := encoder.Encode(item); err != nil {
+				return fmt.Errorf("encode channel_id=%s: %w", item.ChannelID, err)
+			}
+			exported++
+		}
+	}
+	logx.Printf(ctx, "[info] exported %d channels", exported)
+	return nil
+}
+
+// ImportChannels reads newline-delimited JSON written by ExportChannels from r, and saves the channels to the storage.
+// Channels that already exist in the storage are overwritten.
+func (app *App) ImportChannels(ctx context.Context, r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	var imported int
+	for i := 1; ; i++ {
+		var item ChannelItem
+		if err := decoder.Decode(&item); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("decode channel[%d]: %w", i, err)
+		}
+		if item.ChannelID == "" {
+			return fmt.Errorf("channel[%d]: channel id is empty", i)
+		}
+		if app.dryRun {
+			logx.Printf(ctx, "[notice] [dry-run] import channel channel_id=%s, drive_id=%s", item.ChannelID, item.DriveID)
+			continue
+		}
+		err := app.storage.SaveChannel(ctx, &item)
+		if errors.Is(err, ErrChannelAlreadyExists) {
+			// DynamoDB and Memory storages do not overwrite on save.
+			logx.Printf(ctx, "[debug] overwrite channel_id=%s", item.ChannelID)
+			if err = app.storage.DeleteChannel(ctx, &item); err == nil {
+				err = app.storage.SaveChannel(ctx, &item)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("save channel_id=%s: %w", item.ChannelID, err)
+		}
+		logx.Printf(ctx, "[debug] imported channel_id=%s, drive_id=%s", item.ChannelID, item.DriveID)
+		imported++
+	}
+	logx.Printf(ctx, "[info] imported %d channels", imported)
+	return nil
+}
@@ -0,0 +1,47 @@
+package gdnotify
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+var NewEventBridgeNotificationWithClient = newEventBridgeNotification
+
+var NewKinesisNotificationWithClient = newKinesisNotification
+
+var NewDynamoDBStorageWithClient = newDynamoDBStorage
+
+var IsRetryable = isRetryable
+
+func (n *EventBridgeNotification) SetAccount(accountID, region string) {
+	n.accountID = accountID
+	n.region = region
+}
+
+func (app *App) SetupRoute() http.Handler {
+	return app.setupRoute()
+}
+
+func (app *App) RecordOrphanChannel(ctx context.Context, channelID, resourceID string) {
+	app.recordOrphanChannel(ctx, channelID, resourceID)
+}
+
+func (app *App) OrphanChannels() int {
+	app.orphanMu.Lock()
+	defer app.orphanMu.Unlock()
+	return len(app.orphanChannels)
+}
+
+func (app *App) SetStorage(storage Storage) {
+	app.storage = storage
+	app.watchTableRecreated(storage)
+}
+
+func (app *App) SetDryRun(dryRun bool) {
+	app.dryRun = dryRun
+}
+
+func (s *FileStorage) StoreWith(ctx context.Context, encode func(io.Writer) error) error {
+	return s.storeWith(ctx, encode)
+}
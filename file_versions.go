@@ -0,0 +1,76 @@
+package gdnotify
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	logx "github.com/mashiike/go-logx"
+	"github.com/samber/lo"
+	"google.golang.org/api/drive/v3"
+)
+
+// maxFileVersions is the number of files whose last seen version is kept for suppress_version_noops.
+const maxFileVersions = 10000
+
+// fileVersionCache is a LRU cache of the last seen version per file id.
+type fileVersionCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type fileVersionEntry struct {
+	fileID  string
+	version int64
+}
+
+func newFileVersionCache(capacity int) *fileVersionCache {
+	return &fileVersionCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// observe records the version of the file, and reports whether it is newer than the last seen one.
+// A file not seen yet is regarded as newer.
+func (c *fileVersionCache) observe(fileID string, version int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[fileID]; ok {
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*fileVersionEntry)
+		if version <= entry.version {
+			return false
+		}
+		entry.version = version
+		return true
+	}
+	c.entries[fileID] = c.order.PushFront(&fileVersionEntry{fileID: fileID, version: version})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*fileVersionEntry).fileID)
+	}
+	return true
+}
+
+// filterVersionNoops drops file changes whose version is not increased since the last seen change of the file,
+// e.g. metadata touches like viewedByMeTime. The versions are kept in memory, so the first change of a file after start is passed through.
+func (app *App) filterVersionNoops(ctx context.Context, settings *appSettings, changes []*drive.Change) []*drive.Change {
+	if !settings.suppressVersionNoops {
+		return changes
+	}
+	return lo.Filter(changes, func(change *drive.Change, _ int) bool {
+		if change.Removed || change.File == nil || change.File.Version <= 0 {
+			return true
+		}
+		if app.fileVersions.observe(change.File.Id, change.File.Version) {
+			return true
+		}
+		logx.Printf(ctx, "[info] filterd version noop changes item: id=%s version=%d", change.File.Id, change.File.Version)
+		return false
+	})
+}
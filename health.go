@@ -0,0 +1,83 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+)
+
+const readinessTimeout = 3 * time.Second
+
+type readinessResponse struct {
+	Status   string            `json:"status"`
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// degradedReporter is implemented by the storages which can lose their backend at runtime.
+type degradedReporter interface {
+	Degraded() error
+}
+
+// handleHealth is a liveness check, it always returns 200 while the process is serving.
+// With deep=1, it returns 503 while the storage is degraded, e.g. the DynamoDB table is lost and could not be recreated.
+func (app *App) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("deep") == "1" {
+		if d, ok := app.storage.(degradedReporter); ok {
+			if err := d.Degraded(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(&readinessResponse{Status: "degraded", Failures: map[string]string{"storage": err.Error()}})
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&readinessResponse{Status: "ok"})
+}
+
+// handleReady is a readiness check, it probes the Drive API and the storage.
+func (app *App) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	failures := make(map[string]string)
+	var wg sync.WaitGroup
+	probe := func(name string, fn func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx); err != nil {
+				logx.Printf(ctx, "[warn] readiness probe `%s` failed: %s", name, err.Error())
+				mu.Lock()
+				failures[name] = err.Error()
+				mu.Unlock()
+			}
+		}()
+	}
+	probe("drive", func(ctx context.Context) error {
+		_, err := app.driveSvc.Drives.List().PageSize(1).Context(ctx).Do()
+		return err
+	})
+	probe("storage", func(ctx context.Context) error {
+		itemsCh, err := app.storage.FindAllChannels(ctx)
+		if err != nil {
+			return err
+		}
+		for range itemsCh {
+		}
+		return nil
+	})
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&readinessResponse{Status: "unavailable", Failures: failures})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&readinessResponse{Status: "ok"})
+}
@@ -0,0 +1,39 @@
+package gdnotify
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+)
+
+// LogSampler is an io.Writer for the log package, it drops a fraction of `[debug]` log records.
+// The other levels are always written.
+type LogSampler struct {
+	w    io.Writer
+	rate float64
+}
+
+// NewLogSampler returns a LogSampler that writes the debug log records to w at the rate,
+// 1 or more writes all of them, 0 or less drops all of them.
+func NewLogSampler(w io.Writer, rate float64) *LogSampler {
+	return &LogSampler{
+		w:    w,
+		rate: rate,
+	}
+}
+
+func (s *LogSampler) Write(p []byte) (int, error) {
+	if s.rate < 1 && isDebugLog(p) && (s.rate <= 0 || rand.Float64() >= s.rate) {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+// isDebugLog reports whether the first [level] of the record is debug, as logutils.LevelFilter parses it.
+func isDebugLog(p []byte) bool {
+	x := bytes.IndexByte(p, '[')
+	if x < 0 {
+		return false
+	}
+	return bytes.HasPrefix(p[x:], []byte("[debug]"))
+}
@@ -0,0 +1,55 @@
+package gdnotify_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mashiike/gdnotify"
+	"github.com/stretchr/testify/require"
+)
+
+type countingWriter struct {
+	counts map[string]int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	level := string(p[bytes.IndexByte(p, '[')+1 : bytes.IndexByte(p, ']')])
+	w.counts[level]++
+	return len(p), nil
+}
+
+func TestLogSampler(t *testing.T) {
+	cases := []struct {
+		rate     float64
+		expected int
+		delta    float64
+	}{
+		{rate: 1, expected: 10000},
+		{rate: 0.1, expected: 1000, delta: 200},
+		{rate: 0.5, expected: 5000, delta: 300},
+		{rate: 0, expected: 0},
+	}
+	for _, c := range cases {
+		w := &countingWriter{counts: make(map[string]int)}
+		logger := log.New(gdnotify.NewLogSampler(w, c.rate), "", log.LstdFlags)
+		for i := 0; i < 10000; i++ {
+			for _, level := range []string{"debug", "info", "notice", "warn", "error"} {
+				logger.Printf("[%s] message %d", level, i)
+			}
+		}
+		require.InDelta(t, c.expected, w.counts["debug"], c.delta, "rate=%v", c.rate)
+		for _, level := range []string{"info", "notice", "warn", "error"} {
+			require.Equal(t, 10000, w.counts[level], "rate=%v level=%s", c.rate, level)
+		}
+	}
+}
+
+func TestLogSamplerMultiLine(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(gdnotify.NewLogSampler(&buf, 0), "", 0)
+	logger.Println("[debug] receive request\n", "POST / HTTP/1.1\n[info] in body")
+	logger.Println("request_id=xxx [warn] prefixed")
+	require.Equal(t, "request_id=xxx [warn] prefixed", strings.TrimSpace(buf.String()))
+}
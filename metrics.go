@@ -0,0 +1,125 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	logx "github.com/mashiike/go-logx"
+)
+
+// MetricsRecorder records operational metrics of gdnotify.
+type MetricsRecorder interface {
+	IncrChannelsCreated(ctx context.Context, driveID string)
+	IncrChannelsRotated(ctx context.Context, driveID string)
+	IncrChannelRotationFailures(ctx context.Context, driveID string)
+	ObserveChangesProcessed(ctx context.Context, driveID string, count int)
+	ObserveChangesForwarded(ctx context.Context, driveID string, count int)
+	IncrWebhooksReceived(ctx context.Context, state string)
+	IncrNotificationErrors(ctx context.Context, driveID string)
+	ObserveSyncDuration(ctx context.Context, driveID string, d time.Duration)
+}
+
+func NewMetricsRecorder(cfg *MetricsConfig) (MetricsRecorder, error) {
+	switch cfg.Type {
+	case MetricsTypeNone:
+		return NopMetricsRecorder{}, nil
+	case MetricsTypeEMF:
+		return NewEMFMetricsRecorder(*cfg.Namespace, os.Stdout), nil
+	case MetricsTypePrometheus:
+		return NewPrometheusMetricsRecorder(), nil
+	}
+	return nil, fmt.Errorf("unknown metrics type `%s`", cfg.Type)
+}
+
+// NopMetricsRecorder discards all metrics.
+type NopMetricsRecorder struct{}
+
+func (NopMetricsRecorder) IncrChannelsCreated(context.Context, string)                {}
+func (NopMetricsRecorder) IncrChannelsRotated(context.Context, string)                {}
+func (NopMetricsRecorder) IncrChannelRotationFailures(context.Context, string)        {}
+func (NopMetricsRecorder) ObserveChangesProcessed(context.Context, string, int)       {}
+func (NopMetricsRecorder) ObserveChangesForwarded(context.Context, string, int)       {}
+func (NopMetricsRecorder) IncrWebhooksReceived(context.Context, string)               {}
+func (NopMetricsRecorder) IncrNotificationErrors(context.Context, string)             {}
+func (NopMetricsRecorder) ObserveSyncDuration(context.Context, string, time.Duration) {}
+
+// EMFMetricsRecorder writes metrics in CloudWatch Embedded Metric Format.
+// On AWS Lambda, the lines written to stdout are extracted as CloudWatch metrics.
+type EMFMetricsRecorder struct {
+	mu        sync.Mutex
+	w         io.Writer
+	namespace string
+}
+
+func NewEMFMetricsRecorder(namespace string, w io.Writer) *EMFMetricsRecorder {
+	return &EMFMetricsRecorder{
+		w:         w,
+		namespace: namespace,
+	}
+}
+
+func (r *EMFMetricsRecorder) IncrChannelsCreated(ctx context.Context, driveID string) {
+	r.put(ctx, driveID, "ChannelsCreated", 1, "Count")
+}
+
+func (r *EMFMetricsRecorder) IncrChannelsRotated(ctx context.Context, driveID string) {
+	r.put(ctx, driveID, "ChannelsRotated", 1, "Count")
+}
+
+func (r *EMFMetricsRecorder) IncrChannelRotationFailures(ctx context.Context, driveID string) {
+	r.put(ctx, driveID, "ChannelRotationFailures", 1, "Count")
+}
+
+func (r *EMFMetricsRecorder) ObserveChangesProcessed(ctx context.Context, driveID string, count int) {
+	r.put(ctx, driveID, "ChangesProcessed", count, "Count")
+}
+
+func (r *EMFMetricsRecorder) ObserveChangesForwarded(ctx context.Context, driveID string, count int) {
+	r.put(ctx, driveID, "ChangesForwarded", count, "Count")
+}
+
+func (r *EMFMetricsRecorder) IncrWebhooksReceived(ctx context.Context, _ string) {
+	r.put(ctx, "-", "WebhooksReceived", 1, "Count")
+}
+
+func (r *EMFMetricsRecorder) IncrNotificationErrors(ctx context.Context, driveID string) {
+	r.put(ctx, driveID, "NotificationErrors", 1, "Count")
+}
+
+func (r *EMFMetricsRecorder) ObserveSyncDuration(ctx context.Context, driveID string, d time.Duration) {
+	r.put(ctx, driveID, "SyncDuration", d.Milliseconds(), "Milliseconds")
+}
+
+func (r *EMFMetricsRecorder) put(ctx context.Context, driveID string, name string, value interface{}, unit string) {
+	bs, err := json.Marshal(map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": flextime.Now().UnixMilli(),
+			"CloudWatchMetrics": []interface{}{
+				map[string]interface{}{
+					"Namespace":  r.namespace,
+					"Dimensions": [][]string{{"DriveID"}},
+					"Metrics": []interface{}{
+						map[string]string{"Name": name, "Unit": unit},
+					},
+				},
+			},
+		},
+		"DriveID": driveID,
+		name:      value,
+	})
+	if err != nil {
+		logx.Printf(ctx, "[warn] failed marshal metrics `%s`: %s", name, err.Error())
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := fmt.Fprintln(r.w, string(bs)); err != nil {
+		logx.Printf(ctx, "[warn] failed write metrics `%s`: %s", name, err.Error())
+	}
+}
@@ -0,0 +1,188 @@
+package gdnotify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// DefaultSyncDurationBuckets are upper bounds in seconds of the sync duration histogram.
+var DefaultSyncDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// PrometheusMetricsRecorder keeps metrics in memory and exposes them in the Prometheus text exposition format.
+type PrometheusMetricsRecorder struct {
+	mu             sync.Mutex
+	counters       map[string]map[string]float64
+	activeChannels map[string]int
+	buckets        []float64
+	syncs          map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+const (
+	metricChannelsCreated         = "gdnotify_channels_created_total"
+	metricChannelsRotated         = "gdnotify_channels_rotated_total"
+	metricChannelRotationFailures = "gdnotify_channel_rotation_failures_total"
+	metricChangesProcessed        = "gdnotify_changes_processed_total"
+	metricChangesForwarded        = "gdnotify_changes_forwarded_total"
+	metricWebhooksReceived        = "gdnotify_webhooks_received_total"
+	metricNotificationErrors      = "gdnotify_notification_errors_total"
+	metricActiveChannels          = "gdnotify_active_channels"
+	metricSyncDuration            = "gdnotify_sync_duration_seconds"
+)
+
+var metricHelps = map[string]string{
+	metricChannelsCreated:         "Number of notification channels created.",
+	metricChannelsRotated:         "Number of notification channels rotated.",
+	metricChannelRotationFailures: "Number of notification channels that failed to rotate.",
+	metricChangesProcessed:        "Number of changes fetched from Google Drive.",
+	metricChangesForwarded:        "Number of changes sent to the notification.",
+	metricWebhooksReceived:        "Number of push notifications received from Google.",
+	metricNotificationErrors:      "Number of failed notifications.",
+	metricActiveChannels:          "Number of notification channels in the storage.",
+	metricSyncDuration:            "Duration from fetching changes to sending notifications per drive.",
+}
+
+func NewPrometheusMetricsRecorder() *PrometheusMetricsRecorder {
+	return &PrometheusMetricsRecorder{
+		counters: make(map[string]map[string]float64),
+		buckets:  DefaultSyncDurationBuckets,
+		syncs:    make(map[string]*histogram),
+	}
+}
+
+func (r *PrometheusMetricsRecorder) IncrChannelsCreated(_ context.Context, driveID string) {
+	r.add(metricChannelsCreated, driveID, 1)
+}
+
+func (r *PrometheusMetricsRecorder) IncrChannelsRotated(_ context.Context, driveID string) {
+	r.add(metricChannelsRotated, driveID, 1)
+}
+
+func (r *PrometheusMetricsRecorder) IncrChannelRotationFailures(_ context.Context, driveID string) {
+	r.add(metricChannelRotationFailures, driveID, 1)
+}
+
+func (r *PrometheusMetricsRecorder) ObserveChangesProcessed(_ context.Context, driveID string, count int) {
+	r.add(metricChangesProcessed, driveID, float64(count))
+}
+
+func (r *PrometheusMetricsRecorder) ObserveChangesForwarded(_ context.Context, driveID string, count int) {
+	r.add(metricChangesForwarded, driveID, float64(count))
+}
+
+func (r *PrometheusMetricsRecorder) IncrWebhooksReceived(_ context.Context, state string) {
+	r.add(metricWebhooksReceived, state, 1)
+}
+
+// SetActiveChannels replaces the active channels gauge with the number of channels per drive.
+func (r *PrometheusMetricsRecorder) SetActiveChannels(counts map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activeChannels = counts
+}
+
+func (r *PrometheusMetricsRecorder) IncrNotificationErrors(_ context.Context, driveID string) {
+	r.add(metricNotificationErrors, driveID, 1)
+}
+
+func (r *PrometheusMetricsRecorder) ObserveSyncDuration(_ context.Context, driveID string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.syncs[driveID]
+	if !ok {
+		h = &histogram{
+			counts: make([]uint64, len(r.buckets)),
+		}
+		r.syncs[driveID] = h
+	}
+	v := d.Seconds()
+	for i, le := range r.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (r *PrometheusMetricsRecorder) add(name string, labelValue string, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values, ok := r.counters[name]
+	if !ok {
+		values = make(map[string]float64)
+		r.counters[name] = values
+	}
+	values[labelValue] += v
+}
+
+func (r *PrometheusMetricsRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	r.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *PrometheusMetricsRecorder) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	for _, name := range sortedKeys(r.counters) {
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, metricHelps[name])
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		label := "drive_id"
+		if name == metricWebhooksReceived {
+			label = "state"
+		}
+		values := r.counters[name]
+		for _, labelValue := range sortedKeys(values) {
+			fmt.Fprintf(&b, "%s{%s=%q} %s\n", name, label, labelValue, formatFloat(values[labelValue]))
+		}
+	}
+	if r.activeChannels != nil {
+		fmt.Fprintf(&b, "# HELP %s %s\n", metricActiveChannels, metricHelps[metricActiveChannels])
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", metricActiveChannels)
+		for _, driveID := range sortedKeys(r.activeChannels) {
+			fmt.Fprintf(&b, "%s{drive_id=%q} %d\n", metricActiveChannels, driveID, r.activeChannels[driveID])
+		}
+	}
+	if len(r.syncs) > 0 {
+		fmt.Fprintf(&b, "# HELP %s %s\n", metricSyncDuration, metricHelps[metricSyncDuration])
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", metricSyncDuration)
+		for _, driveID := range sortedKeys(r.syncs) {
+			h := r.syncs[driveID]
+			for i, le := range r.buckets {
+				fmt.Fprintf(&b, "%s_bucket{drive_id=%q,le=%q} %d\n", metricSyncDuration, driveID, formatFloat(le), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{drive_id=%q,le=\"+Inf\"} %d\n", metricSyncDuration, driveID, h.count)
+			fmt.Fprintf(&b, "%s_sum{drive_id=%q} %s\n", metricSyncDuration, driveID, formatFloat(h.sum))
+			fmt.Fprintf(&b, "%s_count{drive_id=%q} %d\n", metricSyncDuration, driveID, h.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := lo.Keys(m)
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,55 @@
+package gdnotify_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/mashiike/gdnotify"
+	"github.com/sebdah/goldie/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEMFMetricsRecorder(t *testing.T) {
+	restore := flextime.Fix(time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	var buf bytes.Buffer
+	r := gdnotify.NewEMFMetricsRecorder("gdnotify", &buf)
+	r.ObserveChangesProcessed(context.Background(), "drive1", 3)
+
+	require.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1655251200000,
+			"CloudWatchMetrics": [
+				{
+					"Namespace": "gdnotify",
+					"Dimensions": [["DriveID"]],
+					"Metrics": [{"Name": "ChangesProcessed", "Unit": "Count"}]
+				}
+			]
+		},
+		"DriveID": "drive1",
+		"ChangesProcessed": 3
+	}`, buf.String())
+}
+
+func TestPrometheusMetricsRecorder(t *testing.T) {
+	g := goldie.New(t,
+		goldie.WithFixtureDir("./testdata/golden"),
+	)
+	ctx := context.Background()
+	r := gdnotify.NewPrometheusMetricsRecorder()
+	r.IncrChannelsCreated(ctx, "drive1")
+	r.IncrChannelsCreated(ctx, "drive2")
+	r.ObserveChangesProcessed(ctx, "drive1", 3)
+	r.ObserveSyncDuration(ctx, "drive1", 300*time.Millisecond)
+	r.ObserveSyncDuration(ctx, "drive1", 3*time.Second)
+	r.ObserveSyncDuration(ctx, "drive2", 50*time.Millisecond)
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	g.Assert(t, "prometheus_metrics", buf.Bytes())
+}
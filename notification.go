@@ -5,15 +5,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Songmu/flextime"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
 	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	logx "github.com/mashiike/go-logx"
 	"github.com/samber/lo"
+	"github.com/shogo82148/go-retry"
 	"google.golang.org/api/drive/v3"
 )
 
@@ -21,12 +26,107 @@ type Notification interface {
 	SendChanges(context.Context, *ChannelItem, []*drive.Change) error
 }
 
+// LifecycleNotification is implemented by Notifications that can deliver notification channel lifecycle events.
+type LifecycleNotification interface {
+	SendLifecycleEvent(context.Context, *LifecycleEvent) error
+}
+
+// DeferredNotification is implemented by Notifications that send changes after SendChanges returns, like BatchingNotification.
+// AfterSent calls fn after the changes of the channel passed to SendChanges so far are sent, or at once with ctx if none of them are pending.
+// fn is not called if the pending changes are dropped.
+type DeferredNotification interface {
+	AfterSent(ctx context.Context, channelID string, fn func(context.Context) error) error
+}
+
+const (
+	LifecycleEventKind = "gdnotify#lifecycleEvent"
+
+	DetailTypeChannelCreated        = "Channel Created"
+	DetailTypeChannelRotated        = "Channel Rotated"
+	DetailTypeChannelDeleted        = "Channel Deleted"
+	DetailTypeChannelRotationFailed = "Channel Rotation Failed"
+)
+
+// LifecycleEvent describes what happened to a notification channel, e.g. a rotation failure that leaves the drive unmonitored.
+type LifecycleEvent struct {
+	Kind              string    `json:"kind"`
+	Type              string    `json:"type"`
+	Subject           string    `json:"subject"`
+	ChannelID         string    `json:"channelId"`
+	ResourceID        string    `json:"resourceId"`
+	DriveID           string    `json:"driveId"`
+	FileID            string    `json:"fileId,omitempty"`
+	PreviousChannelID string    `json:"previousChannelId,omitempty"`
+	Error             string    `json:"error,omitempty"`
+	Time              time.Time `json:"time"`
+}
+
+func NewLifecycleEvent(eventType string, item *ChannelItem, cause error) *LifecycleEvent {
+	e := &LifecycleEvent{
+		Kind:       LifecycleEventKind,
+		Type:       eventType,
+		ChannelID:  item.ChannelID,
+		ResourceID: item.ResourceID,
+		DriveID:    item.DriveID,
+		FileID:     item.FileID,
+		Time:       flextime.Now(),
+	}
+	if cause != nil {
+		e.Error = cause.Error()
+	}
+	switch eventType {
+	case DetailTypeChannelCreated:
+		e.Subject = fmt.Sprintf("Channel %s for DriveId %s is created, expires at %s", item.ChannelID, item.DriveID, item.Expiration.Format(time.RFC3339))
+	case DetailTypeChannelDeleted:
+		e.Subject = fmt.Sprintf("Channel %s for DriveId %s is deleted", item.ChannelID, item.DriveID)
+	case DetailTypeChannelRotationFailed:
+		e.Subject = fmt.Sprintf("Channel %s for DriveId %s failed to rotate, drive is unmonitored after %s", item.ChannelID, item.DriveID, item.Expiration.Format(time.RFC3339))
+	default:
+		e.Subject = fmt.Sprintf("Channel %s for DriveId %s: %s", item.ChannelID, item.DriveID, eventType)
+	}
+	return e
+}
+
+// NewChannelRotatedEvent returns the `Channel Rotated` lifecycle event, that the old channel is replaced by the new one.
+func NewChannelRotatedEvent(oldItem, newItem *ChannelItem) *LifecycleEvent {
+	e := NewLifecycleEvent(DetailTypeChannelRotated, newItem, nil)
+	e.PreviousChannelID = oldItem.ChannelID
+	e.Subject = fmt.Sprintf("Channel %s for DriveId %s is rotated to %s, expires at %s", oldItem.ChannelID, newItem.DriveID, newItem.ChannelID, newItem.Expiration.Format(time.RFC3339))
+	return e
+}
+
 func NewNotification(ctx context.Context, cfg *NotificationConfig, awsCfg aws.Config) (Notification, func() error, error) {
+	n, cleanup, err := newNotification(ctx, cfg, awsCfg)
+	if err != nil || cfg.BatchWindow <= 0 {
+		return n, cleanup, err
+	}
+	if isLambda() {
+		logx.Println(ctx, "[info] batch_window on AWS Lambda, pending changes are sent at a later invocation after the window")
+	}
+	bn := NewBatchingNotification(n, cfg.BatchWindow, cfg.BatchSize)
+	return bn, func() error {
+		err := bn.Close()
+		if cleanup != nil {
+			if cleanupErr := cleanup(); cleanupErr != nil {
+				return cleanupErr
+			}
+		}
+		return err
+	}, nil
+}
+
+func newNotification(ctx context.Context, cfg *NotificationConfig, awsCfg aws.Config) (Notification, func() error, error) {
 	switch cfg.Type {
 	case NotificationTypeEventBridge:
 		return NewEventBridgeNotification(ctx, cfg, awsCfg)
 	case NotificationTypeFile:
 		return NewFileNotification(ctx, cfg)
+	case NotificationTypeMulti:
+		return NewMultiNotification(ctx, cfg, awsCfg)
+	case NotificationTypeChat:
+		return NewChatNotification(ctx, cfg)
+	case NotificationTypeKinesis:
+		return NewKinesisNotification(ctx, cfg, awsCfg)
 	}
 	return nil, nil, errors.New("unknown storage type")
 }
@@ -36,29 +136,100 @@ type EventBridgeClient interface {
 }
 
 type EventBridgeNotification struct {
-	client   EventBridgeClient
-	eventBus string
+	client                 EventBridgeClient
+	eventBus               string
+	sourcePrefix           string
+	accountID              string
+	region                 string
+	includeChannelMetadata bool
+	eventTimeSource        string
+	detailTypeExpr         *detailTypeExpr
+
+	retryPolicy *retry.Policy
 }
 
 func NewEventBridgeNotification(ctx context.Context, cfg *NotificationConfig, awsCfg aws.Config) (Notification, func() error, error) {
-	n := &EventBridgeNotification{
-		client:   eventbridge.NewFromConfig(awsCfg),
-		eventBus: *cfg.EventBus,
+	n := newEventBridgeNotification(cfg, eventbridge.NewFromConfig(awsCfg))
+	if cfg.IncludeAccountInSource {
+		output, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("get caller identity: %w", err)
+		}
+		n.accountID = *output.Account
+		n.region = awsCfg.Region
+		logx.Printf(ctx, "[debug] event source includes account_id=%s region=%s", n.accountID, n.region)
 	}
 	return n, nil, nil
 }
 
+func newEventBridgeNotification(cfg *NotificationConfig, client EventBridgeClient) *EventBridgeNotification {
+	n := &EventBridgeNotification{
+		client:                 client,
+		eventBus:               *cfg.EventBus,
+		sourcePrefix:           DefaultSourcePrefix,
+		includeChannelMetadata: cfg.IncludeChannelMetadata,
+		eventTimeSource:        coalesce(cfg.EventTimeSource, EventTimeSourceChange),
+		retryPolicy:            newNotificationRetryPolicy(cfg),
+	}
+	if cfg.SourcePrefix != nil && *cfg.SourcePrefix != "" {
+		n.sourcePrefix = strings.TrimSuffix(*cfg.SourcePrefix, "/")
+	}
+	if cfg.DetailTypeExpr != "" {
+		expr, err := newDetailTypeExpr(cfg.DetailTypeExpr)
+		if err != nil {
+			// validated by Restrict, the built-in detail-type is used.
+			log.Printf("[warn] detail_type_expr is ignored: %s", err.Error())
+		}
+		n.detailTypeExpr = expr
+	}
+	return n
+}
+
+// newNotificationRetryPolicy returns the retry policy of the entries failed with retryable errors, by max_retries, retry_min_delay and retry_max_delay.
+func newNotificationRetryPolicy(cfg *NotificationConfig) *retry.Policy {
+	policy := &retry.Policy{
+		MinDelay: cfg.RetryMinDelay,
+		MaxDelay: cfg.RetryMaxDelay,
+		MaxCount: DefaultNotificationMaxRetries + 1,
+	}
+	if cfg.MaxRetries != nil {
+		policy.MaxCount = *cfg.MaxRetries + 1
+	}
+	if policy.MinDelay == 0 {
+		policy.MinDelay = 100 * time.Millisecond
+	}
+	if policy.MaxDelay == 0 {
+		policy.MaxDelay = 5 * time.Second
+	}
+	return policy
+}
+
+func (n *EventBridgeNotification) eventSource(item *ChannelItem) string {
+	if n.accountID != "" {
+		return fmt.Sprintf("%s/%s/%s/%s", n.sourcePrefix, n.accountID, n.region, item.DriveID)
+	}
+	return fmt.Sprintf("%s/%s", n.sourcePrefix, item.DriveID)
+}
+
 type TargetEntity struct {
 	Id          string `json:"id"`
 	Kind        string `json:"kind"`
 	Name        string `json:"name"`
 	CreatedTime string `json:"createdTime"`
+	// WebViewLink and IconLink are of files, empty if they are not requested.
+	WebViewLink string `json:"webViewLink,omitempty"`
+	IconLink    string `json:"iconLink,omitempty"`
 }
 type ChangeEventDetail struct {
 	Subject string        `json:"subject"`
 	Entity  *TargetEntity `json:"entity"`
 	Actor   *drive.User   `json:"actor"`
 	Change  *drive.Change `json:"change"`
+
+	// channel metadata, populated only if include_channel_metadata is enabled.
+	ChannelID  string `json:"channelId,omitempty"`
+	ResourceID string `json:"resourceId,omitempty"`
+	DriveID    string `json:"driveId,omitempty"`
 }
 
 const (
@@ -70,6 +241,14 @@ const (
 )
 
 func (e *ChangeEventDetail) MarshalJSON() ([]byte, error) {
+	e.complete()
+	type NoMethod ChangeEventDetail
+	data := NoMethod(*e)
+	return json.Marshal(data)
+}
+
+// complete fills Subject, Actor and Entity from Change.
+func (e *ChangeEventDetail) complete() {
 	switch e.DetailType() {
 	case DetailTypeFileRemoved:
 		e.Subject = fmt.Sprintf("FileID %s was removed at %s", e.Change.FileId, e.Change.Time)
@@ -137,6 +316,8 @@ func (e *ChangeEventDetail) MarshalJSON() ([]byte, error) {
 			Kind:        e.Change.File.Kind,
 			Name:        e.Change.File.Name,
 			CreatedTime: e.Change.File.CreatedTime,
+			WebViewLink: e.Change.File.WebViewLink,
+			IconLink:    e.Change.File.IconLink,
 		}
 	case e.Change.DriveId != "":
 		e.Entity = &TargetEntity{
@@ -149,9 +330,6 @@ func (e *ChangeEventDetail) MarshalJSON() ([]byte, error) {
 			Kind: "drive#file",
 		}
 	}
-	type NoMethod ChangeEventDetail
-	data := NoMethod(*e)
-	return json.Marshal(data)
 }
 
 func (e *ChangeEventDetail) DetailType() string {
@@ -187,18 +365,31 @@ func (e *ChangeEventDetail) Source(sourcePrefix string) string {
 	}
 }
 
-func (n *EventBridgeNotification) SendChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
-	sourcePrefix := fmt.Sprintf("oss.gdnotify/%s", item.DriveID)
-	entriesChunk := lo.Chunk(lo.Map(changes, func(c *drive.Change, _ int) types.PutEventsRequestEntry {
+// eventTime returns the timestamp of the change selected by event_time_source.
+func (n *EventBridgeNotification) eventTime(c *drive.Change) string {
+	if n.eventTimeSource == EventTimeSourceModified && c.File != nil && c.File.ModifiedTime != "" {
+		return c.File.ModifiedTime
+	}
+	return c.Time
+}
 
-		t, err := time.Parse(time.RFC3339Nano, c.Time)
+func (n *EventBridgeNotification) SendChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	sourcePrefix := n.eventSource(item)
+	entries := lo.Map(changes, func(c *drive.Change, _ int) types.PutEventsRequestEntry {
+		eventTime := n.eventTime(c)
+		t, err := time.Parse(time.RFC3339Nano, eventTime)
 		if err != nil {
-			logx.Printf(ctx, "[warn] time Parse failed `%s`: %s", c.Time, err.Error())
+			logx.Printf(ctx, "[warn] time Parse failed `%s`: %s", eventTime, err.Error())
 			t = flextime.Now()
 		}
 		ced := &ChangeEventDetail{
 			Change: c,
 		}
+		if n.includeChannelMetadata {
+			ced.ChannelID = item.ChannelID
+			ced.ResourceID = item.ResourceID
+			ced.DriveID = item.DriveID
+		}
 		bs, err := json.Marshal(ced)
 		if err != nil {
 			logx.Printf(ctx, "[warn] change marshal failed: %s", err.Error())
@@ -207,6 +398,9 @@ func (n *EventBridgeNotification) SendChanges(ctx context.Context, item *Channel
 		detail := string(bs)
 		source := ced.Source(sourcePrefix)
 		detailType := ced.DetailType()
+		if n.detailTypeExpr != nil {
+			detailType = n.detailTypeExpr.DetailType(ctx, ced, bs)
+		}
 		logx.Printf(ctx, "[debug] event source=%s, detail-type=%s detail: %s", source, detailType, detail)
 		return types.PutEventsRequestEntry{
 			EventBusName: aws.String(n.eventBus),
@@ -216,33 +410,109 @@ func (n *EventBridgeNotification) SendChanges(ctx context.Context, item *Channel
 			Time:         aws.Time(t),
 			Detail:       aws.String(detail),
 		}
-	}), 10)
+	})
+	return putInBatches(ctx, "put events", n.retryPolicy, entries, eventBridgeMaxEntries, n.putEvents)
+}
+
+// eventBridgeMaxEntries is the max number of entries of a PutEvents request.
+const eventBridgeMaxEntries = 10
+
+func (n *EventBridgeNotification) putEvents(ctx context.Context, entries []types.PutEventsRequestEntry) ([]batchEntryResult, error) {
+	output, err := n.client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: entries,
+	})
+	if err != nil {
+		logx.Printf(ctx, "[error] PutEvents failed: %s", err.Error())
+		return nil, err
+	}
+	results := make([]batchEntryResult, 0, len(output.Entries))
+	for i, entry := range output.Entries {
+		if entry.ErrorCode != nil {
+			logx.Printf(ctx, "[error] put event to %s error_code=%s, error_message=%s detail=%s", n.eventBus, *entry.ErrorCode, aws.ToString(entry.ErrorMessage), *entries[i].Detail)
+		} else if entry.EventId != nil {
+			logx.Printf(ctx, "[info] put event to %s event_id=%s", n.eventBus, *entry.EventId)
+		}
+		results = append(results, batchEntryResult{errorCode: aws.ToString(entry.ErrorCode), errorMessage: aws.ToString(entry.ErrorMessage)})
+	}
+	return results, nil
+}
+
+// batchEntryResult is the result of an entry of a batch put request, errorCode is empty if the entry succeeded.
+type batchEntryResult struct {
+	errorCode    string
+	errorMessage string
+}
+
+// putInBatches puts entries by put in batches of batchSize, and re-submits only the entries failed with retryable errors with exponential backoff.
+// name is used in the errors of the failed entries, e.g. `put events`.
+func putInBatches[T any](ctx context.Context, name string, policy *retry.Policy, entries []T, batchSize int, put func(context.Context, []T) ([]batchEntryResult, error)) error {
 	var lastErr error
-	for _, entries := range entriesChunk {
-		output, err := n.client.PutEvents(ctx, &eventbridge.PutEventsInput{
-			Entries: entries,
-		})
+	for _, batch := range lo.Chunk(entries, batchSize) {
+		if err := putWithRetry(ctx, name, policy, batch, put); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func putWithRetry[T any](ctx context.Context, name string, policy *retry.Policy, entries []T, put func(context.Context, []T) ([]batchEntryResult, error)) error {
+	retrier := policy.Start(ctx)
+	pending := entries
+	var lastErr, permanentErr error
+	for retrier.Continue() {
+		results, err := put(ctx, pending)
 		if err != nil {
-			logx.Printf(ctx, "[error] PutEvents failed: %s", err.Error())
 			lastErr = err
+			if !isRetryable(err) {
+				return err
+			}
 			continue
 		}
-		for i, entry := range output.Entries {
-			if entry.ErrorCode != nil {
-				logx.Printf(ctx, "[error] put event to %s error_code=%s, error_message=%s detail=%s", n.eventBus, *entry.ErrorCode, *entry.ErrorMessage, *entries[i].Detail)
-				lastErr = fmt.Errorf("put events failed error_code=%s, error_message=%s", *entry.ErrorCode, *entry.ErrorMessage)
+		failed := make([]T, 0)
+		for i, result := range results {
+			if result.errorCode == "" {
 				continue
 			}
-			if entry.EventId != nil {
-				logx.Printf(ctx, "[info] put event to %s event_id=%s", n.eventBus, *entry.EventId)
-				continue
+			err := fmt.Errorf("%s failed error_code=%s, error_message=%s", name, result.errorCode, result.errorMessage)
+			if isRetryableErrorCode(result.errorCode) {
+				failed = append(failed, pending[i])
+				lastErr = err
+			} else {
+				permanentErr = err
 			}
 		}
+		if len(failed) == 0 {
+			return permanentErr
+		}
+		logx.Printf(ctx, "[warn] retry %s of %d entries", name, len(failed))
+		pending = failed
+	}
+	if permanentErr != nil {
+		return permanentErr
 	}
 	return lastErr
 }
 
+func (n *EventBridgeNotification) SendLifecycleEvent(ctx context.Context, e *LifecycleEvent) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("lifecycle event marshal: %w", err)
+	}
+	source := fmt.Sprintf("%s/channel/%s", n.eventSource(&ChannelItem{DriveID: e.DriveID}), e.ChannelID)
+	logx.Printf(ctx, "[debug] event source=%s, detail-type=%s detail: %s", source, e.Type, string(bs))
+	entry := types.PutEventsRequestEntry{
+		EventBusName: aws.String(n.eventBus),
+		Resources:    []string{},
+		Source:       aws.String(source),
+		DetailType:   aws.String(e.Type),
+		Time:         aws.Time(e.Time),
+		Detail:       aws.String(string(bs)),
+	}
+	return putInBatches(ctx, "put events", n.retryPolicy, []types.PutEventsRequestEntry{entry}, eventBridgeMaxEntries, n.putEvents)
+}
+
 type FileNotification struct {
+	mu        sync.Mutex
 	eventFile string
 }
 
@@ -254,6 +524,8 @@ func NewFileNotification(ctx context.Context, cfg *NotificationConfig) (*FileNot
 }
 
 func (n *FileNotification) SendChanges(ctx context.Context, _ *ChannelItem, changes []*drive.Change) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	fp, err := os.OpenFile(n.eventFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		logx.Printf(ctx, "[debug] can not crate notification event_file=%s:%s", n.eventFile, err.Error())
@@ -277,3 +549,344 @@ func (n *FileNotification) SendChanges(ctx context.Context, _ *ChannelItem, chan
 	}
 	return lastErr
 }
+
+func (n *FileNotification) SendLifecycleEvent(ctx context.Context, e *LifecycleEvent) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fp, err := os.OpenFile(n.eventFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logx.Printf(ctx, "[debug] can not crate notification event_file=%s:%s", n.eventFile, err.Error())
+		return err
+	}
+	defer fp.Close()
+	logx.Printf(ctx, "[info] output lifecycle event type:%s channel_id:%s drive_id:%s to `%s`", e.Type, e.ChannelID, e.DriveID, n.eventFile)
+	return json.NewEncoder(fp).Encode(e)
+}
+
+// maxBatchFlushAttempts is the number of flushes of pending changes by the window before they are dropped.
+const maxBatchFlushAttempts = 3
+
+// BatchingNotification accumulates changes for a window and sends them to the next Notification together.
+// Pending changes are held in memory: a batch failed to send by the window is kept pending and sent again at the next window,
+// up to maxBatchFlushAttempts times. It is a DeferredNotification, the App advances the page token only after the changes are sent,
+// so that the changes pending when the process exits without Close are fetched again.
+type BatchingNotification struct {
+	mu      sync.Mutex
+	next    Notification
+	window  time.Duration
+	size    int
+	order   []string
+	pending map[string]*pendingChanges
+	sending map[string]*pendingChanges
+	count   int
+	timer   *time.Timer
+	closed  bool
+}
+
+type pendingChanges struct {
+	item      *ChannelItem
+	changes   []*drive.Change
+	attempts  int
+	afterSent []func(context.Context) error
+}
+
+// NewBatchingNotification returns BatchingNotification.
+// Changes are flushed when window elapsed since the first pending change, or when pending changes reach size (size <= 0 means unlimited).
+func NewBatchingNotification(next Notification, window time.Duration, size int) *BatchingNotification {
+	return &BatchingNotification{
+		next:    next,
+		window:  window,
+		size:    size,
+		order:   make([]string, 0),
+		pending: make(map[string]*pendingChanges),
+		sending: make(map[string]*pendingChanges),
+	}
+}
+
+// SendChanges adds changes to the pending, it returns the error of the flush when pending changes reach the size.
+func (n *BatchingNotification) SendChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	n.mu.Lock()
+	p, ok := n.pending[item.ChannelID]
+	if !ok {
+		p = &pendingChanges{
+			changes: make([]*drive.Change, 0, len(changes)),
+		}
+		n.pending[item.ChannelID] = p
+		n.order = append(n.order, item.ChannelID)
+	}
+	p.item = item
+	p.changes = append(p.changes, changes...)
+	n.count += len(changes)
+	logx.Printf(ctx, "[debug] pending changes channel_id=%s pending=%d", item.ChannelID, n.count)
+	if n.size > 0 && n.count >= n.size {
+		batches := n.takePendingLocked()
+		n.mu.Unlock()
+		logx.Printf(ctx, "[debug] batch size reached, flush pending changes")
+		return n.sendOrRequeue(ctx, batches)
+	}
+	n.startTimerLocked()
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *BatchingNotification) startTimerLocked() {
+	if n.timer != nil || n.closed {
+		return
+	}
+	n.timer = time.AfterFunc(n.window, func() {
+		ctx := context.Background()
+		n.mu.Lock()
+		batches := n.takePendingLocked()
+		n.mu.Unlock()
+		if err := n.sendOrRequeue(ctx, batches); err != nil {
+			logx.Printf(ctx, "[error] flush pending changes failed: %s", err.Error())
+		}
+	})
+}
+
+// Flush sends all pending changes immediately.
+// Batches failed to send are not kept pending, the error is returned.
+func (n *BatchingNotification) Flush(ctx context.Context) error {
+	n.mu.Lock()
+	batches := n.takePendingLocked()
+	n.mu.Unlock()
+	failed, err := n.send(ctx, batches)
+	n.mu.Lock()
+	for _, p := range failed {
+		n.doneSendingLocked(p)
+	}
+	n.mu.Unlock()
+	return err
+}
+
+// AfterSent calls fn after the pending changes of the channel are sent, fn is passed to the next Notification if it is a DeferredNotification.
+func (n *BatchingNotification) AfterSent(ctx context.Context, channelID string, fn func(context.Context) error) error {
+	n.mu.Lock()
+	p, ok := n.pending[channelID]
+	if !ok {
+		p, ok = n.sending[channelID]
+	}
+	if ok {
+		p.afterSent = append(p.afterSent, fn)
+		n.mu.Unlock()
+		return nil
+	}
+	n.mu.Unlock()
+	return n.afterSentNext(ctx, channelID, fn)
+}
+
+func (n *BatchingNotification) afterSentNext(ctx context.Context, channelID string, fn func(context.Context) error) error {
+	if next, ok := n.next.(DeferredNotification); ok {
+		return next.AfterSent(ctx, channelID, fn)
+	}
+	return fn(ctx)
+}
+
+// SendLifecycleEvent is not batched, lifecycle events are sent to the next Notification immediately.
+func (n *BatchingNotification) SendLifecycleEvent(ctx context.Context, e *LifecycleEvent) error {
+	next, ok := n.next.(LifecycleNotification)
+	if !ok {
+		return errors.New("lifecycle event is not supported")
+	}
+	return next.SendLifecycleEvent(ctx, e)
+}
+
+// Close flushes pending changes, it is called from App.Close.
+func (n *BatchingNotification) Close() error {
+	n.mu.Lock()
+	n.closed = true
+	n.mu.Unlock()
+	return n.Flush(context.Background())
+}
+
+func (n *BatchingNotification) takePendingLocked() []*pendingChanges {
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	batches := make([]*pendingChanges, 0, len(n.order))
+	for _, channelID := range n.order {
+		p := n.pending[channelID]
+		n.sending[channelID] = p
+		batches = append(batches, p)
+	}
+	n.order = make([]string, 0)
+	n.pending = make(map[string]*pendingChanges)
+	n.count = 0
+	return batches
+}
+
+func (n *BatchingNotification) sendOrRequeue(ctx context.Context, batches []*pendingChanges) error {
+	failed, err := n.send(ctx, batches)
+	if len(failed) > 0 {
+		n.requeue(ctx, failed)
+	}
+	return err
+}
+
+// requeue puts the batches failed to send back before the pending changes, to be sent again at the next window.
+func (n *BatchingNotification) requeue(ctx context.Context, failed []*pendingChanges) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	order := make([]string, 0, len(failed)+len(n.order))
+	for _, p := range failed {
+		n.doneSendingLocked(p)
+		p.attempts++
+		if n.closed || p.attempts >= maxBatchFlushAttempts {
+			logx.Printf(ctx, "[error] drop %d pending changes channel_id=%s, failed to flush %d times", len(p.changes), p.item.ChannelID, p.attempts)
+			continue
+		}
+		n.count += len(p.changes)
+		if newer, ok := n.pending[p.item.ChannelID]; ok {
+			newer.changes = append(p.changes, newer.changes...)
+			newer.afterSent = append(p.afterSent, newer.afterSent...)
+			newer.attempts = p.attempts
+			continue
+		}
+		n.pending[p.item.ChannelID] = p
+		order = append(order, p.item.ChannelID)
+	}
+	n.order = append(order, n.order...)
+	if n.count > 0 {
+		n.startTimerLocked()
+	}
+}
+
+// send sends the batches to the next Notification, and returns the batches failed to send with the last error.
+func (n *BatchingNotification) send(ctx context.Context, batches []*pendingChanges) ([]*pendingChanges, error) {
+	var failed []*pendingChanges
+	var lastErr error
+	for _, p := range batches {
+		logx.Printf(ctx, "[debug] flush changes channel_id=%s changes=%d", p.item.ChannelID, len(p.changes))
+		if err := n.next.SendChanges(ctx, p.item, p.changes); err != nil {
+			logx.Printf(ctx, "[error] flush changes failed channel_id=%s: %s", p.item.ChannelID, err.Error())
+			failed = append(failed, p)
+			lastErr = err
+			continue
+		}
+		n.mu.Lock()
+		n.doneSendingLocked(p)
+		afterSent := p.afterSent
+		n.mu.Unlock()
+		for _, fn := range afterSent {
+			if err := n.afterSentNext(ctx, p.item.ChannelID, fn); err != nil {
+				logx.Printf(ctx, "[error] after sent changes channel_id=%s: %s", p.item.ChannelID, err.Error())
+			}
+		}
+	}
+	return failed, lastErr
+}
+
+func (n *BatchingNotification) doneSendingLocked(p *pendingChanges) {
+	if n.sending[p.item.ChannelID] == p {
+		delete(n.sending, p.item.ChannelID)
+	}
+}
+
+// MultiNotification sends changes to all target Notifications.
+// A failure of one target does not prevent sending to the others, errors are aggregated.
+type MultiNotification struct {
+	targets []Notification
+}
+
+// NewMultiNotification returns MultiNotification with the targets of the config.
+func NewMultiNotification(ctx context.Context, cfg *NotificationConfig, awsCfg aws.Config) (Notification, func() error, error) {
+	targets := make([]Notification, 0, len(cfg.Targets))
+	cleanups := make([]func() error, 0, len(cfg.Targets))
+	cleanup := func() error {
+		var errs []error
+		for _, c := range cleanups {
+			if err := c(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	for i, targetCfg := range cfg.Targets {
+		n, c, err := NewNotification(ctx, targetCfg, awsCfg)
+		if err != nil {
+			if cleanupErr := cleanup(); cleanupErr != nil {
+				logx.Printf(ctx, "[warn] cleanup notification targets failed: %s", cleanupErr.Error())
+			}
+			return nil, nil, fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		targets = append(targets, n)
+		if c != nil {
+			cleanups = append(cleanups, c)
+		}
+	}
+	return NewMultiNotificationWithTargets(targets...), cleanup, nil
+}
+
+// NewMultiNotificationWithTargets returns MultiNotification with the given Notifications.
+func NewMultiNotificationWithTargets(targets ...Notification) *MultiNotification {
+	return &MultiNotification{
+		targets: targets,
+	}
+}
+
+func (n *MultiNotification) SendChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	var errs []error
+	for i, target := range n.targets {
+		if err := target.SendChanges(ctx, item, changes); err != nil {
+			logx.Printf(ctx, "[error] send changes to targets[%d] failed channel_id=%s: %s", i, item.ChannelID, err.Error())
+			errs = append(errs, fmt.Errorf("targets[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AfterSent calls fn after all targets that are DeferredNotification have sent the pending changes of the channel.
+func (n *MultiNotification) AfterSent(ctx context.Context, channelID string, fn func(context.Context) error) error {
+	deferred := make([]DeferredNotification, 0, len(n.targets))
+	for _, target := range n.targets {
+		if d, ok := target.(DeferredNotification); ok {
+			deferred = append(deferred, d)
+		}
+	}
+	if len(deferred) == 0 {
+		return fn(ctx)
+	}
+	var mu sync.Mutex
+	remaining := len(deferred)
+	done := func(ctx context.Context) error {
+		mu.Lock()
+		remaining--
+		last := remaining == 0
+		mu.Unlock()
+		if !last {
+			return nil
+		}
+		return fn(ctx)
+	}
+	var errs []error
+	for _, d := range deferred {
+		if err := d.AfterSent(ctx, channelID, done); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendLifecycleEvent sends the lifecycle event to the targets that support lifecycle events.
+func (n *MultiNotification) SendLifecycleEvent(ctx context.Context, e *LifecycleEvent) error {
+	var errs []error
+	var supported bool
+	for i, target := range n.targets {
+		ln, ok := target.(LifecycleNotification)
+		if !ok {
+			continue
+		}
+		supported = true
+		if err := ln.SendLifecycleEvent(ctx, e); err != nil {
+			errs = append(errs, fmt.Errorf("targets[%d]: %w", i, err))
+		}
+	}
+	if !supported {
+		return errors.New("lifecycle event is not supported")
+	}
+	return errors.Join(errs...)
+}
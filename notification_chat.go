@@ -0,0 +1,133 @@
+package gdnotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/drive/v3"
+)
+
+// ChatNotification posts human readable change messages to a chat incoming webhook, e.g. Slack or Microsoft Teams.
+type ChatNotification struct {
+	client           *http.Client
+	webhookURL       string
+	format           string
+	summaryThreshold int
+	limiter          *rate.Limiter
+}
+
+func NewChatNotification(_ context.Context, cfg *NotificationConfig) (*ChatNotification, func() error, error) {
+	rateLimit := cfg.ChatRateLimit
+	if rateLimit <= 0 {
+		rateLimit = DefaultChatRateLimit
+	}
+	n := &ChatNotification{
+		client:           &http.Client{Timeout: 10 * time.Second},
+		webhookURL:       *cfg.ChatWebhookURL,
+		format:           coalesce(cfg.ChatFormat, ChatFormatSlack),
+		summaryThreshold: cfg.ChatSummaryThreshold,
+		limiter:          rate.NewLimiter(rate.Limit(rateLimit), 1),
+	}
+	if n.summaryThreshold <= 0 {
+		n.summaryThreshold = DefaultChatSummaryThreshold
+	}
+	return n, nil, nil
+}
+
+// SendChanges posts a message per change, or a summary message if the changes are more than chat_summary_threshold.
+func (n *ChatNotification) SendChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	details := make([]*ChangeEventDetail, 0, len(changes))
+	for _, c := range changes {
+		ced := &ChangeEventDetail{Change: c}
+		ced.complete()
+		details = append(details, ced)
+	}
+	if len(details) > n.summaryThreshold {
+		lines := make([]string, 0, n.summaryThreshold+1)
+		for _, ced := range details[:n.summaryThreshold] {
+			lines = append(lines, fmt.Sprintf("- [%s] %s", ced.DetailType(), ced.Subject))
+		}
+		lines = append(lines, fmt.Sprintf("...and %d more changes", len(details)-n.summaryThreshold))
+		title := fmt.Sprintf("%d changes in DriveId %s", len(details), item.DriveID)
+		logx.Printf(ctx, "[info] post summary of %d changes channel_id:%s to chat", len(details), item.ChannelID)
+		return n.post(ctx, title, lines)
+	}
+	var lastErr error
+	for _, ced := range details {
+		if err := n.post(ctx, ced.DetailType(), []string{ced.Subject}); err != nil {
+			logx.Printf(ctx, "[error] post change to chat failed: %s", err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (n *ChatNotification) SendLifecycleEvent(ctx context.Context, e *LifecycleEvent) error {
+	lines := []string{e.Subject}
+	if e.Error != "" {
+		lines = append(lines, "error: "+e.Error)
+	}
+	return n.post(ctx, e.Type, lines)
+}
+
+// chatMessageCard is the legacy actionable message card of Microsoft Teams incoming webhooks.
+type chatMessageCard struct {
+	Type    string `json:"@type"`
+	Context string `json:"@context"`
+	Summary string `json:"summary"`
+	Title   string `json:"title"`
+	Text    string `json:"text"`
+}
+
+func (n *ChatNotification) message(title string, lines []string) interface{} {
+	if n.format == ChatFormatTeams {
+		// Teams renders a single newline as a space.
+		return &chatMessageCard{
+			Type:    "MessageCard",
+			Context: "https://schema.org/extensions",
+			Summary: title,
+			Title:   title,
+			Text:    strings.Join(lines, "\n\n"),
+		}
+	}
+	return map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", title, strings.Join(lines, "\n")),
+	}
+}
+
+func (n *ChatNotification) post(ctx context.Context, title string, lines []string) error {
+	bs, err := json.Marshal(n.message(title, lines))
+	if err != nil {
+		return fmt.Errorf("chat message marshal: %w", err)
+	}
+	if err := n.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(bs))
+	if err != nil {
+		return fmt.Errorf("new chat webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	logx.Printf(ctx, "[debug] post chat message: %s", string(bs))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post chat webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("post chat webhook response status not ok (status:%d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	logx "github.com/mashiike/go-logx"
+)
+
+// detailTypeExpr is the CEL expression of detail_type_expr, it overrides the detail-type of the change events.
+// The expression is evaluated with `detail`, the event detail as sent (e.g. detail.change.file.mimeType),
+// and `detailType`, the built-in detail-type, and must return a string.
+type detailTypeExpr struct {
+	expr string
+	prg  cel.Program
+}
+
+// newDetailTypeExpr compiles the CEL expression of detail_type_expr.
+func newDetailTypeExpr(expr string) (*detailTypeExpr, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("detail", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("detailType", cel.StringType),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if t := ast.OutputType(); !t.IsExactType(cel.StringType) && !t.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("must return string, but returns %s", t)
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &detailTypeExpr{
+		expr: expr,
+		prg:  prg,
+	}, nil
+}
+
+// DetailType evaluates the expression against the marshaled detail of ced.
+// It falls back to the built-in detail-type if the evaluation failed, or the result is not a string or empty.
+func (e *detailTypeExpr) DetailType(ctx context.Context, ced *ChangeEventDetail, detail []byte) string {
+	fallback := ced.DetailType()
+	var vars map[string]interface{}
+	if err := json.Unmarshal(detail, &vars); err != nil {
+		logx.Printf(ctx, "[warn] detail_type_expr: unmarshal detail failed, use `%s`: %s", fallback, err.Error())
+		return fallback
+	}
+	out, _, err := e.prg.Eval(map[string]interface{}{
+		"detail":     vars,
+		"detailType": fallback,
+	})
+	if err != nil {
+		logx.Printf(ctx, "[warn] detail_type_expr: eval `%s` failed, use `%s`: %s", e.expr, fallback, err.Error())
+		return fallback
+	}
+	detailType, ok := out.Value().(string)
+	if !ok || detailType == "" {
+		logx.Printf(ctx, "[warn] detail_type_expr: `%s` returns %v, not a non-empty string, use `%s`", e.expr, out.Value(), fallback)
+		return fallback
+	}
+	return detailType
+}
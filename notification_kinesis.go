@@ -0,0 +1,103 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	logx "github.com/mashiike/go-logx"
+	"github.com/samber/lo"
+	"github.com/shogo82148/go-retry"
+	"google.golang.org/api/drive/v3"
+)
+
+// kinesisMaxRecords is the max number of records of a PutRecords request.
+const kinesisMaxRecords = 500
+
+type KinesisClient interface {
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+}
+
+// KinesisNotification puts each change as a record of ChangeEventDetail to the Kinesis data stream.
+// The partition key is the file ID of the change, or the drive ID, so that the changes of a file are ordered in a shard.
+type KinesisNotification struct {
+	client                 KinesisClient
+	streamName             string
+	includeChannelMetadata bool
+
+	retryPolicy *retry.Policy
+}
+
+func NewKinesisNotification(_ context.Context, cfg *NotificationConfig, awsCfg aws.Config) (*KinesisNotification, func() error, error) {
+	return newKinesisNotification(cfg, kinesis.NewFromConfig(awsCfg)), nil, nil
+}
+
+func newKinesisNotification(cfg *NotificationConfig, client KinesisClient) *KinesisNotification {
+	n := &KinesisNotification{
+		client:                 client,
+		streamName:             *cfg.StreamName,
+		includeChannelMetadata: cfg.IncludeChannelMetadata,
+		retryPolicy:            newNotificationRetryPolicy(cfg),
+	}
+	return n
+}
+
+func (n *KinesisNotification) partitionKey(item *ChannelItem, c *drive.Change) string {
+	return coalesce(c.FileId, c.DriveId, item.DriveID, item.ChannelID)
+}
+
+// SendChanges puts the changes by PutRecords in batches of 500 records, the records failed with retryable errors are re-submitted.
+// The re-submitted records may be out of order with the records succeeded in the same request.
+func (n *KinesisNotification) SendChanges(ctx context.Context, item *ChannelItem, changes []*drive.Change) error {
+	records := lo.Map(changes, func(c *drive.Change, _ int) types.PutRecordsRequestEntry {
+		ced := &ChangeEventDetail{
+			Change: c,
+		}
+		if n.includeChannelMetadata {
+			ced.ChannelID = item.ChannelID
+			ced.ResourceID = item.ResourceID
+			ced.DriveID = item.DriveID
+		}
+		bs, err := json.Marshal(ced)
+		if err != nil {
+			logx.Printf(ctx, "[warn] change marshal failed: %s", err.Error())
+			bs = []byte("{}")
+		}
+		partitionKey := n.partitionKey(item, c)
+		logx.Printf(ctx, "[debug] record partition_key=%s data: %s", partitionKey, string(bs))
+		return types.PutRecordsRequestEntry{
+			Data:         bs,
+			PartitionKey: aws.String(partitionKey),
+		}
+	})
+	return putInBatches(ctx, "put records", n.retryPolicy, records, kinesisMaxRecords, n.putRecords)
+}
+
+func (n *KinesisNotification) putRecords(ctx context.Context, records []types.PutRecordsRequestEntry) ([]batchEntryResult, error) {
+	input := &kinesis.PutRecordsInput{
+		Records: records,
+	}
+	if strings.HasPrefix(n.streamName, "arn:") {
+		input.StreamARN = aws.String(n.streamName)
+	} else {
+		input.StreamName = aws.String(n.streamName)
+	}
+	output, err := n.client.PutRecords(ctx, input)
+	if err != nil {
+		logx.Printf(ctx, "[error] PutRecords failed: %s", err.Error())
+		return nil, err
+	}
+	results := make([]batchEntryResult, 0, len(output.Records))
+	for i, record := range output.Records {
+		if record.ErrorCode != nil {
+			logx.Printf(ctx, "[error] put record to %s error_code=%s, error_message=%s partition_key=%s", n.streamName, *record.ErrorCode, aws.ToString(record.ErrorMessage), *records[i].PartitionKey)
+		} else {
+			logx.Printf(ctx, "[info] put record to %s shard_id=%s, sequence_number=%s", n.streamName, aws.ToString(record.ShardId), aws.ToString(record.SequenceNumber))
+		}
+		results = append(results, batchEntryResult{errorCode: aws.ToString(record.ErrorCode), errorMessage: aws.ToString(record.ErrorMessage)})
+	}
+	return results, nil
+}
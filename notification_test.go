@@ -1,11 +1,26 @@
 package gdnotify_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	"github.com/mashiike/gdnotify"
+	"github.com/samber/lo"
 	"github.com/sebdah/goldie/v2"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/api/drive/v3"
@@ -61,6 +76,58 @@ func TestChangeEventDetailMarshalJSON(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "changed file with links",
+			eventDetail: &gdnotify.ChangeEventDetail{
+				Change: &drive.Change{
+					Kind:       "drive#change",
+					ChangeType: "file",
+					FileId:     "XXXXXXXXXX",
+					File: &drive.File{
+						Id:   "XXXXXXXXXX",
+						Kind: "drive#file",
+						LastModifyingUser: &drive.User{
+							DisplayName: "hoge",
+							Kind:        "drive#user",
+						},
+						MimeType:     "application/vnd.google-apps.spreadsheet",
+						ModifiedTime: "2022-06-15T00:03:45.843Z",
+						Name:         "gdnotify",
+						Version:      20,
+						WebViewLink:  "https://docs.google.com/spreadsheets/d/XXXXXXXXXX/edit?usp=drivesdk",
+						IconLink:     "https://drive-thirdparty.googleusercontent.com/16/type/application/vnd.google-apps.spreadsheet",
+					},
+					Time: "2022-06-15T00:03:55.849Z",
+				},
+			},
+		},
+		{
+			name: "changed file with channel metadata",
+			eventDetail: &gdnotify.ChangeEventDetail{
+				Change: &drive.Change{
+					Kind:       "drive#change",
+					ChangeType: "file",
+					FileId:     "XXXXXXXXXX",
+					File: &drive.File{
+						Id:   "XXXXXXXXXX",
+						Kind: "drive#file",
+						LastModifyingUser: &drive.User{
+							DisplayName: "hoge",
+							Kind:        "drive#user",
+						},
+						MimeType:     "application/vnd.google-apps.spreadsheet",
+						ModifiedTime: "2022-06-15T00:03:45.843Z",
+						Name:         "gdnotify",
+						Version:      20,
+						Size:         1500,
+					},
+					Time: "2022-06-15T00:03:55.849Z",
+				},
+				ChannelID:  "channel1",
+				ResourceID: "resource1",
+				DriveID:    "drive1",
+			},
+		},
 		{
 			name: "changed file with email",
 			eventDetail: &gdnotify.ChangeEventDetail{
@@ -189,3 +256,858 @@ func TestChangeEventDetailMarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+type recordNotification struct {
+	mu    sync.Mutex
+	calls [][]*drive.Change
+	err   error
+}
+
+func (n *recordNotification) SendChanges(_ context.Context, _ *gdnotify.ChannelItem, changes []*drive.Change) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls = append(n.calls, changes)
+	return n.err
+}
+
+func (n *recordNotification) Calls() [][]*drive.Change {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls
+}
+
+func TestBatchingNotificationFlushWindow(t *testing.T) {
+	next := &recordNotification{}
+	n := gdnotify.NewBatchingNotification(next, 100*time.Millisecond, 0)
+	defer n.Close()
+	ctx := context.Background()
+	item := &gdnotify.ChannelItem{ChannelID: "channel1"}
+	require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+	require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file2"}, {FileId: "file3"}}))
+	require.Empty(t, next.Calls(), "changes within the window are not sent yet")
+	require.Eventually(t, func() bool {
+		return len(next.Calls()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Len(t, next.Calls()[0], 3)
+}
+
+func TestBatchingNotificationFlushSize(t *testing.T) {
+	next := &recordNotification{}
+	n := gdnotify.NewBatchingNotification(next, time.Hour, 3)
+	defer n.Close()
+	ctx := context.Background()
+	item := &gdnotify.ChannelItem{ChannelID: "channel1"}
+	require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}, {FileId: "file2"}}))
+	require.Empty(t, next.Calls())
+	require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file3"}, {FileId: "file4"}}))
+	require.Len(t, next.Calls(), 1)
+	require.Len(t, next.Calls()[0], 4)
+}
+
+func (n *recordNotification) SetErr(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.err = err
+}
+
+func TestBatchingNotificationFlushRetry(t *testing.T) {
+	ctx := context.Background()
+	item := &gdnotify.ChannelItem{ChannelID: "channel1"}
+	t.Run("sent again at the next window", func(t *testing.T) {
+		next := &recordNotification{err: errors.New("temporary failure")}
+		n := gdnotify.NewBatchingNotification(next, 50*time.Millisecond, 0)
+		defer n.Close()
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+		require.Eventually(t, func() bool {
+			return len(next.Calls()) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file2"}}))
+		next.SetErr(nil)
+		require.Eventually(t, func() bool {
+			return len(next.Calls()) == 2
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, []*drive.Change{{FileId: "file1"}, {FileId: "file2"}}, next.Calls()[1], "failed changes are sent before the newer ones")
+	})
+	t.Run("dropped after max attempts", func(t *testing.T) {
+		next := &recordNotification{err: errors.New("permanent failure")}
+		n := gdnotify.NewBatchingNotification(next, 20*time.Millisecond, 0)
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+		require.Eventually(t, func() bool {
+			return len(next.Calls()) == 3
+		}, time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		require.Len(t, next.Calls(), 3)
+		require.NoError(t, n.Close(), "nothing is pending")
+		require.Len(t, next.Calls(), 3)
+	})
+	t.Run("error of close", func(t *testing.T) {
+		next := &recordNotification{err: errors.New("failure")}
+		n := gdnotify.NewBatchingNotification(next, time.Hour, 0)
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+		require.EqualError(t, n.Close(), "failure")
+	})
+}
+
+func TestBatchingNotificationFlushOnClose(t *testing.T) {
+	next := &recordNotification{}
+	n := gdnotify.NewBatchingNotification(next, time.Hour, 0)
+	ctx := context.Background()
+	require.NoError(t, n.SendChanges(ctx, &gdnotify.ChannelItem{ChannelID: "channel1"}, []*drive.Change{{FileId: "file1"}}))
+	require.NoError(t, n.SendChanges(ctx, &gdnotify.ChannelItem{ChannelID: "channel2"}, []*drive.Change{{DriveId: "drive1"}}))
+	require.Empty(t, next.Calls())
+	require.NoError(t, n.Close())
+	require.Len(t, next.Calls(), 2, "pending changes are flushed per channel on shutdown")
+}
+
+func TestBatchingNotificationAfterSent(t *testing.T) {
+	ctx := context.Background()
+	item := &gdnotify.ChannelItem{ChannelID: "channel1"}
+	t.Run("nothing pending", func(t *testing.T) {
+		n := gdnotify.NewBatchingNotification(&recordNotification{}, time.Hour, 0)
+		defer n.Close()
+		var called int
+		require.NoError(t, n.AfterSent(ctx, "channel1", func(context.Context) error {
+			called++
+			return nil
+		}))
+		require.Equal(t, 1, called, "called at once")
+		require.EqualError(t, n.AfterSent(ctx, "channel1", func(context.Context) error {
+			return errors.New("commit failed")
+		}), "commit failed")
+	})
+	t.Run("after flushed", func(t *testing.T) {
+		next := &recordNotification{err: errors.New("temporary failure")}
+		n := gdnotify.NewBatchingNotification(next, 20*time.Millisecond, 0)
+		defer n.Close()
+		var called int32
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+		require.NoError(t, n.AfterSent(ctx, "channel1", func(context.Context) error {
+			atomic.AddInt32(&called, 1)
+			return nil
+		}))
+		require.NoError(t, n.AfterSent(ctx, "channel2", func(context.Context) error {
+			return nil
+		}), "other channels are not pending")
+		require.Eventually(t, func() bool {
+			return len(next.Calls()) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.EqualValues(t, 0, atomic.LoadInt32(&called), "not called while the changes failed to send")
+		next.SetErr(nil)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&called) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.Len(t, next.Calls(), 2)
+	})
+	t.Run("not called if failed on close", func(t *testing.T) {
+		next := &recordNotification{err: errors.New("failure")}
+		n := gdnotify.NewBatchingNotification(next, time.Hour, 0)
+		var called bool
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+		require.NoError(t, n.AfterSent(ctx, "channel1", func(context.Context) error {
+			called = true
+			return nil
+		}))
+		require.EqualError(t, n.Close(), "failure")
+		require.False(t, called)
+	})
+	t.Run("multi", func(t *testing.T) {
+		first := gdnotify.NewBatchingNotification(&recordNotification{}, time.Hour, 0)
+		second := gdnotify.NewBatchingNotification(&recordNotification{}, time.Hour, 0)
+		n := gdnotify.NewMultiNotificationWithTargets(first, &recordNotification{}, second)
+		var called int
+		require.NoError(t, n.SendChanges(ctx, item, []*drive.Change{{FileId: "file1"}}))
+		require.NoError(t, n.AfterSent(ctx, "channel1", func(context.Context) error {
+			called++
+			return nil
+		}))
+		require.NoError(t, first.Close())
+		require.Equal(t, 0, called, "waits for all batching targets")
+		require.NoError(t, second.Close())
+		require.Equal(t, 1, called)
+	})
+}
+
+func TestMultiNotification(t *testing.T) {
+	ctx := context.Background()
+	item := &gdnotify.ChannelItem{ChannelID: "channel1"}
+	changes := []*drive.Change{{FileId: "file1"}, {FileId: "file2"}}
+	t.Run("all targets", func(t *testing.T) {
+		first, second := &recordNotification{}, &recordNotification{}
+		n := gdnotify.NewMultiNotificationWithTargets(first, second)
+		require.NoError(t, n.SendChanges(ctx, item, changes))
+		require.EqualValues(t, [][]*drive.Change{changes}, first.Calls())
+		require.EqualValues(t, [][]*drive.Change{changes}, second.Calls())
+	})
+	t.Run("one target failed", func(t *testing.T) {
+		first, second := &recordNotification{err: errors.New("put events failed")}, &recordNotification{}
+		n := gdnotify.NewMultiNotificationWithTargets(first, second)
+		err := n.SendChanges(ctx, item, changes)
+		require.EqualError(t, err, "targets[0]: put events failed")
+		require.EqualValues(t, [][]*drive.Change{changes}, second.Calls(), "other targets are still sent")
+	})
+}
+
+type mockEventBridgeClient struct {
+	mu       sync.Mutex
+	entries  []types.PutEventsRequestEntry
+	calls    [][]string
+	failOnce map[string]string
+	// noErrorMessage returns the failed entries without ErrorMessage.
+	noErrorMessage bool
+}
+
+func (c *mockEventBridgeClient) PutEvents(_ context.Context, params *eventbridge.PutEventsInput, _ ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	output := &eventbridge.PutEventsOutput{
+		Entries: make([]types.PutEventsResultEntry, 0, len(params.Entries)),
+	}
+	sources := make([]string, 0, len(params.Entries))
+	for _, entry := range params.Entries {
+		sources = append(sources, *entry.Source)
+		if code, ok := c.failOnce[*entry.Source]; ok {
+			delete(c.failOnce, *entry.Source)
+			output.FailedEntryCount++
+			entry := types.PutEventsResultEntry{
+				ErrorCode:    aws.String(code),
+				ErrorMessage: aws.String("failed"),
+			}
+			if c.noErrorMessage {
+				entry.ErrorMessage = nil
+			}
+			output.Entries = append(output.Entries, entry)
+			continue
+		}
+		c.entries = append(c.entries, entry)
+		output.Entries = append(output.Entries, types.PutEventsResultEntry{
+			EventId: aws.String("00000000-0000-0000-0000-000000000000"),
+		})
+	}
+	c.calls = append(c.calls, sources)
+	return output, nil
+}
+
+func (c *mockEventBridgeClient) Sources() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sources := make([]string, 0, len(c.entries))
+	for _, entry := range c.entries {
+		sources = append(sources, *entry.Source)
+	}
+	return sources
+}
+
+func TestEventBridgeNotificationSourceIncludesAccount(t *testing.T) {
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "drive1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	cfg := &gdnotify.NotificationConfig{
+		Type:     gdnotify.NotificationTypeEventBridge,
+		EventBus: aws.String("default"),
+	}
+	t.Run("default", func(t *testing.T) {
+		client := &mockEventBridgeClient{}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		require.NoError(t, n.SendChanges(context.Background(), item, changes))
+		require.EqualValues(t, []string{
+			"oss.gdnotify/drive1/file/file1",
+			"oss.gdnotify/drive1/drive/drive1",
+		}, client.Sources())
+	})
+	t.Run("include account", func(t *testing.T) {
+		client := &mockEventBridgeClient{}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		n.SetAccount("123456789012", "ap-northeast-1")
+		require.NoError(t, n.SendChanges(context.Background(), item, changes))
+		require.EqualValues(t, []string{
+			"oss.gdnotify/123456789012/ap-northeast-1/drive1/file/file1",
+			"oss.gdnotify/123456789012/ap-northeast-1/drive1/drive/drive1",
+		}, client.Sources())
+	})
+}
+
+func TestEventBridgeNotificationSourcePrefix(t *testing.T) {
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "drive1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	cfg := &gdnotify.NotificationConfig{
+		Type:         gdnotify.NotificationTypeEventBridge,
+		EventBus:     aws.String("default"),
+		SourcePrefix: aws.String("com.example.gdrive/"),
+	}
+	t.Run("custom", func(t *testing.T) {
+		client := &mockEventBridgeClient{}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		require.NoError(t, n.SendChanges(context.Background(), item, changes))
+		require.EqualValues(t, []string{
+			"com.example.gdrive/drive1/file/file1",
+			"com.example.gdrive/drive1/drive/drive1",
+		}, client.Sources())
+	})
+	t.Run("custom with account", func(t *testing.T) {
+		client := &mockEventBridgeClient{}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		n.SetAccount("123456789012", "ap-northeast-1")
+		require.NoError(t, n.SendChanges(context.Background(), item, changes))
+		require.EqualValues(t, []string{
+			"com.example.gdrive/123456789012/ap-northeast-1/drive1/file/file1",
+			"com.example.gdrive/123456789012/ap-northeast-1/drive1/drive/drive1",
+		}, client.Sources())
+	})
+}
+
+func TestEventBridgeNotificationEventTimeSource(t *testing.T) {
+	now := time.Date(2022, 6, 16, 0, 0, 0, 0, time.UTC)
+	restore := flextime.Fix(now)
+	defer restore()
+	changes := []*drive.Change{
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z",
+			File: &drive.File{Id: "file1", ModifiedTime: "2022-06-14T12:00:00.000Z"},
+		},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:04:00.000Z", Removed: true},
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "file3", Time: "invalid",
+			File: &drive.File{Id: "file3", ModifiedTime: "invalid"},
+		},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	cases := []struct {
+		source   string
+		expected []time.Time
+	}{
+		{
+			source: gdnotify.EventTimeSourceChange,
+			expected: []time.Time{
+				time.Date(2022, 6, 15, 0, 3, 55, 849000000, time.UTC),
+				time.Date(2022, 6, 15, 0, 4, 0, 0, time.UTC),
+				now,
+			},
+		},
+		{
+			source: gdnotify.EventTimeSourceModified,
+			expected: []time.Time{
+				time.Date(2022, 6, 14, 12, 0, 0, 0, time.UTC),
+				time.Date(2022, 6, 15, 0, 4, 0, 0, time.UTC),
+				now,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.source, func(t *testing.T) {
+			cfg := &gdnotify.NotificationConfig{
+				Type:            gdnotify.NotificationTypeEventBridge,
+				EventBus:        aws.String("default"),
+				EventTimeSource: c.source,
+			}
+			client := &mockEventBridgeClient{}
+			n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+			require.NoError(t, n.SendChanges(context.Background(), item, changes))
+			require.Len(t, client.entries, len(c.expected))
+			for i, expected := range c.expected {
+				require.True(t, expected.Equal(*client.entries[i].Time), "entry %d: expected %s, got %s", i, expected, *client.entries[i].Time)
+			}
+		})
+	}
+}
+
+func TestEventBridgeNotificationDetailTypeExpr(t *testing.T) {
+	changes := []*drive.Change{
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z",
+			File: &drive.File{Id: "file1", MimeType: "image/png"},
+		},
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z",
+			File: &drive.File{Id: "file2", MimeType: "text/plain"},
+		},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file3", Time: "2022-06-15T00:04:00.000Z", Removed: true},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	cases := []struct {
+		name     string
+		expr     string
+		expected []string
+	}{
+		{
+			name:     "empty",
+			expected: []string{gdnotify.DetailTypeFileChanged, gdnotify.DetailTypeFileChanged, gdnotify.DetailTypeFileRemoved},
+		},
+		{
+			name:     "by mime type",
+			expr:     `detail.change.file.mimeType.startsWith("image/") ? "Image Changed" : detailType`,
+			expected: []string{"Image Changed", gdnotify.DetailTypeFileChanged, gdnotify.DetailTypeFileRemoved},
+		},
+		{
+			name:     "not a string",
+			expr:     `detail.change`,
+			expected: []string{gdnotify.DetailTypeFileChanged, gdnotify.DetailTypeFileChanged, gdnotify.DetailTypeFileRemoved},
+		},
+		{
+			name:     "empty string",
+			expr:     `detail.change.fileId == "file2" ? "" : "Custom " + detailType`,
+			expected: []string{"Custom File Changed", gdnotify.DetailTypeFileChanged, "Custom File Removed"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &gdnotify.NotificationConfig{
+				Type:           gdnotify.NotificationTypeEventBridge,
+				EventBus:       aws.String("default"),
+				DetailTypeExpr: c.expr,
+			}
+			require.NoError(t, cfg.Restrict())
+			client := &mockEventBridgeClient{}
+			n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+			require.NoError(t, n.SendChanges(context.Background(), item, changes))
+			actual := lo.Map(client.entries, func(entry types.PutEventsRequestEntry, _ int) string {
+				return *entry.DetailType
+			})
+			require.Equal(t, c.expected, actual, "the third change has no file, the evaluation fails")
+		})
+	}
+}
+
+func TestEventBridgeNotificationIncludeChannelMetadata(t *testing.T) {
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", ResourceID: "resource1", DriveID: "drive1"}
+	cases := []struct {
+		name     string
+		include  bool
+		expected map[string]interface{}
+	}{
+		{
+			name:     "default",
+			expected: map[string]interface{}{},
+		},
+		{
+			name:    "include",
+			include: true,
+			expected: map[string]interface{}{
+				"channelId":  "channel1",
+				"resourceId": "resource1",
+				"driveId":    "drive1",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &mockEventBridgeClient{}
+			n := gdnotify.NewEventBridgeNotificationWithClient(&gdnotify.NotificationConfig{
+				Type:                   gdnotify.NotificationTypeEventBridge,
+				EventBus:               aws.String("default"),
+				IncludeChannelMetadata: c.include,
+			}, client)
+			require.NoError(t, n.SendChanges(context.Background(), item, changes))
+			require.Len(t, client.entries, 1)
+			var detail map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(*client.entries[0].Detail), &detail))
+			actual := lo.PickByKeys(detail, []string{"channelId", "resourceId", "driveId"})
+			require.EqualValues(t, c.expected, actual)
+		})
+	}
+}
+
+func TestEventBridgeNotificationEntityLinks(t *testing.T) {
+	changes := []*drive.Change{
+		{
+			Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z",
+			File: &drive.File{
+				Id:          "file1",
+				Name:        "report",
+				WebViewLink: "https://docs.google.com/document/d/file1/edit",
+				IconLink:    "https://drive-thirdparty.googleusercontent.com/16/type/application/vnd.google-apps.document",
+			},
+		},
+	}
+	client := &mockEventBridgeClient{}
+	n := gdnotify.NewEventBridgeNotificationWithClient(&gdnotify.NotificationConfig{
+		Type:     gdnotify.NotificationTypeEventBridge,
+		EventBus: aws.String("default"),
+	}, client)
+	require.NoError(t, n.SendChanges(context.Background(), &gdnotify.ChannelItem{ChannelID: "channel1"}, changes))
+	require.Len(t, client.entries, 1)
+	var detail gdnotify.ChangeEventDetail
+	require.NoError(t, json.Unmarshal([]byte(*client.entries[0].Detail), &detail))
+	require.Equal(t, "https://docs.google.com/document/d/file1/edit", detail.Entity.WebViewLink)
+	require.Equal(t, "https://drive-thirdparty.googleusercontent.com/16/type/application/vnd.google-apps.document", detail.Entity.IconLink)
+}
+
+func TestEventBridgeNotificationRetryFailedEntries(t *testing.T) {
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file3", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file4", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	cfg := &gdnotify.NotificationConfig{
+		Type:          gdnotify.NotificationTypeEventBridge,
+		EventBus:      aws.String("default"),
+		RetryMinDelay: time.Millisecond,
+		RetryMaxDelay: 10 * time.Millisecond,
+	}
+	t.Run("retryable", func(t *testing.T) {
+		client := &mockEventBridgeClient{
+			failOnce: map[string]string{
+				"oss.gdnotify/drive1/file/file2": "ThrottlingException",
+				"oss.gdnotify/drive1/file/file4": "InternalFailure",
+			},
+		}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		require.NoError(t, n.SendChanges(context.Background(), item, changes))
+		require.Len(t, client.calls, 2)
+		require.EqualValues(t, []string{
+			"oss.gdnotify/drive1/file/file2",
+			"oss.gdnotify/drive1/file/file4",
+		}, client.calls[1], "only failed entries are retried")
+		require.ElementsMatch(t, []string{
+			"oss.gdnotify/drive1/file/file1",
+			"oss.gdnotify/drive1/file/file2",
+			"oss.gdnotify/drive1/file/file3",
+			"oss.gdnotify/drive1/file/file4",
+		}, client.Sources())
+	})
+	t.Run("not retryable", func(t *testing.T) {
+		client := &mockEventBridgeClient{
+			failOnce: map[string]string{
+				"oss.gdnotify/drive1/file/file2": "MalformedDetail",
+			},
+		}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		require.Error(t, n.SendChanges(context.Background(), item, changes))
+		require.Len(t, client.calls, 1)
+		require.Len(t, client.Sources(), 3)
+	})
+	t.Run("max retries", func(t *testing.T) {
+		client := &mockEventBridgeClient{
+			failOnce: map[string]string{
+				"oss.gdnotify/drive1/file/file2": "ThrottlingException",
+			},
+		}
+		cfg := *cfg
+		cfg.MaxRetries = aws.Int(0)
+		n := gdnotify.NewEventBridgeNotificationWithClient(&cfg, client)
+		require.Error(t, n.SendChanges(context.Background(), item, changes))
+		require.Len(t, client.calls, 1)
+	})
+}
+
+func TestChatNotification(t *testing.T) {
+	changes := lo.Map([]string{"file1", "file2", "file3", "file4", "file5"}, func(fileID string, _ int) *drive.Change {
+		return &drive.Change{
+			Kind: "drive#change", ChangeType: "file", FileId: fileID, Time: "2022-06-15T00:03:55.849Z",
+			File: &drive.File{Id: fileID, Name: fileID + ".txt", ModifiedTime: "2022-06-15T00:03:55.849Z",
+				LastModifyingUser: &drive.User{DisplayName: "hoge", EmailAddress: "hoge@example.com"}},
+		}
+	})
+	cases := []struct {
+		name     string
+		format   string
+		changes  []*drive.Change
+		expected []map[string]interface{}
+	}{
+		{
+			name:    "slack",
+			format:  gdnotify.ChatFormatSlack,
+			changes: changes[:2],
+			expected: []map[string]interface{}{
+				{"text": "*File Changed*\nFile file1.txt (file1) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z"},
+				{"text": "*File Changed*\nFile file2.txt (file2) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z"},
+			},
+		},
+		{
+			name:    "slack summary",
+			format:  gdnotify.ChatFormatSlack,
+			changes: changes,
+			expected: []map[string]interface{}{
+				{"text": "*5 changes in DriveId __default__*\n" +
+					"- [File Changed] File file1.txt (file1) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z\n" +
+					"- [File Changed] File file2.txt (file2) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z\n" +
+					"- [File Changed] File file3.txt (file3) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z\n" +
+					"...and 2 more changes"},
+			},
+		},
+		{
+			name:    "teams",
+			format:  gdnotify.ChatFormatTeams,
+			changes: changes[:1],
+			expected: []map[string]interface{}{
+				{
+					"@type":    "MessageCard",
+					"@context": "https://schema.org/extensions",
+					"summary":  "File Changed",
+					"title":    "File Changed",
+					"text":     "File file1.txt (file1) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z",
+				},
+			},
+		},
+		{
+			name:    "teams summary",
+			format:  gdnotify.ChatFormatTeams,
+			changes: changes[:4],
+			expected: []map[string]interface{}{
+				{
+					"@type":    "MessageCard",
+					"@context": "https://schema.org/extensions",
+					"summary":  "4 changes in DriveId __default__",
+					"title":    "4 changes in DriveId __default__",
+					"text": "- [File Changed] File file1.txt (file1) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z\n\n" +
+						"- [File Changed] File file2.txt (file2) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z\n\n" +
+						"- [File Changed] File file3.txt (file3) changed by hoge [hoge@example.com] at 2022-06-15T00:03:55.849Z\n\n" +
+						"...and 1 more changes",
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			messages := make([]map[string]interface{}, 0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var message map[string]interface{}
+				if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&message) != nil {
+					http.Error(w, "invalid_payload", http.StatusBadRequest)
+					return
+				}
+				mu.Lock()
+				messages = append(messages, message)
+				mu.Unlock()
+			}))
+			defer server.Close()
+			cfg := &gdnotify.NotificationConfig{
+				Type:                 gdnotify.NotificationTypeChat,
+				ChatWebhookURL:       aws.String(server.URL),
+				ChatFormat:           c.format,
+				ChatSummaryThreshold: 3,
+				ChatRateLimit:        100,
+			}
+			require.NoError(t, cfg.Restrict())
+			n, _, err := gdnotify.NewNotification(context.Background(), cfg, aws.Config{})
+			require.NoError(t, err)
+			item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}
+			require.NoError(t, n.SendChanges(context.Background(), item, c.changes))
+			require.Equal(t, c.expected, messages)
+		})
+	}
+}
+
+func TestChatNotificationErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer server.Close()
+	cfg := &gdnotify.NotificationConfig{
+		Type:           gdnotify.NotificationTypeChat,
+		ChatWebhookURL: aws.String(server.URL),
+	}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, gdnotify.ChatFormatSlack, cfg.ChatFormat)
+	require.Equal(t, gdnotify.DefaultChatSummaryThreshold, cfg.ChatSummaryThreshold)
+	n, _, err := gdnotify.NewChatNotification(context.Background(), cfg)
+	require.NoError(t, err)
+	err = n.SendChanges(context.Background(), &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}, []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	})
+	require.EqualError(t, err, "post chat webhook response status not ok (status:403): invalid_token")
+}
+
+func TestEventBridgeNotificationLifecycleEventWithoutErrorMessage(t *testing.T) {
+	cfg := &gdnotify.NotificationConfig{
+		Type:     gdnotify.NotificationTypeEventBridge,
+		EventBus: aws.String("default"),
+	}
+	client := &mockEventBridgeClient{
+		failOnce:       map[string]string{"oss.gdnotify/drive1/channel/channel1": "MalformedDetail"},
+		noErrorMessage: true,
+	}
+	n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+	e := gdnotify.NewLifecycleEvent(gdnotify.DetailTypeChannelCreated, &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}, nil)
+	require.EqualError(t, n.SendLifecycleEvent(context.Background(), e), "put events failed error_code=MalformedDetail, error_message=")
+}
+
+func TestEventBridgeNotificationLifecycleEventRetry(t *testing.T) {
+	cfg := &gdnotify.NotificationConfig{
+		Type:          gdnotify.NotificationTypeEventBridge,
+		EventBus:      aws.String("default"),
+		RetryMinDelay: time.Millisecond,
+		RetryMaxDelay: 10 * time.Millisecond,
+	}
+	e := gdnotify.NewLifecycleEvent(gdnotify.DetailTypeChannelCreated, &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}, nil)
+	t.Run("throttled", func(t *testing.T) {
+		client := &mockEventBridgeClient{
+			failOnce: map[string]string{"oss.gdnotify/drive1/channel/channel1": "ThrottlingException"},
+		}
+		n := gdnotify.NewEventBridgeNotificationWithClient(cfg, client)
+		require.NoError(t, n.SendLifecycleEvent(context.Background(), e))
+		require.Len(t, client.calls, 2, "retried")
+		require.Equal(t, []string{"oss.gdnotify/drive1/channel/channel1"}, client.Sources())
+	})
+	t.Run("max retries", func(t *testing.T) {
+		client := &mockEventBridgeClient{
+			failOnce: map[string]string{"oss.gdnotify/drive1/channel/channel1": "ThrottlingException"},
+		}
+		cfg := *cfg
+		cfg.MaxRetries = aws.Int(0)
+		n := gdnotify.NewEventBridgeNotificationWithClient(&cfg, client)
+		require.EqualError(t, n.SendLifecycleEvent(context.Background(), e), "put events failed error_code=ThrottlingException, error_message=failed")
+		require.Len(t, client.calls, 1)
+	})
+}
+
+type mockKinesisClient struct {
+	mu       sync.Mutex
+	inputs   []*kinesis.PutRecordsInput
+	calls    [][]string
+	records  []kinesistypes.PutRecordsRequestEntry
+	failOnce map[string]string
+}
+
+func (c *mockKinesisClient) PutRecords(_ context.Context, params *kinesis.PutRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inputs = append(c.inputs, params)
+	output := &kinesis.PutRecordsOutput{
+		Records:           make([]kinesistypes.PutRecordsResultEntry, 0, len(params.Records)),
+		FailedRecordCount: aws.Int32(0),
+	}
+	keys := make([]string, 0, len(params.Records))
+	for _, record := range params.Records {
+		keys = append(keys, *record.PartitionKey)
+		if code, ok := c.failOnce[*record.PartitionKey]; ok {
+			delete(c.failOnce, *record.PartitionKey)
+			*output.FailedRecordCount++
+			output.Records = append(output.Records, kinesistypes.PutRecordsResultEntry{
+				ErrorCode:    aws.String(code),
+				ErrorMessage: aws.String("failed"),
+			})
+			continue
+		}
+		c.records = append(c.records, record)
+		output.Records = append(output.Records, kinesistypes.PutRecordsResultEntry{
+			SequenceNumber: aws.String("49590338271490256608559692538361571095921575989136588898"),
+			ShardId:        aws.String("shardId-000000000000"),
+		})
+	}
+	c.calls = append(c.calls, keys)
+	return output, nil
+}
+
+func (c *mockKinesisClient) PartitionKeys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.records))
+	for _, record := range c.records {
+		keys = append(keys, *record.PartitionKey)
+	}
+	return keys
+}
+
+func TestKinesisNotification(t *testing.T) {
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1", ResourceID: "resource1"}
+	cfg := &gdnotify.NotificationConfig{
+		Type:                   gdnotify.NotificationTypeKinesis,
+		StreamName:             aws.String("gdnotify"),
+		IncludeChannelMetadata: true,
+	}
+	client := &mockKinesisClient{}
+	n := gdnotify.NewKinesisNotificationWithClient(cfg, client)
+	require.NoError(t, n.SendChanges(context.Background(), item, []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		{Kind: "drive#change", ChangeType: "drive", DriveId: "drive1", Time: "2022-06-15T00:03:55.849Z"},
+	}))
+	require.Len(t, client.inputs, 1)
+	require.Equal(t, "gdnotify", aws.ToString(client.inputs[0].StreamName))
+	require.Nil(t, client.inputs[0].StreamARN)
+	require.Equal(t, []string{"file1", "drive1"}, client.PartitionKeys(), "partitioned by the file ID, or the drive ID")
+	var detail gdnotify.ChangeEventDetail
+	require.NoError(t, json.Unmarshal(client.records[0].Data, &detail))
+	require.Equal(t, "file1", detail.Change.FileId)
+	require.Equal(t, "channel1", detail.ChannelID)
+
+	t.Run("stream arn", func(t *testing.T) {
+		cfg := *cfg
+		cfg.StreamName = aws.String("arn:aws:kinesis:ap-northeast-1:123456789012:stream/gdnotify")
+		client := &mockKinesisClient{}
+		n := gdnotify.NewKinesisNotificationWithClient(&cfg, client)
+		require.NoError(t, n.SendChanges(context.Background(), item, []*drive.Change{{FileId: "file1"}}))
+		require.Nil(t, client.inputs[0].StreamName)
+		require.Equal(t, *cfg.StreamName, aws.ToString(client.inputs[0].StreamARN))
+	})
+}
+
+func TestKinesisNotificationBatch(t *testing.T) {
+	changes := make([]*drive.Change, 0, 1201)
+	for i := 0; i < 1201; i++ {
+		changes = append(changes, &drive.Change{Kind: "drive#change", ChangeType: "file", FileId: fmt.Sprintf("file%d", i)})
+	}
+	client := &mockKinesisClient{}
+	n := gdnotify.NewKinesisNotificationWithClient(&gdnotify.NotificationConfig{
+		Type:       gdnotify.NotificationTypeKinesis,
+		StreamName: aws.String("gdnotify"),
+	}, client)
+	require.NoError(t, n.SendChanges(context.Background(), &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}, changes))
+	require.Len(t, client.calls, 3)
+	require.Len(t, client.calls[0], 500)
+	require.Len(t, client.calls[1], 500)
+	require.Len(t, client.calls[2], 201)
+	require.Len(t, client.PartitionKeys(), 1201)
+}
+
+func TestKinesisNotificationRetryFailedRecords(t *testing.T) {
+	changes := []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file2"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file3"},
+		{Kind: "drive#change", ChangeType: "file", FileId: "file4"},
+	}
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	cfg := &gdnotify.NotificationConfig{
+		Type:          gdnotify.NotificationTypeKinesis,
+		StreamName:    aws.String("gdnotify"),
+		RetryMinDelay: time.Millisecond,
+		RetryMaxDelay: 10 * time.Millisecond,
+	}
+	t.Run("retryable", func(t *testing.T) {
+		client := &mockKinesisClient{
+			failOnce: map[string]string{
+				"file2": "ProvisionedThroughputExceededException",
+				"file4": "InternalFailure",
+			},
+		}
+		n := gdnotify.NewKinesisNotificationWithClient(cfg, client)
+		require.NoError(t, n.SendChanges(context.Background(), item, changes))
+		require.Len(t, client.calls, 2)
+		require.Equal(t, []string{"file2", "file4"}, client.calls[1], "only failed records are retried")
+		require.ElementsMatch(t, []string{"file1", "file2", "file3", "file4"}, client.PartitionKeys())
+	})
+	t.Run("not retryable", func(t *testing.T) {
+		client := &mockKinesisClient{
+			failOnce: map[string]string{
+				"file2": "KMSAccessDeniedException",
+			},
+		}
+		n := gdnotify.NewKinesisNotificationWithClient(cfg, client)
+		require.ErrorContains(t, n.SendChanges(context.Background(), item, changes), "error_code=KMSAccessDeniedException")
+		require.Len(t, client.calls, 1)
+		require.Len(t, client.PartitionKeys(), 3)
+	})
+	t.Run("max retries", func(t *testing.T) {
+		client := &mockKinesisClient{
+			failOnce: map[string]string{
+				"file2": "ProvisionedThroughputExceededException",
+			},
+		}
+		cfg := *cfg
+		cfg.MaxRetries = aws.Int(0)
+		n := gdnotify.NewKinesisNotificationWithClient(&cfg, client)
+		require.Error(t, n.SendChanges(context.Background(), item, changes))
+		require.Len(t, client.calls, 1)
+	})
+}
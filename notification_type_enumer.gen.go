@@ -7,11 +7,11 @@ import (
 	"strings"
 )
 
-const _NotificationTypeName = "EventBridgeFile"
+const _NotificationTypeName = "EventBridgeFileMultiChatKinesis"
 
-var _NotificationTypeIndex = [...]uint8{0, 11, 15}
+var _NotificationTypeIndex = [...]uint8{0, 11, 15, 20, 24, 31}
 
-const _NotificationTypeLowerName = "eventbridgefile"
+const _NotificationTypeLowerName = "eventbridgefilemultichatkinesis"
 
 func (i NotificationType) String() string {
 	if i < 0 || i >= NotificationType(len(_NotificationTypeIndex)-1) {
@@ -26,20 +26,32 @@ func _NotificationTypeNoOp() {
 	var x [1]struct{}
 	_ = x[NotificationTypeEventBridge-(0)]
 	_ = x[NotificationTypeFile-(1)]
+	_ = x[NotificationTypeMulti-(2)]
+	_ = x[NotificationTypeChat-(3)]
+	_ = x[NotificationTypeKinesis-(4)]
 }
 
-var _NotificationTypeValues = []NotificationType{NotificationTypeEventBridge, NotificationTypeFile}
+var _NotificationTypeValues = []NotificationType{NotificationTypeEventBridge, NotificationTypeFile, NotificationTypeMulti, NotificationTypeChat, NotificationTypeKinesis}
 
 var _NotificationTypeNameToValueMap = map[string]NotificationType{
 	_NotificationTypeName[0:11]:       NotificationTypeEventBridge,
 	_NotificationTypeLowerName[0:11]:  NotificationTypeEventBridge,
 	_NotificationTypeName[11:15]:      NotificationTypeFile,
 	_NotificationTypeLowerName[11:15]: NotificationTypeFile,
+	_NotificationTypeName[15:20]:      NotificationTypeMulti,
+	_NotificationTypeLowerName[15:20]: NotificationTypeMulti,
+	_NotificationTypeName[20:24]:      NotificationTypeChat,
+	_NotificationTypeLowerName[20:24]: NotificationTypeChat,
+	_NotificationTypeName[24:31]:      NotificationTypeKinesis,
+	_NotificationTypeLowerName[24:31]: NotificationTypeKinesis,
 }
 
 var _NotificationTypeNames = []string{
 	_NotificationTypeName[0:11],
 	_NotificationTypeName[11:15],
+	_NotificationTypeName[15:20],
+	_NotificationTypeName[20:24],
+	_NotificationTypeName[24:31],
 }
 
 // NotificationTypeString retrieves an enum value from the enum constants string name.
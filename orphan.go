@@ -0,0 +1,140 @@
+package gdnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// orphanChannelThreshold is the number of webhooks received for an unknown channel before it is stopped.
+// A single unknown webhook may race with channel creation, so the channel is stopped only when it repeats.
+const orphanChannelThreshold = 2
+
+const (
+	// orphanChannelTTL is how long an unknown channel is remembered since its last webhook.
+	orphanChannelTTL = time.Hour
+	// maxOrphanChannels caps the number of unknown channels remembered, the least recently seen one is dropped first.
+	maxOrphanChannels = 1000
+	// maxOrphanStopFailures is the number of failed channels:stop after which an orphaned channel is given up.
+	maxOrphanStopFailures = 3
+)
+
+// orphanChannel is a channel that is active on Google Drive, but not found in the storage.
+// It happens when the storage is wiped while the channels are still active.
+type orphanChannel struct {
+	channelID  string
+	resourceID string
+	count      int
+	failures   int
+	lastSeen   time.Time
+}
+
+func (app *App) recordOrphanChannel(ctx context.Context, channelID, resourceID string) {
+	if channelID == "" || resourceID == "" {
+		return
+	}
+	now := app.clock.Now()
+	app.orphanMu.Lock()
+	defer app.orphanMu.Unlock()
+	app.evictOrphanChannels(now)
+	o, ok := app.orphanChannels[channelID]
+	if !ok {
+		if len(app.orphanChannels) >= maxOrphanChannels {
+			app.evictOldestOrphanChannel()
+		}
+		o = &orphanChannel{
+			channelID:  channelID,
+			resourceID: resourceID,
+		}
+		app.orphanChannels[channelID] = o
+	}
+	o.count++
+	o.lastSeen = now
+	logx.Printf(ctx, "[warn] unknown channel webhook received channel_id=%s resource_id=%s count=%d", channelID, resourceID, o.count)
+}
+
+// evictOrphanChannels drops the unknown channels not seen within orphanChannelTTL, orphanMu must be held.
+func (app *App) evictOrphanChannels(now time.Time) {
+	for channelID, o := range app.orphanChannels {
+		if now.Sub(o.lastSeen) > orphanChannelTTL {
+			delete(app.orphanChannels, channelID)
+		}
+	}
+}
+
+// evictOldestOrphanChannel drops the least recently seen unknown channel, orphanMu must be held.
+func (app *App) evictOldestOrphanChannel() {
+	var oldest *orphanChannel
+	for _, o := range app.orphanChannels {
+		if oldest == nil || o.lastSeen.Before(oldest.lastSeen) {
+			oldest = o
+		}
+	}
+	if oldest != nil {
+		delete(app.orphanChannels, oldest.channelID)
+	}
+}
+
+// ReconcileOrphans stops the orphaned channels that webhooks were received repeatedly for.
+func (app *App) ReconcileOrphans(ctx context.Context) error {
+	app.orphanMu.Lock()
+	targets := make([]*orphanChannel, 0, len(app.orphanChannels))
+	for _, o := range app.orphanChannels {
+		if o.count >= orphanChannelThreshold {
+			targets = append(targets, o)
+		}
+	}
+	app.orphanMu.Unlock()
+	var errs []error
+	for _, o := range targets {
+		if err := app.StopOrphanChannel(ctx, o.channelID, o.resourceID); err != nil {
+			errs = append(errs, err)
+			app.orphanMu.Lock()
+			o.failures++
+			if o.failures >= maxOrphanStopFailures {
+				logx.Printf(ctx, "[warn] give up stopping orphaned channel channel_id=%s resource_id=%s failures=%d", o.channelID, o.resourceID, o.failures)
+				delete(app.orphanChannels, o.channelID)
+			}
+			app.orphanMu.Unlock()
+			continue
+		}
+		app.orphanMu.Lock()
+		delete(app.orphanChannels, o.channelID)
+		app.orphanMu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// StopOrphanChannel stops the channel on Google Drive, if it is not found in the storage.
+func (app *App) StopOrphanChannel(ctx context.Context, channelID, resourceID string) error {
+	_, err := app.storage.FindOneByChannelID(ctx, channelID)
+	if err == nil {
+		return fmt.Errorf("channel_id:%s is found in the storage, not orphaned", channelID)
+	}
+	if !errors.Is(err, ErrChannelNotFound) {
+		return fmt.Errorf("find channel: %w", err)
+	}
+	logx.Printf(ctx, "[info] stop orphaned channel channel_id=%s resource_id=%s", channelID, resourceID)
+	if err := app.waitDriveAPI(ctx); err != nil {
+		return err
+	}
+	err = app.driveSvc.Channels.Stop(&drive.Channel{
+		Id:         channelID,
+		ResourceId: resourceID,
+	}).Context(ctx).Do()
+	if err != nil {
+		var apiError *googleapi.Error
+		if errors.As(err, &apiError) && apiError.Code == http.StatusNotFound {
+			logx.Printf(ctx, "[warn] orphaned channel is already stopped channel_id=%s resource_id=%s", channelID, resourceID)
+			return nil
+		}
+		return fmt.Errorf("drive API channels:stop:%w", err)
+	}
+	return nil
+}
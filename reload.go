@@ -0,0 +1,141 @@
+package gdnotify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+	"github.com/samber/lo"
+)
+
+// appSettings is the part of the configuration that can be replaced by Reload while the webhook server is running.
+type appSettings struct {
+	drivesAutoDetect          bool
+	drives                    map[string]*DriveConfig
+	expiration                time.Duration
+	expirationJitter          time.Duration
+	rotateRemaining           time.Duration
+	webhookAddresses          []string
+	withinModifiedTime        *time.Duration
+	includeDriveChangesAlways bool
+	changeTypes               map[string]bool
+	suppressSelfEdits         bool
+	suppressVersionNoops      bool
+	includePermissions        bool
+	changeFileFields          []string
+	selfEditEmails            map[string]bool
+	includeDriveIDs           map[string]bool
+	excludeDriveIDs           map[string]bool
+	parentFolderIDs           map[string]bool
+}
+
+func newAppSettings(cfg *Config) *appSettings {
+	drives := lo.FromEntries(lo.Map(cfg.Drives, func(cfg *DriveConfig, _ int) lo.Entry[string, *DriveConfig] {
+		return lo.Entry[string, *DriveConfig]{
+			Key:   cfg.DriveID,
+			Value: cfg,
+		}
+	}))
+	toSet := func(values []string, normalize func(string) string) map[string]bool {
+		return lo.FromEntries(lo.Map(values, func(value string, _ int) lo.Entry[string, bool] {
+			return lo.Entry[string, bool]{
+				Key:   normalize(value),
+				Value: true,
+			}
+		}))
+	}
+	identity := func(value string) string { return value }
+	rotateRemaining := time.Duration(0.2 * float64(cfg.Expiration))
+	log.Printf("[debug] cfg.Expiration=%s 20%% rotateRemaining=%s", cfg.Expiration, rotateRemaining)
+	return &appSettings{
+		drivesAutoDetect:          cfg.DrivesAutoDetect != nil && *cfg.DrivesAutoDetect,
+		drives:                    drives,
+		expiration:                cfg.Expiration,
+		expirationJitter:          cfg.ExpirationJitter,
+		rotateRemaining:           rotateRemaining,
+		webhookAddresses:          webhookAddresses(cfg),
+		withinModifiedTime:        cfg.WithinModifiedTime,
+		includeDriveChangesAlways: cfg.IncludeDriveChangesAlways,
+		changeTypes:               toSet(cfg.ChangeTypes, identity),
+		suppressSelfEdits:         cfg.SuppressSelfEdits,
+		suppressVersionNoops:      cfg.SuppressVersionNoops,
+		includePermissions:        cfg.IncludePermissions,
+		changeFileFields:          cfg.ChangeFileFields,
+		selfEditEmails:            toSet(cfg.SelfEditEmails, strings.ToLower),
+		includeDriveIDs:           toSet(cfg.IncludeDriveIDs, identity),
+		excludeDriveIDs:           toSet(cfg.ExcludeDriveIDs, identity),
+		parentFolderIDs:           toSet(cfg.ParentFolderIDs, identity),
+	}
+}
+
+// describe returns the settings as the config keys and the printable values, for logging what is changed by Reload.
+func (s *appSettings) describe() map[string]string {
+	keys := func(m map[string]bool) string {
+		ks := lo.Keys(m)
+		sort.Strings(ks)
+		return "[" + strings.Join(ks, ",") + "]"
+	}
+	drives := lo.MapToSlice(s.drives, func(driveID string, cfg *DriveConfig) string {
+		if cfg.Expiration > 0 {
+			return fmt.Sprintf("%s(expiration=%s)", driveID, cfg.Expiration)
+		}
+		return driveID
+	})
+	sort.Strings(drives)
+	withinModifiedTime := "-"
+	if s.withinModifiedTime != nil {
+		withinModifiedTime = s.withinModifiedTime.String()
+	}
+	return map[string]string{
+		"drives_auto_detect":           fmt.Sprint(s.drivesAutoDetect),
+		"drives":                       "[" + strings.Join(drives, ",") + "]",
+		"expiration":                   s.expiration.String(),
+		"expiration_jitter":            s.expirationJitter.String(),
+		"webhook_addresses":            "[" + strings.Join(s.webhookAddresses, ",") + "]",
+		"within_modified_time":         withinModifiedTime,
+		"include_drive_changes_always": fmt.Sprint(s.includeDriveChangesAlways),
+		"change_types":                 keys(s.changeTypes),
+		"suppress_self_edits":          fmt.Sprint(s.suppressSelfEdits),
+		"suppress_version_noops":       fmt.Sprint(s.suppressVersionNoops),
+		"include_permissions":          fmt.Sprint(s.includePermissions),
+		"change_file_fields":           "[" + strings.Join(s.changeFileFields, ",") + "]",
+		"self_edit_emails":             keys(s.selfEditEmails),
+		"include_drive_ids":            keys(s.includeDriveIDs),
+		"exclude_drive_ids":            keys(s.excludeDriveIDs),
+		"parent_folder_ids":            keys(s.parentFolderIDs),
+	}
+}
+
+func (app *App) currentSettings() *appSettings {
+	app.settingsMu.RLock()
+	defer app.settingsMu.RUnlock()
+	return app.settings
+}
+
+// Reload replaces the webhook addresses, the expiration, the drives and the change filters with the ones of cfg, without stopping the webhook server.
+// cfg must be loaded and restricted. The storage, the notification, the credentials and the server settings are not reloaded.
+func (app *App) Reload(ctx context.Context, cfg *Config) {
+	settings := newAppSettings(cfg)
+	app.settingsMu.Lock()
+	old := app.settings
+	app.settings = settings
+	app.settingsMu.Unlock()
+
+	before, after := old.describe(), settings.describe()
+	keys := lo.Keys(after)
+	sort.Strings(keys)
+	changed := 0
+	for _, key := range keys {
+		if before[key] != after[key] {
+			logx.Printf(ctx, "[info] reload config %s: %s -> %s", key, before[key], after[key])
+			changed++
+		}
+	}
+	if changed == 0 {
+		logx.Println(ctx, "[info] reload config: no changes")
+	}
+}
@@ -0,0 +1,130 @@
+package gdnotify
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	logx "github.com/mashiike/go-logx"
+	"google.golang.org/api/drive/v3"
+)
+
+// ReplayOptions is the options of Replay.
+type ReplayOptions struct {
+	// PageToken is the page token to replay the changes from, the stored page token of the channel if empty.
+	PageToken string `json:"pageToken,omitempty"`
+	// AdvancePageToken persists the new start page token after the replay, as a change notification does.
+	AdvancePageToken bool `json:"advancePageToken,omitempty"`
+}
+
+// ReplayResult is the result of Replay.
+type ReplayResult struct {
+	ChannelID    string `json:"channelId"`
+	PageToken    string `json:"pageToken"`
+	NewPageToken string `json:"newPageToken"`
+	Changes      int    `json:"changes"`
+	Advanced     bool   `json:"advanced"`
+}
+
+// Replay fetches the changes of the channel from the page token again and re-sends the notifications.
+// The stored page token is not advanced unless opts.AdvancePageToken is true. files:watch channels can not be replayed.
+func (app *App) Replay(ctx context.Context, channelID string, opts *ReplayOptions) (*ReplayResult, error) {
+	if opts == nil {
+		opts = &ReplayOptions{}
+	}
+	item, err := app.findChannel(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if item.FileID != "" {
+		return nil, fmt.Errorf("channel_id=%s is a files:watch channel, it has no page token to replay", channelID)
+	}
+	replayItem := *item
+	replayItem.PageToken = coalesce(opts.PageToken, item.PageToken)
+	logx.Printf(ctx, "[info] replay channel_id=%s drive_id=%s page_token=%s advance_page_token=%v",
+		item.ChannelID, item.DriveID, replayItem.PageToken, opts.AdvancePageToken,
+	)
+	processed := 0
+	var sendErr error
+	newItem, err := app.changesPages(ctx, &replayItem, func(changes []*drive.Change) error {
+		processed += len(changes)
+		if err := app.sendChangesPage(ctx, item, changes); err != nil {
+			logx.Printf(ctx, "[error] replay send changes failed channel_id:%s resource_id:%s err:%s",
+				coalesce(item.ChannelID, "-"),
+				coalesce(item.ResourceID, "-"),
+				err.Error(),
+			)
+			sendErr = err
+		}
+		return nil
+	}, opts.AdvancePageToken)
+	if err != nil {
+		return nil, err
+	}
+	if sendErr != nil {
+		return nil, fmt.Errorf("replay send changes: %w", sendErr)
+	}
+	return &ReplayResult{
+		ChannelID:    item.ChannelID,
+		PageToken:    replayItem.PageToken,
+		NewPageToken: newItem.PageToken,
+		Changes:      processed,
+		Advanced:     opts.AdvancePageToken,
+	}, nil
+}
+
+type replayRequest struct {
+	ChannelID string `json:"channelId"`
+	ReplayOptions
+}
+
+// handleReplay is POST /replay, it is registered only if server.replay_token is set.
+func (app *App) handleReplay(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer r.Body.Close()
+	writeError := func(status int, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !hmac.Equal([]byte(token), []byte(app.replayToken)) {
+		logx.Println(ctx, "[warn] invalid replay token, return 401")
+		writeError(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+	var req replayRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if req.ChannelID == "" {
+		writeError(http.StatusBadRequest, "channelId is required")
+		return
+	}
+	ctx, done := app.startWork(ctx)
+	defer done()
+	result, err := app.Replay(ctx, req.ChannelID, &req.ReplayOptions)
+	if err != nil {
+		logx.Printf(ctx, "[error] replay failed channel_id:%s err:%s", req.ChannelID, err.Error())
+		if errors.Is(err, ErrChannelNotFound) {
+			writeError(http.StatusNotFound, err.Error())
+			return
+		}
+		writeError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,101 @@
+package gdnotify
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/shogo82148/go-retry"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy is the retry policy of Drive API calls.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first call, 0 means no retry.
+	MaxRetries int
+	MinDelay   time.Duration
+	MaxDelay   time.Duration
+	// Retryable reports whether a failed call is retried, the default classification of rate limit, server and network timeout errors if nil.
+	Retryable func(err error) bool
+}
+
+// SetRetryPolicy replaces the retry policy of Drive API calls, which is built from drive_api by default.
+// It must be called before the App is run.
+func (app *App) SetRetryPolicy(policy RetryPolicy) {
+	app.driveAPIRetryPolicy = &retry.Policy{
+		MinDelay: policy.MinDelay,
+		MaxDelay: policy.MaxDelay,
+		MaxCount: policy.MaxRetries + 1,
+	}
+	app.driveAPIRetryable = policy.Retryable
+	if app.driveAPIRetryable == nil {
+		app.driveAPIRetryable = isRetryable
+	}
+}
+
+// isRetryable reports whether the error of Google Drive, DynamoDB or EventBridge is transient:
+// rate limit, throttling, server errors and network timeouts.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiError *googleapi.Error
+	if errors.As(err, &apiError) {
+		switch {
+		case apiError.Code == http.StatusTooManyRequests || apiError.Code >= 500:
+			return true
+		case apiError.Code == http.StatusForbidden:
+			for _, item := range apiError.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) && isRetryableErrorCode(ae.ErrorCode()) {
+		return true
+	}
+	var re interface{ HTTPStatusCode() int }
+	if errors.As(err, &re) && (re.HTTPStatusCode() == http.StatusTooManyRequests || re.HTTPStatusCode() >= 500) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// isRetryableErrorCode reports whether the error code of AWS APIs, or of a PutEvents entry, is throttling or a server error.
+func isRetryableErrorCode(code string) bool {
+	switch code {
+	case "ThrottlingException", "Throttling", "ThrottledException", "TooManyRequestsException",
+		"RequestLimitExceeded", "RequestThrottled", "RequestThrottledException", "ProvisionedThroughputExceededException",
+		"TransactionInProgressException", "InternalFailure", "InternalException", "InternalServerError", "ServiceUnavailable":
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfterOf returns the duration of Retry-After header of the Google API error, 0 if none.
+func retryAfterOf(err error) time.Duration {
+	var apiError *googleapi.Error
+	if !errors.As(err, &apiError) {
+		return 0
+	}
+	v := apiError.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,71 @@
+package gdnotify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/mashiike/gdnotify"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	responseError := func(status int) error {
+		return &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      errors.New("response error"),
+		}
+	}
+	cases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "drive rate limit", err: &googleapi.Error{Code: http.StatusTooManyRequests}, expected: true},
+		{name: "drive server error", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, expected: true},
+		{
+			name: "drive user rate limit",
+			err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{
+				{Reason: "userRateLimitExceeded"},
+			}},
+			expected: true,
+		},
+		{
+			name: "drive forbidden",
+			err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{
+				{Reason: "insufficientFilePermissions"},
+			}},
+			expected: false,
+		},
+		{name: "drive not found", err: &googleapi.Error{Code: http.StatusNotFound}, expected: false},
+		{name: "wrapped drive server error", err: fmt.Errorf("changes:list: %w", &googleapi.Error{Code: http.StatusInternalServerError}), expected: true},
+		{name: "dynamodb throughput exceeded", err: &types.ProvisionedThroughputExceededException{}, expected: true},
+		{name: "dynamodb request limit", err: &types.RequestLimitExceeded{}, expected: true},
+		{name: "dynamodb internal server error", err: &types.InternalServerError{}, expected: true},
+		{name: "dynamodb conditional check failed", err: &types.ConditionalCheckFailedException{}, expected: false},
+		{name: "dynamodb table not found", err: &types.ResourceNotFoundException{}, expected: false},
+		{name: "eventbridge throttling", err: &smithy.GenericAPIError{Code: "ThrottlingException"}, expected: true},
+		{name: "eventbridge internal", err: &ebtypes.InternalException{}, expected: true},
+		{name: "eventbridge not found", err: &ebtypes.ResourceNotFoundException{}, expected: false},
+		{name: "aws server error response", err: responseError(http.StatusBadGateway), expected: true},
+		{name: "aws bad request response", err: responseError(http.StatusBadRequest), expected: false},
+		{name: "network timeout", err: &url.Error{Op: "Post", URL: "https://example.com", Err: os.ErrDeadlineExceeded}, expected: true},
+		{name: "context canceled", err: context.Canceled, expected: false},
+		{name: "plain error", err: errors.New("something wrong"), expected: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, gdnotify.IsRetryable(c.err))
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package gdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+	"github.com/olekukonko/tablewriter"
+)
+
+// ChannelStats is the aggregate health of notification channels.
+type ChannelStats struct {
+	TotalChannels    int            `json:"totalChannels"`
+	ChannelsPerDrive map[string]int `json:"channelsPerDrive"`
+	// AboutToExpire is the number of channels to be rotated at the next maintenance.
+	AboutToExpire int `json:"aboutToExpire"`
+	// OldestPageTokenAge is the elapsed time since the oldest start page token was fetched, in nanoseconds for JSON.
+	OldestPageTokenAge   time.Duration `json:"oldestPageTokenAge"`
+	DrivesWithoutChannel []string      `json:"drivesWithoutChannel"`
+}
+
+// Stats returns the aggregate health of notification channels in the storage.
+func (app *App) Stats(ctx context.Context) (*ChannelStats, error) {
+	// DriveIDs first, the scan of the storage blocks until the channels are read.
+	driveIDs, err := app.DriveIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get DriveIDs: %w", err)
+	}
+	itemsCh, err := app.storage.FindAllChannels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("find all channels: %w", err)
+	}
+	now := app.clock.Now()
+	stats := &ChannelStats{
+		ChannelsPerDrive:     make(map[string]int),
+		DrivesWithoutChannel: make([]string, 0),
+	}
+	for items := range itemsCh {
+		for _, item := range items {
+			stats.TotalChannels++
+			if item.FileID == "" {
+				stats.ChannelsPerDrive[item.DriveID]++
+			}
+			if item.isAboutToExpiredAt(ctx, now, app.driveRotateRemaining(item.DriveID)) {
+				stats.AboutToExpire++
+			}
+			if age := now.Sub(item.PageTokenFetchedAt); age > stats.OldestPageTokenAge {
+				stats.OldestPageTokenAge = age
+			}
+		}
+	}
+	for _, driveID := range driveIDs {
+		if stats.ChannelsPerDrive[driveID] == 0 {
+			stats.DrivesWithoutChannel = append(stats.DrivesWithoutChannel, driveID)
+		}
+	}
+	sort.Strings(stats.DrivesWithoutChannel)
+	logx.Printf(ctx, "[debug] stats total_channels=%d about_to_expire=%d", stats.TotalChannels, stats.AboutToExpire)
+	return stats, nil
+}
+
+// WriteStats writes the stats to w, format is `table` (default) or `json`.
+func (app *App) WriteStats(ctx context.Context, w io.Writer, format string) error {
+	switch format {
+	case ListFormatTable, ListFormatJSON, "":
+	default:
+		return fmt.Errorf("unknown stats format `%s`", format)
+	}
+	stats, err := app.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if format == ListFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	driveIDs := make([]string, 0, len(stats.ChannelsPerDrive))
+	for driveID := range stats.ChannelsPerDrive {
+		driveIDs = append(driveIDs, driveID)
+	}
+	sort.Strings(driveIDs)
+	perDrive := make([]string, 0, len(driveIDs))
+	for _, driveID := range driveIDs {
+		perDrive = append(perDrive, fmt.Sprintf("%s=%d", driveID, stats.ChannelsPerDrive[driveID]))
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Name", "Value"})
+	table.AppendBulk([][]string{
+		{"Total Channels", strconv.Itoa(stats.TotalChannels)},
+		{"Channels Per Drive", strings.Join(perDrive, ", ")},
+		{"About To Expire", strconv.Itoa(stats.AboutToExpire)},
+		{"Oldest Page Token Age", stats.OldestPageTokenAge.String()},
+		{"Drives Without Channel", strings.Join(stats.DrivesWithoutChannel, ", ")},
+	})
+	table.Render()
+	return nil
+}
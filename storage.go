@@ -2,13 +2,19 @@ package gdnotify
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Songmu/flextime"
@@ -28,13 +34,20 @@ type ChannelItem struct {
 	PageToken          string
 	ResourceID         string
 	DriveID            string
+	FileID             string
+	WebhookAddress     string
+	LastMessageNumber  int64
+	LastChangeAt       time.Time
 	PageTokenFetchedAt time.Time
 	CreatedAt          time.Time
 	UpdatedAt          time.Time
 }
 
 func (item *ChannelItem) IsAboutToExpired(ctx context.Context, remaining time.Duration) bool {
-	now := flextime.Now()
+	return item.isAboutToExpiredAt(ctx, flextime.Now(), remaining)
+}
+
+func (item *ChannelItem) isAboutToExpiredAt(ctx context.Context, now time.Time, remaining time.Duration) bool {
 	d := item.Expiration.Sub(now)
 	logx.Printf(ctx, "[debug] IsAboutToExpired remaining=%s expiration=%s, now=%s, channel_id=%s, resource_id=%s, drive_id=%s ",
 		d, item.Expiration.Format(time.RFC3339), now.Format(time.RFC3339), item.ChannelID, item.ResourceID, item.DriveID,
@@ -78,6 +91,26 @@ func NewChannelItemWithDynamoDBAttributeValues(values map[string]types.Attribute
 	if ok {
 		item.DriveID = driveIDValue.Value
 	}
+	fileIDValue, ok := GetAttributeValueAs[*types.AttributeValueMemberS]("FileID", values)
+	if ok {
+		item.FileID = fileIDValue.Value
+	}
+	webhookAddressValue, ok := GetAttributeValueAs[*types.AttributeValueMemberS]("WebhookAddress", values)
+	if ok {
+		item.WebhookAddress = webhookAddressValue.Value
+	}
+	lastMessageNumberValue, ok := GetAttributeValueAs[*types.AttributeValueMemberN]("LastMessageNumber", values)
+	if ok {
+		if lastMessageNumber, err := strconv.ParseInt(lastMessageNumberValue.Value, 10, 64); err == nil {
+			item.LastMessageNumber = lastMessageNumber
+		}
+	}
+	lastChangeAtValue, ok := GetAttributeValueAs[*types.AttributeValueMemberN]("LastChangeAt", values)
+	if ok {
+		if lastChangeAt, err := strconv.ParseFloat(lastChangeAtValue.Value, 64); err == nil {
+			item.LastChangeAt = time.UnixMilli(int64(lastChangeAt))
+		}
+	}
 	pageTokenFetchedAtValue, ok := GetAttributeValueAs[*types.AttributeValueMemberN]("PageTokenFetchedAt", values)
 	if ok {
 		if pageTokenFetchedAt, err := strconv.ParseFloat(pageTokenFetchedAtValue.Value, 64); err == nil {
@@ -120,6 +153,12 @@ func (item *ChannelItem) ToDynamoDBAttributeValues() map[string]types.AttributeV
 		"DriveID": &types.AttributeValueMemberS{
 			Value: item.DriveID,
 		},
+		"WebhookAddress": &types.AttributeValueMemberS{
+			Value: item.WebhookAddress,
+		},
+		"LastMessageNumber": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(item.LastMessageNumber, 10),
+		},
 		"PageTokenFetchedAt": &types.AttributeValueMemberN{
 			Value: pageTokenFetchedAt,
 		},
@@ -130,6 +169,16 @@ func (item *ChannelItem) ToDynamoDBAttributeValues() map[string]types.AttributeV
 			Value: updatedAt,
 		},
 	}
+	if item.FileID != "" {
+		values["FileID"] = &types.AttributeValueMemberS{
+			Value: item.FileID,
+		}
+	}
+	if !item.LastChangeAt.IsZero() {
+		values["LastChangeAt"] = &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(float64(item.LastChangeAt.UnixMilli()), 'f', -1, 64),
+		}
+	}
 	return values
 }
 
@@ -141,6 +190,18 @@ type Storage interface {
 	DeleteChannel(context.Context, *ChannelItem) error
 }
 
+// ResumableStorage is a Storage that can find all channels page by page, to checkpoint and resume iterating huge channel sets.
+// FindAllChannelsFrom returns a page of channels from the cursor, empty for the first page, and the cursor of the next page, empty if it is the last page.
+// The cursor is opaque.
+type ResumableStorage interface {
+	Storage
+	FindAllChannelsFrom(ctx context.Context, cursor string) (<-chan []*ChannelItem, string, error)
+}
+
+// ErrChannelNotFound matches *ChannelNotFound by errors.Is, for callers that do not need the channel id.
+var ErrChannelNotFound = errors.New("channel not found")
+
+// ChannelNotFound is returned by the storages when the channel is not stored.
 type ChannelNotFound struct {
 	ChannelID string
 }
@@ -149,6 +210,31 @@ func (err *ChannelNotFound) Error() string {
 	return fmt.Sprintf("channel_id:%s not found", err.ChannelID)
 }
 
+func (err *ChannelNotFound) Is(target error) bool {
+	return target == ErrChannelNotFound
+}
+
+// LockTimeout is returned when the file storage lock can not be acquired within the retries.
+type LockTimeout struct {
+	LockFile string
+	Err      error
+}
+
+func (err *LockTimeout) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("lock `%s` timeout: %s", err.LockFile, err.Err.Error())
+	}
+	return fmt.Sprintf("lock `%s` timeout", err.LockFile)
+}
+
+func (err *LockTimeout) Unwrap() error {
+	return err.Err
+}
+
+// ErrChannelAlreadyExists matches *ChannelAlreadyExists by errors.Is.
+var ErrChannelAlreadyExists = errors.New("channel already exists")
+
+// ChannelAlreadyExists is returned by SaveChannel of the storages that do not overwrite the stored channel.
 type ChannelAlreadyExists struct {
 	ChannelID string
 }
@@ -157,25 +243,85 @@ func (err *ChannelAlreadyExists) Error() string {
 	return fmt.Sprintf("channel_id:%s already exists", err.ChannelID)
 }
 
+func (err *ChannelAlreadyExists) Is(target error) bool {
+	return target == ErrChannelAlreadyExists
+}
+
+// StorageTimeoutError is returned when a storage operation does not complete within operation_timeout.
+type StorageTimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+	Err       error
+}
+
+func (err *StorageTimeoutError) Error() string {
+	return fmt.Sprintf("storage operation %s timeout after %s: %s", err.Operation, err.Timeout, err.Err.Error())
+}
+
+func (err *StorageTimeoutError) Unwrap() error {
+	return err.Err
+}
+
+type TableNotFound struct {
+	TableName string
+}
+
+func (err *TableNotFound) Error() string {
+	return fmt.Sprintf("dynamodb table `%s` not found", err.TableName)
+}
+
 func NewStorage(ctx context.Context, cfg *StorageConfig, awsCfg aws.Config) (Storage, func() error, error) {
 	switch cfg.Type {
 	case StorageTypeDynamoDB:
 		return NewDynamoDBStorage(ctx, cfg, awsCfg)
 	case StorageTypeFile:
 		return NewFileStorage(ctx, cfg)
+	case StorageTypeMemory:
+		return NewMemoryStorage(), nil, nil
 	}
 	return nil, nil, errors.New("unknown storage type")
 }
 
+type DynamoDBClient interface {
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
 type DynamoDBStorage struct {
-	client    *dynamodb.Client
-	tableName string
+	client           DynamoDBClient
+	tableName        string
+	autoCreate       bool
+	billingMode      string
+	readCapacity     int64
+	writeCapacity    int64
+	scanSegments     int
+	operationTimeout time.Duration
+
+	recoverMu   sync.Mutex
+	recreated   bool
+	onRecreated func()
+	degraded    atomic.Pointer[TableNotFound]
 }
 
 func NewDynamoDBStorage(ctx context.Context, cfg *StorageConfig, awsCfg aws.Config) (*DynamoDBStorage, func() error, error) {
+	return newDynamoDBStorage(ctx, cfg, dynamodb.NewFromConfig(awsCfg))
+}
+
+func newDynamoDBStorage(ctx context.Context, cfg *StorageConfig, client DynamoDBClient) (*DynamoDBStorage, func() error, error) {
 	s := &DynamoDBStorage{
-		client:    dynamodb.NewFromConfig(awsCfg),
-		tableName: *cfg.TableName,
+		client:           client,
+		tableName:        *cfg.TableName,
+		autoCreate:       cfg.AutoCreate == nil || *cfg.AutoCreate,
+		billingMode:      coalesce(cfg.BillingMode, BillingModePayPerRequest),
+		readCapacity:     cfg.ReadCapacity,
+		writeCapacity:    cfg.WriteCapacity,
+		scanSegments:     lo.Max([]int{cfg.ScanSegments, 1}),
+		operationTimeout: cfg.OperationTimeout,
 	}
 	logx.Printf(ctx, "[info] check describe dynamodb table `%s`", s.tableName)
 	exists, err := s.tableExists(ctx)
@@ -183,6 +329,9 @@ func NewDynamoDBStorage(ctx context.Context, cfg *StorageConfig, awsCfg aws.Conf
 		return nil, nil, err
 	}
 	if !exists {
+		if !s.autoCreate {
+			return nil, nil, &TableNotFound{TableName: s.tableName}
+		}
 		if err := s.createTable(ctx); err != nil {
 			return nil, nil, err
 		}
@@ -191,17 +340,113 @@ func NewDynamoDBStorage(ctx context.Context, cfg *StorageConfig, awsCfg aws.Conf
 	return s, nil, nil
 }
 
+func isResourceNotFound(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode() == "ResourceNotFoundException"
+	}
+	return false
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode() == "ConditionalCheckFailedException"
+	}
+	return false
+}
+
+// withTimeout wraps fn to be canceled at operation_timeout, and to return StorageTimeoutError then.
+func (s *DynamoDBStorage) withTimeout(operation string, fn func(context.Context) error) func(context.Context) error {
+	if s.operationTimeout <= 0 {
+		return fn
+	}
+	return func(ctx context.Context) error {
+		timeoutCtx, cancel := context.WithTimeout(ctx, s.operationTimeout)
+		defer cancel()
+		err := fn(timeoutCtx)
+		if err != nil && ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+			return &StorageTimeoutError{Operation: operation, Timeout: s.operationTimeout, Err: err}
+		}
+		return err
+	}
+}
+
+// OnTableRecreated sets fn to be called after the table is recreated at runtime, to re-register the channels.
+func (s *DynamoDBStorage) OnTableRecreated(fn func()) {
+	s.recoverMu.Lock()
+	defer s.recoverMu.Unlock()
+	s.onRecreated = fn
+}
+
+// Degraded returns the error of the table being lost at runtime, or nil while the table is healthy.
+func (s *DynamoDBStorage) Degraded() error {
+	if err := s.degraded.Load(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// recoverTable handles the table being deleted while running.
+// if auto_create is enabled, the table is recreated only once per process and fn is retried once;
+// otherwise TableNotFound is returned and the storage reports degraded until an operation succeeds again.
+func (s *DynamoDBStorage) recoverTable(ctx context.Context, operation string, fn func(context.Context) error) error {
+	fn = s.withTimeout(operation, fn)
+	err := fn(ctx)
+	if err == nil || !isResourceNotFound(err) {
+		if err == nil {
+			s.degraded.Store(nil)
+		}
+		return err
+	}
+	logx.Printf(ctx, "[error] dynamodb table `%s` not found: %s", s.tableName, err.Error())
+	notFound := &TableNotFound{TableName: s.tableName}
+	if !s.autoCreate {
+		s.degraded.Store(notFound)
+		return notFound
+	}
+
+	s.recoverMu.Lock()
+	recreated := false
+	if !s.recreated {
+		s.recreated = true
+		logx.Printf(ctx, "[warn] try recreate dynamodb table `%s`", s.tableName)
+		if err := s.createTable(ctx); err != nil {
+			logx.Printf(ctx, "[error] failed recreate dynamodb table `%s`: %s", s.tableName, err.Error())
+			s.recoverMu.Unlock()
+			s.degraded.Store(notFound)
+			return notFound
+		}
+		recreated = true
+	}
+	onRecreated := s.onRecreated
+	s.recoverMu.Unlock()
+	if recreated && onRecreated != nil {
+		logx.Printf(ctx, "[info] dynamodb table `%s` recreated, re-register channels", s.tableName)
+		onRecreated()
+	}
+
+	// the table may have been recreated by another call, so fn is retried either way.
+	if err := fn(ctx); err != nil {
+		if isResourceNotFound(err) {
+			logx.Printf(ctx, "[error] dynamodb table `%s` is lost again, it is recreated only once", s.tableName)
+			s.degraded.Store(notFound)
+			return notFound
+		}
+		return err
+	}
+	s.degraded.Store(nil)
+	return nil
+}
+
 func (s *DynamoDBStorage) tableExists(ctx context.Context) (bool, error) {
 	logx.Printf(ctx, "[debug] check describe dynamodb table `%s`", s.tableName)
 	table, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
 		TableName: aws.String(s.tableName),
 	})
 	if err != nil {
-		var ae smithy.APIError
-		if errors.As(err, &ae) {
-			if ae.ErrorCode() == "ResourceNotFoundException" {
-				return false, nil
-			}
+		if isResourceNotFound(err) {
+			return false, nil
 		}
 		logx.Println(ctx, "[debug] DescribeTable: ", err)
 		return false, err
@@ -230,6 +475,9 @@ func (s *DynamoDBStorage) waitTableActive(ctx context.Context) error {
 		if err == nil && exists {
 			return nil
 		}
+		if err != nil && !isRetryable(err) {
+			break
+		}
 	}
 	logx.Printf(ctx, "[debug] timeout wait dynamodb table `%s` active", s.tableName)
 	if err == nil {
@@ -239,8 +487,8 @@ func (s *DynamoDBStorage) waitTableActive(ctx context.Context) error {
 }
 
 func (s *DynamoDBStorage) createTable(ctx context.Context) error {
-	logx.Printf(ctx, "[debug] create dynamodb table `%s`", s.tableName)
-	output, err := s.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+	logx.Printf(ctx, "[debug] create dynamodb table `%s` billing_mode=%s", s.tableName, s.billingMode)
+	input := &dynamodb.CreateTableInput{
 		TableName: aws.String(s.tableName),
 		AttributeDefinitions: []types.AttributeDefinition{
 			{
@@ -254,8 +502,15 @@ func (s *DynamoDBStorage) createTable(ctx context.Context) error {
 				KeyType:       types.KeyTypeHash,
 			},
 		},
-		BillingMode: types.BillingModePayPerRequest,
-	})
+		BillingMode: types.BillingMode(s.billingMode),
+	}
+	if input.BillingMode == types.BillingModeProvisioned {
+		input.ProvisionedThroughput = &types.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(s.readCapacity),
+			WriteCapacityUnits: aws.Int64(s.writeCapacity),
+		}
+	}
+	output, err := s.client.CreateTable(ctx, input)
 	if err != nil {
 		var ae smithy.APIError
 		if errors.As(err, &ae) {
@@ -278,11 +533,12 @@ func (s *DynamoDBStorage) createTable(ctx context.Context) error {
 }
 
 func (s *DynamoDBStorage) FindAllChannels(ctx context.Context) (<-chan []*ChannelItem, error) {
-	logx.Printf(ctx, "[debug] scan dynamodb table `%s`", s.tableName)
-	output, err := s.client.Scan(ctx, &dynamodb.ScanInput{
-		TableName:      aws.String(s.tableName),
-		Select:         types.SelectAllAttributes,
-		ConsistentRead: aws.Bool(false),
+	logx.Printf(ctx, "[debug] scan dynamodb table `%s` segments=%d", s.tableName, s.scanSegments)
+	var output *dynamodb.ScanOutput
+	err := s.recoverTable(ctx, "Scan", func(ctx context.Context) error {
+		var err error
+		output, err = s.client.Scan(ctx, s.scanInput(0, nil))
+		return err
 	})
 	if err != nil {
 		logx.Printf(ctx, "[debug] scan dynamodb table failed: %s", err.Error())
@@ -293,52 +549,165 @@ func (s *DynamoDBStorage) FindAllChannels(ctx context.Context) (<-chan []*Channe
 	ch <- lo.Map(output.Items, func(values map[string]types.AttributeValue, _ int) *ChannelItem {
 		return NewChannelItemWithDynamoDBAttributeValues(values)
 	})
-	if output.LastEvaluatedKey == nil {
+	if output.LastEvaluatedKey == nil && s.scanSegments <= 1 {
 		logx.Printf(ctx, "[debug] LastEvaluatedKey is null return FindAllChannels")
 		close(ch)
 		return ch, nil
 	}
 	logx.Printf(ctx, "[debug] need background scan dynamodb table")
+	// the first page of segment 0 is already scanned, the other segments are scanned from the beginning in parallel.
+	var wg sync.WaitGroup
+	for segment := 0; segment < s.scanSegments; segment++ {
+		var startKey map[string]types.AttributeValue
+		if segment == 0 {
+			if output.LastEvaluatedKey == nil {
+				continue
+			}
+			startKey = output.LastEvaluatedKey
+		}
+		wg.Add(1)
+		go func(segment int, startKey map[string]types.AttributeValue) {
+			defer wg.Done()
+			s.scanSegment(ctx, ch, segment, startKey)
+		}(segment, startKey)
+	}
 	go func() {
-		logx.Printf(ctx, "[debug] start background scan dynamodb table `%s`", s.tableName)
 		defer func() {
 			logx.Printf(ctx, "[debug] finish background scan dynamodb table `%s`", s.tableName)
 			close(ch)
 		}()
-		for output.LastEvaluatedKey != nil {
-			output, err = s.client.Scan(ctx, &dynamodb.ScanInput{
-				TableName:      aws.String(s.tableName),
-				Select:         types.SelectAllAttributes,
-				ConsistentRead: aws.Bool(false),
-			})
-			if err != nil {
-				logx.Printf(ctx, "[error] background scan dynamodb table failed: %s", err.Error())
-				return
-			}
-			logx.Printf(ctx, "[debug] background scan dynamodb table success item_count=%d", output.Count)
-			ch <- lo.Map(output.Items, func(values map[string]types.AttributeValue, _ int) *ChannelItem {
-				return NewChannelItemWithDynamoDBAttributeValues(values)
-			})
-			time.Sleep(100 * time.Millisecond)
-		}
+		wg.Wait()
 	}()
 	return ch, nil
 }
 
+// FindAllChannelsFrom scans a page of the table from the cursor, the LastEvaluatedKey of the previous page encoded in base64.
+// The table is scanned without segments, even if scan_segments is set.
+func (s *DynamoDBStorage) FindAllChannelsFrom(ctx context.Context, cursor string) (<-chan []*ChannelItem, string, error) {
+	startKey, err := decodeScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	logx.Printf(ctx, "[debug] scan dynamodb table `%s` from cursor `%s`", s.tableName, cursor)
+	input := s.scanInput(0, startKey)
+	input.Segment = nil
+	input.TotalSegments = nil
+	var output *dynamodb.ScanOutput
+	err = s.recoverTable(ctx, "Scan", func(ctx context.Context) error {
+		var err error
+		output, err = s.client.Scan(ctx, input)
+		return err
+	})
+	if err != nil {
+		logx.Printf(ctx, "[debug] scan dynamodb table failed: %s", err.Error())
+		return nil, "", err
+	}
+	nextCursor, err := encodeScanCursor(output.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	logx.Printf(ctx, "[debug] scan dynamodb table success item_count=%d next_cursor=`%s`", output.Count, nextCursor)
+	ch := make(chan []*ChannelItem, 1)
+	ch <- lo.Map(output.Items, func(values map[string]types.AttributeValue, _ int) *ChannelItem {
+		return NewChannelItemWithDynamoDBAttributeValues(values)
+	})
+	close(ch)
+	return ch, nextCursor, nil
+}
+
+// encodeScanCursor encodes the LastEvaluatedKey of the string keys as base64 of JSON, empty if key is empty.
+func encodeScanCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	values := make(map[string]string, len(key))
+	for name, value := range key {
+		s, ok := value.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", fmt.Errorf("encode cursor: key `%s` is not a string", name)
+		}
+		values[name] = s.Value
+	}
+	bs, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+func decodeScanCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor `%s`: %w", cursor, err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(bs, &values); err != nil {
+		return nil, fmt.Errorf("invalid cursor `%s`: %w", cursor, err)
+	}
+	key := make(map[string]types.AttributeValue, len(values))
+	for name, value := range values {
+		key[name] = &types.AttributeValueMemberS{Value: value}
+	}
+	return key, nil
+}
+
+// scanSegment scans the segment from startKey to the end, and sends the items to ch.
+func (s *DynamoDBStorage) scanSegment(ctx context.Context, ch chan<- []*ChannelItem, segment int, startKey map[string]types.AttributeValue) {
+	logx.Printf(ctx, "[debug] start background scan dynamodb table `%s` segment=%d", s.tableName, segment)
+	for {
+		var output *dynamodb.ScanOutput
+		err := s.withTimeout("Scan", func(ctx context.Context) error {
+			var err error
+			output, err = s.client.Scan(ctx, s.scanInput(segment, startKey))
+			return err
+		})(ctx)
+		if err != nil {
+			logx.Printf(ctx, "[error] background scan dynamodb table failed segment=%d: %s", segment, err.Error())
+			return
+		}
+		logx.Printf(ctx, "[debug] background scan dynamodb table success segment=%d item_count=%d", segment, output.Count)
+		ch <- lo.Map(output.Items, func(values map[string]types.AttributeValue, _ int) *ChannelItem {
+			return NewChannelItemWithDynamoDBAttributeValues(values)
+		})
+		if output.LastEvaluatedKey == nil {
+			return
+		}
+		startKey = output.LastEvaluatedKey
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *DynamoDBStorage) scanInput(segment int, startKey map[string]types.AttributeValue) *dynamodb.ScanInput {
+	input := &dynamodb.ScanInput{
+		TableName:         aws.String(s.tableName),
+		Select:            types.SelectAllAttributes,
+		ConsistentRead:    aws.Bool(false),
+		ExclusiveStartKey: startKey,
+	}
+	if s.scanSegments > 1 {
+		input.Segment = aws.Int32(int32(segment))
+		input.TotalSegments = aws.Int32(int32(s.scanSegments))
+	}
+	return input
+}
+
 func (s *DynamoDBStorage) SaveChannel(ctx context.Context, item *ChannelItem) error {
 	logx.Printf(ctx, "[debug] put item channel_id=`%s` to dynamodb table `%s`", item.ChannelID, s.tableName)
-	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName:           aws.String(s.tableName),
-		Item:                item.ToDynamoDBAttributeValues(),
-		ConditionExpression: aws.String("attribute_not_exists(ChannelID)"),
+	err := s.recoverTable(ctx, "PutItem", func(ctx context.Context) error {
+		_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(s.tableName),
+			Item:                item.ToDynamoDBAttributeValues(),
+			ConditionExpression: aws.String("attribute_not_exists(ChannelID)"),
+		})
+		return err
 	})
 	if err != nil {
-		var ae smithy.APIError
 		logx.Printf(ctx, "[warn] failed put item channel_id=`%s` resource_id=%s to dynamodb table `%s`: %s", item.ChannelID, item.ResourceID, s.tableName, err.Error())
-		if errors.As(err, &ae) {
-			if ae.ErrorCode() == "ConditionalCheckFailedException" {
-				return &ChannelAlreadyExists{ChannelID: item.ChannelID}
-			}
+		if isConditionalCheckFailed(err) {
+			return &ChannelAlreadyExists{ChannelID: item.ChannelID}
 		}
 		return err
 	}
@@ -349,26 +718,45 @@ func (s *DynamoDBStorage) SaveChannel(ctx context.Context, item *ChannelItem) er
 func (s *DynamoDBStorage) UpdatePageToken(ctx context.Context, target *ChannelItem) error {
 	logx.Printf(ctx, "[debug] update item channel_id=`%s` to dynamodb table `%s`", target.ChannelID, s.tableName)
 	values := target.ToDynamoDBAttributeValues()
-	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(s.tableName),
-		Key: map[string]types.AttributeValue{
-			"ChannelID": &types.AttributeValueMemberS{
-				Value: target.ChannelID,
+	updateExpression := "SET #PageToken=:PageToken,#LastMessageNumber=:LastMessageNumber,#UpdatedAt=:UpdatedAt"
+	names := map[string]string{
+		"#PageToken":         "PageToken",
+		"#LastMessageNumber": "LastMessageNumber",
+		"#UpdatedAt":         "UpdatedAt",
+	}
+	attributeValues := map[string]types.AttributeValue{
+		":UpdatedAt":         values["UpdatedAt"],
+		":PageToken":         values["PageToken"],
+		":LastMessageNumber": values["LastMessageNumber"],
+	}
+	if lastChangeAt, ok := values["LastChangeAt"]; ok {
+		updateExpression += ",#LastChangeAt=:LastChangeAt"
+		names["#LastChangeAt"] = "LastChangeAt"
+		attributeValues[":LastChangeAt"] = lastChangeAt
+	}
+	err := s.recoverTable(ctx, "UpdateItem", func(ctx context.Context) error {
+		_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key: map[string]types.AttributeValue{
+				"ChannelID": &types.AttributeValueMemberS{
+					Value: target.ChannelID,
+				},
 			},
-		},
-		UpdateExpression:    aws.String("SET #PageToken=:PageToken,#UpdatedAt=:UpdatedAt"),
-		ConditionExpression: aws.String("attribute_exists(ChannelID) AND UpdatedAt < :UpdatedAt"),
-		ExpressionAttributeNames: map[string]string{
-			"#PageToken": "PageToken",
-			"#UpdatedAt": "UpdatedAt",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":UpdatedAt": values["UpdatedAt"],
-			":PageToken": values["PageToken"],
-		},
+			UpdateExpression:          aws.String(updateExpression),
+			ConditionExpression:       aws.String("attribute_exists(ChannelID) AND UpdatedAt < :UpdatedAt"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: attributeValues,
+		})
+		return err
 	})
 	if err != nil {
 		logx.Printf(ctx, "[warn] failed update item channel_id=`%s` to dynamodb table `%s` page_token=%s", target.ChannelID, s.tableName, target.PageToken)
+		if isConditionalCheckFailed(err) {
+			// the condition fails also for a stale UpdatedAt, the item is absent only if it is not found.
+			if _, findErr := s.FindOneByChannelID(ctx, target.ChannelID); findErr != nil && errors.Is(findErr, ErrChannelNotFound) {
+				return findErr
+			}
+		}
 		return err
 	}
 	logx.Printf(ctx, "[info] update item channel_id=`%s` to dynamodb table `%s` page_token=%s", target.ChannelID, s.tableName, target.PageToken)
@@ -377,16 +765,24 @@ func (s *DynamoDBStorage) UpdatePageToken(ctx context.Context, target *ChannelIt
 
 func (s *DynamoDBStorage) DeleteChannel(ctx context.Context, target *ChannelItem) error {
 	logx.Printf(ctx, "[debug] delete item channel_id=`%s` from dynamodb table `%s`", target.ChannelID, s.tableName)
-	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-		TableName: aws.String(s.tableName),
-		Key: map[string]types.AttributeValue{
-			"ChannelID": &types.AttributeValueMemberS{
-				Value: target.ChannelID,
+	err := s.recoverTable(ctx, "DeleteItem", func(ctx context.Context) error {
+		_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(s.tableName),
+			Key: map[string]types.AttributeValue{
+				"ChannelID": &types.AttributeValueMemberS{
+					Value: target.ChannelID,
+				},
 			},
-		},
-		ConditionExpression: aws.String("attribute_exists(ChannelID)"),
+			ConditionExpression: aws.String("attribute_exists(ChannelID)"),
+		})
+		return err
 	})
 	if err != nil {
+		if isConditionalCheckFailed(err) {
+			// the item is already deleted, e.g. by a previous cleanup, as the other storages delete an absent item without error.
+			logx.Printf(ctx, "[info] item channel_id=`%s` is already deleted from dynamodb table `%s`", target.ChannelID, s.tableName)
+			return nil
+		}
 		logx.Printf(ctx, "[warn] failed delete item channel_id=`%s` resource_id=%s from dynamodb table `%s`", target.ChannelID, target.ResourceID, s.tableName)
 		return err
 	}
@@ -396,18 +792,27 @@ func (s *DynamoDBStorage) DeleteChannel(ctx context.Context, target *ChannelItem
 
 func (s *DynamoDBStorage) FindOneByChannelID(ctx context.Context, channelID string) (*ChannelItem, error) {
 	logx.Printf(ctx, "[debug] get item channel_id=`%s` from dynamodb table `%s`", channelID, s.tableName)
-	output, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(s.tableName),
-		Key: map[string]types.AttributeValue{
-			"ChannelID": &types.AttributeValueMemberS{
-				Value: channelID,
+	var output *dynamodb.GetItemOutput
+	err := s.recoverTable(ctx, "GetItem", func(ctx context.Context) error {
+		var err error
+		output, err = s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(s.tableName),
+			Key: map[string]types.AttributeValue{
+				"ChannelID": &types.AttributeValueMemberS{
+					Value: channelID,
+				},
 			},
-		},
+		})
+		return err
 	})
 	if err != nil {
 		logx.Printf(ctx, "[warn] failed get item channel_id=`%s` from dynamodb table `%s`", channelID, s.tableName)
 		return nil, err
 	}
+	if len(output.Item) == 0 {
+		logx.Printf(ctx, "[debug] item channel_id=`%s` not found in dynamodb table `%s`", channelID, s.tableName)
+		return nil, &ChannelNotFound{ChannelID: channelID}
+	}
 	logx.Printf(ctx, "[debug] success get item channel_id=`%s` from dynamodb table `%s`", channelID, s.tableName)
 	return NewChannelItemWithDynamoDBAttributeValues(output.Item), nil
 }
@@ -417,12 +822,23 @@ type FileStorage struct {
 
 	LockFile string
 	FilePath string
+
+	format           string
+	operationTimeout time.Duration
+	mu               sync.Mutex
+}
+
+// fileStorageJSON is the data of the File storage in json format.
+type fileStorageJSON struct {
+	Items []*ChannelItem `json:"items"`
 }
 
 func NewFileStorage(ctx context.Context, cfg *StorageConfig) (*FileStorage, func() error, error) {
 	s := &FileStorage{
-		FilePath: *cfg.DataFile,
-		LockFile: *cfg.LockFile,
+		FilePath:         *cfg.DataFile,
+		LockFile:         *cfg.LockFile,
+		format:           cfg.FileFormat,
+		operationTimeout: cfg.OperationTimeout,
 	}
 
 	return s, nil, nil
@@ -432,7 +848,7 @@ func (s *FileStorage) FindAllChannels(ctx context.Context) (<-chan []*ChannelIte
 	ch := make(chan []*ChannelItem, 1)
 	go func() {
 		if err := s.transactional(ctx, func(context.Context) error {
-			ch <- s.Items
+			ch <- copyChannelItems(s.Items)
 			return nil
 		}); err != nil {
 			logx.Println(ctx, "[error] failed background channels read:", err)
@@ -442,15 +858,64 @@ func (s *FileStorage) FindAllChannels(ctx context.Context) (<-chan []*ChannelIte
 	return ch, nil
 }
 
+// fileStorageCursorPageSize is the number of channels of a page of FileStorage.FindAllChannelsFrom.
+const fileStorageCursorPageSize = 100
+
+// FindAllChannelsFrom returns a page of the channels from the cursor, the index of the first channel of the page.
+// It is best-effort, a channel may be skipped or returned twice if the channels are saved or deleted between the calls.
+func (s *FileStorage) FindAllChannelsFrom(ctx context.Context, cursor string) (<-chan []*ChannelItem, string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		start, err = strconv.Atoi(cursor)
+		if err != nil || start < 0 {
+			return nil, "", fmt.Errorf("invalid cursor `%s`", cursor)
+		}
+	}
+	var items []*ChannelItem
+	var nextCursor string
+	if err := s.transactional(ctx, func(context.Context) error {
+		if start >= len(s.Items) {
+			return nil
+		}
+		end := start + fileStorageCursorPageSize
+		if end < len(s.Items) {
+			nextCursor = strconv.Itoa(end)
+		} else {
+			end = len(s.Items)
+		}
+		items = copyChannelItems(s.Items[start:end])
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	ch := make(chan []*ChannelItem, 1)
+	ch <- items
+	close(ch)
+	return ch, nextCursor, nil
+}
+
+// copyChannelItems returns copies of the items, so that the callers do not share the stored channels with the following restore.
+func copyChannelItems(items []*ChannelItem) []*ChannelItem {
+	copied := make([]*ChannelItem, 0, len(items))
+	for _, item := range items {
+		c := *item
+		copied = append(copied, &c)
+	}
+	return copied
+}
+
+// SaveChannel stores a copy of the item, so that the caller keeps reading its item while the following restore replaces the stored one.
 func (s *FileStorage) SaveChannel(ctx context.Context, item *ChannelItem) error {
+	copied := *item
 	return s.transactional(ctx, func(context.Context) error {
 		for i, c := range s.Items {
-			if c.ChannelID == item.ChannelID {
-				s.Items[i] = item
+			if c.ChannelID == copied.ChannelID {
+				s.Items[i] = &copied
 				return nil
 			}
 		}
-		s.Items = append(s.Items, item)
+		s.Items = append(s.Items, &copied)
 		return nil
 	})
 }
@@ -463,7 +928,11 @@ func (s *FileStorage) UpdatePageToken(ctx context.Context, target *ChannelItem)
 					s.Items[i].ChannelID, s.Items[i].PageToken, target.PageToken,
 				)
 				s.Items[i].PageToken = target.PageToken
-
+				s.Items[i].LastMessageNumber = target.LastMessageNumber
+				s.Items[i].UpdatedAt = target.UpdatedAt
+				if !target.LastChangeAt.IsZero() {
+					s.Items[i].LastChangeAt = target.LastChangeAt
+				}
 				return nil
 			}
 		}
@@ -488,7 +957,9 @@ func (s *FileStorage) FindOneByChannelID(ctx context.Context, channelID string)
 	if err := s.transactional(ctx, func(context.Context) error {
 		for _, item := range s.Items {
 			if item.ChannelID == channelID {
-				ret = item
+				// a copy, so that the caller can not modify the stored channel without saving it.
+				copied := *item
+				ret = &copied
 				logx.Printf(ctx, "[debug] found ChannelItem channel_id=%s resource_id=%s drive_id=%s:",
 					ret.ChannelID, ret.ResourceID, ret.DriveID,
 				)
@@ -507,6 +978,22 @@ func (s *FileStorage) FindOneByChannelID(ctx context.Context, channelID string)
 }
 
 func (s *FileStorage) transactional(ctx context.Context, fn func(context.Context) error) error {
+	if s.operationTimeout <= 0 {
+		return s.transaction(ctx, fn)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, s.operationTimeout)
+	defer cancel()
+	err := s.transaction(timeoutCtx, fn)
+	if err != nil && ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+		return &StorageTimeoutError{Operation: "transaction", Timeout: s.operationTimeout, Err: err}
+	}
+	return err
+}
+
+func (s *FileStorage) transaction(ctx context.Context, fn func(context.Context) error) error {
+	// file lock does not exclude goroutines in the same process, so serialize them first.
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	fileLock := flock.New(s.LockFile)
 	policy := retry.Policy{
 		MinDelay: 100 * time.Millisecond,
@@ -519,6 +1006,9 @@ func (s *FileStorage) transactional(ctx context.Context, fn func(context.Context
 	var err error
 	var locked bool
 	for retrier.Continue() {
+		if ctx.Err() != nil {
+			break
+		}
 		logx.Println(ctx, "[debug] try file storage lock:", s.LockFile)
 		locked, err = fileLock.TryLock()
 		if err != nil {
@@ -531,7 +1021,10 @@ func (s *FileStorage) transactional(ctx context.Context, fn func(context.Context
 		}
 	}
 	if !locked {
-		return fmt.Errorf("cannot get lock: %w", err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("cannot get lock `%s`: %w", s.LockFile, ctxErr)
+		}
+		return &LockTimeout{LockFile: s.LockFile, Err: err}
 	}
 	defer func() {
 		if err := fileLock.Unlock(); err != nil {
@@ -561,26 +1054,164 @@ func (s *FileStorage) restore(ctx context.Context) error {
 		return nil
 	}
 	defer fp.Close()
+	if s.format == FileFormatJSON {
+		var data fileStorageJSON
+		if err := json.NewDecoder(fp).Decode(&data); err != nil && err != io.EOF {
+			log.Printf("[error] failed restore file storage: %s", err.Error())
+			return err
+		}
+		s.Items = data.Items
+		return nil
+	}
+	// decode into a fresh value, decoding into s reuses the stored items in place.
+	var data FileStorage
 	decoder := gob.NewDecoder(fp)
-	if err := decoder.Decode(s); err != nil && err != io.EOF {
+	if err := decoder.Decode(&data); err != nil && err != io.EOF {
 		log.Printf("[error] failed restore file storage: %s", err.Error())
 		return err
 	}
+	s.Items = data.Items
 	return nil
 }
 
 func (s *FileStorage) store(ctx context.Context) error {
-	fp, err := os.Create(s.FilePath)
+	return s.storeWith(ctx, func(w io.Writer) error {
+		if s.format == FileFormatJSON {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(&fileStorageJSON{Items: s.Items})
+		}
+		return gob.NewEncoder(w).Encode(s)
+	})
+}
+
+// storeWith writes the encoded data to a temporary file in the same directory, and renames it to the data file.
+// The rename is atomic, so the previous data file is kept if the encoding fails.
+func (s *FileStorage) storeWith(ctx context.Context, encode func(io.Writer) error) error {
+	fp, err := os.CreateTemp(filepath.Dir(s.FilePath), filepath.Base(s.FilePath)+".*.tmp")
 	if err != nil {
-		logx.Printf(ctx, "[error] failed store to file storage: create file: %s", err.Error())
+		logx.Printf(ctx, "[error] failed store to file storage: create temp file: %s", err.Error())
 		return err
 	}
-	defer fp.Close()
-	encoder := gob.NewEncoder(fp)
-	if err := encoder.Encode(s); err != nil {
-		logx.Printf(ctx, "[error] failed store to file storage: encode gob: %s", err.Error())
+	tmpPath := fp.Name()
+	stored := false
+	defer func() {
+		if stored {
+			return
+		}
+		fp.Close()
+		if err := os.Remove(tmpPath); err != nil {
+			logx.Printf(ctx, "[warn] failed remove temp file `%s`: %s", tmpPath, err.Error())
+		}
+	}()
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(s.FilePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := fp.Chmod(mode); err != nil {
+		logx.Printf(ctx, "[error] failed store to file storage: chmod temp file: %s", err.Error())
+		return err
+	}
+	if err := encode(fp); err != nil {
+		logx.Printf(ctx, "[error] failed store to file storage: encode: %s", err.Error())
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		logx.Printf(ctx, "[error] failed store to file storage: sync temp file: %s", err.Error())
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		logx.Printf(ctx, "[error] failed store to file storage: close temp file: %s", err.Error())
+		return err
+	}
+	if err := os.Rename(tmpPath, s.FilePath); err != nil {
+		logx.Printf(ctx, "[error] failed store to file storage: rename temp file: %s", err.Error())
 		return err
 	}
+	stored = true
 	log.Printf("[debug] file storage store to `%s`", s.FilePath)
 	return nil
 }
+
+// MemoryStorage keeps the channels in memory, for embedding App in tests or short-lived processes.
+// The channels are lost when the process exits.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	items map[string]*ChannelItem
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		items: make(map[string]*ChannelItem),
+	}
+}
+
+func (s *MemoryStorage) FindAllChannels(ctx context.Context) (<-chan []*ChannelItem, error) {
+	s.mu.Lock()
+	items := make([]*ChannelItem, 0, len(s.items))
+	for _, item := range s.items {
+		copied := *item
+		items = append(items, &copied)
+	}
+	s.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ChannelID < items[j].ChannelID
+	})
+	ch := make(chan []*ChannelItem, 1)
+	ch <- items
+	close(ch)
+	return ch, nil
+}
+
+// SaveChannel saves the channel, ChannelAlreadyExists if the channel_id is already saved as same as DynamoDB storage.
+func (s *MemoryStorage) SaveChannel(ctx context.Context, item *ChannelItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[item.ChannelID]; ok {
+		logx.Printf(ctx, "[warn] failed save channel_id=`%s` to memory storage: already exists", item.ChannelID)
+		return &ChannelAlreadyExists{ChannelID: item.ChannelID}
+	}
+	copied := *item
+	s.items[item.ChannelID] = &copied
+	logx.Printf(ctx, "[info] save channel_id=`%s` to memory storage", item.ChannelID)
+	return nil
+}
+
+func (s *MemoryStorage) UpdatePageToken(ctx context.Context, target *ChannelItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[target.ChannelID]
+	if !ok {
+		return &ChannelNotFound{ChannelID: target.ChannelID}
+	}
+	logx.Printf(ctx, "[debug] update PageToken channel_id=%s old_page_token=%s new_page_token=%s",
+		item.ChannelID, item.PageToken, target.PageToken,
+	)
+	item.PageToken = target.PageToken
+	item.LastMessageNumber = target.LastMessageNumber
+	item.UpdatedAt = target.UpdatedAt
+	if !target.LastChangeAt.IsZero() {
+		item.LastChangeAt = target.LastChangeAt
+	}
+	return nil
+}
+
+func (s *MemoryStorage) DeleteChannel(ctx context.Context, target *ChannelItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, target.ChannelID)
+	logx.Printf(ctx, "[info] delete channel_id=`%s` from memory storage", target.ChannelID)
+	return nil
+}
+
+// FindOneByChannelID returns a copy of the channel, so that the caller can not modify the stored channel.
+func (s *MemoryStorage) FindOneByChannelID(ctx context.Context, channelID string) (*ChannelItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[channelID]
+	if !ok {
+		return nil, &ChannelNotFound{ChannelID: channelID}
+	}
+	copied := *item
+	return &copied, nil
+}
@@ -2,12 +2,28 @@ package gdnotify_test
 
 import (
 	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/gofrs/flock"
 	"github.com/google/uuid"
 	"github.com/mashiike/gdnotify"
 	"github.com/najeira/randstr"
@@ -25,9 +41,13 @@ func TestConvertChannelItemDynamoDBAttributeValues(t *testing.T) {
 		items = append(items, &gdnotify.ChannelItem{
 			ChannelID:          uuidObj.String(),
 			DriveID:            randstr.CryptoString(10),
+			FileID:             randstr.CryptoString(16),
 			PageToken:          fmt.Sprintf("%d", r.Intn(100)+1),
 			Expiration:         time.Unix(1650000000+int64(r.Intn(5000000)), 0).In(time.Local),
 			ResourceID:         randstr.CryptoString(12),
+			WebhookAddress:     "https://" + randstr.CryptoString(8) + ".example.com/",
+			LastMessageNumber:  int64(r.Intn(1000)),
+			LastChangeAt:       time.Unix(1650000000+int64(r.Intn(5000000)), 0).In(time.Local),
 			PageTokenFetchedAt: time.Unix(1650000000+int64(r.Intn(5000000)), 0).In(time.Local),
 			CreatedAt:          time.Unix(1650000000+int64(r.Intn(5000000)), 0).In(time.Local),
 			UpdatedAt:          time.Unix(1650000000+int64(r.Intn(5000000)), 0).In(time.Local),
@@ -36,9 +56,13 @@ func TestConvertChannelItemDynamoDBAttributeValues(t *testing.T) {
 	expectedKeys := []string{
 		"ChannelID",
 		"DriveID",
+		"FileID",
 		"PageToken",
 		"Expiration",
 		"ResourceID",
+		"WebhookAddress",
+		"LastMessageNumber",
+		"LastChangeAt",
 		"PageTokenFetchedAt",
 		"CreatedAt",
 		"UpdatedAt",
@@ -52,6 +76,20 @@ func TestConvertChannelItemDynamoDBAttributeValues(t *testing.T) {
 			require.EqualValues(t, item, gdnotify.NewChannelItemWithDynamoDBAttributeValues(values))
 		})
 	}
+	t.Run("no last change", func(t *testing.T) {
+		item := *items[0]
+		item.LastChangeAt = time.Time{}
+		values := item.ToDynamoDBAttributeValues()
+		require.NotContains(t, values, "LastChangeAt")
+		require.True(t, gdnotify.NewChannelItemWithDynamoDBAttributeValues(values).LastChangeAt.IsZero())
+	})
+	t.Run("drive channel", func(t *testing.T) {
+		item := *items[0]
+		item.FileID = ""
+		values := item.ToDynamoDBAttributeValues()
+		require.NotContains(t, values, "FileID")
+		require.EqualValues(t, &item, gdnotify.NewChannelItemWithDynamoDBAttributeValues(values))
+	})
 }
 
 func TestChannelItemIsAboutToExpired(t *testing.T) {
@@ -104,3 +142,870 @@ func TestChannelItemIsAboutToExpired(t *testing.T) {
 		})
 	}
 }
+
+type mockDynamoDBClient struct {
+	mu           sync.Mutex
+	tableExists  bool
+	createCalls  int
+	items        map[string]map[string]types.AttributeValue
+	createFailed bool
+	createInput  *dynamodb.CreateTableInput
+	delay        time.Duration
+	scanPageSize int
+	scanInputs   []*dynamodb.ScanInput
+}
+
+func newMockDynamoDBClient() *mockDynamoDBClient {
+	return &mockDynamoDBClient{
+		tableExists: true,
+		items:       make(map[string]map[string]types.AttributeValue),
+	}
+}
+
+func (c *mockDynamoDBClient) DeleteTable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tableExists = false
+	c.items = make(map[string]map[string]types.AttributeValue)
+}
+
+func (c *mockDynamoDBClient) CreateCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.createCalls
+}
+
+func (c *mockDynamoDBClient) notFound() error {
+	return &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "Requested resource not found"}
+}
+
+func (c *mockDynamoDBClient) DescribeTable(_ context.Context, params *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tableExists {
+		return nil, c.notFound()
+	}
+	return &dynamodb.DescribeTableOutput{
+		Table: &types.TableDescription{
+			TableName:   params.TableName,
+			TableStatus: types.TableStatusActive,
+		},
+	}, nil
+}
+
+func (c *mockDynamoDBClient) CreateTable(_ context.Context, params *dynamodb.CreateTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.createCalls++
+	c.createInput = params
+	if c.createFailed {
+		return nil, errors.New("create table failed")
+	}
+	c.tableExists = true
+	return &dynamodb.CreateTableOutput{
+		TableDescription: &types.TableDescription{
+			TableArn:    aws.String("arn:aws:dynamodb:ap-northeast-1:123456789012:table/" + *params.TableName),
+			TableName:   params.TableName,
+			TableStatus: types.TableStatusCreating,
+		},
+	}, nil
+}
+
+func (c *mockDynamoDBClient) Scan(_ context.Context, params *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scanInputs = append(c.scanInputs, params)
+	if !c.tableExists {
+		return nil, c.notFound()
+	}
+	keys := lo.Keys(c.items)
+	sort.Strings(keys)
+	if params.TotalSegments != nil {
+		// items are split into segments by the hash of the key, like DynamoDB.
+		keys = lo.Filter(keys, func(key string, _ int) bool {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return int32(h.Sum32()%uint32(*params.TotalSegments)) == *params.Segment
+		})
+	}
+	if startKey, ok := params.ExclusiveStartKey["ChannelID"].(*types.AttributeValueMemberS); ok {
+		keys = lo.Filter(keys, func(key string, _ int) bool {
+			return key > startKey.Value
+		})
+	}
+	output := &dynamodb.ScanOutput{}
+	if c.scanPageSize > 0 && len(keys) > c.scanPageSize {
+		keys = keys[:c.scanPageSize]
+		output.LastEvaluatedKey = map[string]types.AttributeValue{
+			"ChannelID": &types.AttributeValueMemberS{Value: keys[len(keys)-1]},
+		}
+	}
+	for _, key := range keys {
+		output.Items = append(output.Items, c.items[key])
+	}
+	output.Count = int32(len(output.Items))
+	return output, nil
+}
+
+func (c *mockDynamoDBClient) ScanInputs() []*dynamodb.ScanInput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*dynamodb.ScanInput{}, c.scanInputs...)
+}
+
+func (c *mockDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if c.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.delay):
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tableExists {
+		return nil, c.notFound()
+	}
+	key := params.Key["ChannelID"].(*types.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: c.items[key]}, nil
+}
+
+func (c *mockDynamoDBClient) PutItem(_ context.Context, params *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tableExists {
+		return nil, c.notFound()
+	}
+	key := params.Item["ChannelID"].(*types.AttributeValueMemberS).Value
+	if _, ok := c.items[key]; ok && strings.Contains(aws.ToString(params.ConditionExpression), "attribute_not_exists(ChannelID)") {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	c.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// UpdateItem supports `SET #Name=:Name,...` and the conditions of attribute_exists(ChannelID) and `UpdatedAt < :UpdatedAt`.
+func (c *mockDynamoDBClient) UpdateItem(_ context.Context, params *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tableExists {
+		return nil, c.notFound()
+	}
+	key := params.Key["ChannelID"].(*types.AttributeValueMemberS).Value
+	item, ok := c.items[key]
+	condition := aws.ToString(params.ConditionExpression)
+	conditionFailed := &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	if !ok {
+		if strings.Contains(condition, "attribute_exists(ChannelID)") {
+			return nil, conditionFailed
+		}
+		item = map[string]types.AttributeValue{"ChannelID": params.Key["ChannelID"]}
+	}
+	if strings.Contains(condition, "UpdatedAt < :UpdatedAt") {
+		if current, ok := item["UpdatedAt"].(*types.AttributeValueMemberN); ok {
+			old, _ := strconv.ParseFloat(current.Value, 64)
+			updated, _ := strconv.ParseFloat(params.ExpressionAttributeValues[":UpdatedAt"].(*types.AttributeValueMemberN).Value, 64)
+			if old >= updated {
+				return nil, conditionFailed
+			}
+		}
+	}
+	updated := make(map[string]types.AttributeValue, len(item))
+	for name, value := range item {
+		updated[name] = value
+	}
+	for _, assignment := range strings.Split(strings.TrimPrefix(aws.ToString(params.UpdateExpression), "SET "), ",") {
+		name, value, _ := strings.Cut(assignment, "=")
+		updated[params.ExpressionAttributeNames[name]] = params.ExpressionAttributeValues[value]
+	}
+	c.items[key] = updated
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (c *mockDynamoDBClient) DeleteItem(_ context.Context, params *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tableExists {
+		return nil, c.notFound()
+	}
+	key := params.Key["ChannelID"].(*types.AttributeValueMemberS).Value
+	if _, ok := c.items[key]; !ok && strings.Contains(aws.ToString(params.ConditionExpression), "attribute_exists(ChannelID)") {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	delete(c.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestDynamoDBStorageTableDeleted(t *testing.T) {
+	item := &gdnotify.ChannelItem{
+		ChannelID:  "channel1",
+		DriveID:    gdnotify.DefaultDriveID,
+		ResourceID: "resource1",
+		PageToken:  "100",
+		Expiration: time.Unix(1650000000, 0),
+	}
+	t.Run("auto_create", func(t *testing.T) {
+		ctx := context.Background()
+		client := newMockDynamoDBClient()
+		s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeDynamoDB,
+			TableName:  aws.String("gdnotify"),
+			AutoCreate: aws.Bool(true),
+		}, client)
+		require.NoError(t, err)
+		require.NoError(t, s.SaveChannel(ctx, item))
+
+		client.DeleteTable()
+		require.NoError(t, s.SaveChannel(ctx, item), "table recreated and retried")
+		require.Equal(t, 1, client.CreateCalls())
+		actual, err := s.FindOneByChannelID(ctx, item.ChannelID)
+		require.NoError(t, err)
+		require.Equal(t, item.ChannelID, actual.ChannelID)
+	})
+	t.Run("auto_create_failed", func(t *testing.T) {
+		ctx := context.Background()
+		client := newMockDynamoDBClient()
+		s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeDynamoDB,
+			TableName:  aws.String("gdnotify"),
+			AutoCreate: aws.Bool(true),
+		}, client)
+		require.NoError(t, err)
+
+		client.DeleteTable()
+		client.createFailed = true
+		_, err = s.FindOneByChannelID(ctx, item.ChannelID)
+		var tableNotFound *gdnotify.TableNotFound
+		require.ErrorAs(t, err, &tableNotFound)
+		require.Equal(t, "gdnotify", tableNotFound.TableName)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		ctx := context.Background()
+		client := newMockDynamoDBClient()
+		s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeDynamoDB,
+			TableName:  aws.String("gdnotify"),
+			AutoCreate: aws.Bool(false),
+		}, client)
+		require.NoError(t, err)
+
+		require.NoError(t, s.Degraded())
+
+		client.DeleteTable()
+		_, err = s.FindAllChannels(ctx)
+		var tableNotFound *gdnotify.TableNotFound
+		require.ErrorAs(t, err, &tableNotFound)
+		require.Equal(t, 0, client.CreateCalls())
+		require.ErrorAs(t, s.Degraded(), &tableNotFound)
+
+		client.CreateTable(ctx, &dynamodb.CreateTableInput{TableName: aws.String("gdnotify")})
+		require.NoError(t, s.SaveChannel(ctx, item))
+		require.NoError(t, s.Degraded(), "recovered by the table created out of gdnotify")
+	})
+	t.Run("recreated_once", func(t *testing.T) {
+		ctx := context.Background()
+		client := newMockDynamoDBClient()
+		s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeDynamoDB,
+			TableName:  aws.String("gdnotify"),
+			AutoCreate: aws.Bool(true),
+		}, client)
+		require.NoError(t, err)
+		var recreated int32
+		s.OnTableRecreated(func() {
+			atomic.AddInt32(&recreated, 1)
+		})
+
+		client.DeleteTable()
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				item := *item
+				item.ChannelID = fmt.Sprintf("channel%d", i)
+				errs[i] = s.SaveChannel(ctx, &item)
+			}(i)
+		}
+		wg.Wait()
+		require.Equal(t, make([]error, 10), errs)
+		require.Equal(t, 1, client.CreateCalls(), "recreated once by the concurrent calls")
+		require.EqualValues(t, 1, atomic.LoadInt32(&recreated))
+		require.NoError(t, s.Degraded())
+
+		client.DeleteTable()
+		err = s.SaveChannel(ctx, item)
+		var tableNotFound *gdnotify.TableNotFound
+		require.ErrorAs(t, err, &tableNotFound)
+		require.Equal(t, 1, client.CreateCalls(), "not recreated again")
+		require.EqualValues(t, 1, atomic.LoadInt32(&recreated))
+		require.ErrorAs(t, s.Degraded(), &tableNotFound)
+	})
+}
+
+func TestDynamoDBStorageBillingMode(t *testing.T) {
+	cases := []struct {
+		casename              string
+		cfg                   gdnotify.StorageConfig
+		expectedBillingMode   types.BillingMode
+		expectedProvisionedTP *types.ProvisionedThroughput
+	}{
+		{
+			casename:            "default",
+			expectedBillingMode: types.BillingModePayPerRequest,
+		},
+		{
+			casename: "provisioned",
+			cfg: gdnotify.StorageConfig{
+				BillingMode:   gdnotify.BillingModeProvisioned,
+				ReadCapacity:  5,
+				WriteCapacity: 10,
+			},
+			expectedBillingMode: types.BillingModeProvisioned,
+			expectedProvisionedTP: &types.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(5),
+				WriteCapacityUnits: aws.Int64(10),
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			ctx := context.Background()
+			client := newMockDynamoDBClient()
+			client.DeleteTable()
+			cfg := c.cfg
+			cfg.Type = gdnotify.StorageTypeDynamoDB
+			cfg.TableName = aws.String("gdnotify")
+			cfg.AutoCreate = aws.Bool(true)
+			require.NoError(t, cfg.Restrict())
+			_, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &cfg, client)
+			require.NoError(t, err)
+			require.Equal(t, 1, client.CreateCalls())
+			require.Equal(t, c.expectedBillingMode, client.createInput.BillingMode)
+			require.Equal(t, c.expectedProvisionedTP, client.createInput.ProvisionedThroughput)
+		})
+	}
+}
+
+func TestDynamoDBStorageScanSegments(t *testing.T) {
+	for _, segments := range []int{0, 4} {
+		t.Run(fmt.Sprintf("segments=%d", segments), func(t *testing.T) {
+			ctx := context.Background()
+			client := newMockDynamoDBClient()
+			client.scanPageSize = 3
+			s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+				Type:         gdnotify.StorageTypeDynamoDB,
+				TableName:    aws.String("gdnotify"),
+				AutoCreate:   aws.Bool(true),
+				ScanSegments: segments,
+			}, client)
+			require.NoError(t, err)
+			expected := make([]string, 0, 25)
+			for i := 0; i < 25; i++ {
+				item := &gdnotify.ChannelItem{
+					ChannelID: fmt.Sprintf("channel%02d", i),
+					DriveID:   gdnotify.DefaultDriveID,
+				}
+				require.NoError(t, s.SaveChannel(ctx, item))
+				expected = append(expected, item.ChannelID)
+			}
+
+			itemsCh, err := s.FindAllChannels(ctx)
+			require.NoError(t, err)
+			actual := make([]string, 0, 25)
+			for items := range itemsCh {
+				for _, item := range items {
+					actual = append(actual, item.ChannelID)
+				}
+			}
+			require.ElementsMatch(t, expected, actual, "all items once, without duplicates")
+
+			inputs := client.ScanInputs()
+			if segments <= 1 {
+				for _, input := range inputs {
+					require.Nil(t, input.TotalSegments)
+				}
+				return
+			}
+			requested := make(map[int32]bool)
+			for _, input := range inputs {
+				require.EqualValues(t, segments, aws.ToInt32(input.TotalSegments))
+				requested[aws.ToInt32(input.Segment)] = true
+			}
+			require.Equal(t, map[int32]bool{0: true, 1: true, 2: true, 3: true}, requested)
+		})
+	}
+}
+
+func TestDynamoDBStorageFindAllChannelsFrom(t *testing.T) {
+	ctx := context.Background()
+	client := newMockDynamoDBClient()
+	client.scanPageSize = 10
+	s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+		Type:         gdnotify.StorageTypeDynamoDB,
+		TableName:    aws.String("gdnotify"),
+		AutoCreate:   aws.Bool(true),
+		ScanSegments: 4,
+	}, client)
+	require.NoError(t, err)
+	expected := make([]string, 0, 15)
+	for i := 0; i < 15; i++ {
+		item := &gdnotify.ChannelItem{
+			ChannelID: fmt.Sprintf("channel%02d", i),
+			DriveID:   gdnotify.DefaultDriveID,
+		}
+		require.NoError(t, s.SaveChannel(ctx, item))
+		expected = append(expected, item.ChannelID)
+	}
+	var resumable gdnotify.ResumableStorage = s
+	first, cursor, err := resumable.FindAllChannelsFrom(ctx, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, cursor)
+	actual := collectChannelIDs(first)
+	require.Len(t, actual, 10)
+
+	second, cursor, err := resumable.FindAllChannelsFrom(ctx, cursor)
+	require.NoError(t, err)
+	require.Empty(t, cursor, "the last page")
+	actual = append(actual, collectChannelIDs(second)...)
+	require.Equal(t, expected, actual, "no overlap or gaps between the pages")
+	for _, input := range client.ScanInputs() {
+		require.Nil(t, input.TotalSegments)
+	}
+
+	_, _, err = resumable.FindAllChannelsFrom(ctx, "not a cursor")
+	require.Error(t, err)
+}
+
+func collectChannelIDs(itemsCh <-chan []*gdnotify.ChannelItem) []string {
+	var channelIDs []string
+	for items := range itemsCh {
+		for _, item := range items {
+			channelIDs = append(channelIDs, item.ChannelID)
+		}
+	}
+	return channelIDs
+}
+
+func TestDynamoDBStorageChannelNotFound(t *testing.T) {
+	ctx := context.Background()
+	s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+		Type:       gdnotify.StorageTypeDynamoDB,
+		TableName:  aws.String("gdnotify"),
+		AutoCreate: aws.Bool(true),
+	}, newMockDynamoDBClient())
+	require.NoError(t, err)
+	_, err = s.FindOneByChannelID(ctx, "unknown")
+	var channelNotFound *gdnotify.ChannelNotFound
+	require.ErrorAs(t, err, &channelNotFound)
+	require.EqualValues(t, "unknown", channelNotFound.ChannelID)
+	require.ErrorIs(t, err, gdnotify.ErrChannelNotFound)
+	require.ErrorIs(t, fmt.Errorf("describe channel: %w", err), gdnotify.ErrChannelNotFound, "wrapped error matches")
+	require.False(t, errors.Is(errors.New("channel_id:unknown not found"), gdnotify.ErrChannelNotFound))
+}
+
+func TestDynamoDBStorageChannelAlreadyExists(t *testing.T) {
+	ctx := context.Background()
+	s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+		Type:       gdnotify.StorageTypeDynamoDB,
+		TableName:  aws.String("gdnotify"),
+		AutoCreate: aws.Bool(true),
+	}, newMockDynamoDBClient())
+	require.NoError(t, err)
+	item := &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: "drive1"}
+	require.NoError(t, s.SaveChannel(ctx, item))
+	err = s.SaveChannel(ctx, item)
+	var alreadyExists *gdnotify.ChannelAlreadyExists
+	require.ErrorAs(t, err, &alreadyExists)
+	require.EqualValues(t, "channel1", alreadyExists.ChannelID)
+	require.ErrorIs(t, err, gdnotify.ErrChannelAlreadyExists)
+	require.ErrorIs(t, fmt.Errorf("save channel:%w", err), gdnotify.ErrChannelAlreadyExists, "wrapped error matches")
+}
+
+func TestDynamoDBStorageOperationTimeout(t *testing.T) {
+	ctx := context.Background()
+	client := newMockDynamoDBClient()
+	s, _, err := gdnotify.NewDynamoDBStorageWithClient(ctx, &gdnotify.StorageConfig{
+		Type:             gdnotify.StorageTypeDynamoDB,
+		TableName:        aws.String("gdnotify"),
+		AutoCreate:       aws.Bool(true),
+		OperationTimeout: 50 * time.Millisecond,
+	}, client)
+	require.NoError(t, err)
+	client.delay = time.Minute
+
+	start := time.Now()
+	_, err = s.FindOneByChannelID(ctx, "channel1")
+	require.Less(t, time.Since(start), 5*time.Second, "aborted at the operation timeout")
+	var timeoutErr *gdnotify.StorageTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, "GetItem", timeoutErr.Operation)
+	require.Equal(t, 50*time.Millisecond, timeoutErr.Timeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFileStorageLockCanceled(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &gdnotify.StorageConfig{
+		Type:     gdnotify.StorageTypeFile,
+		DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+		LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+	}
+	other := flock.New(*cfg.LockFile)
+	locked, err := other.TryLock()
+	require.NoError(t, err)
+	require.True(t, locked)
+	defer other.Unlock()
+
+	s, _, err := gdnotify.NewFileStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(150*time.Millisecond, cancel)
+	start := time.Now()
+	err = s.SaveChannel(ctx, &gdnotify.ChannelItem{ChannelID: "channel1"})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), time.Second, "returns promptly on cancellation")
+	var lockTimeout *gdnotify.LockTimeout
+	require.False(t, errors.As(err, &lockTimeout))
+}
+
+func TestFileStorageFindAllChannelsFrom(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &gdnotify.StorageConfig{
+		Type:     gdnotify.StorageTypeFile,
+		DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+		LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+	}
+	ctx := context.Background()
+	s, _, err := gdnotify.NewFileStorage(ctx, cfg)
+	require.NoError(t, err)
+	expected := make([]string, 0, 150)
+	for i := 0; i < 150; i++ {
+		item := &gdnotify.ChannelItem{
+			ChannelID: fmt.Sprintf("channel%03d", i),
+			DriveID:   gdnotify.DefaultDriveID,
+		}
+		require.NoError(t, s.SaveChannel(ctx, item))
+		expected = append(expected, item.ChannelID)
+	}
+	var resumable gdnotify.ResumableStorage = s
+	first, cursor, err := resumable.FindAllChannelsFrom(ctx, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, cursor)
+	actual := collectChannelIDs(first)
+	require.Len(t, actual, 100)
+
+	second, cursor, err := resumable.FindAllChannelsFrom(ctx, cursor)
+	require.NoError(t, err)
+	require.Empty(t, cursor, "the last page")
+	actual = append(actual, collectChannelIDs(second)...)
+	require.Equal(t, expected, actual, "no overlap or gaps between the pages")
+
+	_, _, err = resumable.FindAllChannelsFrom(ctx, "-1")
+	require.Error(t, err)
+}
+
+func TestFileStorageWebhookAddress(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &gdnotify.StorageConfig{
+		Type:     gdnotify.StorageTypeFile,
+		DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+		LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+	}
+	ctx := context.Background()
+	s, _, err := gdnotify.NewFileStorage(ctx, cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveChannel(ctx, &gdnotify.ChannelItem{
+		ChannelID:      "channel1",
+		DriveID:        gdnotify.DefaultDriveID,
+		WebhookAddress: "https://gdnotify.example.com/",
+	}))
+	actual, err := s.FindOneByChannelID(ctx, "channel1")
+	require.NoError(t, err)
+	require.EqualValues(t, "https://gdnotify.example.com/", actual.WebhookAddress)
+}
+
+func TestFileStorageDoesNotShareItems(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &gdnotify.StorageConfig{
+		Type:     gdnotify.StorageTypeFile,
+		DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+		LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+	}
+	ctx := context.Background()
+	s, _, err := gdnotify.NewFileStorage(ctx, cfg)
+	require.NoError(t, err)
+	item := &gdnotify.ChannelItem{
+		ChannelID: "channel1",
+		DriveID:   gdnotify.DefaultDriveID,
+		PageToken: "100",
+	}
+	require.NoError(t, s.SaveChannel(ctx, item))
+	item.PageToken = "changed by the caller"
+	itemsCh, err := s.FindAllChannels(ctx)
+	require.NoError(t, err)
+	items := <-itemsCh
+	require.Len(t, items, 1)
+	require.Equal(t, "100", items[0].PageToken, "the saved item is a copy")
+
+	items[0].PageToken = "changed by the reader"
+	require.NoError(t, s.UpdatePageToken(ctx, &gdnotify.ChannelItem{ChannelID: "channel1", PageToken: "200"}))
+	require.Equal(t, "changed by the reader", items[0].PageToken, "the found items are copies")
+	actual, err := s.FindOneByChannelID(ctx, "channel1")
+	require.NoError(t, err)
+	require.Equal(t, "200", actual.PageToken)
+}
+
+type failingWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.w.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("disk full")
+	}
+	w.limit -= len(p)
+	return w.w.Write(p)
+}
+
+func TestFileStorageAtomicStore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &gdnotify.StorageConfig{
+		Type:     gdnotify.StorageTypeFile,
+		DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+		LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+	}
+	ctx := context.Background()
+	s, _, err := gdnotify.NewFileStorage(ctx, cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveChannel(ctx, &gdnotify.ChannelItem{ChannelID: "channel1", DriveID: gdnotify.DefaultDriveID}))
+	good, err := os.ReadFile(*cfg.DataFile)
+	require.NoError(t, err)
+
+	err = s.StoreWith(ctx, func(w io.Writer) error {
+		return gob.NewEncoder(&failingWriter{w: w, limit: 10}).Encode(s)
+	})
+	require.Error(t, err)
+	actual, err := os.ReadFile(*cfg.DataFile)
+	require.NoError(t, err)
+	require.Equal(t, good, actual, "previous good file is preserved")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"storage.gob", "storage.lock"}, lo.Map(entries, func(entry os.DirEntry, _ int) string {
+		return entry.Name()
+	}), "temp file is removed")
+
+	item, err := s.FindOneByChannelID(ctx, "channel1")
+	require.NoError(t, err)
+	require.EqualValues(t, gdnotify.DefaultDriveID, item.DriveID)
+}
+
+func TestFileStorageFormat(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	expected := &gdnotify.ChannelItem{
+		ChannelID:          "channel1",
+		DriveID:            gdnotify.DefaultDriveID,
+		PageToken:          "100",
+		Expiration:         base.Add(7 * 24 * time.Hour),
+		PageTokenFetchedAt: base,
+		CreatedAt:          base,
+		UpdatedAt:          base,
+	}
+	newStorage := func(t *testing.T, dataFile string, format string) *gdnotify.FileStorage {
+		t.Helper()
+		cfg := &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeFile,
+			DataFile:   aws.String(dataFile),
+			FileFormat: format,
+		}
+		require.NoError(t, cfg.Restrict())
+		cfg.LockFile = aws.String(filepath.Join(filepath.Dir(dataFile), "storage.lock"))
+		s, _, err := gdnotify.NewFileStorage(ctx, cfg)
+		require.NoError(t, err)
+		return s
+	}
+	t.Run("json", func(t *testing.T) {
+		dataFile := filepath.Join(t.TempDir(), "storage.json")
+		s := newStorage(t, dataFile, gdnotify.FileFormatJSON)
+		require.NoError(t, s.SaveChannel(ctx, expected))
+		bs, err := os.ReadFile(dataFile)
+		require.NoError(t, err)
+		require.Contains(t, string(bs), `"Expiration": "2022-06-22T00:00:00Z"`, "time fields are readable")
+
+		actual, err := newStorage(t, dataFile, gdnotify.FileFormatJSON).FindOneByChannelID(ctx, "channel1")
+		require.NoError(t, err)
+		require.EqualValues(t, expected, actual)
+	})
+	t.Run("existing gob", func(t *testing.T) {
+		dataFile := filepath.Join(t.TempDir(), "storage.gob")
+		fp, err := os.Create(dataFile)
+		require.NoError(t, err)
+		require.NoError(t, gob.NewEncoder(fp).Encode(&gdnotify.FileStorage{
+			Items:    []*gdnotify.ChannelItem{expected},
+			FilePath: dataFile,
+		}))
+		require.NoError(t, fp.Close())
+
+		actual, err := newStorage(t, dataFile, "").FindOneByChannelID(ctx, "channel1")
+		require.NoError(t, err)
+		require.True(t, expected.Expiration.Equal(actual.Expiration))
+		require.EqualValues(t, expected.PageToken, actual.PageToken)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		cfg := &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeFile,
+			DataFile:   aws.String("storage.xml"),
+			FileFormat: "xml",
+		}
+		require.EqualError(t, cfg.Restrict(), "file_format: `xml` is invalid, allowed `gob` or `json`")
+	})
+}
+
+func TestStorageUpdatePageToken(t *testing.T) {
+	backends := map[string]func(t *testing.T) gdnotify.Storage{
+		"file": func(t *testing.T) gdnotify.Storage {
+			dir := t.TempDir()
+			s, _, err := gdnotify.NewFileStorage(context.Background(), &gdnotify.StorageConfig{
+				Type:     gdnotify.StorageTypeFile,
+				DataFile: aws.String(filepath.Join(dir, "storage.gob")),
+				LockFile: aws.String(filepath.Join(dir, "storage.lock")),
+			})
+			require.NoError(t, err)
+			return s
+		},
+		"memory": func(t *testing.T) gdnotify.Storage {
+			return gdnotify.NewMemoryStorage()
+		},
+		"dynamodb": func(t *testing.T) gdnotify.Storage {
+			s, _, err := gdnotify.NewDynamoDBStorageWithClient(context.Background(), &gdnotify.StorageConfig{
+				Type:      gdnotify.StorageTypeDynamoDB,
+				TableName: aws.String("gdnotify"),
+			}, newMockDynamoDBClient())
+			require.NoError(t, err)
+			return s
+		},
+	}
+	now := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newStorage(t)
+			require.NoError(t, s.SaveChannel(ctx, &gdnotify.ChannelItem{
+				ChannelID:  "channel1",
+				DriveID:    "drive1",
+				PageToken:  "100",
+				Expiration: now.Add(time.Hour),
+				CreatedAt:  now,
+				UpdatedAt:  now,
+			}))
+			require.NoError(t, s.UpdatePageToken(ctx, &gdnotify.ChannelItem{
+				ChannelID:         "channel1",
+				PageToken:         "200",
+				LastMessageNumber: 3,
+				LastChangeAt:      now.Add(time.Minute),
+				UpdatedAt:         now.Add(time.Minute),
+			}))
+			found, err := s.FindOneByChannelID(ctx, "channel1")
+			require.NoError(t, err)
+			require.Equal(t, "200", found.PageToken)
+			require.EqualValues(t, 3, found.LastMessageNumber)
+			require.True(t, now.Add(time.Minute).Equal(found.UpdatedAt), "UpdatedAt is updated: %s", found.UpdatedAt)
+			require.True(t, now.Add(time.Minute).Equal(found.LastChangeAt), "LastChangeAt is updated: %s", found.LastChangeAt)
+
+			require.NoError(t, s.UpdatePageToken(ctx, &gdnotify.ChannelItem{
+				ChannelID:         "channel1",
+				PageToken:         "300",
+				LastMessageNumber: 4,
+				UpdatedAt:         now.Add(2 * time.Minute),
+			}), "without changes")
+			found, err = s.FindOneByChannelID(ctx, "channel1")
+			require.NoError(t, err)
+			require.Equal(t, "300", found.PageToken)
+			require.True(t, now.Add(2*time.Minute).Equal(found.UpdatedAt), "UpdatedAt is updated: %s", found.UpdatedAt)
+			require.True(t, now.Add(time.Minute).Equal(found.LastChangeAt), "zero LastChangeAt keeps the last one: %s", found.LastChangeAt)
+			require.Equal(t, "drive1", found.DriveID)
+			require.True(t, now.Add(time.Hour).Equal(found.Expiration))
+
+			var notFound *gdnotify.ChannelNotFound
+			require.ErrorAs(t, s.UpdatePageToken(ctx, &gdnotify.ChannelItem{ChannelID: "channel2", UpdatedAt: now}), &notFound)
+		})
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	cfg := &gdnotify.StorageConfig{Type: gdnotify.StorageTypeMemory}
+	require.NoError(t, cfg.Restrict())
+	storage, cleanup, err := gdnotify.NewStorage(ctx, cfg, aws.Config{})
+	require.NoError(t, err)
+	require.Nil(t, cleanup)
+	s, ok := storage.(*gdnotify.MemoryStorage)
+	require.True(t, ok)
+
+	now := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	item := &gdnotify.ChannelItem{
+		ChannelID:  "channel1",
+		DriveID:    "drive1",
+		PageToken:  "100",
+		Expiration: now.Add(time.Hour),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	require.NoError(t, s.SaveChannel(ctx, item))
+	item.PageToken = "modified"
+	var alreadyExists *gdnotify.ChannelAlreadyExists
+	err = s.SaveChannel(ctx, item)
+	require.ErrorAs(t, err, &alreadyExists)
+	require.Equal(t, "channel1", alreadyExists.ChannelID)
+	require.ErrorIs(t, err, gdnotify.ErrChannelAlreadyExists)
+	require.False(t, errors.Is(err, gdnotify.ErrChannelNotFound))
+	require.NoError(t, s.SaveChannel(ctx, &gdnotify.ChannelItem{ChannelID: "channel2", DriveID: "drive2"}))
+
+	found, err := s.FindOneByChannelID(ctx, "channel1")
+	require.NoError(t, err)
+	require.Equal(t, "100", found.PageToken, "saved item is a copy")
+	found.PageToken = "modified"
+	found, err = s.FindOneByChannelID(ctx, "channel1")
+	require.NoError(t, err)
+	require.Equal(t, "100", found.PageToken, "found item is a copy")
+
+	require.NoError(t, s.UpdatePageToken(ctx, &gdnotify.ChannelItem{
+		ChannelID:         "channel1",
+		PageToken:         "200",
+		LastMessageNumber: 3,
+		LastChangeAt:      now.Add(time.Minute),
+		UpdatedAt:         now.Add(time.Minute),
+	}))
+	found, err = s.FindOneByChannelID(ctx, "channel1")
+	require.NoError(t, err)
+	require.Equal(t, "200", found.PageToken)
+	require.EqualValues(t, 3, found.LastMessageNumber)
+	require.Equal(t, now.Add(time.Minute), found.LastChangeAt)
+	require.Equal(t, "drive1", found.DriveID)
+	require.Equal(t, now.Add(time.Hour), found.Expiration)
+
+	var notFound *gdnotify.ChannelNotFound
+	require.ErrorAs(t, s.UpdatePageToken(ctx, &gdnotify.ChannelItem{ChannelID: "channel3"}), &notFound)
+
+	ch, err := s.FindAllChannels(ctx)
+	require.NoError(t, err)
+	var channelIDs []string
+	for items := range ch {
+		for _, item := range items {
+			channelIDs = append(channelIDs, item.ChannelID)
+		}
+	}
+	require.Equal(t, []string{"channel1", "channel2"}, channelIDs)
+
+	require.NoError(t, s.DeleteChannel(ctx, &gdnotify.ChannelItem{ChannelID: "channel1"}))
+	_, err = s.FindOneByChannelID(ctx, "channel1")
+	require.ErrorAs(t, err, &notFound)
+	require.Equal(t, "channel1", notFound.ChannelID)
+	require.ErrorIs(t, err, gdnotify.ErrChannelNotFound)
+	require.NoError(t, s.DeleteChannel(ctx, &gdnotify.ChannelItem{ChannelID: "channel1"}), "deleting a missing channel is not an error")
+}
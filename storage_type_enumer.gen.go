@@ -7,11 +7,11 @@ import (
 	"strings"
 )
 
-const _StorageTypeName = "DynamoDBFile"
+const _StorageTypeName = "DynamoDBFileMemory"
 
-var _StorageTypeIndex = [...]uint8{0, 8, 12}
+var _StorageTypeIndex = [...]uint8{0, 8, 12, 18}
 
-const _StorageTypeLowerName = "dynamodbfile"
+const _StorageTypeLowerName = "dynamodbfilememory"
 
 func (i StorageType) String() string {
 	if i < 0 || i >= StorageType(len(_StorageTypeIndex)-1) {
@@ -26,20 +26,24 @@ func _StorageTypeNoOp() {
 	var x [1]struct{}
 	_ = x[StorageTypeDynamoDB-(0)]
 	_ = x[StorageTypeFile-(1)]
+	_ = x[StorageTypeMemory-(2)]
 }
 
-var _StorageTypeValues = []StorageType{StorageTypeDynamoDB, StorageTypeFile}
+var _StorageTypeValues = []StorageType{StorageTypeDynamoDB, StorageTypeFile, StorageTypeMemory}
 
 var _StorageTypeNameToValueMap = map[string]StorageType{
-	_StorageTypeName[0:8]:       StorageTypeDynamoDB,
-	_StorageTypeLowerName[0:8]:  StorageTypeDynamoDB,
-	_StorageTypeName[8:12]:      StorageTypeFile,
-	_StorageTypeLowerName[8:12]: StorageTypeFile,
+	_StorageTypeName[0:8]:        StorageTypeDynamoDB,
+	_StorageTypeLowerName[0:8]:   StorageTypeDynamoDB,
+	_StorageTypeName[8:12]:       StorageTypeFile,
+	_StorageTypeLowerName[8:12]:  StorageTypeFile,
+	_StorageTypeName[12:18]:      StorageTypeMemory,
+	_StorageTypeLowerName[12:18]: StorageTypeMemory,
 }
 
 var _StorageTypeNames = []string{
 	_StorageTypeName[0:8],
 	_StorageTypeName[8:12],
+	_StorageTypeName[12:18],
 }
 
 // StorageTypeString retrieves an enum value from the enum constants string name.
@@ -0,0 +1,34 @@
+package gdnotify
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mashiike/gdnotify"
+
+func newTracer(cfg *Config) trace.Tracer {
+	if !cfg.EnableTracing {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// SetTracerProvider replaces the TracerProvider of the spans of webhooks, changes:list pages and notifications.
+// By default, they are recorded by the global TracerProvider of OpenTelemetry if enable_tracing is true, and not recorded otherwise.
+func (app *App) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	app.tracer = tp.Tracer(tracerName)
+}
+
+// endSpan records err on the span if it is not nil, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
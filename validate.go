@@ -0,0 +1,45 @@
+package gdnotify
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/samber/lo"
+)
+
+// WriteSummary writes the summary of the loaded config to w, for the validate command.
+// It does not create App, so no channel is created and neither Google Drive nor AWS is called.
+func (cfg *Config) WriteSummary(w io.Writer) error {
+	notificationType := cfg.Notification.Type.String()
+	if len(cfg.Notification.Targets) > 0 {
+		notificationType += " (" + strings.Join(lo.Map(cfg.Notification.Targets, func(target *NotificationConfig, _ int) string {
+			return target.Type.String()
+		}), ", ") + ")"
+	}
+	withinModifiedTime := ""
+	if cfg.WithinModifiedTime != nil {
+		withinModifiedTime = cfg.WithinModifiedTime.String()
+	}
+	if _, err := fmt.Fprintln(w, "config is valid"); err != nil {
+		return err
+	}
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Name", "Value"})
+	table.AppendBulk([][]string{
+		{"Required Version", cfg.RequiredVersion},
+		{"Webhook Addresses", strings.Join(webhookAddresses(cfg), ", ")},
+		{"Expiration", cfg.Expiration.String()},
+		{"Storage", cfg.Storage.Type.String()},
+		{"Notification", notificationType},
+		{"Credentials", cfg.Credentials.BackendType.String()},
+		{"Drives", strings.Join(lo.Map(cfg.Drives, func(drive *DriveConfig, _ int) string {
+			return drive.DriveID
+		}), ", ")},
+		{"Drives Auto Detect", fmt.Sprint(cfg.DrivesAutoDetect != nil && *cfg.DrivesAutoDetect)},
+		{"Within Modified Time", withinModifiedTime},
+	})
+	table.Render()
+	return nil
+}
@@ -0,0 +1,107 @@
+package gdnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	logx "github.com/mashiike/go-logx"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// WatchFile creates a notification channel that watches a single file by files:watch, instead of the changes of the whole drive.
+// A change notification of the channel sends the metadata of the file, without running changes:list.
+func (app *App) WatchFile(ctx context.Context, fileID string) error {
+	if app.dryRun {
+		logx.Printf(ctx, "[notice] [dry-run] create channel file_id=%s", fileID)
+		return nil
+	}
+	file, err := app.getFile(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	item := &ChannelItem{
+		DriveID: coalesce(file.DriveId, DefaultDriveID),
+		FileID:  fileID,
+	}
+	if err := app.createChannel(ctx, item); err != nil {
+		return err
+	}
+	app.metrics.IncrChannelsCreated(ctx, item.DriveID)
+	app.sendLifecycleEvent(ctx, NewLifecycleEvent(DetailTypeChannelCreated, item, nil))
+	return nil
+}
+
+// watchFile calls files:watch with the webhook address.
+func (app *App) watchFile(ctx context.Context, item *ChannelItem, address string) (*drive.Channel, error) {
+	watchCall := app.driveSvc.Files.Watch(item.FileID, &drive.Channel{
+		Id:         item.ChannelID,
+		Address:    address,
+		Expiration: item.Expiration.UnixMilli(),
+		Type:       "web_hook",
+		Payload:    true,
+	}).SupportsAllDrives(true)
+	var resp *drive.Channel
+	err := app.retryDriveAPI(ctx, "files:watch", func() error {
+		var err error
+		resp, err = watchCall.Context(ctx).Do()
+		return err
+	})
+	return resp, err
+}
+
+func (app *App) getFile(ctx context.Context, fileID string) (*drive.File, error) {
+	var file *drive.File
+	err := app.retryDriveAPI(ctx, "files:get", func() error {
+		var err error
+		file, err = app.driveSvc.Files.Get(fileID).Fields(googleapi.Field(fileFieldNamesOf(app.currentSettings()))).SupportsAllDrives(true).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		logx.Printf(ctx, "[debug] failed Drive API files:get file_id=%s: %s", fileID, err.Error())
+		return nil, fmt.Errorf("drive API files:get: %w", err)
+	}
+	return file, nil
+}
+
+// FileChange fetches the metadata of the watched file of the files:watch channel, and calls fn with it as a change.
+// The change is regarded as removed if the resource state is `remove` or the file is not found.
+func (app *App) FileChange(ctx context.Context, item *ChannelItem, state string, fn func([]*drive.Change) error) (*ChannelItem, error) {
+	now := app.clock.Now()
+	change := &drive.Change{
+		Kind:       "drive#change",
+		ChangeType: "file",
+		FileId:     item.FileID,
+		Time:       now.Format(time.RFC3339Nano),
+	}
+	if state == "remove" {
+		change.Removed = true
+	} else {
+		file, err := app.getFile(ctx, item.FileID)
+		var apiError *googleapi.Error
+		switch {
+		case err == nil:
+			change.File = file
+			change.DriveId = file.DriveId
+		case errors.As(err, &apiError) && apiError.Code == http.StatusNotFound:
+			change.Removed = true
+		default:
+			return nil, err
+		}
+	}
+	logx.Printf(ctx, "[debug] file change channel_id=%s file_id=%s removed=%v", item.ChannelID, item.FileID, change.Removed)
+	if err := fn([]*drive.Change{change}); err != nil {
+		return nil, err
+	}
+	newItem := *item
+	newItem.UpdatedAt = now
+	newItem.LastChangeAt = now
+	if err := app.storage.UpdatePageToken(ctx, &newItem); err != nil {
+		return nil, err
+	}
+	app.metrics.ObserveChangesProcessed(ctx, item.DriveID, 1)
+	return &newItem, nil
+}
@@ -1,13 +1,26 @@
 package gdnotify
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	logx "github.com/mashiike/go-logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/drive/v3"
 )
 
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -16,6 +29,13 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	state := r.Header.Get("X-Goog-Resource-State")
 	userAgent := r.Header.Get("User-Agent")
 	resourceID := r.Header.Get("X-Goog-Resource-Id")
+	ctx, span := app.tracer.Start(ctx, "webhook", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("gdnotify.channel_id", channelID),
+		attribute.String("gdnotify.resource_id", resourceID),
+		attribute.String("gdnotify.resource_state", state),
+	))
+	defer span.End()
+	w = &spanStatusWriter{ResponseWriter: w, span: span}
 	logx.Printf(ctx, "[info] method:%s uri:%s user_agent:%s channel_id:%s resource_id:%s resource_state:%s message_number:%s forwarded_for:%s channel_expiration:%s",
 		coalesce(r.Method, "-"),
 		coalesce(r.URL.String(), "-"),
@@ -28,16 +48,19 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		coalesce(r.Header.Get("X-Goog-Channel-Expiration"), "-"),
 	)
 	defer r.Body.Close()
-	if d, err := httputil.DumpRequest(r, true); err == nil {
-		logx.Println(ctx, "[debug] receive request\n", string(d))
+	app.metrics.IncrWebhooksReceived(ctx, coalesce(state, "-"))
+	if d, err := dumpRequest(r, app.maxDumpBytes); err == nil {
+		logx.Println(ctx, "[debug] receive request\n", d)
 	}
-	if !strings.HasPrefix(userAgent, "APIs-Google;") {
+	if !app.isAllowedUserAgent(userAgent) {
 		logx.Printf(ctx, "[warn]  user-agent unexpected return 404: `%s`", userAgent)
 		w.WriteHeader(http.StatusNotFound)
 		io.WriteString(w, http.StatusText(http.StatusNotFound))
 		return
 	}
-	if state == "sync" {
+	switch state {
+	case "sync":
+		// sync is sent once when the channel is created, there are no changes to fetch.
 		logx.Printf(ctx, "[info] sync accepted channel_id:%s resource_id:%s",
 			coalesce(channelID, "-"),
 			coalesce(resourceID, "-"),
@@ -45,9 +68,21 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, http.StatusText(http.StatusOK))
 		return
-	}
-	if state != "change" {
-		logx.Printf(ctx, "[warn] unknown state:%s channel_id:%s resource_id:%s",
+	case "change", "update", "exists", "add", "remove", "trash", "untrash":
+		// change is the state of changes:watch channels.
+		// The others are documented for resource watches, e.g. files:watch, and tell that the resource has been changed as well,
+		// so the changes are fetched in the same way.
+	case "not_exists":
+		// not_exists tells that the watched resource does not exist, there are no changes to fetch.
+		logx.Printf(ctx, "[info] not_exists accepted channel_id:%s resource_id:%s",
+			coalesce(channelID, "-"),
+			coalesce(resourceID, "-"),
+		)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, http.StatusText(http.StatusOK))
+		return
+	default:
+		logx.Printf(ctx, "[debug] unknown state:%s channel_id:%s resource_id:%s",
 			coalesce(state, "-"),
 			coalesce(channelID, "-"),
 			coalesce(resourceID, "-"),
@@ -56,46 +91,201 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, http.StatusText(http.StatusOK))
 		return
 	}
-	logx.Printf(ctx, "[info] change accepted channel_id:%s resource_id:%s",
+	logx.Printf(ctx, "[info] %s accepted channel_id:%s resource_id:%s",
+		state,
 		coalesce(channelID, "-"),
 		coalesce(resourceID, "-"),
 	)
-	changes, item, err := app.ChangesList(ctx, channelID)
-	if err != nil {
-		logx.Printf(ctx, "[error] get changes list failed channel_id:%s resource_id:%s err:%s",
+	release, ok := app.acquireWebhook(ctx)
+	if !ok {
+		logx.Printf(ctx, "[warn] too many concurrent webhooks, return 503 channel_id:%s resource_id:%s",
 			coalesce(channelID, "-"),
 			coalesce(resourceID, "-"),
-			err.Error(),
 		)
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, http.StatusText(http.StatusInternalServerError))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, http.StatusText(http.StatusServiceUnavailable))
 		return
 	}
-	if len(changes) > 0 {
-		logx.Printf(ctx, "[debug] send changes channel_id:%s resource_id:%s",
+	defer release()
+	ctx, done := app.startWork(ctx)
+	defer done()
+	start := time.Now()
+	var sendErr error
+	messageNumber, _ := strconv.ParseInt(r.Header.Get("X-Goog-Message-Number"), 10, 64)
+	item, err := app.findChannel(ctx, channelID)
+	if err == nil && messageNumber > 0 && messageNumber <= item.LastMessageNumber {
+		// Google may redeliver a notification, skip it if a newer one has been processed.
+		logx.Printf(ctx, "[info] duplicate message skipped channel_id:%s resource_id:%s message_number:%d last_message_number:%d",
 			coalesce(channelID, "-"),
 			coalesce(resourceID, "-"),
+			messageNumber,
+			item.LastMessageNumber,
 		)
-		if err := app.SendNotification(ctx, item, changes); err != nil {
-			logx.Printf(ctx, "[error] send changes failed channel_id:%s resource_id:%s err:%s",
-				coalesce(channelID, "-"),
-				coalesce(resourceID, "-"),
-				err.Error(),
-			)
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, http.StatusText(http.StatusInternalServerError))
-			return
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, http.StatusText(http.StatusOK))
+		return
+	}
+	if err == nil {
+		if messageNumber > 0 {
+			// persisted with the page token.
+			item.LastMessageNumber = messageNumber
+		}
+		// with the retry policy, a failure aborts the pages, so that neither the page token nor the message number is saved
+		// and the redelivery by Google fetches the changes again.
+		retryOnFailure := app.notificationFailureStatus != http.StatusOK
+		send := func(changes []*drive.Change) error {
+			if err := app.sendChangesPage(ctx, item, changes); err != nil {
+				logx.Printf(ctx, "[error] send changes failed channel_id:%s resource_id:%s err:%s",
+					coalesce(channelID, "-"),
+					coalesce(resourceID, "-"),
+					err.Error(),
+				)
+				sendErr = err
+				if retryOnFailure {
+					return err
+				}
+			}
+			return nil
+		}
+		if item.FileID != "" {
+			// files:watch channel, the watched file is fetched instead of changes:list.
+			_, err = app.FileChange(ctx, item, state, send)
+		} else {
+			_, err = app.ChangesPages(ctx, item, send)
+		}
+		if sendErr != nil && retryOnFailure {
+			// responded with the notification failure status below.
+			err = nil
 		}
-	} else {
-		logx.Printf(ctx, "[debug] no changes channel_id:%s resource_id:%s",
+	}
+	if err != nil {
+		logx.Printf(ctx, "[error] get changes list failed channel_id:%s resource_id:%s err:%s",
 			coalesce(channelID, "-"),
 			coalesce(resourceID, "-"),
+			err.Error(),
 		)
+		if errors.Is(err, ErrChannelNotFound) {
+			app.recordOrphanChannel(ctx, channelID, resourceID)
+			if err := app.ReconcileOrphans(ctx); err != nil {
+				logx.Printf(ctx, "[warn] reconcile orphaned channels failed: %s", err.Error())
+			}
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, http.StatusText(http.StatusOK))
+			return
+		}
+		var tableNotFound *TableNotFound
+		if errors.As(err, &tableNotFound) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer func() {
+		app.metrics.ObserveSyncDuration(ctx, item.DriveID, time.Since(start))
+	}()
+	if sendErr != nil {
+		w.WriteHeader(app.notificationFailureStatus)
+		io.WriteString(w, http.StatusText(app.notificationFailureStatus))
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, http.StatusText(http.StatusOK))
 }
 
+// redactedHeaders are the headers of secrets, their values are not logged by the request dump.
+var redactedHeaders = []string{"Authorization", "X-Goog-Channel-Token", "X-Signature"}
+
+// dumpRequest dumps the request for the debug log, with the redacted headers and the dump truncated to maxBytes.
+// Only maxBytes of the body are read for the dump, the body is restored for the handler.
+func dumpRequest(r *http.Request, maxBytes int) (string, error) {
+	dumpReq := r.Clone(r.Context())
+	for _, name := range redactedHeaders {
+		if dumpReq.Header.Get(name) != "" {
+			dumpReq.Header.Set(name, "[REDACTED]")
+		}
+	}
+	d, err := httputil.DumpRequest(dumpReq, false)
+	if err != nil {
+		return "", err
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody && len(d) < maxBytes {
+		body, err = io.ReadAll(io.LimitReader(r.Body, int64(maxBytes-len(d)+1)))
+		if err != nil {
+			return "", err
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	d = append(d, body...)
+	if len(d) > maxBytes {
+		return fmt.Sprintf("%s\n... (truncated, max_dump_bytes=%d)", d[:maxBytes], maxBytes), nil
+	}
+	return string(d), nil
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 of the Goog headers of the webhook request,
+// X-Goog-Channel-Id, X-Goog-Resource-Id, X-Goog-Resource-State and X-Goog-Message-Number joined by newline.
+func WebhookSignature(secret []byte, header http.Header) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, strings.Join([]string{
+		header.Get("X-Goog-Channel-Id"),
+		header.Get("X-Goog-Resource-Id"),
+		header.Get("X-Goog-Resource-State"),
+		header.Get("X-Goog-Message-Number"),
+	}, "\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature returns 401 for requests without a valid X-Signature header, if webhook_hmac_secret is set.
+func (app *App) verifySignature(next http.Handler) http.Handler {
+	if len(app.webhookHMACSecret) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := WebhookSignature(app.webhookHMACSecret, r.Header)
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(r.Header.Get("X-Signature")))) {
+			logx.Printf(r.Context(), "[warn] invalid signature, return 401 channel_id:%s resource_id:%s",
+				coalesce(r.Header.Get("X-Goog-Channel-Id"), "-"),
+				coalesce(r.Header.Get("X-Goog-Resource-Id"), "-"),
+			)
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAllowedUserAgent reports whether the User-Agent has one of server.allowed_user_agent_prefixes.
+func (app *App) isAllowedUserAgent(userAgent string) bool {
+	for _, prefix := range app.allowedUserAgentPrefixes {
+		if strings.HasPrefix(userAgent, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireWebhook waits for a slot to process a change notification up to the webhook queue timeout.
+// It reports false if no slot is available in time, then Google retries the notification by 503.
+func (app *App) acquireWebhook(ctx context.Context) (func(), bool) {
+	if app.webhookSem == nil {
+		return func() {}, true
+	}
+	ctx, cancel := context.WithTimeout(ctx, app.webhookQueueTimeout)
+	defer cancel()
+	if err := app.webhookSem.Acquire(ctx, 1); err != nil {
+		return nil, false
+	}
+	return func() { app.webhookSem.Release(1) }, true
+}
+
 func coalesce(strs ...string) string {
 	for _, str := range strs {
 		if str != "" {
@@ -104,3 +294,17 @@ func coalesce(strs ...string) string {
 	}
 	return ""
 }
+
+// spanStatusWriter records the response status of the webhook on the span.
+type spanStatusWriter struct {
+	http.ResponseWriter
+	span trace.Span
+}
+
+func (w *spanStatusWriter) WriteHeader(status int) {
+	w.span.SetAttributes(attribute.Int("http.status_code", status))
+	if status >= http.StatusInternalServerError {
+		w.span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
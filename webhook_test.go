@@ -0,0 +1,1009 @@
+package gdnotify_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/mashiike/gdnotify"
+	logx "github.com/mashiike/go-logx"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/api/drive/v3"
+)
+
+func newWebhookRequest(channelID string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("User-Agent", "APIs-Google; (+https://developers.google.com/webmasters/APIs-Google.html)")
+	req.Header.Set("X-Goog-Channel-Id", channelID)
+	req.Header.Set("X-Goog-Resource-Id", "resource-"+channelID)
+	req.Header.Set("X-Goog-Resource-State", "change")
+	req.Header.Set("X-Goog-Message-Number", "2")
+	return req
+}
+
+func TestWebhookNotificationFailurePolicy(t *testing.T) {
+	cases := []struct {
+		policy            string
+		expected          int
+		expectedPageToken string
+	}{
+		{policy: gdnotify.NotificationFailureAck, expected: http.StatusOK, expectedPageToken: "200"},
+		{policy: gdnotify.NotificationFailureRetry, expected: http.StatusInternalServerError, expectedPageToken: "100"},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			f := newFakeDrive()
+			f.changes = []*drive.Change{
+				{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+			}
+			app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.Server = &gdnotify.ServerConfig{
+					NotificationFailure: c.policy,
+				}
+				*cfg.Notification.EventFile = filepath.Join(t.TempDir(), "not_found", "events.json")
+			})
+			ctx := context.Background()
+			require.NoError(t, app.RunWithContext(ctx,
+				gdnotify.WithRunMode("cli"),
+				gdnotify.WithCLICommand("maintenance"),
+			))
+			channelID := f.WatchCalls()[0].Id
+			f.mu.Lock()
+			f.startPageToken = "200"
+			f.mu.Unlock()
+
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, newWebhookRequest(channelID))
+			require.Equal(t, c.expected, w.Code)
+
+			storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+			require.NoError(t, err)
+			item, err := storage.FindOneByChannelID(ctx, channelID)
+			require.NoError(t, err)
+			require.Equal(t, c.expectedPageToken, item.PageToken)
+			if c.policy != gdnotify.NotificationFailureRetry {
+				return
+			}
+			require.Zero(t, item.LastMessageNumber, "message number is not saved")
+
+			// the redelivery by Google sends the changes after recovery.
+			require.NoError(t, os.MkdirAll(filepath.Dir(*cfg.Notification.EventFile), 0o755))
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, newWebhookRequest(channelID))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Len(t, readEvents(t, cfg), 1)
+			item, err = storage.FindOneByChannelID(ctx, channelID)
+			require.NoError(t, err)
+			require.Equal(t, "200", item.PageToken)
+		})
+	}
+}
+
+func TestWebhookMetricsEndpoint(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		app, _ := newTestApp(t, newFakeDrive())
+		w := httptest.NewRecorder()
+		app.SetupRoute().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.NotEqual(t, http.StatusOK, w.Code)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		f := newFakeDrive()
+		f.changes = []*drive.Change{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+			{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+		}
+		app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+			cfg.Server.EnableMetrics = true
+		})
+		ctx := context.Background()
+		require.NoError(t, app.RunWithContext(ctx,
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		))
+		handler := app.SetupRoute()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newWebhookRequest(f.WatchCalls()[0].Id))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+		body := w.Body.String()
+		for _, expected := range []string{
+			"# TYPE gdnotify_active_channels gauge\n",
+			`gdnotify_active_channels{drive_id="__default__"} 1` + "\n",
+			"# TYPE gdnotify_webhooks_received_total counter\n",
+			`gdnotify_webhooks_received_total{state="change"} 1` + "\n",
+			"# TYPE gdnotify_changes_forwarded_total counter\n",
+			`gdnotify_changes_forwarded_total{drive_id="__default__"} 2` + "\n",
+		} {
+			require.Contains(t, body, expected)
+		}
+	})
+}
+
+func TestWebhookHealthAndReady(t *testing.T) {
+	cases := []struct {
+		name           string
+		drivesError    bool
+		expectedReady  int
+		expectedStatus string
+	}{
+		{name: "healthy", drivesError: false, expectedReady: http.StatusOK, expectedStatus: "ok"},
+		{name: "drive unavailable", drivesError: true, expectedReady: http.StatusServiceUnavailable, expectedStatus: "unavailable"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFakeDrive()
+			f.drivesError = c.drivesError
+			app, _ := newTestApp(t, f)
+			handler := app.SetupRoute()
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			require.Equal(t, http.StatusOK, w.Code, "liveness does not depend on dependencies")
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			require.Equal(t, c.expectedReady, w.Code)
+			var body struct {
+				Status   string            `json:"status"`
+				Failures map[string]string `json:"failures"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			require.Equal(t, c.expectedStatus, body.Status)
+			if c.drivesError {
+				require.Contains(t, body.Failures, "drive")
+				require.NotContains(t, body.Failures, "storage")
+			} else {
+				require.Empty(t, body.Failures)
+			}
+		})
+	}
+}
+
+func TestWebhookBatchWindowRestarted(t *testing.T) {
+	f := newFakeDrive()
+	var mu sync.Mutex
+	var pageTokens []string
+	f.changesHook = func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		pageTokens = append(pageTokens, r.URL.Query().Get("pageToken"))
+	}
+	withBatchWindow := func(cfg *gdnotify.Config) {
+		cfg.Notification.BatchWindow = time.Hour
+	}
+	app, cfg := newTestApp(t, f, withBatchWindow)
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	f.mu.Lock()
+	f.changes = []*drive.Change{{Kind: "drive#change", ChangeType: "file", FileId: "file1"}}
+	f.startPageToken = "200"
+	f.mu.Unlock()
+	storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, newWebhookRequest(channelID))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, readEvents(t, cfg), "pending within the window")
+	item, err := storage.FindOneByChannelID(ctx, channelID)
+	require.NoError(t, err)
+	require.Equal(t, "100", item.PageToken, "the page token is not saved while the changes are pending")
+
+	req := newWebhookRequest(channelID)
+	req.Header.Set("X-Goog-Message-Number", "3")
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the process is killed without Close, and restarted with the same storage.
+	restarted, _ := newTestApp(t, f, withBatchWindow, func(c *gdnotify.Config) {
+		c.Storage = cfg.Storage
+		c.Notification = cfg.Notification
+	})
+	req = newWebhookRequest(channelID)
+	req.Header.Set("X-Goog-Message-Number", "4")
+	w = httptest.NewRecorder()
+	restarted.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	mu.Lock()
+	require.Equal(t, []string{"100", "200", "100"}, pageTokens, "fetched from the pending page token, and again from the saved one after restart")
+	mu.Unlock()
+
+	require.NoError(t, restarted.Close())
+	events := readEvents(t, cfg)
+	require.Len(t, events, 1, "the changes pending in the killed process are delivered")
+	require.Equal(t, "file1", events[0].FileId)
+	item, err = storage.FindOneByChannelID(ctx, channelID)
+	require.NoError(t, err)
+	require.Equal(t, "200", item.PageToken, "saved after sent")
+}
+
+func TestWebhookTableDeleted(t *testing.T) {
+	newApp := func(t *testing.T, autoCreate bool) (*gdnotify.App, *fakeDrive, *mockDynamoDBClient, *gdnotify.DynamoDBStorage) {
+		t.Helper()
+		f := newFakeDrive()
+		app, _ := newTestApp(t, f)
+		client := newMockDynamoDBClient()
+		storage, _, err := gdnotify.NewDynamoDBStorageWithClient(context.Background(), &gdnotify.StorageConfig{
+			Type:       gdnotify.StorageTypeDynamoDB,
+			TableName:  aws.String("gdnotify"),
+			AutoCreate: aws.Bool(autoCreate),
+		}, client)
+		require.NoError(t, err)
+		app.SetStorage(storage)
+		require.NoError(t, app.RunWithContext(context.Background(),
+			gdnotify.WithRunMode("cli"),
+			gdnotify.WithCLICommand("maintenance"),
+		))
+		require.Len(t, f.WatchCalls(), 1)
+		return app, f, client, storage
+	}
+	deepHealth := func(t *testing.T, handler http.Handler) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health?deep=1", nil))
+		var body struct {
+			Status string `json:"status"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body.Status
+	}
+	t.Run("auto_create", func(t *testing.T) {
+		app, f, client, storage := newApp(t, true)
+		channelID := f.WatchCalls()[0].Id
+		client.DeleteTable()
+
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, newWebhookRequest(channelID))
+		require.Equal(t, 1, client.CreateCalls())
+		require.Eventually(t, func() bool {
+			return len(f.WatchCalls()) == 2
+		}, 5*time.Second, 10*time.Millisecond, "channels are re-registered")
+		require.Eventually(t, func() bool {
+			itemsCh, err := storage.FindAllChannels(context.Background())
+			if err != nil {
+				return false
+			}
+			var items []*gdnotify.ChannelItem
+			for batch := range itemsCh {
+				items = append(items, batch...)
+			}
+			return len(items) == 1 && items[0].ChannelID == f.WatchCalls()[1].Id
+		}, 5*time.Second, 10*time.Millisecond)
+		code, status := deepHealth(t, app.SetupRoute())
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "ok", status)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		app, f, client, _ := newApp(t, false)
+		channelID := f.WatchCalls()[0].Id
+		client.DeleteTable()
+
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, newWebhookRequest(channelID))
+		require.Equal(t, 0, client.CreateCalls())
+		handler := app.SetupRoute()
+		code, status := deepHealth(t, handler)
+		require.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, "degraded", status)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, w.Code, "liveness is not affected")
+	})
+}
+
+func TestWebhookStopOrphanChannel(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	knownChannelID := f.WatchCalls()[0].Id
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, newWebhookRequest("orphan"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, f.StopCalls(), "a single unknown webhook does not stop the channel")
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, newWebhookRequest("orphan"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, f.StopCalls(), 1, "repeated unknown webhooks stop the channel")
+	require.EqualValues(t, "orphan", f.StopCalls()[0].Id)
+	require.EqualValues(t, "resource-orphan", f.StopCalls()[0].ResourceId)
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, newWebhookRequest(knownChannelID))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, f.StopCalls(), 1, "known channel is not stopped")
+
+	require.Error(t, app.StopOrphanChannel(ctx, knownChannelID, "resource-"+knownChannelID), "known channel is not orphaned")
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("reconcile"),
+		gdnotify.WithOrphanChannel("orphan2", "resource-orphan2"),
+	))
+	require.Len(t, f.StopCalls(), 2)
+	require.EqualValues(t, "orphan2", f.StopCalls()[1].Id)
+}
+
+func TestWebhookOrphanChannelsBounded(t *testing.T) {
+	ctx := context.Background()
+	t.Run("ttl", func(t *testing.T) {
+		app, _ := newTestApp(t, newFakeDrive())
+		clock := &fixedClock{now: time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)}
+		app.SetClock(clock)
+		app.RecordOrphanChannel(ctx, "orphan1", "resource-orphan1")
+		require.Equal(t, 1, app.OrphanChannels())
+		clock.Set(clock.Now().Add(2 * time.Hour))
+		app.RecordOrphanChannel(ctx, "orphan2", "resource-orphan2")
+		require.Equal(t, 1, app.OrphanChannels(), "the channel seen only once long ago is dropped")
+	})
+	t.Run("size cap", func(t *testing.T) {
+		app, _ := newTestApp(t, newFakeDrive())
+		clock := &fixedClock{now: time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)}
+		app.SetClock(clock)
+		for i := 0; i < 1100; i++ {
+			clock.Set(clock.Now().Add(time.Millisecond))
+			app.RecordOrphanChannel(ctx, fmt.Sprintf("orphan%04d", i), "resource")
+		}
+		require.Equal(t, 1000, app.OrphanChannels())
+	})
+	t.Run("stop failures", func(t *testing.T) {
+		f := newFakeDrive()
+		app, _ := newTestApp(t, f)
+		f.failures = map[string][]int{
+			"/channels/stop": {http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest},
+		}
+		for i := 0; i < 4; i++ {
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, newWebhookRequest("orphan"))
+			require.Equal(t, http.StatusOK, w.Code)
+		}
+		require.Equal(t, 0, app.OrphanChannels(), "given up after the failed stops")
+		f.mu.Lock()
+		require.Len(t, f.failures["/channels/stop"], 1, "stopped only 3 times")
+		f.mu.Unlock()
+	})
+}
+
+func TestWebhookResourceStates(t *testing.T) {
+	cases := []struct {
+		state   string
+		changes bool
+	}{
+		{state: "sync", changes: false},
+		{state: "change", changes: true},
+		{state: "update", changes: true},
+		{state: "exists", changes: true},
+		{state: "add", changes: true},
+		{state: "remove", changes: true},
+		{state: "trash", changes: true},
+		{state: "untrash", changes: true},
+		{state: "not_exists", changes: false},
+		{state: "unknown", changes: false},
+		{state: "", changes: false},
+	}
+	for _, c := range cases {
+		t.Run(c.state, func(t *testing.T) {
+			f := newFakeDrive()
+			f.changes = []*drive.Change{
+				{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+			}
+			app, cfg := newTestApp(t, f)
+			require.NoError(t, app.RunWithContext(context.Background(),
+				gdnotify.WithRunMode("cli"),
+				gdnotify.WithCLICommand("maintenance"),
+			))
+			req := newWebhookRequest(f.WatchCalls()[0].Id)
+			req.Header.Set("X-Goog-Resource-State", c.state)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			if c.changes {
+				require.Len(t, readEvents(t, cfg), 1, "changes are fetched and sent")
+			} else {
+				require.Empty(t, readEvents(t, cfg), "changes are not fetched")
+			}
+		})
+	}
+}
+
+func TestWebhookDuplicateMessageNumber(t *testing.T) {
+	f := newFakeDrive()
+	f.changes = []*drive.Change{
+		{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+	}
+	app, cfg := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	deliver := func(messageNumber string) {
+		t.Helper()
+		req := newWebhookRequest(channelID)
+		req.Header.Set("X-Goog-Message-Number", messageNumber)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	deliver("2")
+	deliver("2")
+	require.Len(t, readEvents(t, cfg), 1, "redelivered message is skipped")
+
+	storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+	require.NoError(t, err)
+	item, err := storage.FindOneByChannelID(ctx, channelID)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, item.LastMessageNumber)
+
+	deliver("3")
+	require.Len(t, readEvents(t, cfg), 2, "newer message is processed")
+}
+
+func TestWebhookMaxConcurrentWebhooks(t *testing.T) {
+	f := newFakeDrive()
+	var inFlight, maxInFlight int32
+	entered := make(chan struct{}, 10)
+	release := make(chan struct{})
+	f.changesHook = func(_ *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		entered <- struct{}{}
+		<-release
+	}
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Server = &gdnotify.ServerConfig{
+			MaxConcurrentWebhooks: 2,
+			WebhookQueueTimeout:   100 * time.Millisecond,
+		}
+	})
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	// without message numbers, so that concurrent notifications are not skipped as duplicates.
+	deliver := func() int {
+		req := newWebhookRequest(channelID)
+		req.Header.Del("X-Goog-Message-Number")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code
+	}
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = deliver()
+		}(i)
+	}
+	<-entered
+	<-entered
+	require.Equal(t, http.StatusServiceUnavailable, deliver(), "saturated beyond the queue timeout")
+	close(release)
+	wg.Wait()
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+	require.EqualValues(t, 2, atomic.LoadInt32(&maxInFlight))
+	require.Equal(t, http.StatusOK, deliver(), "slots are released")
+}
+
+func TestWebhookHMACSignature(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Server = &gdnotify.ServerConfig{
+			WebhookHMACSecret: "secret",
+		}
+	})
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	handler := app.SetupRoute()
+	sign := func(req *http.Request) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(channelID + "\n" + "resource-" + channelID + "\n" + req.Header.Get("X-Goog-Resource-State") + "\n" + req.Header.Get("X-Goog-Message-Number")))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	cases := []struct {
+		casename string
+		prepare  func(req *http.Request)
+		expected int
+	}{
+		{
+			casename: "valid",
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Signature", sign(req))
+			},
+			expected: http.StatusOK,
+		},
+		{
+			casename: "missing",
+			prepare:  func(req *http.Request) {},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			casename: "tampered header",
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Signature", sign(req))
+				req.Header.Set("X-Goog-Message-Number", "3")
+			},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			casename: "wrong secret",
+			prepare: func(req *http.Request) {
+				req.Header.Set("X-Signature", gdnotify.WebhookSignature([]byte("other"), req.Header))
+			},
+			expected: http.StatusUnauthorized,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			req := newWebhookRequest(channelID)
+			c.prepare(req)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, c.expected, w.Code)
+		})
+	}
+	t.Run("health is not signed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestWebhookFileChannel(t *testing.T) {
+	f := newFakeDrive()
+	f.files = map[string]*drive.File{
+		"file1": {Id: "file1", Name: "report.xlsx", DriveId: "drive1", Version: 2},
+	}
+	f.changesHook = func(_ *http.Request) {
+		t.Error("changes:list is called for the file channel")
+	}
+	app, cfg := newTestApp(t, f)
+	ctx := context.Background()
+	require.NoError(t, app.WatchFile(ctx, "file1"))
+	channelID := f.WatchCalls()[0].Id
+
+	deliver := func(state string) int {
+		req := newWebhookRequest(channelID)
+		req.Header.Set("X-Goog-Resource-State", state)
+		req.Header.Del("X-Goog-Message-Number")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, http.StatusOK, deliver("update"))
+	events := readEvents(t, cfg)
+	require.Len(t, events, 1)
+	require.EqualValues(t, "file1", events[0].FileId)
+	require.False(t, events[0].Removed)
+	require.NotNil(t, events[0].File)
+	require.EqualValues(t, "report.xlsx", events[0].File.Name)
+
+	storage, _, err := gdnotify.NewFileStorage(ctx, cfg.Storage)
+	require.NoError(t, err)
+	item, err := storage.FindOneByChannelID(ctx, channelID)
+	require.NoError(t, err)
+	require.False(t, item.LastChangeAt.IsZero())
+
+	f.mu.Lock()
+	delete(f.files, "file1")
+	f.mu.Unlock()
+	require.Equal(t, http.StatusOK, deliver("trash"))
+	events = readEvents(t, cfg)
+	require.Len(t, events, 2)
+	require.True(t, events[1].Removed, "not found file is sent as removed")
+}
+
+func TestWebhookReplay(t *testing.T) {
+	f := newFakeDrive()
+	f.changePages = [][]*drive.Change{
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		},
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+		},
+	}
+	app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Server = &gdnotify.ServerConfig{
+			ReplayToken: "replay-secret",
+		}
+	})
+	ctx := context.Background()
+	require.NoError(t, app.RunWithContext(ctx,
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	f.mu.Lock()
+	f.startPageToken = "200"
+	f.mu.Unlock()
+	handler := app.SetupRoute()
+	replay := func(token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/replay", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	storedPageToken := func() string {
+		desc, err := app.DescribeChannel(ctx, channelID)
+		require.NoError(t, err)
+		return desc.PageToken
+	}
+	fileIDs := func(changes []*drive.Change) []string {
+		ids := make([]string, 0, len(changes))
+		for _, c := range changes {
+			ids = append(ids, c.FileId)
+		}
+		return ids
+	}
+
+	t.Run("explicit page token", func(t *testing.T) {
+		before := len(readEvents(t, cfg))
+		w := replay("replay-secret", `{"channelId":"`+channelID+`","pageToken":"page-1"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result gdnotify.ReplayResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+		require.Equal(t, gdnotify.ReplayResult{
+			ChannelID:    channelID,
+			PageToken:    "page-1",
+			NewPageToken: "200",
+			Changes:      1,
+		}, result)
+		require.Equal(t, []string{"file2"}, fileIDs(readEvents(t, cfg)[before:]))
+		require.Equal(t, "100", storedPageToken(), "stored page token is not advanced")
+	})
+	t.Run("stored page token", func(t *testing.T) {
+		before := len(readEvents(t, cfg))
+		w := replay("replay-secret", `{"channelId":"`+channelID+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, []string{"file1", "file2"}, fileIDs(readEvents(t, cfg)[before:]))
+		require.Equal(t, "100", storedPageToken(), "stored page token is not advanced")
+	})
+	t.Run("advance page token", func(t *testing.T) {
+		w := replay("replay-secret", `{"channelId":"`+channelID+`","advancePageToken":true}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, "200", storedPageToken())
+	})
+	t.Run("invalid token", func(t *testing.T) {
+		w := replay("wrong", `{"channelId":"`+channelID+`"}`)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+	t.Run("channel not found", func(t *testing.T) {
+		w := replay("replay-secret", `{"channelId":"unknown"}`)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+	t.Run("channel id is required", func(t *testing.T) {
+		w := replay("replay-secret", `{}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+	t.Run("method not allowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/replay", nil)
+		req.Header.Set("Authorization", "Bearer replay-secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func TestWebhookAccessLog(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f)
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	handler := app.SetupRoute()
+
+	var buf bytes.Buffer
+	req := newWebhookRequest(channelID)
+	req.Header.Set("X-Request-Id", "req-1")
+	req = req.WithContext(logx.WithLogger(req.Context(), log.New(&buf, "", 0)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "req-1", w.Header().Get("X-Request-Id"))
+
+	var records []gdnotify.AccessLog
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if after, ok := strings.CutPrefix(line, "[info] access "); ok {
+			var record gdnotify.AccessLog
+			require.NoError(t, json.Unmarshal([]byte(after), &record))
+			records = append(records, record)
+		}
+	}
+	require.Contains(t, buf.String(), "request_id=req-1 [info] change accepted channel_id:"+channelID, "logs of the request are prefixed with the request id")
+	require.Len(t, records, 1)
+	record := records[0]
+	require.Greater(t, record.DurationMs, 0.0)
+	record.DurationMs = 0
+	require.Equal(t, gdnotify.AccessLog{
+		RequestID:     "req-1",
+		Method:        http.MethodPost,
+		Path:          "/",
+		ChannelID:     channelID,
+		ResourceID:    "resource-" + channelID,
+		ResourceState: "change",
+		MessageNumber: "2",
+		Status:        http.StatusOK,
+	}, record)
+
+	t.Run("generated request id", func(t *testing.T) {
+		var buf bytes.Buffer
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req = req.WithContext(logx.WithLogger(req.Context(), log.New(&buf, "", 0)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		requestID := w.Header().Get("X-Request-Id")
+		require.NotEmpty(t, requestID)
+		require.Contains(t, buf.String(), `"request_id":"`+requestID+`"`)
+		require.Contains(t, buf.String(), `"status":200`)
+	})
+}
+
+func TestWebhookTracing(t *testing.T) {
+	f := newFakeDrive()
+	f.changePages = [][]*drive.Change{
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z"},
+		},
+		{
+			{Kind: "drive#change", ChangeType: "file", FileId: "file2", Time: "2022-06-15T00:03:55.849Z"},
+		},
+	}
+	app, _ := newTestApp(t, f)
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	exporter := tracetest.NewInMemoryExporter()
+	app.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	w := httptest.NewRecorder()
+	app.SetupRoute().ServeHTTP(w, newWebhookRequest(channelID))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	spans := exporter.GetSpans()
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].StartTime.Before(spans[j].StartTime)
+	})
+	var root tracetest.SpanStub
+	for _, span := range spans {
+		if span.Name == "webhook" {
+			root = span
+		}
+	}
+	require.Equal(t, "webhook", root.Name)
+	require.False(t, root.Parent.IsValid(), "webhook span is the root")
+	require.Contains(t, root.Attributes, attribute.String("gdnotify.channel_id", channelID))
+	require.Contains(t, root.Attributes, attribute.Int("http.status_code", http.StatusOK))
+	children := make([]string, 0)
+	for _, span := range spans {
+		if span.Name == "webhook" {
+			continue
+		}
+		require.Equal(t, root.SpanContext.TraceID(), span.SpanContext.TraceID())
+		require.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), "%s is a child of webhook", span.Name)
+		children = append(children, span.Name)
+	}
+	require.Equal(t, []string{"changes:list", "notification", "changes:list", "notification"}, children)
+}
+
+func TestWebhookAllowedUserAgentPrefixes(t *testing.T) {
+	cases := []struct {
+		casename  string
+		prefixes  []string
+		userAgent string
+		expected  int
+	}{
+		{
+			casename:  "default",
+			userAgent: "APIs-Google; (+https://developers.google.com/webmasters/APIs-Google.html)",
+			expected:  http.StatusOK,
+		},
+		{
+			casename:  "default rejects others",
+			userAgent: "curl/8.0.1",
+			expected:  http.StatusNotFound,
+		},
+		{
+			casename:  "custom allowlist",
+			prefixes:  []string{"APIs-Google;", "gdnotify-test/"},
+			userAgent: "gdnotify-test/1.0",
+			expected:  http.StatusOK,
+		},
+		{
+			casename:  "custom allowlist rejects not listed",
+			prefixes:  []string{"gdnotify-test/"},
+			userAgent: "APIs-Google; (+https://developers.google.com/webmasters/APIs-Google.html)",
+			expected:  http.StatusNotFound,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			f := newFakeDrive()
+			app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.Server = &gdnotify.ServerConfig{
+					AllowedUserAgentPrefixes: c.prefixes,
+				}
+			})
+			require.NoError(t, app.RunWithContext(context.Background(),
+				gdnotify.WithRunMode("cli"),
+				gdnotify.WithCLICommand("maintenance"),
+			))
+			req := newWebhookRequest(f.WatchCalls()[0].Id)
+			req.Header.Set("User-Agent", c.userAgent)
+			w := httptest.NewRecorder()
+			app.SetupRoute().ServeHTTP(w, req)
+			require.Equal(t, c.expected, w.Code)
+		})
+	}
+}
+
+func TestWebhookIncludePermissions(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("include_permissions=%v", enabled), func(t *testing.T) {
+			f := newFakeDrive()
+			f.changes = []*drive.Change{
+				{
+					Kind: "drive#change", ChangeType: "file", FileId: "file1", Time: "2022-06-15T00:03:55.849Z",
+					File: &drive.File{
+						Id:            "file1",
+						Name:          "shared.txt",
+						PermissionIds: []string{"anyoneWithLink"},
+						Permissions: []*drive.Permission{
+							{Id: "anyoneWithLink", Type: "anyone", Role: "reader"},
+						},
+					},
+				},
+			}
+			var fields []string
+			f.changesHook = func(r *http.Request) {
+				fields = append(fields, r.URL.Query().Get("fields"))
+			}
+			app, cfg := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.IncludePermissions = enabled
+			})
+			require.NoError(t, app.CreateChannel(context.Background(), gdnotify.DefaultDriveID))
+			w := httptest.NewRecorder()
+			app.SetupRoute().ServeHTTP(w, newWebhookRequest(f.WatchCalls()[0].Id))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			require.Len(t, fields, 1)
+			if !enabled {
+				require.NotContains(t, fields[0], "permissions")
+				return
+			}
+			require.Contains(t, fields[0], "permissions,permissionIds")
+			events := readEvents(t, cfg)
+			require.Len(t, events, 1)
+			require.Equal(t, []string{"anyoneWithLink"}, events[0].File.PermissionIds)
+			require.Equal(t, "anyone", events[0].File.Permissions[0].Type)
+		})
+	}
+}
+
+func TestWebhookChangeFileFields(t *testing.T) {
+	cases := []struct {
+		casename string
+		fields   []string
+		expected string
+	}{
+		{
+			casename: "default",
+			expected: "file(id,name,driveId,kind,mimeType,modifiedTime,lastModifyingUser,trashed,trashedTime,trashingUser,version,size,md5Checksum,createdTime,parents,webViewLink,iconLink)",
+		},
+		{
+			casename: "override",
+			fields:   []string{"id", "name", "webViewLink", "owners(emailAddress)"},
+			expected: "file(id,name,webViewLink,owners(emailAddress))",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			f := newFakeDrive()
+			var fields []string
+			f.changesHook = func(r *http.Request) {
+				fields = append(fields, r.URL.Query().Get("fields"))
+			}
+			app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+				cfg.ChangeFileFields = c.fields
+			})
+			require.NoError(t, app.CreateChannel(context.Background(), gdnotify.DefaultDriveID))
+			w := httptest.NewRecorder()
+			app.SetupRoute().ServeHTTP(w, newWebhookRequest(f.WatchCalls()[0].Id))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Len(t, fields, 1)
+			require.Contains(t, fields[0], c.expected)
+		})
+	}
+}
+
+func TestWebhookRequestDump(t *testing.T) {
+	f := newFakeDrive()
+	app, _ := newTestApp(t, f, func(cfg *gdnotify.Config) {
+		cfg.Server = &gdnotify.ServerConfig{
+			MaxDumpBytes: 1024,
+		}
+	})
+	require.NoError(t, app.RunWithContext(context.Background(),
+		gdnotify.WithRunMode("cli"),
+		gdnotify.WithCLICommand("maintenance"),
+	))
+	channelID := f.WatchCalls()[0].Id
+	handler := app.SetupRoute()
+
+	var buf bytes.Buffer
+	body := strings.Repeat("x", 4096)
+	req := newWebhookRequest(channelID)
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("X-Goog-Channel-Token", "channel-secret")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req = req.WithContext(logx.WithLogger(req.Context(), log.New(&buf, "", 0)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	logs := buf.String()
+	start := strings.Index(logs, "[debug] receive request")
+	require.GreaterOrEqual(t, start, 0)
+	end := strings.Index(logs[start:], "(truncated, max_dump_bytes=1024)")
+	require.Greater(t, end, 0, "dump is truncated")
+	dump := logs[start : start+end]
+	require.NotContains(t, dump, "channel-secret")
+	require.NotContains(t, dump, "secret-token")
+	require.Contains(t, dump, "X-Goog-Channel-Token: [REDACTED]")
+	require.Contains(t, dump, "Authorization: [REDACTED]")
+	require.Less(t, len(dump), 1024+100)
+	require.Contains(t, dump, "xxxx", "the head of the body is dumped")
+}